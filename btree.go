@@ -49,6 +49,12 @@ func (tr *BTree) Set(item any) (prev any) {
 	return tr.SetHint(item, nil)
 }
 
+// ResetHint clears the path of the hint and binds it to the tree. See
+// PathHint.
+func (tr *BTree) ResetHint(hint *PathHint) {
+	tr.base.ResetHint(hint)
+}
+
 // SetHint sets or replace a value for a key using a path hint
 // Returns the value for the replaced item or nil if the key was not found.
 func (tr *BTree) SetHint(item any, hint *PathHint) (prev any) {
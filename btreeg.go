@@ -3,34 +3,121 @@
 // license that can be found in the LICENSE file.
 package btree
 
-import "sync"
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
 
 type BTreeG[T any] struct {
 	isoid        uint64
+	length       int64 // count for Len, stored atomically on write unlocks
 	mu           *sync.RWMutex
 	root         *node[T]
 	count        int
+	id           uint64 // identity of the tree for path hints, see PathHint
 	locks        bool
 	copyItems    bool
 	isoCopyItems bool
 	less         func(a, b T) bool
+	weight       func(item T) int64
+	summary      func(item T) uint64
+	hash         func(item T) uint64      // see SetItemHasher
+	atomicRoot   *atomic.Pointer[node[T]] // see Options.AtomicReads
+	reentry      *reentryDetector
+	version      uint64
+	capacity     int // see Options.Capacity
+	maxLen       int // see Options.MaxLen
+	evictPolicy  EvictPolicy
+	onCopy       func(level int)
+	dups         bool // see Options.AllowDuplicates
+	sparseRight  bool // see appendSplit
 	empty        T
 	max          int
 	min          int
+	initState    int32 // see initState* constants
+	frozen       int32 // see Freeze
 }
 
 type node[T any] struct {
 	isoid    uint64
 	count    int
+	weight   int64  // sum of all item weights, only for weighted trees
+	summin   uint64 // range of the item summaries, see SetItemSummarizer
+	summax   uint64
+	checksum uint64 // of the items, see SetItemHasher
 	items    []T
 	children *[]*node[T]
 }
 
 // PathHint is a utility type used with the *Hint() functions. Hints provide
 // faster operations for clustered keys.
+// A zero-value PathHint covers the top 8 levels of the tree. Use NewPathHint
+// for taller trees.
+//
+// A hint is bound to the first tree it's used with, and is ignored by any
+// other tree, including a copy of that tree, which evolves independently.
+// Use ResetHint to bind a hint to another tree.
 type PathHint struct {
-	used [8]bool
-	path [8]uint8
+	used  [8]bool
+	path  [8]uint8
+	deep  *pathHintDeep // levels past the first 8, see NewPathHint
+	owner uint64        // id of the tree that the hint is bound to, or zero
+}
+
+// pathHintDeep holds the levels of a PathHint past the first 8.
+type pathHintDeep struct {
+	used []bool
+	path []uint8
+}
+
+// NewPathHint returns a new PathHint that covers the top maxDepth levels of
+// the tree. A maxDepth of 8 or less, including zero, covers 8 levels, just
+// like a zero-value PathHint. The levels past the first 8 are stored apart
+// from the PathHint, and are shared by copies of it.
+func NewPathHint(maxDepth int) *PathHint {
+	hint := new(PathHint)
+	if maxDepth > len(hint.path) {
+		hint.deep = &pathHintDeep{
+			used: make([]bool, maxDepth-len(hint.path)),
+			path: make([]uint8, maxDepth-len(hint.path)),
+		}
+	}
+	return hint
+}
+
+// level returns the used flag and the path index of the hint at depth.
+// Returns nil pointers if the hint does not cover depth.
+func (hint *PathHint) level(depth int) (*bool, *uint8) {
+	if depth < len(hint.path) {
+		return &hint.used[depth], &hint.path[depth]
+	}
+	depth -= len(hint.path)
+	if hint.deep == nil || depth >= len(hint.deep.path) {
+		return nil, nil
+	}
+	return &hint.deep.used[depth], &hint.deep.path[depth]
+}
+
+// unuse marks the used levels of the hint, starting at depth, as unused.
+// The used levels are always a prefix of the path.
+func (hint *PathHint) unuse(depth int) {
+	for ; depth < len(hint.used); depth++ {
+		if !hint.used[depth] {
+			return
+		}
+		hint.used[depth] = false
+	}
+	if hint.deep != nil {
+		used := hint.deep.used
+		for i := depth - len(hint.used); i < len(used) && used[i]; i++ {
+			used[i] = false
+		}
+	}
 }
 
 // Options for passing to New when creating a new BTree.
@@ -39,11 +126,143 @@ type Options struct {
 	// can contain before it must branch. For example, a degree of 2 will
 	// create a 2-3-4 tree, where each node may contains 1-3 items and
 	// 2-4 children. See https://en.wikipedia.org/wiki/2–3–4_tree.
-	// Default is 32
+	// Default is 32. Degrees greater than MaxDegree cause a panic.
 	Degree int
+	// TargetNodeBytes, when no Degree is set, computes the degree from the
+	// size of the items, or of the key-value pairs of a Map, so that a full
+	// node holds about this many bytes of items. The degree is at least 2
+	// and at most MaxDegree. See Degree. The size is from unsafe.Sizeof,
+	// which does not include memory that the items point to, such as the
+	// bytes of a string.
+	TargetNodeBytes int
 	// NoLocks will disable locking. Otherwide a sync.RWMutex is used to
 	// ensure all operations are safe across multiple goroutines.
+	// Without locks, the caller must synchronize access to the tree, and
+	// must treat the Mut methods, such as ScanMut and GetMut, as writes.
+	// Those perform copy-on-write on the nodes that they visit, even when no
+	// items are changed. Copy is the exception, as it only changes the
+	// isoid of the tree, which is never read by the other read methods, so
+	// it may be called while other goroutines are reading. The copies must
+	// not be written until those reads are done.
 	NoLocks bool
+	// RejectNaN will cause a Map with floating-point keys to reject NaN keys,
+	// which cannot be ordered using the "<" operator. See Map.SetE.
+	// Ignored by BTreeG, which should use a comparator such as
+	// TotalOrderFloats instead.
+	RejectNaN bool
+	// DetectReentrancy will cause a panic, rather than a deadlock or a
+	// corrupted tree, when the tree is modified from within the callback of
+	// one of its own iterating functions, such as Scan, Ascend, or Walk.
+	// This is a debugging aid that adds overhead to those functions. It
+	// counts the running callbacks, so a write from another goroutine while
+	// a callback is running also panics.
+	DetectReentrancy bool
+	// Capacity is a hint for the number of items that the tree will hold,
+	// which is used to pre-size the first node, avoiding the reallocations
+	// of its items as it grows. It has no other effect. Zero means no hint,
+	// and a negative capacity causes a panic.
+	Capacity int
+	// OnStructureChange is called after an operation on a Map that created
+	// or removed nodes, such as a Set that split a node or a Delete that
+	// merged nodes, with the name of the operation. It's called at most once
+	// per operation, while the map is still locked, so it must not use the
+	// map. Ignored by BTreeG.
+	OnStructureChange func(op string)
+	// MaxLen bounds the number of items. When a Set or Load makes the tree
+	// hold more than MaxLen items, the item chosen by EvictPolicy is deleted
+	// while the tree is still locked. The new item is inserted first, so it
+	// may be the one that's evicted. See SetEvict. Zero means no bound, and
+	// a negative MaxLen causes a panic.
+	MaxLen int
+	// EvictPolicy selects the item that is evicted when MaxLen is exceeded.
+	// The default is EvictMin.
+	EvictPolicy EvictPolicy
+	// OnCopy is called whenever a node that is shared with a copy of the
+	// tree is duplicated before it's changed, with the level of the node,
+	// which is zero for leaves and counts up towards the root. It's called
+	// while the tree is locked, so it must not use the tree.
+	OnCopy func(level int)
+	// AllowDuplicates will cause a BTreeG to keep items that are equal to an
+	// existing item, rather than replacing it. A new item is inserted after
+	// the equal items, so they stay in the order that they were set. Get
+	// returns the first of the equal items, Delete deletes one of them, and
+	// Ascend, Descend, and Seek visit all of them. Ignored by Map and Set,
+	// which always have unique keys.
+	AllowDuplicates bool
+	// AtomicReads will cause a BTreeG to store its root atomically, so that
+	// Get, GetHint, and Scan read it without taking the lock. Each write
+	// then copies the path to every node that it changes, rather than
+	// changing the nodes that readers may be using, and stores the new root
+	// when it's done. This makes writes slower, for lock-free reads.
+	// Ignored by Map and Set, and when NoLocks is set.
+	AtomicReads bool
+}
+
+// EvictPolicy selects the item to evict from a tree that has exceeded its
+// Options.MaxLen.
+type EvictPolicy int
+
+const (
+	// EvictMin evicts the minimum item, which keeps the largest items.
+	EvictMin EvictPolicy = iota
+	// EvictMax evicts the maximum item, which keeps the smallest items.
+	EvictMax
+)
+
+// maxLenOption validates the MaxLen option.
+func maxLenOption(maxLen int) int {
+	if maxLen < 0 {
+		panic("btree: negative MaxLen")
+	}
+	return maxLen
+}
+
+// reentryDetector counts the callbacks of iterating functions that are
+// running. See Options.DetectReentrancy.
+type reentryDetector struct {
+	active int32
+}
+
+// enter marks a callback as running, until the matching leave.
+func (d *reentryDetector) enter() {
+	atomic.AddInt32(&d.active, 1)
+}
+
+func (d *reentryDetector) leave() {
+	atomic.AddInt32(&d.active, -1)
+}
+
+// check panics if a callback is running. It's called by the write path,
+// before taking the lock.
+func (d *reentryDetector) check() {
+	if atomic.LoadInt32(&d.active) != 0 {
+		panic("btree: tree modified from within an iterator callback")
+	}
+}
+
+// TotalOrderFloats is a less function for floating-point items that follows
+// the IEEE-754 totalOrder predicate, such that -Inf < ... < -0 < +0 < ... <
+// +Inf < NaN. Unlike the "<" operator, this orders every value, including
+// NaNs, which are all placed after +Inf.
+func TotalOrderFloats[F ~float32 | ~float64](a, b F) bool {
+	anan, bnan := a != a, b != b
+	if anan || bnan {
+		if anan && bnan {
+			return floatOrderBits(float64(a)) < floatOrderBits(float64(b))
+		}
+		return bnan
+	}
+	return floatOrderBits(float64(a)) < floatOrderBits(float64(b))
+}
+
+// floatOrderBits returns the bits of f in a form that compares as a signed
+// integer in the same order as the IEEE-754 totalOrder predicate.
+func floatOrderBits(f float64) int64 {
+	bits := int64(math.Float64bits(f))
+	if bits < 0 {
+		bits ^= math.MaxInt64
+	}
+	return bits
 }
 
 // New returns a new BTree
@@ -56,20 +275,57 @@ func NewBTreeGOptions[T any](less func(a, b T) bool, opts Options) *BTreeG[T] {
 	tr.isoid = newIsoID()
 	tr.mu = new(sync.RWMutex)
 	tr.locks = !opts.NoLocks
+	if opts.DetectReentrancy {
+		tr.reentry = new(reentryDetector)
+	}
 	tr.less = less
-	tr.init(opts.Degree)
+	tr.init(degreeOption(opts, unsafe.Sizeof(tr.empty)))
+	tr.capacity = capacityHint(opts.Capacity, tr.max)
+	tr.maxLen = maxLenOption(opts.MaxLen)
+	tr.evictPolicy = opts.EvictPolicy
+	tr.onCopy = opts.OnCopy
+	tr.dups = opts.AllowDuplicates
+	if opts.AtomicReads && tr.locks {
+		tr.atomicRoot = new(atomic.Pointer[node[T]])
+	}
+	return tr
+}
+
+// capacityHint validates the Capacity option and returns the capacity of the
+// items of the first node, which is never more than max items.
+func capacityHint(capacity, max int) int {
+	if capacity < 0 {
+		panic("btree: negative capacity")
+	}
+	if capacity > max {
+		return max
+	}
+	return capacity
+}
+
+// NewBTreeGWeighted returns a new BTree where every item has a weight, as
+// provided by the weight function. The sum of the weights is maintained for
+// each subtree, which allows for the SelectByWeight and TotalWeight methods.
+// Weights should not be negative.
+func NewBTreeGWeighted[T any](less func(a, b T) bool, weight func(item T) int64,
+) *BTreeG[T] {
+	tr := NewBTreeGOptions(less, Options{})
+	tr.weight = weight
 	return tr
 }
 
 func (tr *BTreeG[T]) init(degree int) {
-	if tr.min != 0 {
+	min, max := degreeToMinMax(degree)
+	if !beginInit(&tr.initState) {
 		return
 	}
-	tr.min, tr.max = degreeToMinMax(degree)
+	tr.min, tr.max = min, max
+	tr.id = newIsoID()
 	_, tr.copyItems = ((interface{})(tr.empty)).(copier[T])
 	if !tr.copyItems {
 		_, tr.isoCopyItems = ((interface{})(tr.empty)).(isoCopier[T])
 	}
+	endInit(&tr.initState)
 }
 
 // Less is a convenience function that performs a comparison of two items
@@ -91,6 +347,15 @@ func (n *node[T]) leaf() bool {
 	return n.children == nil
 }
 
+// level returns the number of levels below the node.
+func (n *node[T]) level() int {
+	var level int
+	for ; !n.leaf(); n = (*n.children)[0] {
+		level++
+	}
+	return level
+}
+
 func (tr *BTreeG[T]) bsearch(n *node[T], key T) (index int, found bool) {
 	low, high := 0, len(n.items)
 	for low < high {
@@ -115,14 +380,58 @@ func (tr *BTreeG[T]) find(n *node[T], key T, hint *PathHint, depth int,
 	return tr.hintsearch(n, key, hint, depth)
 }
 
+// bsearchFirst returns the index of the first item that is not less than
+// key.
+func (tr *BTreeG[T]) bsearchFirst(n *node[T], key T) int {
+	low, high := 0, len(n.items)
+	for low < high {
+		h := (low + high) / 2
+		if tr.less(n.items[h], key) {
+			low = h + 1
+		} else {
+			high = h
+		}
+	}
+	return low
+}
+
+// findPivot is find for the searches that start iterating at pivot. When
+// the tree allows duplicates, the pivot is never found, and the index is
+// before the first item equal to pivot, or after the last one when desc is
+// true, so that the search goes on to the children that may hold more
+// equal items.
+func (tr *BTreeG[T]) findPivot(n *node[T], pivot T, hint *PathHint,
+	depth int, desc bool,
+) (index int, found bool) {
+	if !tr.dups {
+		return tr.find(n, pivot, hint, depth)
+	}
+	if desc {
+		i, found := tr.bsearch(n, pivot)
+		if found {
+			i++
+		}
+		return i, false
+	}
+	return tr.bsearchFirst(n, pivot), false
+}
+
 func (tr *BTreeG[T]) hintsearch(n *node[T], key T, hint *PathHint, depth int,
 ) (index int, found bool) {
 	// Best case finds the exact match, updates the hint and returns.
 	// Worst case, updates the low and high bounds to binary search between.
 	low := 0
 	high := len(n.items) - 1
-	if depth < 8 && hint.used[depth] {
-		index = int(hint.path[depth])
+	if hint.owner != tr.id {
+		if hint.owner != 0 {
+			// The hint belongs to another tree, and its path is of no use.
+			return tr.bsearch(n, key)
+		}
+		hint.owner = tr.id
+	}
+	used, path := hint.level(depth)
+	if used != nil && *used {
+		index = int(*path)
 		if index >= len(n.items) {
 			// tail item
 			if tr.Less(n.items[len(n.items)-1], key) {
@@ -172,43 +481,103 @@ func (tr *BTreeG[T]) hintsearch(n *node[T], key T, hint *PathHint, depth int,
 	}
 
 path_match:
-	if depth < 8 {
-		hint.used[depth] = true
+	if used != nil {
+		*used = true
 		var pathIndex uint8
 		if n.leaf() && found {
 			pathIndex = uint8(index + 1)
 		} else {
 			pathIndex = uint8(index)
 		}
-		if pathIndex != hint.path[depth] {
-			hint.path[depth] = pathIndex
-			for i := depth + 1; i < 8; i++ {
-				hint.used[i] = false
-			}
+		if pathIndex != *path {
+			*path = pathIndex
+			hint.unuse(depth + 1)
 		}
 	}
 	return index, found
 }
 
+// ResetHint clears the path of the hint and binds it to the tree. See
+// PathHint.
+func (tr *BTreeG[T]) ResetHint(hint *PathHint) {
+	hint.unuse(0)
+	hint.owner = tr.id
+}
+
 // SetHint sets or replace a value for a key using a path hint
 func (tr *BTreeG[T]) SetHint(item T, hint *PathHint) (prev T, replaced bool) {
+	if tr.Frozen() {
+		panic(ErrFrozen)
+	}
+	if tr.reentry != nil {
+		tr.reentry.check()
+	}
 	if tr.locks {
+		// deferred, so that a less function that panics does not leave the
+		// tree locked
 		tr.mu.Lock()
-		prev, replaced = tr.setHint(item, hint)
-		tr.mu.Unlock()
-	} else {
-		prev, replaced = tr.setHint(item, hint)
+		defer tr.unlock(true)
+		tr.isolateReaders()
+	}
+	prev, replaced = tr.setHint(item, hint)
+	if tr.maxLen > 0 {
+		tr.evict()
 	}
 	return prev, replaced
 }
 
+// SetEvict is like Set, but also returns the item that was evicted, if any,
+// when the tree was created with the MaxLen option. The item being set is
+// inserted before an item is evicted, so it's evicted itself when it's the
+// minimum item with EvictMin, or the maximum item with EvictMax.
+func (tr *BTreeG[T]) SetEvict(item T) (evicted T, hadEviction bool, prev T,
+	replaced bool,
+) {
+	if tr.Frozen() {
+		panic(ErrFrozen)
+	}
+	if tr.reentry != nil {
+		tr.reentry.check()
+	}
+	if tr.locks {
+		tr.mu.Lock()
+		defer tr.unlock(true)
+		tr.isolateReaders()
+	}
+	prev, replaced = tr.setHint(item, nil)
+	evicted, hadEviction = tr.evict()
+	return evicted, hadEviction, prev, replaced
+}
+
+// evict deletes an item, chosen by the evict policy, if the tree has more
+// than maxLen items.
+func (tr *BTreeG[T]) evict() (T, bool) {
+	if tr.maxLen == 0 || tr.count <= tr.maxLen {
+		return tr.empty, false
+	}
+	if tr.evictPolicy == EvictMax {
+		return tr.popMax()
+	}
+	return tr.popMin()
+}
+
 func (tr *BTreeG[T]) setHint(item T, hint *PathHint) (prev T, replaced bool) {
 	if tr.root == nil {
 		tr.init(0)
 		tr.root = tr.newNode(true)
-		tr.root.items = append([]T{}, item)
+		tr.root.items = append(make([]T, 0, tr.capacity), item)
 		tr.root.count = 1
+		if tr.weight != nil {
+			tr.root.weight = tr.weight(item)
+		}
+		if tr.summary != nil {
+			tr.summarize(tr.root)
+		}
+		if tr.hash != nil {
+			tr.rehash(tr.root)
+		}
 		tr.count = 1
+		tr.version++
 		return tr.empty, false
 	}
 	prev, replaced, split := tr.nodeSet(&tr.root, item, hint, 0)
@@ -216,12 +585,12 @@ func (tr *BTreeG[T]) setHint(item T, hint *PathHint) (prev T, replaced bool) {
 		left := tr.isoLoad(&tr.root, true)
 		right, median := tr.nodeSplit(left)
 		tr.root = tr.newNode(false)
-		*tr.root.children = make([]*node[T], 0, tr.max+1)
 		*tr.root.children = append([]*node[T]{}, left, right)
 		tr.root.items = append([]T{}, median)
-		tr.root.updateCount()
+		tr.updateCount(tr.root)
 		return tr.setHint(item, hint)
 	}
+	tr.version++
 	if replaced {
 		return prev, true
 	}
@@ -244,7 +613,7 @@ func (tr *BTreeG[T]) nodeSplit(n *node[T]) (right *node[T], median T) {
 	if !n.leaf() {
 		*right.children = (*n.children)[i+1:]
 	}
-	right.updateCount()
+	tr.updateCount(right)
 
 	// left node
 	n.items[i] = tr.empty
@@ -252,25 +621,119 @@ func (tr *BTreeG[T]) nodeSplit(n *node[T]) (right *node[T], median T) {
 	if !n.leaf() {
 		*n.children = (*n.children)[: i+1 : i+1]
 	}
-	n.updateCount()
+	tr.updateCount(n)
 
 	return right, median
 }
 
-func (n *node[T]) updateCount() {
+// updateCount recalculates the count, and weight, summary, and checksum if
+// needed, of the node.
+func (tr *BTreeG[T]) updateCount(n *node[T]) {
 	n.count = len(n.items)
 	if !n.leaf() {
 		for i := 0; i < len(*n.children); i++ {
 			n.count += (*n.children)[i].count
 		}
 	}
+	if tr.weight != nil {
+		n.weight = 0
+		for i := 0; i < len(n.items); i++ {
+			n.weight += tr.weight(n.items[i])
+		}
+		if !n.leaf() {
+			for i := 0; i < len(*n.children); i++ {
+				n.weight += (*n.children)[i].weight
+			}
+		}
+	}
+	if tr.summary != nil {
+		tr.summarize(n)
+	}
+	if tr.hash != nil {
+		tr.rehash(n)
+	}
+}
+
+// summarize recalculates the summary range of the node from its items and
+// the summary ranges of its children.
+func (tr *BTreeG[T]) summarize(n *node[T]) {
+	n.summin, n.summax = math.MaxUint64, 0
+	for i := 0; i < len(n.items); i++ {
+		n.extendSummary(tr.summary(n.items[i]))
+	}
+	if !n.leaf() {
+		for _, child := range *n.children {
+			n.extendSummary(child.summin)
+			n.extendSummary(child.summax)
+		}
+	}
+}
+
+// extendSummary extends the summary range of the node to include s.
+func (n *node[T]) extendSummary(s uint64) {
+	if s < n.summin {
+		n.summin = s
+	}
+	if s > n.summax {
+		n.summax = s
+	}
+}
+
+// summarizePath recalculates the summary ranges of the nodes along a path,
+// like the one for addWeight, from the leaf up to the root.
+func (tr *BTreeG[T]) summarizePath(path []int, first bool) {
+	var nodesbuf [16]*node[T]
+	nodes := nodesbuf[:0]
+	n := tr.root
+	for depth := 0; ; depth++ {
+		nodes = append(nodes, n)
+		if n.leaf() {
+			break
+		}
+		if path != nil {
+			n = (*n.children)[path[depth]]
+		} else if first {
+			n = (*n.children)[0]
+		} else {
+			n = (*n.children)[len(*n.children)-1]
+		}
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		tr.summarize(nodes[i])
+	}
+}
+
+// addWeight adds delta to the weight of every node along a path that was
+// just followed from the root to a leaf. The path is the child index taken
+// at each level, or nil for the leftmost (first) or rightmost (!first) path.
+func (tr *BTreeG[T]) addWeight(delta int64, path []int, first bool) {
+	n := tr.root
+	for depth := 0; n != nil; depth++ {
+		n.weight += delta
+		if n.leaf() {
+			break
+		}
+		if path != nil {
+			n = (*n.children)[path[depth]]
+		} else if first {
+			n = (*n.children)[0]
+		} else {
+			n = (*n.children)[len(*n.children)-1]
+		}
+	}
 }
 
 // Copy the node for safe isolation.
 func (tr *BTreeG[T]) copy(n *node[T]) *node[T] {
+	if tr.onCopy != nil {
+		tr.onCopy(n.level())
+	}
 	n2 := new(node[T])
 	n2.isoid = tr.isoid
 	n2.count = n.count
+	n2.weight = n.weight
+	n2.summin, n2.summax = n.summin, n.summax
+	n2.checksum = n.checksum
 	n2.items = make([]T, len(n.items), cap(n.items))
 	copy(n2.items, n.items)
 	if tr.copyItems {
@@ -284,7 +747,7 @@ func (tr *BTreeG[T]) copy(n *node[T]) *node[T] {
 	}
 	if !n.leaf() {
 		n2.children = new([]*node[T])
-		*n2.children = make([]*node[T], len(*n.children), tr.max+1)
+		*n2.children = make([]*node[T], len(*n.children), cap(*n.children))
 		copy(*n2.children, *n.children)
 	}
 	return n2
@@ -307,14 +770,27 @@ func (tr *BTreeG[T]) nodeSet(cn **node[T], item T,
 	n := *cn
 	var i int
 	var found bool
-	if hint == nil {
+	if hint == nil || tr.dups {
 		i, found = tr.bsearch(n, item)
 	} else {
 		i, found = tr.hintsearch(n, item, hint, depth)
 	}
+	if found && tr.dups {
+		// insert after the equal items
+		i, found = i+1, false
+	}
 	if found {
 		prev = n.items[i]
 		n.items[i] = item
+		if tr.weight != nil {
+			n.weight += tr.weight(item) - tr.weight(prev)
+		}
+		if tr.summary != nil {
+			tr.summarize(n)
+		}
+		if tr.hash != nil {
+			tr.rehash(n)
+		}
 		return prev, true, false
 	}
 	if n.leaf() {
@@ -325,6 +801,15 @@ func (tr *BTreeG[T]) nodeSet(cn **node[T], item T,
 		copy(n.items[i+1:], n.items[i:])
 		n.items[i] = item
 		n.count++
+		if tr.weight != nil {
+			n.weight += tr.weight(item)
+		}
+		if tr.summary != nil {
+			n.extendSummary(tr.summary(item))
+		}
+		if tr.hash != nil {
+			tr.rehash(n)
+		}
 		return tr.empty, false, false
 	}
 	prev, replaced, split = tr.nodeSet(&(*n.children)[i], item, hint, depth+1)
@@ -339,11 +824,28 @@ func (tr *BTreeG[T]) nodeSet(cn **node[T], item T,
 		n.items = append(n.items, tr.empty)
 		copy(n.items[i+1:], n.items[i:])
 		n.items[i] = median
+		if tr.hash != nil {
+			tr.rehash(n)
+		}
 		return tr.nodeSet(&n, item, hint, depth)
 	}
 	if !replaced {
 		n.count++
 	}
+	if tr.weight != nil {
+		if replaced {
+			n.weight += tr.weight(item) - tr.weight(prev)
+		} else {
+			n.weight += tr.weight(item)
+		}
+	}
+	if tr.summary != nil {
+		if replaced {
+			tr.summarize(n)
+		} else {
+			n.extendSummary(tr.summary(item))
+		}
+	}
 	return prev, replaced, false
 }
 
@@ -354,14 +856,142 @@ func (tr *BTreeG[T]) ScanMut(iter func(item T) bool) {
 	tr.scan(iter, true)
 }
 
+// ScanN is like Scan, but stops after limit items. Nothing is visited if
+// limit is zero or less.
+func (tr *BTreeG[T]) ScanN(limit int, iter func(item T) bool) {
+	var count int
+	if limit > 0 {
+		tr.scan(iterN(limit, iter, &count), false)
+	}
+}
+
+// ScanE is like Scan, but the iterator may also return an error, which stops
+// the iteration and is returned by ScanE.
+func (tr *BTreeG[T]) ScanE(iter func(item T) (bool, error)) error {
+	return tr.scanE(iter, false)
+}
+
+// ScanMutE is like ScanMut, but the iterator may also return an error, which
+// stops the iteration and is returned by ScanMutE.
+func (tr *BTreeG[T]) ScanMutE(iter func(item T) (bool, error)) error {
+	return tr.scanE(iter, true)
+}
+
+func (tr *BTreeG[T]) scanE(iter func(item T) (bool, error), mut bool) error {
+	var err error
+	tr.scan(iterE(iter, &err), mut)
+	return err
+}
+
+// Enumerate visits all items in ascending order, passing each item with its
+// index, which is counted up from start. This avoids the cost of looking up
+// the position of each item while scanning.
+// Return false to stop iterating.
+func (tr *BTreeG[T]) Enumerate(start int, iter func(index int, item T) bool) {
+	index := start
+	tr.Scan(func(item T) bool {
+		index++
+		return iter(index-1, item)
+	})
+}
+
+// ScanLimit visits at most limit items in ascending order, starting with the
+// first item that is greater-or-equal-to the resume item, or with the first
+// item when resume is nil. It returns the item to resume from, or done when
+// there are no more items or the iterator returned false.
+// See Map.ScanLimit.
+func (tr *BTreeG[T]) ScanLimit(limit int, resume *T, iter func(item T) bool,
+) (next *T, done bool) {
+	if limit < 1 {
+		panic("btree: limit must be positive")
+	}
+	var n int
+	chunk := func(item T) bool {
+		if n == limit {
+			next = &item
+			return false
+		}
+		n++
+		return iter(item)
+	}
+	if resume == nil {
+		tr.Scan(chunk)
+	} else {
+		tr.Ascend(*resume, chunk)
+	}
+	return next, next == nil
+}
+
+// iterE adapts an iterator that may return an error for the iterating
+// functions. The error is stored in err, and stops the iteration.
+func iterE[T any](iter func(item T) (bool, error), err *error,
+) func(item T) bool {
+	return func(item T) bool {
+		var ok bool
+		ok, *err = iter(item)
+		return ok && *err == nil
+	}
+}
+
+// contextCheckInterval is the number of items that are visited between the
+// checks for cancellation by the Context iterating functions.
+const contextCheckInterval = 64
+
+// iterContext adapts an iterator for the Context iterating functions. The
+// context is checked once every contextCheckInterval items, rather than for
+// every item, and a cancellation is stored in err, and stops the iteration.
+func iterContext[T any](ctx context.Context, iter func(item T) bool,
+	err *error,
+) func(item T) bool {
+	var n int
+	return func(item T) bool {
+		if n++; n%contextCheckInterval == 0 {
+			if *err = ctx.Err(); *err != nil {
+				return false
+			}
+		}
+		return iter(item)
+	}
+}
+
+// iterN adapts an iterator for the N iterating functions. The items are
+// counted in count, and the iteration stops after n items, before moving on
+// to any other item or subtree.
+func iterN[T any](n int, iter func(item T) bool, count *int,
+) func(item T) bool {
+	return func(item T) bool {
+		*count++
+		return iter(item) && *count < n
+	}
+}
+
+// ScanContext is like Scan, but stops early when ctx is cancelled, returning
+// ctx.Err(). The context is checked before the first item, and then once
+// every 64 items.
+func (tr *BTreeG[T]) ScanContext(ctx context.Context, iter func(item T) bool,
+) error {
+	err := ctx.Err()
+	if err == nil {
+		tr.scan(iterContext(ctx, iter, &err), false)
+	}
+	return err
+}
+
 func (tr *BTreeG[T]) scan(iter func(item T) bool, mut bool) {
-	if tr.lock(mut) {
+	root := &tr.root
+	if r, ok := tr.readRoot(mut); ok {
+		root = &r
+	} else if tr.lock(mut) {
 		defer tr.unlock(mut)
 	}
-	if tr.root == nil {
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if *root == nil {
 		return
 	}
-	tr.nodeScan(&tr.root, iter, mut)
+	tr.nodeScan(root, iter, mut)
 }
 
 func (tr *BTreeG[T]) nodeScan(cn **node[T], iter func(item T) bool, mut bool,
@@ -395,6 +1025,71 @@ func (tr *BTreeG[T]) GetMut(key T) (T, bool) {
 	return tr.getHint(key, nil, true)
 }
 
+// MultiGet returns the items for keys, along with whether each item was
+// found, in the same order as keys. See Map.MultiGet.
+func (tr *BTreeG[T]) MultiGet(keys []T) ([]T, []bool) {
+	items := make([]T, len(keys))
+	found := make([]bool, len(keys))
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return tr.less(keys[order[i]], keys[order[j]])
+	})
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.root != nil {
+		tr.nodeMultiGet(tr.root, keys, order, items, found)
+	}
+	return items, found
+}
+
+// nodeMultiGet looks up the keys at the sorted indexes in order, which are
+// all within the range of the node.
+func (tr *BTreeG[T]) nodeMultiGet(n *node[T], keys []T, order []int,
+	items []T, found []bool,
+) {
+	var lo int
+	for len(order) > 0 {
+		// The keys are sorted, so each search starts where the last one
+		// ended.
+		key := keys[order[0]]
+		i, high := lo, len(n.items)
+		for i < high {
+			h := (i + high) / 2
+			if !tr.less(key, n.items[h]) {
+				i = h + 1
+			} else {
+				high = h
+			}
+		}
+		if i > 0 && !tr.less(n.items[i-1], key) {
+			items[order[0]], found[order[0]] = n.items[i-1], true
+			order = order[1:]
+			lo = i - 1
+			continue
+		}
+		lo = i
+		if n.leaf() {
+			order = order[1:]
+			continue
+		}
+		// Pass down all the keys that belong to the same child.
+		j := 1
+		if i < len(n.items) {
+			for j < len(order) && tr.less(keys[order[j]], n.items[i]) {
+				j++
+			}
+		} else {
+			j = len(order)
+		}
+		tr.nodeMultiGet((*n.children)[i], keys, order[:j], items, found)
+		order = order[j:]
+	}
+}
+
 // GetHint gets a value for key using a path hint
 func (tr *BTreeG[T]) GetHint(key T, hint *PathHint) (value T, ok bool) {
 	return tr.getHint(key, hint, false)
@@ -405,32 +1100,114 @@ func (tr *BTreeG[T]) GetHintMut(key T, hint *PathHint) (value T, ok bool) {
 
 // GetHint gets a value for key using a path hint
 func (tr *BTreeG[T]) getHint(key T, hint *PathHint, mut bool) (T, bool) {
-	if tr.lock(mut) {
+	root := &tr.root
+	if r, ok := tr.readRoot(mut); ok {
+		root = &r
+	} else if tr.lock(mut) {
 		defer tr.unlock(mut)
 	}
-	if tr.root == nil {
+	if *root == nil {
 		return tr.empty, false
 	}
-	n := tr.isoLoad(&tr.root, mut)
+	if tr.dups {
+		return tr.getFirst(root, key, mut)
+	}
+	// Search without copying, so that a missing key never performs a
+	// copy-on-write of the path. The path is only copied if the key is found
+	// in, or under, a node that is shared with another tree.
+	var shared bool
+	n := *root
 	depth := 0
 	for {
+		if mut && n.isoid != tr.isoid {
+			shared = true
+		}
 		i, found := tr.find(n, key, hint, depth)
 		if found {
+			if shared {
+				return tr.isoGet(key, hint)
+			}
 			return n.items[i], true
 		}
 		if n.children == nil {
 			return tr.empty, false
 		}
-		n = tr.isoLoad(&(*n.children)[i], mut)
+		n = (*n.children)[i]
+		depth++
+	}
+}
+
+// getFirst returns the first of the items that are equal to key, for trees
+// that allow duplicates, starting at root. The path is copied when mut is
+// true.
+func (tr *BTreeG[T]) getFirst(root **node[T], key T, mut bool) (T, bool) {
+	item, found := tr.empty, false
+	cn := root
+	for {
+		n := tr.isoLoad(cn, mut)
+		i := tr.bsearchFirst(n, key)
+		if i < len(n.items) && !tr.less(key, n.items[i]) {
+			item, found = n.items[i], true
+		}
+		if n.leaf() {
+			return item, found
+		}
+		cn = &(*n.children)[i]
+	}
+}
+
+// isoGet returns an existing item, copying the path to the item.
+func (tr *BTreeG[T]) isoGet(key T, hint *PathHint) (T, bool) {
+	n := tr.isoLoad(&tr.root, true)
+	depth := 0
+	for {
+		i, found := tr.find(n, key, hint, depth)
+		if found {
+			return n.items[i], true
+		}
+		n = tr.isoLoad(&(*n.children)[i], true)
 		depth++
 	}
 }
 
+// Contains returns true if an item matching key exists in the tree.
+// This is like Get, but without returning a copy of the item.
+func (tr *BTreeG[T]) Contains(key T) bool {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.root == nil {
+		return false
+	}
+	n := tr.root
+	for {
+		i, found := tr.bsearch(n, key)
+		if found {
+			return true
+		}
+		if n.leaf() {
+			return false
+		}
+		n = (*n.children)[i]
+	}
+}
+
 // Len returns the number of items in the tree
 func (tr *BTreeG[T]) Len() int {
+	if tr.locks {
+		// Writers store the count when releasing the lock, so it can be
+		// read without taking the lock.
+		return int(atomic.LoadInt64(&tr.length))
+	}
 	return tr.count
 }
 
+// IsEmpty returns true if the tree has no items. Like Len, it does not take
+// the lock.
+func (tr *BTreeG[T]) IsEmpty() bool {
+	return tr.Len() == 0
+}
+
 // Delete a value for a key and returns the deleted value.
 // Returns false if there was no value by that key found.
 func (tr *BTreeG[T]) Delete(key T) (T, bool) {
@@ -447,28 +1224,94 @@ func (tr *BTreeG[T]) DeleteHint(key T, hint *PathHint) (T, bool) {
 	return tr.deleteHint(key, hint)
 }
 
-func (tr *BTreeG[T]) deleteHint(key T, hint *PathHint) (T, bool) {
-	if tr.root == nil {
-		return tr.empty, false
-	}
-	prev, deleted := tr.delete(&tr.root, false, key, hint, 0)
-	if !deleted {
-		return tr.empty, false
-	}
-	if len(tr.root.items) == 0 && !tr.root.leaf() {
-		tr.root = (*tr.root.children)[0]
+// DeleteAndNeighbors deletes a value for a key, like Delete, and returns the
+// items that were before and after the deleted item, which are its neighbors
+// after the deletion. See Map.DeleteAndNeighbors.
+func (tr *BTreeG[T]) DeleteAndNeighbors(key T) (prev T, hasPrev bool, next T,
+	hasNext bool, deleted bool,
+) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
 	}
-	tr.count--
-	if tr.count == 0 {
-		tr.root = nil
+	prev, next, hasPrev, hasNext, found := tr.neighbors(key)
+	if !found {
+		return tr.empty, false, tr.empty, false, false
 	}
-	return prev, true
+	tr.deleteHint(key, nil)
+	return prev, hasPrev, next, hasNext, true
 }
 
-func (tr *BTreeG[T]) delete(cn **node[T], max bool, key T,
-	hint *PathHint, depth int,
-) (T, bool) {
-	n := tr.isoLoad(cn, true)
+// neighbors returns the items that are before and after the item that
+// Delete would remove for key, without copying, if the key exists.
+func (tr *BTreeG[T]) neighbors(key T) (prev, next T, hasPrev, hasNext,
+	found bool,
+) {
+	n := tr.root
+	for n != nil {
+		var i int
+		i, found = tr.find(n, key, nil, 0)
+		if found {
+			if n.leaf() {
+				if i > 0 {
+					prev, hasPrev = n.items[i-1], true
+				}
+				if i < len(n.items)-1 {
+					next, hasNext = n.items[i+1], true
+				}
+				return prev, next, hasPrev, hasNext, true
+			}
+			// The neighbors are the max of the left child and the min of
+			// the right child.
+			c := (*n.children)[i]
+			for !c.leaf() {
+				c = (*c.children)[len(*c.children)-1]
+			}
+			prev, hasPrev = c.items[len(c.items)-1], true
+			c = (*n.children)[i+1]
+			for !c.leaf() {
+				c = (*c.children)[0]
+			}
+			next, hasNext = c.items[0], true
+			return prev, next, hasPrev, hasNext, true
+		}
+		if n.leaf() {
+			break
+		}
+		// The items around the child are the nearest neighbors so far.
+		if i > 0 {
+			prev, hasPrev = n.items[i-1], true
+		}
+		if i < len(n.items) {
+			next, hasNext = n.items[i], true
+		}
+		n = (*n.children)[i]
+	}
+	return tr.empty, tr.empty, false, false, false
+}
+
+func (tr *BTreeG[T]) deleteHint(key T, hint *PathHint) (T, bool) {
+	if tr.root == nil {
+		return tr.empty, false
+	}
+	prev, deleted := tr.delete(&tr.root, false, key, hint, 0)
+	if !deleted {
+		return tr.empty, false
+	}
+	if len(tr.root.items) == 0 && !tr.root.leaf() {
+		tr.root = (*tr.root.children)[0]
+	}
+	tr.count--
+	if tr.count == 0 {
+		tr.root = nil
+	}
+	tr.version++
+	return prev, true
+}
+
+func (tr *BTreeG[T]) delete(cn **node[T], max bool, key T,
+	hint *PathHint, depth int,
+) (T, bool) {
+	n := tr.isoLoad(cn, true)
 	var i int
 	var found bool
 	if max {
@@ -479,12 +1322,7 @@ func (tr *BTreeG[T]) delete(cn **node[T], max bool, key T,
 	if n.leaf() {
 		if found {
 			// found the items at the leaf, remove it and return.
-			prev := n.items[i]
-			copy(n.items[i:], n.items[i+1:])
-			n.items[len(n.items)-1] = tr.empty
-			n.items = n.items[:len(n.items)-1]
-			n.count--
-			return prev, true
+			return tr.leafDelete(n, i), true
 		}
 		return tr.empty, false
 	}
@@ -508,12 +1346,92 @@ func (tr *BTreeG[T]) delete(cn **node[T], max bool, key T,
 		return tr.empty, false
 	}
 	n.count--
+	if tr.weight != nil {
+		n.weight -= tr.weight(prev)
+	}
+	changed := found && !max // an item was replaced
 	if len((*n.children)[i].items) < tr.min {
 		tr.nodeRebalance(n, i)
+		changed = true
+	}
+	if tr.summary != nil {
+		tr.summarize(n)
+	}
+	if tr.hash != nil && changed {
+		tr.rehash(n)
 	}
 	return prev, true
 }
 
+// leafDelete removes the item at index i of the leaf n, and returns it.
+func (tr *BTreeG[T]) leafDelete(n *node[T], i int) T {
+	prev := n.items[i]
+	copy(n.items[i:], n.items[i+1:])
+	n.items[len(n.items)-1] = tr.empty
+	n.items = n.items[:len(n.items)-1]
+	n.count--
+	if tr.weight != nil {
+		n.weight -= tr.weight(prev)
+	}
+	if tr.summary != nil {
+		tr.summarize(n)
+	}
+	if tr.hash != nil {
+		tr.rehash(n)
+	}
+	return prev
+}
+
+// deletePath deletes the item at the end of path, which holds the index of
+// the child at each level, followed by the index of the item in its node.
+// Unlike deleteHint, this removes that exact item rather than one that is
+// equal to it, which keeps the order of duplicates.
+func (tr *BTreeG[T]) deletePath(path []int) T {
+	prev := tr.deletePathNode(&tr.root, path)
+	if len(tr.root.items) == 0 && !tr.root.leaf() {
+		tr.root = (*tr.root.children)[0]
+	}
+	tr.count--
+	if tr.count == 0 {
+		tr.root = nil
+	}
+	tr.version++
+	return prev
+}
+
+func (tr *BTreeG[T]) deletePathNode(cn **node[T], path []int) T {
+	n := tr.isoLoad(cn, true)
+	i := path[0]
+	if n.leaf() {
+		return tr.leafDelete(n, i)
+	}
+	var prev T
+	found := len(path) == 1
+	if found {
+		// replace the item with the maximum item of its left child
+		prev = n.items[i]
+		n.items[i], _ = tr.delete(&(*n.children)[i], true, tr.empty, nil, 0)
+	} else {
+		prev = tr.deletePathNode(&(*n.children)[i], path[1:])
+	}
+	n.count--
+	if tr.weight != nil {
+		n.weight -= tr.weight(prev)
+	}
+	changed := found
+	if len((*n.children)[i].items) < tr.min {
+		tr.nodeRebalance(n, i)
+		changed = true
+	}
+	if tr.summary != nil {
+		tr.summarize(n)
+	}
+	if tr.hash != nil && changed {
+		tr.rehash(n)
+	}
+	return prev
+}
+
 // nodeRebalance rebalances the child nodes following a delete operation.
 // Provide the index of the child node with the number of items that fell
 // below minItems.
@@ -539,6 +1457,9 @@ func (tr *BTreeG[T]) nodeRebalance(n *node[T], i int) {
 			*left.children = append(*left.children, *right.children...)
 		}
 		left.count += right.count + 1
+		if tr.weight != nil {
+			left.weight += right.weight + tr.weight(n.items[i])
+		}
 
 		// move the items over one slot
 		copy(n.items[i:], n.items[i+1:])
@@ -563,6 +1484,10 @@ func (tr *BTreeG[T]) nodeRebalance(n *node[T], i int) {
 		left.items[len(left.items)-1] = tr.empty
 		left.items = left.items[:len(left.items)-1]
 		left.count--
+		if tr.weight != nil {
+			right.weight += tr.weight(right.items[0])
+			left.weight -= tr.weight(n.items[i])
+		}
 
 		if !left.leaf() {
 			// move the left-node last child into the right-node first slot
@@ -573,6 +1498,8 @@ func (tr *BTreeG[T]) nodeRebalance(n *node[T], i int) {
 			(*left.children) = (*left.children)[:len(*left.children)-1]
 			left.count -= (*right.children)[0].count
 			right.count += (*right.children)[0].count
+			left.weight -= (*right.children)[0].weight
+			right.weight += (*right.children)[0].weight
 		}
 	} else {
 		// move left <- right over one slot
@@ -585,6 +1512,10 @@ func (tr *BTreeG[T]) nodeRebalance(n *node[T], i int) {
 		right.items[len(right.items)-1] = tr.empty
 		right.items = right.items[:len(right.items)-1]
 		right.count--
+		if tr.weight != nil {
+			left.weight += tr.weight(left.items[len(left.items)-1])
+			right.weight -= tr.weight(n.items[i])
+		}
 
 		if !left.leaf() {
 			*left.children = append(*left.children, (*right.children)[0])
@@ -593,8 +1524,19 @@ func (tr *BTreeG[T]) nodeRebalance(n *node[T], i int) {
 			*right.children = (*right.children)[:len(*right.children)-1]
 			left.count += (*left.children)[len(*left.children)-1].count
 			right.count -= (*left.children)[len(*left.children)-1].count
+			left.weight += (*left.children)[len(*left.children)-1].weight
+			right.weight -= (*left.children)[len(*left.children)-1].weight
 		}
 	}
+	if tr.summary != nil {
+		// the right node is discarded after a merge, which is harmless
+		tr.summarize(left)
+		tr.summarize(right)
+	}
+	if tr.hash != nil {
+		tr.rehash(left)
+		tr.rehash(right)
+	}
 }
 
 // Ascend the tree within the range [pivot, last]
@@ -606,12 +1548,74 @@ func (tr *BTreeG[T]) Ascend(pivot T, iter func(item T) bool) {
 func (tr *BTreeG[T]) AscendMut(pivot T, iter func(item T) bool) {
 	tr.ascend(pivot, iter, true, nil)
 }
+
+// AscendEqual iterates over the items that are equal to key, that is where
+// neither item is less than the other, in ascending order. Unless the tree
+// was created with the AllowDuplicates option, the tree replaces an item when
+// setting an equal one, so this visits at most one item.
+// Return false to stop iterating.
+func (tr *BTreeG[T]) AscendEqual(key T, iter func(item T) bool) {
+	tr.ascend(key, func(item T) bool {
+		return !tr.less(key, item) && iter(item)
+	}, false, nil)
+}
+
+// GetAll returns the items that are equal to key, in ascending order.
+// See AscendEqual, which this is the eager form of.
+func (tr *BTreeG[T]) GetAll(key T) []T {
+	return tr.GetAllAppend(nil, key)
+}
+
+// GetAllAppend is like GetAll, but appends the items to dst and returns the
+// extended slice, which avoids allocating when dst has the capacity.
+func (tr *BTreeG[T]) GetAllAppend(dst []T, key T) []T {
+	tr.AscendEqual(key, func(item T) bool {
+		dst = append(dst, item)
+		return true
+	})
+	return dst
+}
+
+// AscendE is like Ascend, but the iterator may also return an error, which
+// stops the iteration and is returned by AscendE.
+func (tr *BTreeG[T]) AscendE(pivot T, iter func(item T) (bool, error)) error {
+	var err error
+	tr.ascend(pivot, iterE(iter, &err), false, nil)
+	return err
+}
+
+// AscendContext is like Ascend, but stops early when ctx is cancelled,
+// returning ctx.Err(). See ScanContext.
+func (tr *BTreeG[T]) AscendContext(ctx context.Context, pivot T,
+	iter func(item T) bool,
+) error {
+	err := ctx.Err()
+	if err == nil {
+		tr.ascend(pivot, iterContext(ctx, iter, &err), false, nil)
+	}
+	return err
+}
+
+// AscendN is like Ascend, but stops after n items, and returns the number of
+// items visited. Nothing is visited if n is zero or less.
+func (tr *BTreeG[T]) AscendN(pivot T, n int, iter func(item T) bool) int {
+	var count int
+	if n > 0 {
+		tr.ascend(pivot, iterN(n, iter, &count), false, nil)
+	}
+	return count
+}
+
 func (tr *BTreeG[T]) ascend(pivot T, iter func(item T) bool, mut bool,
 	hint *PathHint,
 ) {
 	if tr.lock(mut) {
 		defer tr.unlock(mut)
 	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
 	if tr.root == nil {
 		return
 	}
@@ -633,7 +1637,7 @@ func (tr *BTreeG[T]) nodeAscend(cn **node[T], pivot T, hint *PathHint,
 	depth int, iter func(item T) bool, mut bool,
 ) bool {
 	n := tr.isoLoad(cn, mut)
-	i, found := tr.find(n, pivot, hint, depth)
+	i, found := tr.findPivot(n, pivot, hint, depth, false)
 	if !found {
 		if !n.leaf() {
 			if !tr.nodeAscend(&(*n.children)[i], pivot, hint, depth+1, iter,
@@ -659,16 +1663,255 @@ func (tr *BTreeG[T]) nodeAscend(cn **node[T], pivot T, hint *PathHint,
 	return true
 }
 
+// SetItemSummarizer sets a function that returns a summary of an item, such
+// as a timestamp that's part of a composite item. The tree keeps the range of
+// the summaries in each subtree, like it does for counts, which allows
+// AscendSummaryRange to skip over the subtrees that have no items with a
+// summary in the range. Setting the summarizer computes the summaries of all
+// items, and passing nil removes it.
+func (tr *BTreeG[T]) SetItemSummarizer(summary func(item T) uint64) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	tr.summary = summary
+	if summary != nil && tr.root != nil {
+		tr.summarizeAll(&tr.root)
+	}
+}
+
+func (tr *BTreeG[T]) summarizeAll(cn **node[T]) {
+	n := tr.isoLoad(cn, true)
+	if !n.leaf() {
+		for i := range *n.children {
+			tr.summarizeAll(&(*n.children)[i])
+		}
+	}
+	tr.summarize(n)
+}
+
+// SetItemHasher sets a function that returns a hash of an item, which is used
+// to keep a checksum of the items in each node, for detecting memory
+// corruption in long-lived trees with VerifyChecksums. Only the nodes that
+// are changed are rehashed. The hash should only depend on the parts of the
+// item that are used for ordering. Setting the hasher computes the checksums
+// of all nodes, and passing nil removes it.
+func (tr *BTreeG[T]) SetItemHasher(hash func(item T) uint64) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	tr.hash = hash
+	if hash != nil && tr.root != nil {
+		tr.rehashAll(&tr.root)
+	}
+}
+
+func (tr *BTreeG[T]) rehashAll(cn **node[T]) {
+	n := tr.isoLoad(cn, true)
+	if !n.leaf() {
+		for i := range *n.children {
+			tr.rehashAll(&(*n.children)[i])
+		}
+	}
+	tr.rehash(n)
+}
+
+// rehash recalculates the checksum of the node from its items.
+func (tr *BTreeG[T]) rehash(n *node[T]) {
+	n.checksum = tr.checksum(n)
+}
+
+func (tr *BTreeG[T]) checksum(n *node[T]) uint64 {
+	const prime = 1099511628211 // FNV-1a 64-bit prime
+	sum := uint64(len(n.items))
+	for _, item := range n.items {
+		sum = (sum ^ tr.hash(item)) * prime
+	}
+	return sum
+}
+
+// ChecksumError is returned by VerifyChecksums for the first node with a
+// checksum that does not match its items. Depth is the number of levels
+// above the node, and Index is the position of the node from the left
+// among the nodes at that depth.
+type ChecksumError struct {
+	Depth int
+	Index int
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("btree: checksum mismatch at depth %d, index %d",
+		e.Depth, e.Index)
+}
+
+// VerifyChecksums recalculates the checksum of every node, in breadth-first
+// order, and returns a *ChecksumError for the first node that does not
+// match. Returns nil if the tree has no item hasher. See SetItemHasher.
+func (tr *BTreeG[T]) VerifyChecksums() error {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	return tr.verifyChecksums()
+}
+
+func (tr *BTreeG[T]) verifyChecksums() error {
+	if tr.hash == nil || tr.root == nil {
+		return nil
+	}
+	level := []*node[T]{tr.root}
+	for depth := 0; len(level) > 0; depth++ {
+		var next []*node[T]
+		for i, n := range level {
+			if tr.checksum(n) != n.checksum {
+				return &ChecksumError{Depth: depth, Index: i}
+			}
+			if !n.leaf() {
+				next = append(next, *n.children...)
+			}
+		}
+		level = next
+	}
+	return nil
+}
+
+// AscendSummaryRange visits, in ascending order, the items with a summary
+// that is within the range [lo, hi]. Subtrees with a summary range that does
+// not intersect with [lo, hi] are skipped without visiting their items.
+// Panics if the tree has no item summarizer. See SetItemSummarizer.
+// Return false from iter to stop iterating.
+func (tr *BTreeG[T]) AscendSummaryRange(lo, hi uint64, iter func(item T) bool,
+) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.summary == nil {
+		panic("btree: no item summarizer")
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root != nil {
+		tr.nodeAscendSummaryRange(tr.root, lo, hi, iter)
+	}
+}
+
+func (tr *BTreeG[T]) nodeAscendSummaryRange(n *node[T], lo, hi uint64,
+	iter func(item T) bool,
+) bool {
+	if n.summax < lo || n.summin > hi {
+		return true
+	}
+	for i, item := range n.items {
+		if !n.leaf() {
+			if !tr.nodeAscendSummaryRange((*n.children)[i], lo, hi, iter) {
+				return false
+			}
+		}
+		if s := tr.summary(item); s >= lo && s <= hi && !iter(item) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return tr.nodeAscendSummaryRange((*n.children)[len(n.items)], lo, hi,
+			iter)
+	}
+	return true
+}
+
+// AscendFiltered is like Ascend, but the skip function can prune entire
+// subtrees. Before visiting a subtree, including a single leaf, skip is
+// called with bounds that all items in the subtree are within, inclusively.
+// The bounds are the items that separate the subtree from its neighbors, or
+// the minimum or maximum item of the tree. The subtree is skipped when skip
+// returns true, which should only be done when no item in that range is
+// wanted.
+// Return false from iter to stop iterating.
+func (tr *BTreeG[T]) AscendFiltered(pivot T, skip func(min, max T) bool,
+	iter func(item T) bool,
+) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root == nil {
+		return
+	}
+	min, max := tr.root, tr.root
+	for !min.leaf() {
+		min = (*min.children)[0]
+		max = (*max.children)[len(*max.children)-1]
+	}
+	tr.nodeAscendFiltered(tr.root, pivot, min.items[0],
+		max.items[len(max.items)-1], skip, iter)
+}
+
+func (tr *BTreeG[T]) nodeAscendFiltered(n *node[T], pivot, min, max T,
+	skip func(min, max T) bool, iter func(item T) bool,
+) bool {
+	if skip(min, max) {
+		return true
+	}
+	i, found := tr.findPivot(n, pivot, nil, 0, false)
+	if !found && !n.leaf() {
+		lo, hi := min, max
+		if i > 0 {
+			lo = n.items[i-1]
+		}
+		if i < len(n.items) {
+			hi = n.items[i]
+		}
+		if !tr.nodeAscendFiltered((*n.children)[i], pivot, lo, hi, skip,
+			iter) {
+			return false
+		}
+	}
+	for ; i < len(n.items); i++ {
+		if !iter(n.items[i]) {
+			return false
+		}
+		if !n.leaf() {
+			hi := max
+			if i+1 < len(n.items) {
+				hi = n.items[i+1]
+			}
+			if !tr.nodeAscendFiltered((*n.children)[i+1], pivot, n.items[i],
+				hi, skip, iter) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (tr *BTreeG[T]) Reverse(iter func(item T) bool) {
 	tr.reverse(iter, false)
 }
 func (tr *BTreeG[T]) ReverseMut(iter func(item T) bool) {
 	tr.reverse(iter, true)
 }
+
+// ReverseContext is like Reverse, but stops early when ctx is cancelled,
+// returning ctx.Err(). See ScanContext.
+func (tr *BTreeG[T]) ReverseContext(ctx context.Context,
+	iter func(item T) bool,
+) error {
+	err := ctx.Err()
+	if err == nil {
+		tr.reverse(iterContext(ctx, iter, &err), false)
+	}
+	return err
+}
 func (tr *BTreeG[T]) reverse(iter func(item T) bool, mut bool) {
 	if tr.lock(mut) {
 		defer tr.unlock(mut)
 	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
 	if tr.root == nil {
 		return
 	}
@@ -709,12 +1952,47 @@ func (tr *BTreeG[T]) Descend(pivot T, iter func(item T) bool) {
 func (tr *BTreeG[T]) DescendMut(pivot T, iter func(item T) bool) {
 	tr.descend(pivot, iter, true, nil)
 }
+
+// DescendE is like Descend, but the iterator may also return an error, which
+// stops the iteration and is returned by DescendE.
+func (tr *BTreeG[T]) DescendE(pivot T, iter func(item T) (bool, error)) error {
+	var err error
+	tr.descend(pivot, iterE(iter, &err), false, nil)
+	return err
+}
+
+// DescendContext is like Descend, but stops early when ctx is cancelled,
+// returning ctx.Err(). See ScanContext.
+func (tr *BTreeG[T]) DescendContext(ctx context.Context, pivot T,
+	iter func(item T) bool,
+) error {
+	err := ctx.Err()
+	if err == nil {
+		tr.descend(pivot, iterContext(ctx, iter, &err), false, nil)
+	}
+	return err
+}
+
+// DescendN is like Descend, but stops after n items, and returns the number
+// of items visited. Nothing is visited if n is zero or less.
+func (tr *BTreeG[T]) DescendN(pivot T, n int, iter func(item T) bool) int {
+	var count int
+	if n > 0 {
+		tr.descend(pivot, iterN(n, iter, &count), false, nil)
+	}
+	return count
+}
+
 func (tr *BTreeG[T]) descend(pivot T, iter func(item T) bool, mut bool,
 	hint *PathHint,
 ) {
 	if tr.lock(mut) {
 		defer tr.unlock(mut)
 	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
 	if tr.root == nil {
 		return
 	}
@@ -736,7 +2014,7 @@ func (tr *BTreeG[T]) nodeDescend(cn **node[T], pivot T, hint *PathHint,
 	depth int, iter func(item T) bool, mut bool,
 ) bool {
 	n := tr.isoLoad(cn, mut)
-	i, found := tr.find(n, pivot, hint, depth)
+	i, found := tr.findPivot(n, pivot, hint, depth, true)
 	if !found {
 		if !n.leaf() {
 			if !tr.nodeDescend(&(*n.children)[i], pivot, hint, depth+1, iter,
@@ -764,34 +2042,143 @@ func (tr *BTreeG[T]) Load(item T) (T, bool) {
 	if tr.lock(true) {
 		defer tr.unlock(true)
 	}
+	prev, replaced := tr.load(item)
+	if tr.maxLen > 0 {
+		tr.evict()
+	}
+	return prev, replaced
+}
+
+func (tr *BTreeG[T]) load(item T) (T, bool) {
 	if tr.root == nil {
 		return tr.setHint(item, nil)
 	}
 	n := tr.isoLoad(&tr.root, true)
-	for {
-		n.count++ // optimistically update counts
-		if n.leaf() {
-			if len(n.items) < tr.max {
-				if tr.Less(n.items[len(n.items)-1], item) {
-					n.items = append(n.items, item)
-					tr.count++
-					return tr.empty, false
-				}
-			}
-			break
-		}
+	for !n.leaf() {
 		n = tr.isoLoad(&(*n.children)[len(*n.children)-1], true)
 	}
-	// revert the counts
-	n = tr.root
-	for {
-		n.count--
+	// The comparison is done before any counts are changed, so that a less
+	// function that panics cannot leave the tree in a corrupt state.
+	if !tr.Less(n.items[len(n.items)-1], item) {
+		return tr.setHint(item, nil)
+	}
+	if len(n.items) == tr.max {
+		// The item is greater than all other items, but the rightmost leaf
+		// is full.
+		tr.appendSplit(item)
+		return tr.empty, false
+	}
+	n.items = append(n.items, item)
+	if tr.hash != nil {
+		tr.rehash(n)
+	}
+	for n = tr.root; ; n = (*n.children)[len(*n.children)-1] {
+		n.count++
+		if tr.summary != nil {
+			n.extendSummary(tr.summary(item))
+		}
 		if n.leaf() {
 			break
 		}
-		n = (*n.children)[len(*n.children)-1]
 	}
-	return tr.setHint(item, nil)
+	tr.count++
+	tr.version++
+	if tr.weight != nil {
+		tr.addWeight(tr.weight(item), nil, false)
+	}
+	return tr.empty, false
+}
+
+// appendSplit adds an item that is greater than all other items to a tree
+// where the rightmost leaf is full.
+//
+// Rather than splitting the full nodes on the right spine in half, which
+// would leave the nodes behind the right spine half empty forever when items
+// are loaded in order, each full node keeps all but its last item, and the
+// new right node starts out with just one item. This means the nodes on the
+// right spine may have fewer than the minimum number of items, but the nodes
+// behind it are nearly full. The tree is then marked as sparseRight, which
+// is the only case where Sane allows it.
+func (tr *BTreeG[T]) appendSplit(item T) {
+	tr.sparseRight = true
+	right, median, split := tr.nodeAppend(tr.isoLoad(&tr.root, true), item)
+	if split {
+		left := tr.root
+		tr.root = tr.newNode(false)
+		*tr.root.children = append([]*node[T]{}, left, right)
+		tr.root.items = append([]T{}, median)
+		tr.updateCount(tr.root)
+	}
+	tr.count++
+	tr.version++
+}
+
+func (tr *BTreeG[T]) nodeAppend(n *node[T], item T,
+) (right *node[T], median T, split bool) {
+	if n.leaf() {
+		if len(n.items) < tr.max {
+			n.items = append(n.items, item)
+			n.count++
+			if tr.weight != nil {
+				n.weight += tr.weight(item)
+			}
+			if tr.summary != nil {
+				n.extendSummary(tr.summary(item))
+			}
+			if tr.hash != nil {
+				tr.rehash(n)
+			}
+			return nil, tr.empty, false
+		}
+		median = n.items[len(n.items)-1]
+		n.items[len(n.items)-1] = tr.empty
+		n.items = n.items[:len(n.items)-1]
+		right = tr.newNode(true)
+		right.items = append([]T{}, item)
+		tr.updateCount(n)
+		tr.updateCount(right)
+		return right, median, true
+	}
+	child := tr.isoLoad(&(*n.children)[len(*n.children)-1], true)
+	cright, cmedian, split := tr.nodeAppend(child, item)
+	if !split {
+		n.count++
+		if tr.weight != nil {
+			n.weight += tr.weight(item)
+		}
+		if tr.summary != nil {
+			n.extendSummary(tr.summary(item))
+		}
+		return nil, tr.empty, false
+	}
+	if len(n.items) < tr.max {
+		n.items = append(n.items, cmedian)
+		*n.children = append(*n.children, cright)
+		n.count++
+		if tr.weight != nil {
+			n.weight += tr.weight(item)
+		}
+		if tr.summary != nil {
+			n.extendSummary(tr.summary(item))
+		}
+		if tr.hash != nil {
+			tr.rehash(n)
+		}
+		return nil, tr.empty, false
+	}
+	// The node is full. Move its last item up and its last child, which is
+	// the child that was just split, to the new right node.
+	median = n.items[len(n.items)-1]
+	n.items[len(n.items)-1] = tr.empty
+	n.items = n.items[:len(n.items)-1]
+	(*n.children)[len(*n.children)-1] = nil
+	*n.children = (*n.children)[:len(*n.children)-1]
+	right = tr.newNode(false)
+	right.items = append([]T{}, cmedian)
+	*right.children = append([]*node[T]{}, child, cright)
+	tr.updateCount(n)
+	tr.updateCount(right)
+	return right, median, true
 }
 
 // Min returns the minimum item in tree.
@@ -830,6 +2217,27 @@ func (tr *BTreeG[T]) MaxMut() (T, bool) {
 	return tr.maxMut(true)
 }
 
+// PeekMin returns the minimum item in tree, and panics if the tree has no
+// items. The Peek methods are for trees that are known to be non-empty, and
+// are otherwise the same as Min and Max.
+func (tr *BTreeG[T]) PeekMin() T {
+	item, ok := tr.Min()
+	if !ok {
+		panic("btree: PeekMin on empty BTreeG")
+	}
+	return item
+}
+
+// PeekMax returns the maximum item in tree, and panics if the tree has no
+// items.
+func (tr *BTreeG[T]) PeekMax() T {
+	item, ok := tr.Max()
+	if !ok {
+		panic("btree: PeekMax on empty BTreeG")
+	}
+	return item
+}
+
 func (tr *BTreeG[T]) maxMut(mut bool) (T, bool) {
 	if tr.lock(mut) {
 		defer tr.unlock(mut)
@@ -852,24 +2260,42 @@ func (tr *BTreeG[T]) PopMin() (T, bool) {
 	if tr.lock(true) {
 		defer tr.unlock(true)
 	}
+	return tr.popMin()
+}
+
+func (tr *BTreeG[T]) popMin() (T, bool) {
 	if tr.root == nil {
 		return tr.empty, false
 	}
+	var pathbuf [8]int // track the path
+	path := pathbuf[:0]
 	n := tr.isoLoad(&tr.root, true)
 	var item T
 	for {
 		n.count-- // optimistically update counts
+		path = append(path, 0)
 		if n.leaf() {
 			item = n.items[0]
-			if len(n.items) == tr.min {
+			if len(n.items) <= tr.min {
 				break
 			}
 			copy(n.items[:], n.items[1:])
 			n.items[len(n.items)-1] = tr.empty
 			n.items = n.items[:len(n.items)-1]
+			if tr.hash != nil {
+				tr.rehash(n)
+			}
 			tr.count--
+			tr.version++
 			if tr.count == 0 {
 				tr.root = nil
+			} else {
+				if tr.weight != nil {
+					tr.addWeight(-tr.weight(item), nil, true)
+				}
+				if tr.summary != nil {
+					tr.summarizePath(nil, true)
+				}
 			}
 			return item, true
 		}
@@ -884,7 +2310,7 @@ func (tr *BTreeG[T]) PopMin() (T, bool) {
 		}
 		n = (*n.children)[0]
 	}
-	return tr.deleteHint(item, nil)
+	return tr.deletePath(path), true
 }
 
 // PopMax removes the maximum item in tree and returns it.
@@ -893,26 +2319,45 @@ func (tr *BTreeG[T]) PopMax() (T, bool) {
 	if tr.lock(true) {
 		defer tr.unlock(true)
 	}
+	return tr.popMax()
+}
+
+func (tr *BTreeG[T]) popMax() (T, bool) {
 	if tr.root == nil {
 		return tr.empty, false
 	}
+	var pathbuf [8]int // track the path
+	path := pathbuf[:0]
 	n := tr.isoLoad(&tr.root, true)
 	var item T
 	for {
 		n.count-- // optimistically update counts
 		if n.leaf() {
 			item = n.items[len(n.items)-1]
-			if len(n.items) == tr.min {
+			if len(n.items) <= tr.min {
+				path = append(path, len(n.items)-1)
 				break
 			}
 			n.items[len(n.items)-1] = tr.empty
 			n.items = n.items[:len(n.items)-1]
+			if tr.hash != nil {
+				tr.rehash(n)
+			}
 			tr.count--
+			tr.version++
 			if tr.count == 0 {
 				tr.root = nil
+			} else {
+				if tr.weight != nil {
+					tr.addWeight(-tr.weight(item), nil, false)
+				}
+				if tr.summary != nil {
+					tr.summarizePath(nil, false)
+				}
 			}
 			return item, true
 		}
+		path = append(path, len(*n.children)-1)
 		n = tr.isoLoad(&(*n.children)[len(*n.children)-1], true)
 	}
 	// revert the counts
@@ -924,7 +2369,150 @@ func (tr *BTreeG[T]) PopMax() (T, bool) {
 		}
 		n = (*n.children)[len(*n.children)-1]
 	}
-	return tr.deleteHint(item, nil)
+	return tr.deletePath(path), true
+}
+
+// PopFirstN removes up to n of the minimum items in tree and returns them in
+// ascending order.
+func (tr *BTreeG[T]) PopFirstN(n int) []T {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if n > tr.count {
+		n = tr.count
+	}
+	if n <= 0 {
+		return nil
+	}
+	items := make([]T, n)
+	for i := 0; i < n; i++ {
+		items[i], _ = tr.popMin()
+	}
+	return items
+}
+
+// PopLastN removes up to n of the maximum items in tree and returns them in
+// ascending order.
+func (tr *BTreeG[T]) PopLastN(n int) []T {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if n > tr.count {
+		n = tr.count
+	}
+	if n <= 0 {
+		return nil
+	}
+	items := make([]T, n)
+	for i := n - 1; i >= 0; i-- {
+		items[i], _ = tr.popMax()
+	}
+	return items
+}
+
+// LenRange returns the number of items within the range [lo, hi), which
+// includes lo but not hi. It uses the counts of the nodes, so only the paths
+// to lo and hi are visited, rather than the items in the range.
+func (tr *BTreeG[T]) LenRange(lo, hi T) int {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.root == nil || !tr.less(lo, hi) {
+		return 0
+	}
+	return tr.rank(hi) - tr.rank(lo)
+}
+
+// rank returns the number of items that are less than key.
+func (tr *BTreeG[T]) rank(key T) int {
+	var index int
+	n := tr.root
+	for {
+		i, found := tr.findPivot(n, key, nil, 0, false)
+		index += i
+		if n.leaf() {
+			return index
+		}
+		for _, child := range (*n.children)[:i] {
+			index += child.count
+		}
+		if found {
+			return index + (*n.children)[i].count
+		}
+		n = (*n.children)[i]
+	}
+}
+
+// SelectFunc returns the k-th item, counting from zero, of the items in
+// ascending order for which match returns true. Iteration stops as soon as
+// the item is found.
+// Returns false if there are not more than k matching items.
+func (tr *BTreeG[T]) SelectFunc(k int, match func(item T) bool) (T, bool) {
+	return tr.selectFunc(k, match, tr.Scan)
+}
+
+// SelectFuncReverse is like SelectFunc, but counts the matching items in
+// descending order.
+func (tr *BTreeG[T]) SelectFuncReverse(k int, match func(item T) bool,
+) (T, bool) {
+	return tr.selectFunc(k, match, tr.Reverse)
+}
+
+func (tr *BTreeG[T]) selectFunc(k int, match func(item T) bool,
+	scan func(iter func(item T) bool),
+) (T, bool) {
+	item, found := tr.empty, false
+	if k < 0 {
+		return item, false
+	}
+	scan(func(v T) bool {
+		if !match(v) {
+			return true
+		}
+		if k == 0 {
+			item, found = v, true
+			return false
+		}
+		k--
+		return true
+	})
+	return item, found
+}
+
+// Around returns the items nearest to pivot, in ascending order, which are
+// up to before items that are less than pivot, the item equal to pivot when
+// it exists, and up to after items that are greater than pivot. The items
+// are read while holding the lock once.
+func (tr *BTreeG[T]) Around(pivot T, before, after int) []T {
+	var items []T
+	iter := tr.Iter()
+	defer iter.Release()
+	ok := iter.Seek(pivot)
+	if !ok {
+		// all items are less than pivot
+		ok = before > 0 && iter.Last()
+		if ok {
+			items = append(items, iter.Item())
+		}
+	}
+	for ok && len(items) < before {
+		if ok = iter.Prev(); ok {
+			items = append(items, iter.Item())
+		}
+	}
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	ok = iter.Seek(pivot)
+	if ok && !tr.less(pivot, iter.Item()) {
+		items = append(items, iter.Item())
+		ok = iter.Next()
+	}
+	for n := 0; ok && n < after; n++ {
+		items = append(items, iter.Item())
+		ok = iter.Next()
+	}
+	return items
 }
 
 // GetAt returns the value at index.
@@ -939,6 +2527,10 @@ func (tr *BTreeG[T]) getAt(index int, mut bool) (T, bool) {
 	if tr.lock(mut) {
 		defer tr.unlock(mut)
 	}
+	return tr.atIndex(index, mut)
+}
+
+func (tr *BTreeG[T]) atIndex(index int, mut bool) (T, bool) {
 	if tr.root == nil || index < 0 || index >= tr.count {
 		return tr.empty, false
 	}
@@ -969,7 +2561,7 @@ func (tr *BTreeG[T]) DeleteAt(index int) (T, bool) {
 	if tr.root == nil || index < 0 || index >= tr.count {
 		return tr.empty, false
 	}
-	var pathbuf [8]uint8 // track the path
+	var pathbuf [8]int // track the path
 	path := pathbuf[:0]
 	var item T
 	n := tr.isoLoad(&tr.root, true)
@@ -979,16 +2571,27 @@ outer:
 		if n.leaf() {
 			// the index is the item position
 			item = n.items[index]
-			if len(n.items) == tr.min {
-				path = append(path, uint8(index))
+			if len(n.items) <= tr.min {
+				path = append(path, index)
 				break outer
 			}
 			copy(n.items[index:], n.items[index+1:])
 			n.items[len(n.items)-1] = tr.empty
 			n.items = n.items[:len(n.items)-1]
+			if tr.hash != nil {
+				tr.rehash(n)
+			}
 			tr.count--
+			tr.version++
 			if tr.count == 0 {
 				tr.root = nil
+			} else {
+				if tr.weight != nil {
+					tr.addWeight(-tr.weight(item), path, false)
+				}
+				if tr.summary != nil {
+					tr.summarizePath(path, false)
+				}
 			}
 			return item, true
 		}
@@ -998,28 +2601,127 @@ outer:
 				break
 			} else if index == (*n.children)[i].count {
 				item = n.items[i]
-				path = append(path, uint8(i))
+				path = append(path, i)
 				break outer
 			}
 			index -= (*n.children)[i].count + 1
 		}
-		path = append(path, uint8(i))
+		path = append(path, i)
 		n = tr.isoLoad(&(*n.children)[i], true)
 	}
 	// revert the counts
-	var hint PathHint
 	n = tr.root
 	for i := 0; i < len(path); i++ {
-		if i < len(hint.path) {
-			hint.path[i] = uint8(path[i])
-			hint.used[i] = true
-		}
 		n.count++
 		if !n.leaf() {
-			n = (*n.children)[uint8(path[i])]
+			n = (*n.children)[path[i]]
 		}
 	}
-	return tr.deleteHint(item, &hint)
+	return tr.deletePath(path), true
+}
+
+// TotalWeight returns the sum of the weights of all items in the tree.
+// Returns zero if the tree was not created with NewBTreeGWeighted.
+func (tr *BTreeG[T]) TotalWeight() int64 {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.root == nil {
+		return 0
+	}
+	return tr.root.weight
+}
+
+// WeightBetween returns the sum of the weights of the items within the range
+// [lo, hi), which includes lo but not hi. Like LenRange, only the paths to lo
+// and hi are visited.
+// Returns zero if the tree was not created with NewBTreeGWeighted.
+func (tr *BTreeG[T]) WeightBetween(lo, hi T) int64 {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.weight == nil || tr.root == nil || !tr.less(lo, hi) {
+		return 0
+	}
+	return tr.weightRank(hi) - tr.weightRank(lo)
+}
+
+// weightRank returns the sum of the weights of the items that are less than
+// key.
+func (tr *BTreeG[T]) weightRank(key T) int64 {
+	var sum int64
+	n := tr.root
+	for {
+		i, found := tr.findPivot(n, key, nil, 0, false)
+		for _, item := range n.items[:i] {
+			sum += tr.weight(item)
+		}
+		if n.leaf() {
+			return sum
+		}
+		for _, child := range (*n.children)[:i] {
+			sum += child.weight
+		}
+		if found {
+			return sum + (*n.children)[i].weight
+		}
+		n = (*n.children)[i]
+	}
+}
+
+// SelectByWeight returns the item whose weight range contains target, where
+// each item covers the range that starts at the sum of the weights of all
+// items before it. This allows for weighted selection by passing a target
+// in the range [0, TotalWeight()).
+// Returns false if the target is out of range or the tree was not created
+// with NewBTreeGWeighted.
+func (tr *BTreeG[T]) SelectByWeight(target int64) (T, bool) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.weight == nil || tr.root == nil || target < 0 ||
+		target >= tr.root.weight {
+		return tr.empty, false
+	}
+	n := tr.root
+	for {
+		i := 0
+		for ; i < len(n.items); i++ {
+			if !n.leaf() {
+				if target < (*n.children)[i].weight {
+					break
+				}
+				target -= (*n.children)[i].weight
+			}
+			w := tr.weight(n.items[i])
+			if target < w {
+				return n.items[i], true
+			}
+			target -= w
+		}
+		if n.leaf() {
+			// only reachable with negative weights
+			return tr.empty, false
+		}
+		n = (*n.children)[i]
+	}
+}
+
+// Version returns the version of the tree, which increases each time the
+// items in the tree are changed, such as with Set, Delete, Load, PopMin, and
+// Clear. This is useful for detecting when data derived from the tree needs
+// to be refreshed. Copies start with the version of the tree they were
+// copied from.
+func (tr *BTreeG[T]) Version() uint64 {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	return tr.version
+}
+
+// Degree returns the degree of the tree.
+func (tr *BTreeG[T]) Degree() int {
+	return maxToDegree(tr.max)
 }
 
 // Height returns the height of the tree.
@@ -1042,6 +2744,45 @@ func (tr *BTreeG[T]) Height() int {
 	return height
 }
 
+// ForEachChunk visits all items in ascending order, in chunks of n items,
+// except for the last chunk, which may be smaller. The same buffer is reused
+// for every chunk, so the chunk must not be retained after fn returns.
+// Return false to stop iterating.
+func (tr *BTreeG[T]) ForEachChunk(n int, fn func(chunk []T) bool) {
+	tr.forEachChunk(n, fn, tr.scan)
+}
+
+// ForEachChunkReverse is like ForEachChunk, but visits the items in
+// descending order, so the items of each chunk are also in descending
+// order.
+func (tr *BTreeG[T]) ForEachChunkReverse(n int, fn func(chunk []T) bool) {
+	tr.forEachChunk(n, fn, tr.reverse)
+}
+
+func (tr *BTreeG[T]) forEachChunk(n int, fn func(chunk []T) bool,
+	scan func(iter func(item T) bool, mut bool),
+) {
+	if n < 1 {
+		panic("btree: chunk size must be positive")
+	}
+	var chunk []T
+	ok := true
+	scan(func(item T) bool {
+		if chunk == nil {
+			chunk = make([]T, 0, n)
+		}
+		chunk = append(chunk, item)
+		if len(chunk) == n {
+			ok = fn(chunk)
+			chunk = chunk[:0]
+		}
+		return ok
+	}, false)
+	if ok && len(chunk) > 0 {
+		fn(chunk)
+	}
+}
+
 // Walk iterates over all items in tree, in order.
 // The items param will contain one or more items.
 func (tr *BTreeG[T]) Walk(iter func(item []T) bool) {
@@ -1054,29 +2795,146 @@ func (tr *BTreeG[T]) walk(iter func(item []T) bool, mut bool) {
 	if tr.lock(mut) {
 		defer tr.unlock(mut)
 	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root == nil {
+		return
+	}
+	tr.nodeWalk(&tr.root, iter, mut)
+}
+
+func (tr *BTreeG[T]) nodeWalk(cn **node[T], iter func(item []T) bool, mut bool,
+) bool {
+	n := tr.isoLoad(cn, mut)
+	if n.leaf() {
+		if !iter(n.items) {
+			return false
+		}
+	} else {
+		for i := 0; i < len(n.items); i++ {
+			if !tr.nodeWalk(&(*n.children)[i], iter, mut) {
+				return false
+			}
+			if !iter(n.items[i : i+1]) {
+				return false
+			}
+		}
+		if !tr.nodeWalk(&(*n.children)[len(n.items)], iter, mut) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReverseWalk is like Walk, but passes the items in descending order. Each
+// items param holds the same items as with Walk, which are in ascending
+// order, and must not be modified.
+func (tr *BTreeG[T]) ReverseWalk(iter func(items []T) bool) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root == nil {
+		return
+	}
+	tr.root.reverseWalk(iter)
+}
+
+func (n *node[T]) reverseWalk(iter func(items []T) bool) bool {
+	if n.leaf() {
+		return iter(n.items)
+	}
+	if !(*n.children)[len(n.items)].reverseWalk(iter) {
+		return false
+	}
+	for i := len(n.items) - 1; i >= 0; i-- {
+		if !iter(n.items[i:i+1]) || !(*n.children)[i].reverseWalk(iter) {
+			return false
+		}
+	}
+	return true
+}
+
+// WalkNodes iterates over every node in the tree, in depth-first pre-order.
+// The level is the depth of the node, where the root is zero. The items
+// param is the items stored in the node and must not be modified.
+// Return false to stop iterating.
+func (tr *BTreeG[T]) WalkNodes(
+	iter func(level int, isLeaf bool, items []T) bool,
+) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root == nil {
+		return
+	}
+	tr.root.walkNodes(0, iter)
+}
+
+func (n *node[T]) walkNodes(level int,
+	iter func(level int, isLeaf bool, items []T) bool,
+) bool {
+	if !iter(level, n.leaf(), n.items) {
+		return false
+	}
+	if !n.leaf() {
+		for i := 0; i < len(*n.children); i++ {
+			if !(*n.children)[i].walkNodes(level+1, iter) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// WalkNodeLayout is like WalkNodes, but also provides the item counts of the
+// children of each node, which is enough to persist the exact shape of the
+// tree. The nodes are visited in depth-first pre-order, and the children of
+// a node are visited in ascending order. The childCounts param is nil for
+// leaves. The items and childCounts params must not be modified, and are
+// only valid until fn returns.
+// Return false to stop iterating.
+func (tr *BTreeG[T]) WalkNodeLayout(
+	fn func(items []T, childCounts []int, leaf bool, level int) bool,
+) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
 	if tr.root == nil {
 		return
 	}
-	tr.nodeWalk(&tr.root, iter, mut)
+	counts := make([]int, 0, tr.max+1)
+	tr.root.walkNodeLayout(0, counts, fn)
 }
 
-func (tr *BTreeG[T]) nodeWalk(cn **node[T], iter func(item []T) bool, mut bool,
+func (n *node[T]) walkNodeLayout(level int, counts []int,
+	fn func(items []T, childCounts []int, leaf bool, level int) bool,
 ) bool {
-	n := tr.isoLoad(cn, mut)
 	if n.leaf() {
-		if !iter(n.items) {
-			return false
-		}
-	} else {
-		for i := 0; i < len(n.items); i++ {
-			if !tr.nodeWalk(&(*n.children)[i], iter, mut) {
-				return false
-			}
-			if !iter(n.items[i : i+1]) {
-				return false
-			}
-		}
-		if !tr.nodeWalk(&(*n.children)[len(n.items)], iter, mut) {
+		return fn(n.items[:len(n.items):len(n.items)], nil, true, level)
+	}
+	counts = counts[:0]
+	for _, child := range *n.children {
+		counts = append(counts, child.count)
+	}
+	if !fn(n.items[:len(n.items):len(n.items)], counts, false, level) {
+		return false
+	}
+	for _, child := range *n.children {
+		if !child.walkNodeLayout(level+1, counts, fn) {
 			return false
 		}
 	}
@@ -1089,22 +2947,205 @@ func (tr *BTreeG[T]) Copy() *BTreeG[T] {
 	return tr.IsoCopy()
 }
 
+// CopyWithFilter returns a new tree, with the same options as tr, that
+// contains only the items for which keep returns true. The new tree is loaded
+// in a single ordered pass, without copying the entire tree first.
+func (tr *BTreeG[T]) CopyWithFilter(keep func(item T) bool) *BTreeG[T] {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	tr2 := tr.newEmpty(maxToDegree(tr.max))
+	if tr.root != nil {
+		tr.nodeScan(&tr.root, func(item T) bool {
+			if keep(item) {
+				tr2.load(tr.copyItem(item))
+			}
+			return true
+		}, false)
+	}
+	tr2.length = int64(tr2.count)
+	if tr2.atomicRoot != nil {
+		tr2.atomicRoot.Store(tr2.root)
+	}
+	return tr2
+}
+
+// Rebuild returns a new tree, with the same items and options as tr, that
+// uses the provided degree. The new tree is built from the bottom up in a
+// single ordered pass. Degrees greater than MaxDegree cause a panic.
+func (tr *BTreeG[T]) Rebuild(degree int) *BTreeG[T] {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	tr2 := tr.newEmpty(degree)
+	items := make([]T, 0, tr.count)
+	if tr.root != nil {
+		tr.nodeScan(&tr.root, func(item T) bool {
+			items = append(items, tr.copyItem(item))
+			return true
+		}, false)
+	}
+	tr2.build(items)
+	return tr2
+}
+
+// newEmpty returns a new empty tree with the same options as tr, and the
+// provided degree.
+func (tr *BTreeG[T]) newEmpty(degree int) *BTreeG[T] {
+	tr2 := new(BTreeG[T])
+	tr2.isoid = newIsoID()
+	tr2.mu = new(sync.RWMutex)
+	tr2.locks = tr.locks
+	if tr.reentry != nil {
+		tr2.reentry = new(reentryDetector)
+	}
+	tr2.less = tr.less
+	tr2.weight = tr.weight
+	tr2.summary = tr.summary
+	tr2.hash = tr.hash
+	tr2.maxLen, tr2.evictPolicy = tr.maxLen, tr.evictPolicy
+	tr2.onCopy = tr.onCopy
+	tr2.dups = tr.dups
+	if tr.atomicRoot != nil {
+		tr2.atomicRoot = new(atomic.Pointer[node[T]])
+	}
+	tr2.init(degree)
+	return tr2
+}
+
+// copyItem returns a copy of the item, for items that implement copier or
+// isoCopier, and otherwise returns the item.
+func (tr *BTreeG[T]) copyItem(item T) T {
+	if tr.copyItems {
+		return ((interface{})(item)).(copier[T]).Copy()
+	} else if tr.isoCopyItems {
+		return ((interface{})(item)).(isoCopier[T]).IsoCopy()
+	}
+	return item
+}
+
+// build replaces the contents of the tree with the provided items, which must
+// be sorted and unique. See Map.build.
+func (tr *BTreeG[T]) build(items []T) {
+	tr.root = nil
+	tr.sparseRight = false
+	tr.count = len(items)
+	tr.length = int64(tr.count)
+	if len(items) == 0 {
+		return
+	}
+	height := 1
+	for capacity := tr.max; capacity < len(items); height++ {
+		capacity = (capacity+1)*(tr.max+1) - 1
+	}
+	tr.root = tr.buildNode(items, height)
+	if tr.atomicRoot != nil {
+		tr.atomicRoot.Store(tr.root)
+	}
+}
+
+func (tr *BTreeG[T]) buildNode(items []T, height int) *node[T] {
+	n := tr.newNode(height == 1)
+	if height == 1 {
+		n.items = make([]T, len(items))
+		copy(n.items, items)
+		tr.updateCount(n)
+		return n
+	}
+	// Use the fewest children that can hold all of the items. Each child is
+	// then guaranteed to be at least half full.
+	childCap := tr.max
+	for i := 2; i < height; i++ {
+		childCap = (childCap+1)*(tr.max+1) - 1
+	}
+	nchildren := (len(items) + childCap + 1) / (childCap + 1)
+	n.items = make([]T, 0, nchildren-1)
+	*n.children = make([]*node[T], 0, nchildren)
+	size := len(items) - (nchildren - 1)
+	for i := 0; i < nchildren; i++ {
+		csize := size / nchildren
+		if i < size%nchildren {
+			csize++
+		}
+		*n.children = append(*n.children, tr.buildNode(items[:csize], height-1))
+		items = items[csize:]
+		if i < nchildren-1 {
+			n.items = append(n.items, items[0])
+			items = items[1:]
+		}
+	}
+	tr.updateCount(n)
+	return n
+}
+
 func (tr *BTreeG[T]) IsoCopy() *BTreeG[T] {
-	if tr.lock(true) {
-		defer tr.unlock(true)
+	// A frozen tree is never changed, so it can share its nodes without
+	// taking a new isoid.
+	if !tr.Frozen() {
+		if tr.lock(true) {
+			defer tr.unlock(true)
+		}
+		tr.isoid = newIsoID()
 	}
-	tr.isoid = newIsoID()
 	tr2 := new(BTreeG[T])
 	*tr2 = *tr
+	tr2.frozen = 0
+	tr2.id = newIsoID()
 	tr2.mu = new(sync.RWMutex)
+	if tr.atomicRoot != nil {
+		tr2.atomicRoot = new(atomic.Pointer[node[T]])
+		tr2.atomicRoot.Store(tr2.root)
+	}
+	if tr.reentry != nil {
+		tr2.reentry = new(reentryDetector)
+	}
 	tr2.isoid = newIsoID()
 	return tr2
 }
 
+// Freeze makes the tree immutable. Any following change to the tree,
+// including the Mut methods and IterMut, panics with ErrFrozen. Reads are not
+// affected, and skip the lock of a tree with locks, as there are no writes to
+// wait for. A copy of a frozen tree is not frozen.
+func (tr *BTreeG[T]) Freeze() {
+	if tr.reentry != nil {
+		tr.reentry.check()
+	}
+	if tr.locks {
+		// Wait for the writes that are in progress.
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+	}
+	atomic.StoreInt32(&tr.frozen, 1)
+}
+
+// Frozen returns true if the tree is frozen. See Freeze.
+func (tr *BTreeG[T]) Frozen() bool {
+	return atomic.LoadInt32(&tr.frozen) != 0
+}
+
 func (tr *BTreeG[T]) lock(write bool) bool {
+	if tr.Frozen() {
+		if write {
+			panic(ErrFrozen)
+		}
+		return false
+	}
+	if write && tr.reentry != nil {
+		tr.reentry.check()
+	}
 	if tr.locks {
 		if write {
 			tr.mu.Lock()
+			tr.isolateReaders()
 		} else {
 			tr.mu.RLock()
 		}
@@ -1112,8 +3153,30 @@ func (tr *BTreeG[T]) lock(write bool) bool {
 	return tr.locks
 }
 
+// isolateReaders gives a tree with atomic reads a new isoid, which is done
+// by writers while holding the lock. The nodes that readers may be using are
+// then copied, rather than changed, by the write.
+func (tr *BTreeG[T]) isolateReaders() {
+	if tr.atomicRoot != nil {
+		tr.isoid = newIsoID()
+	}
+}
+
+// readRoot returns the stored root for a read of a tree with atomic reads,
+// which needs no lock. Returns false if the read must take the lock.
+func (tr *BTreeG[T]) readRoot(mut bool) (*node[T], bool) {
+	if mut || tr.atomicRoot == nil {
+		return nil, false
+	}
+	return tr.atomicRoot.Load(), true
+}
+
 func (tr *BTreeG[T]) unlock(write bool) {
 	if write {
+		atomic.StoreInt64(&tr.length, int64(tr.count))
+		if tr.atomicRoot != nil {
+			tr.atomicRoot.Store(tr.root)
+		}
 		tr.mu.Unlock()
 	} else {
 		tr.mu.RUnlock()
@@ -1124,7 +3187,7 @@ func (tr *BTreeG[T]) unlock(write bool) {
 type IterG[T any] struct {
 	tr      *BTreeG[T]
 	mut     bool
-	locked  bool
+	locked  *releaseGuard // nil unless the iterator holds the lock
 	seeked  bool
 	atstart bool
 	atend   bool
@@ -1133,6 +3196,26 @@ type IterG[T any] struct {
 	item    T
 }
 
+// releaseGuard is shared by the copies of an iterator that holds the lock of
+// its tree, so that only the first Release of any of the copies unlocks it.
+type releaseGuard struct {
+	released int32
+}
+
+// newReleaseGuard returns a guard if locked is true, and otherwise nil.
+func newReleaseGuard(locked bool) *releaseGuard {
+	if !locked {
+		return nil
+	}
+	return new(releaseGuard)
+}
+
+// release returns true if the lock should be released, which is only true
+// for the first call.
+func (g *releaseGuard) release() bool {
+	return g != nil && atomic.CompareAndSwapInt32(&g.released, 0, 1)
+}
+
 type iterStackItemG[T any] struct {
 	n *node[T]
 	i int
@@ -1148,15 +3231,86 @@ func (tr *BTreeG[T]) IterMut() IterG[T] {
 	return tr.iter(true)
 }
 
+// UnsafeIter returns a read-only iterator that skips locking, even for a
+// tree that uses locks. The caller must guarantee that there are no
+// concurrent writes while the iterator is in use, much like ranging over a
+// plain Go map. Calling Release is not required.
+func (tr *BTreeG[T]) UnsafeIter() IterG[T] {
+	var iter IterG[T]
+	iter.tr = tr
+	iter.stack = iter.stack0[:0]
+	return iter
+}
+
 func (tr *BTreeG[T]) iter(mut bool) IterG[T] {
 	var iter IterG[T]
 	iter.tr = tr
 	iter.mut = mut
-	iter.locked = tr.lock(iter.mut)
+	iter.locked = newReleaseGuard(tr.lock(iter.mut))
 	iter.stack = iter.stack0[:0]
 	return iter
 }
 
+// SeekIter returns a read-only iterator that is positioned at the first item
+// that is greater-or-equal-to key. This is like calling Iter followed by
+// Seek, but the iterator is only made once the item is found, so a tree with
+// no such item is just locked for the descent. The Release method must be
+// called when finished with the iterator.
+// Returns false if there was no item found, in which case the iterator is
+// already released.
+func (tr *BTreeG[T]) SeekIter(key T) (IterG[T], bool) {
+	return tr.seekIter(key, false)
+}
+
+// SeekIterLT returns a read-only iterator that is positioned at the last item
+// that is less-than key, which is found in a single descent. The Release
+// method must be called when finished with the iterator.
+// Returns false if there was no item found, in which case the iterator is
+// already released.
+func (tr *BTreeG[T]) SeekIterLT(key T) (IterG[T], bool) {
+	return tr.seekIter(key, true)
+}
+
+func (tr *BTreeG[T]) seekIter(key T, lt bool) (IterG[T], bool) {
+	locked := tr.lock(false)
+	var iter IterG[T]
+	iter.tr = tr
+	iter.stack = iter.stack0[:0]
+	var ok bool
+	if lt {
+		ok = iter.seekLT(key)
+	} else {
+		ok = iter.seek(key, nil)
+	}
+	if !ok {
+		if locked {
+			tr.unlock(false)
+		}
+		return IterG[T]{}, false
+	}
+	iter.locked = newReleaseGuard(locked)
+	return iter, true
+}
+
+// seekLT moves the iterator to the last item that is less-than key, by
+// descending to the leaf position of key and then stepping back once.
+func (iter *IterG[T]) seekLT(key T) bool {
+	iter.seeked = true
+	iter.stack = iter.stack[:0]
+	if iter.tr.root == nil {
+		return false
+	}
+	n := iter.tr.isoLoad(&iter.tr.root, iter.mut)
+	for depth := 0; ; depth++ {
+		i, _ := iter.tr.findPivot(n, key, nil, depth, false)
+		iter.stack = append(iter.stack, iterStackItemG[T]{n, i})
+		if n.leaf() {
+			return iter.Prev()
+		}
+		n = iter.tr.isoLoad(&(*n.children)[i], iter.mut)
+	}
+}
+
 // Seek to item greater-or-equal-to key.
 // Returns false if there was no item found.
 func (iter *IterG[T]) Seek(key T) bool {
@@ -1179,7 +3333,7 @@ func (iter *IterG[T]) seek(key T, hint *PathHint) bool {
 	n := iter.tr.isoLoad(&iter.tr.root, iter.mut)
 	var depth int
 	for {
-		i, found := iter.tr.find(n, key, hint, depth)
+		i, found := iter.tr.findPivot(n, key, hint, depth, false)
 		iter.stack = append(iter.stack, iterStackItemG[T]{n, i})
 		if found {
 			iter.item = n.items[i]
@@ -1245,15 +3399,17 @@ func (iter *IterG[T]) Last() bool {
 	return true
 }
 
-// Release the iterator.
+// Release the iterator. It's safe to call Release more than once, and on
+// copies of the iterator, as the lock is only released by the first call.
+// A copy must not be used after any copy has been released.
 func (iter *IterG[T]) Release() {
 	if iter.tr == nil {
 		return
 	}
-	if iter.locked {
+	if iter.locked.release() {
 		iter.tr.unlock(iter.mut)
-		iter.locked = false
 	}
+	iter.locked = nil
 	iter.stack = nil
 	iter.tr = nil
 }
@@ -1305,6 +3461,28 @@ func (iter *IterG[T]) Next() bool {
 	return true
 }
 
+// NextDistinct moves iterator to the next item that is not equal to the
+// current item, as determined by the equal function. This is useful for
+// iterating over groups of items, such as when the tree is ordered by a
+// compound key and only the leading field is of interest.
+// Returns false if the tree is empty or the iterator has reached the end of
+// the tree.
+func (iter *IterG[T]) NextDistinct(equal func(a, b T) bool) bool {
+	if iter.tr == nil {
+		return false
+	}
+	if !iter.seeked {
+		return iter.First()
+	}
+	item := iter.item
+	for iter.Next() {
+		if !equal(item, iter.item) {
+			return true
+		}
+	}
+	return false
+}
+
 // Prev moves iterator to the previous item in iterator.
 // Returns false if the tree is empty or the iterator is at the beginning of
 // the tree.
@@ -1359,11 +3537,111 @@ func (iter *IterG[T]) Item() T {
 	return iter.item
 }
 
+// Valid returns true if the iterator is at an item. It's false until the
+// iterator is first moved, and after it moves past either end of the tree.
+//
+//	for iter.First(); iter.Valid(); iter.Advance() {
+//		item := iter.Item()
+//	}
+func (iter *IterG[T]) Valid() bool {
+	return iter.tr != nil && iter.seeked && len(iter.stack) > 0
+}
+
+// Advance is the same as Next.
+func (iter *IterG[T]) Advance() bool {
+	return iter.Next()
+}
+
+// Retreat is the same as Prev.
+func (iter *IterG[T]) Retreat() bool {
+	return iter.Prev()
+}
+
+// Token returns a compact resume token for the current item, which is the
+// position of the item in the tree. Use IterFromToken to return to it.
+// The token is an approximate position, because positions shift as items are
+// inserted and deleted, and it's only stable on trees that are no longer
+// changed, such as snapshots. Returns false if the iterator is not on an
+// item, such as before it's first moved or after it has moved past either end
+// of the tree.
+func (iter *IterG[T]) Token() (uint64, bool) {
+	if !iter.Valid() {
+		return 0, false
+	}
+	var index int
+	for j, s := range iter.stack {
+		index += s.i
+		if s.n.leaf() {
+			continue
+		}
+		for k := 0; k < s.i; k++ {
+			index += (*s.n.children)[k].count
+		}
+		if j == len(iter.stack)-1 {
+			// the current item is in this branch node
+			index += (*s.n.children)[s.i].count
+		}
+	}
+	return uint64(index), true
+}
+
+// IterFromToken returns a read-only iterator that is positioned at the item
+// for a token from IterG.Token. The Release method must be called when
+// finished with the iterator.
+// Returns false if there is no item at that position, in which case the
+// iterator has already been released.
+func (tr *BTreeG[T]) IterFromToken(tok uint64) (IterG[T], bool) {
+	iter := tr.Iter()
+	if !iter.seekAt(tok) {
+		iter.Release()
+		return iter, false
+	}
+	return iter, true
+}
+
+// seekAt moves the iterator to the item at index.
+func (iter *IterG[T]) seekAt(index uint64) bool {
+	iter.seeked = true
+	iter.stack = iter.stack[:0]
+	if iter.tr.root == nil || index >= uint64(iter.tr.count) {
+		return false
+	}
+	i := int(index)
+	n := iter.tr.isoLoad(&iter.tr.root, iter.mut)
+	for {
+		if n.leaf() {
+			iter.stack = append(iter.stack, iterStackItemG[T]{n, i})
+			iter.item = n.items[i]
+			return true
+		}
+		j := 0
+		for ; j < len(n.items); j++ {
+			count := (*n.children)[j].count
+			if i == count {
+				iter.stack = append(iter.stack, iterStackItemG[T]{n, j})
+				iter.item = n.items[j]
+				return true
+			} else if i < count {
+				break
+			}
+			i -= count + 1
+		}
+		iter.stack = append(iter.stack, iterStackItemG[T]{n, j})
+		n = iter.tr.isoLoad(&(*n.children)[j], iter.mut)
+	}
+}
+
 // Items returns all the items in order.
 func (tr *BTreeG[T]) Items() []T {
 	return tr.items(false)
 }
 
+// ToSortedSlice returns a sorted copy of all the items.
+// This is the same as Items.
+func (tr *BTreeG[T]) ToSortedSlice() []T {
+	return tr.items(false)
+}
+
 func (tr *BTreeG[T]) ItemsMut() []T {
 	return tr.items(true)
 }
@@ -1379,6 +3657,125 @@ func (tr *BTreeG[T]) items(mut bool) []T {
 	return items
 }
 
+// Quantiles returns the items at each of the quantiles in qs, which must be
+// within the range [0, 1]. The item for the quantile q is the item at the
+// index q*(Len()-1), rounded to the nearest index. All of the items are found
+// in a single walk of the tree.
+// Returns nil if the tree has no items.
+func (tr *BTreeG[T]) Quantiles(qs []float64) []T {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	order, indexes := quantileIndexes(qs, tr.count)
+	if tr.root == nil {
+		return nil
+	}
+	found := tr.root.getAts(indexes, 0, make([]T, 0, len(qs)))
+	items := make([]T, len(qs))
+	for i, j := range order {
+		items[j] = found[i]
+	}
+	return items
+}
+
+// Quantile returns the item at the rank int(q*Len()) of the tree, which is
+// clamped to the last item when q is 1. Unlike Quantiles, which picks the
+// nearest of the Len()-1 intervals, this is a plain rank lookup like GetAt.
+// Returns false if the tree is empty or q is not within the range [0, 1].
+func (tr *BTreeG[T]) Quantile(q float64) (T, bool) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	index, ok := quantileIndex(q, tr.count)
+	if !ok {
+		return tr.empty, false
+	}
+	return tr.atIndex(index, false)
+}
+
+// Percentile is the same as Quantile(p/100), for p within the range
+// [0, 100].
+func (tr *BTreeG[T]) Percentile(p int) (T, bool) {
+	return tr.Quantile(float64(p) / 100)
+}
+
+// quantileIndex returns the rank of the quantile q for a tree of count
+// items. Returns false if q is not within the range [0, 1].
+func quantileIndex(q float64, count int) (int, bool) {
+	if !(q >= 0 && q <= 1) {
+		return 0, false
+	}
+	index := int(q * float64(count))
+	if index == count {
+		index--
+	}
+	return index, true
+}
+
+// quantileIndexes validates the quantiles and returns the indexes of the
+// items for a tree of count items, in ascending order. The order slice holds
+// the position in qs for each index.
+func quantileIndexes(qs []float64, count int) (order, indexes []int) {
+	for _, q := range qs {
+		if !(q >= 0 && q <= 1) {
+			panic("btree: quantile must be within the range [0, 1]")
+		}
+	}
+	order = make([]int, len(qs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return qs[order[i]] < qs[order[j]]
+	})
+	indexes = make([]int, len(qs))
+	for i, j := range order {
+		indexes[i] = int(math.Round(qs[j] * float64(count-1)))
+	}
+	return order, indexes
+}
+
+// getAts appends the items at the ascending indexes, which are offset by the
+// position of the node in the tree, visiting each node at most once.
+func (n *node[T]) getAts(indexes []int, offset int, items []T) []T {
+	if n.leaf() {
+		for _, index := range indexes {
+			items = append(items, n.items[index-offset])
+		}
+		return items
+	}
+	for i := 0; len(indexes) > 0; i++ {
+		child := (*n.children)[i]
+		j := 0
+		for j < len(indexes) && indexes[j] < offset+child.count {
+			j++
+		}
+		if j > 0 {
+			items = child.getAts(indexes[:j], offset, items)
+			indexes = indexes[j:]
+		}
+		offset += child.count
+		for len(indexes) > 0 && indexes[0] == offset {
+			items = append(items, n.items[i])
+			indexes = indexes[1:]
+		}
+		offset++
+	}
+	return items
+}
+
+// SnapshotItems returns all the items in order, like Items, but only holds
+// the lock of the tree long enough to make a Copy. The items are then read
+// from the copy, without blocking writers to the tree.
+func (tr *BTreeG[T]) SnapshotItems() []T {
+	snap := tr.Copy()
+	items := make([]T, 0, snap.count)
+	if snap.root != nil {
+		items = snap.nodeItems(&snap.root, items, false)
+	}
+	return items
+}
+
 func (tr *BTreeG[T]) nodeItems(cn **node[T], items []T, mut bool) []T {
 	n := tr.isoLoad(cn, mut)
 	if n.leaf() {
@@ -1397,7 +3794,129 @@ func (tr *BTreeG[T]) Clear() {
 		defer tr.unlock(true)
 	}
 	tr.root = nil
+	tr.sparseRight = false
 	tr.count = 0
+	tr.version++
+}
+
+// Shrink releases the unused capacity of the node slices, such as after bulk
+// deletes. See Map.Shrink.
+// Nodes that are shared with copies of the tree are copied first, so it
+// should only be called on trees that are no longer shared.
+func (tr *BTreeG[T]) Shrink() {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.root != nil {
+		tr.shrink(&tr.root)
+	}
+}
+
+func (tr *BTreeG[T]) shrink(cn **node[T]) {
+	n := tr.isoLoad(cn, true)
+	if cap(n.items) > len(n.items) {
+		items := make([]T, len(n.items))
+		copy(items, n.items)
+		n.items = items
+	}
+	if n.leaf() {
+		return
+	}
+	if cap(*n.children) > len(*n.children) {
+		children := make([]*node[T], len(*n.children))
+		copy(children, *n.children)
+		*n.children = children
+	}
+	for i := range *n.children {
+		tr.shrink(&(*n.children)[i])
+	}
+}
+
+// Reset replaces the less function of an empty tree, allowing for the tree
+// to be reused with a different ordering. The tree keeps its options.
+// Panics if the tree has items, which would be out of order.
+func (tr *BTreeG[T]) Reset(less func(a, b T) bool) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.count > 0 {
+		panic("btree: Reset on non-empty BTreeG")
+	}
+	tr.root = nil
+	tr.less = less
+	tr.version++
+}
+
+// MergeScan iterates over the items of both trees in a single ordered pass,
+// using less to compare items across the trees. The from argument of iter is
+// 0 for an item that is only in a, 1 for an item that is only in b, and 2 for
+// an item that is in both, in which case the item from a is passed.
+// Return false to stop iterating.
+func MergeScan[T any](a, b *BTreeG[T], less func(a, b T) bool,
+	iter func(item T, from int) bool,
+) {
+	if a == b {
+		a.Scan(func(item T) bool {
+			return iter(item, 2)
+		})
+		return
+	}
+	// The trees are locked in the order of their ids, so that merges of the
+	// same two trees in the opposite order cannot deadlock while writers are
+	// waiting on both trees.
+	var iter1, iter2 IterG[T]
+	if b.id < a.id {
+		iter2 = b.Iter()
+		iter1 = a.Iter()
+	} else {
+		iter1 = a.Iter()
+		iter2 = b.Iter()
+	}
+	defer iter1.Release()
+	defer iter2.Release()
+	ok1, ok2 := iter1.First(), iter2.First()
+	for ok1 || ok2 {
+		var ok bool
+		switch {
+		case !ok2 || (ok1 && less(iter1.Item(), iter2.Item())):
+			ok = iter(iter1.Item(), 0)
+			ok1 = iter1.Next()
+		case !ok1 || less(iter2.Item(), iter1.Item()):
+			ok = iter(iter2.Item(), 1)
+			ok2 = iter2.Next()
+		default:
+			ok = iter(iter1.Item(), 2)
+			ok1, ok2 = iter1.Next(), iter2.Next()
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// Diff returns the items that are in next but not in prev, and the items
+// that are in prev but not in next, using a single ordered pass over both
+// trees. See MergeScan.
+func Diff[T any](prev, next *BTreeG[T], less func(a, b T) bool,
+) (added, removed []T) {
+	return AppendDiff(nil, nil, prev, next, less)
+}
+
+// AppendDiff is like Diff, but appends the items to the provided slices,
+// which allows for reusing the slices between calls.
+func AppendDiff[T any](added, removed []T, prev, next *BTreeG[T],
+	less func(a, b T) bool,
+) ([]T, []T) {
+	MergeScan(prev, next, less, func(item T, from int) bool {
+		switch from {
+		case 0:
+			removed = append(removed, item)
+		case 1:
+			added = append(added, item)
+		}
+		return true
+	})
+	return added, removed
 }
 
 // Generic BTree
@@ -1,12 +1,16 @@
 package btree
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
+	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -941,6 +945,24 @@ func TestGenericDeleteAt(t *testing.T) {
 	}
 }
 
+func TestGenericDeleteAtWide(t *testing.T) {
+	// nodes with more than 256 children
+	weight := func(item int) int64 { return int64(item%7 + 1) }
+	tr := NewBTreeGWeighted(testLess, weight).Rebuild(200)
+	N := 300_000
+	for i := 0; i < N; i++ {
+		tr.Load(testMakeItem(i))
+	}
+	tr.sane()
+	for i := 0; i < 1000; i++ {
+		index := tr.Len() - 1 - rand.Intn(10_000)
+		item1, ok1 := tr.GetAt(index)
+		item2, ok2 := tr.DeleteAt(index)
+		assert(ok1 && ok2 && item1 == item2)
+	}
+	tr.sane()
+}
+
 func TestGenericCopy(t *testing.T) {
 	items := randKeys(100000)
 	itemsM := testNewBTree()
@@ -1131,190 +1153,6 @@ func (tr *BTreeG[T]) sane() {
 	}
 }
 
-type saneError string
-
-func (err saneError) Error() string {
-	return string(err)
-}
-
-// btree_sane returns true if the entire btree and every node are valid.
-// - height of all leaves are the equal to the btree height.
-// - deep count matches the btree count.
-// - all nodes have the correct number of items and counts.
-// - all items are in order.
-func (tr *BTreeG[T]) Sane() error {
-	if tr == nil {
-		return nil
-	}
-	if !tr.saneheight() {
-		return saneError("!sane-height")
-	}
-	if tr.Len() != tr.count || tr.deepcount() != tr.count {
-		return saneError("!sane-count")
-	}
-	if !tr.saneprops() {
-		return saneError("!sane-props")
-	}
-	if !tr.saneorder() {
-		return saneError("!sane-order")
-	}
-	if !tr.sanenils() {
-		return saneError("!sane-nils")
-	}
-	return nil
-}
-
-// btree_saneheight returns true if the height of all leaves match the height
-// of the btree.
-func (tr *BTreeG[T]) saneheight() bool {
-	height := tr.Height()
-	if tr.root != nil {
-		if height == 0 {
-			return false
-		}
-		return tr.root.saneheight(1, height)
-	}
-	return height == 0
-}
-
-func (n *node[T]) saneheight(height, maxheight int) bool {
-	if n.leaf() {
-		if height != maxheight {
-			return false
-		}
-	} else {
-		i := 0
-		for ; i < len(n.items); i++ {
-			if !(*n.children)[i].saneheight(height+1, maxheight) {
-				return false
-			}
-		}
-		if !(*n.children)[i].saneheight(height+1, maxheight) {
-			return false
-		}
-	}
-	return true
-}
-
-// btree_deepcount returns the number of items in the btree.
-func (tr *BTreeG[T]) deepcount() int {
-	if tr.root != nil {
-		return tr.root.deepcount()
-	}
-	return 0
-}
-
-func (n *node[T]) deepcount() int {
-	count := len(n.items)
-	if !n.leaf() {
-		for i := 0; i <= len(n.items); i++ {
-			count += (*n.children)[i].deepcount()
-		}
-	}
-	if n.count != count {
-		return -1
-	}
-	return count
-}
-
-func (tr *BTreeG[T]) nodesaneprops(n *node[T], height int) bool {
-	if height == 1 {
-		if len(n.items) < 1 || len(n.items) > tr.max {
-			println(len(n.items) < 1)
-			return false
-		}
-	} else {
-		if len(n.items) < tr.min || len(n.items) > tr.max {
-			println(2)
-			return false
-		}
-	}
-	if !n.leaf() {
-		if len(*n.children) != len(n.items)+1 {
-			println(3)
-			return false
-		}
-		for i := 0; i < len(n.items); i++ {
-			if !tr.nodesaneprops((*n.children)[i], height+1) {
-				println(4)
-				return false
-			}
-		}
-		if !tr.nodesaneprops((*n.children)[len(n.items)], height+1) {
-			println(5)
-			return false
-		}
-	}
-	return true
-}
-
-func (tr *BTreeG[T]) saneprops() bool {
-	if tr.root != nil {
-		return tr.nodesaneprops(tr.root, 1)
-	}
-	return true
-}
-
-func (tr *BTreeG[T]) sanenilsnode(n *node[T]) bool {
-	items := n.items[:cap(n.items):cap(n.items)]
-	for i := len(n.items); i < len(items); i++ {
-		if !tr.eq(items[i], tr.empty) {
-			return false
-		}
-	}
-	if !n.leaf() {
-		for i := 0; i < len(*n.children); i++ {
-			if (*n.children)[i] == nil {
-				return false
-			}
-		}
-		children := (*n.children)[:cap(*n.children):cap(*n.children)]
-		for i := len(*n.children); i < len(children); i++ {
-			if children[i] != nil {
-				return false
-			}
-		}
-		for i := 0; i < len(*n.children); i++ {
-			if !tr.sanenilsnode((*n.children)[i]) {
-				return false
-			}
-		}
-	}
-	return true
-}
-
-// sanenils checks that all the slots in the item slice that are not used,
-//
-//	n.items[len(n.items):cap(n.items):cap(n.items)]
-//
-// are equal to the empty value of the kind.
-func (tr *BTreeG[T]) sanenils() bool {
-	if tr.root != nil {
-		return tr.sanenilsnode(tr.root)
-	}
-	return true
-}
-
-func (tr *BTreeG[T]) saneorder() bool {
-	var last T
-	var count int
-	var bad bool
-	tr.Walk(func(items []T) bool {
-		for _, item := range items {
-			if count > 0 {
-				if !tr.Less(last, item) {
-					bad = true
-					return false
-				}
-			}
-			last = item
-			count++
-		}
-		return true
-	})
-	return !bad && count == tr.count
-}
-
 func TestGenericIter(t *testing.T) {
 	N := 100_000
 	tr := testNewBTree()
@@ -1479,3 +1317,2835 @@ func TestGenericIterSeekPrefix(t *testing.T) {
 		iter.Release()
 	}
 }
+
+// FuzzOpKind is the kind of operation applied by a BTreeGFuzzer.
+type FuzzOpKind int
+
+const (
+	FuzzSet FuzzOpKind = iota
+	FuzzGet
+	FuzzDelete
+	FuzzGetAt
+	FuzzDeleteAt
+	FuzzPopMin
+	FuzzPopMax
+	FuzzLoad
+	fuzzNumOps
+)
+
+// FuzzOp is a single operation applied by a BTreeGFuzzer.
+// The Item field is used by Set, Load, Get, and Delete. The Index field is
+// used by GetAt and DeleteAt.
+type FuzzOp[T any] struct {
+	Kind  FuzzOpKind
+	Item  T
+	Index int
+}
+
+// BTreeGFuzzer applies a stream of operations to a BTreeG and to a sorted
+// reference slice, and checks that both always agree.
+type BTreeGFuzzer[T any] struct {
+	tr   *BTreeG[T]
+	less func(a, b T) bool
+	ref  []T
+	nops int
+	// SaneEvery is how often the tree invariants are checked.
+	// Default is every operation.
+	SaneEvery int
+}
+
+// NewBTreeGFuzzer returns a new fuzzer for an empty BTreeG.
+func NewBTreeGFuzzer[T any](less func(a, b T) bool) *BTreeGFuzzer[T] {
+	return newBTreeGFuzzerOptions(less, Options{})
+}
+
+func newBTreeGFuzzerOptions[T any](less func(a, b T) bool, opts Options,
+) *BTreeGFuzzer[T] {
+	return &BTreeGFuzzer[T]{
+		tr:   NewBTreeGOptions(less, opts),
+		less: less,
+	}
+}
+
+func (f *BTreeGFuzzer[T]) eq(a, b T) bool {
+	return !f.less(a, b) && !f.less(b, a)
+}
+
+// search returns the index of item in the reference slice.
+func (f *BTreeGFuzzer[T]) search(item T) (int, bool) {
+	i := sort.Search(len(f.ref), func(i int) bool {
+		return !f.less(f.ref[i], item)
+	})
+	return i, i < len(f.ref) && !f.less(item, f.ref[i])
+}
+
+func (f *BTreeGFuzzer[T]) refDelete(i int) T {
+	item := f.ref[i]
+	f.ref = append(f.ref[:i], f.ref[i+1:]...)
+	return item
+}
+
+func (f *BTreeGFuzzer[T]) check(name string, v1 T, ok1 bool, v2 T, ok2 bool,
+) error {
+	if ok1 != ok2 || (ok1 && !f.eq(v1, v2)) {
+		return fmt.Errorf("%s: expected (%v, %v), got (%v, %v)",
+			name, v2, ok2, v1, ok1)
+	}
+	return nil
+}
+
+// Apply each operation to the tree and the reference slice.
+// Returns an error at the first operation where the two disagree, or when the
+// tree fails its sanity check.
+func (f *BTreeGFuzzer[T]) Apply(ops []FuzzOp[T]) error {
+	var empty T
+	for _, op := range ops {
+		var err error
+		switch op.Kind {
+		case FuzzSet, FuzzLoad:
+			i, found := f.search(op.Item)
+			prev := empty
+			if found {
+				prev = f.ref[i]
+				f.ref[i] = op.Item
+			} else {
+				f.ref = append(f.ref, empty)
+				copy(f.ref[i+1:], f.ref[i:])
+				f.ref[i] = op.Item
+			}
+			if op.Kind == FuzzLoad {
+				v, ok := f.tr.Load(op.Item)
+				err = f.check("Load", v, ok, prev, found)
+			} else {
+				v, ok := f.tr.Set(op.Item)
+				err = f.check("Set", v, ok, prev, found)
+			}
+		case FuzzGet:
+			i, found := f.search(op.Item)
+			prev := empty
+			if found {
+				prev = f.ref[i]
+			}
+			v, ok := f.tr.Get(op.Item)
+			err = f.check("Get", v, ok, prev, found)
+		case FuzzDelete:
+			i, found := f.search(op.Item)
+			prev := empty
+			if found {
+				prev = f.refDelete(i)
+			}
+			v, ok := f.tr.Delete(op.Item)
+			err = f.check("Delete", v, ok, prev, found)
+		case FuzzGetAt:
+			found := op.Index >= 0 && op.Index < len(f.ref)
+			prev := empty
+			if found {
+				prev = f.ref[op.Index]
+			}
+			v, ok := f.tr.GetAt(op.Index)
+			err = f.check("GetAt", v, ok, prev, found)
+		case FuzzDeleteAt:
+			found := op.Index >= 0 && op.Index < len(f.ref)
+			prev := empty
+			if found {
+				prev = f.refDelete(op.Index)
+			}
+			v, ok := f.tr.DeleteAt(op.Index)
+			err = f.check("DeleteAt", v, ok, prev, found)
+		case FuzzPopMin:
+			found := len(f.ref) > 0
+			prev := empty
+			if found {
+				prev = f.refDelete(0)
+			}
+			v, ok := f.tr.PopMin()
+			err = f.check("PopMin", v, ok, prev, found)
+		case FuzzPopMax:
+			found := len(f.ref) > 0
+			prev := empty
+			if found {
+				prev = f.refDelete(len(f.ref) - 1)
+			}
+			v, ok := f.tr.PopMax()
+			err = f.check("PopMax", v, ok, prev, found)
+		default:
+			err = fmt.Errorf("invalid op kind: %d", op.Kind)
+		}
+		if err != nil {
+			return err
+		}
+		if f.tr.Len() != len(f.ref) {
+			return fmt.Errorf("Len: expected %d, got %d", len(f.ref), f.tr.Len())
+		}
+		f.nops++
+		if f.SaneEvery <= 1 || f.nops%f.SaneEvery == 0 {
+			if err := f.tr.Sane(); err != nil {
+				return err
+			}
+		}
+	}
+	items := f.tr.Items()
+	if len(items) != len(f.ref) {
+		return fmt.Errorf("Items: expected %d items, got %d",
+			len(f.ref), len(items))
+	}
+	for i := range items {
+		if !f.eq(items[i], f.ref[i]) {
+			return fmt.Errorf("Items: expected %v at %d, got %v",
+				f.ref[i], i, items[i])
+		}
+	}
+	return nil
+}
+
+// fuzzDecodeOps turns raw fuzz input into operations. Every two bytes is one
+// operation, where the first is the op kind and the second is the operand.
+func fuzzDecodeOps(data []byte) []FuzzOp[int] {
+	ops := make([]FuzzOp[int], 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		ops = append(ops, FuzzOp[int]{
+			Kind:  FuzzOpKind(data[i]) % fuzzNumOps,
+			Item:  int(data[i+1]),
+			Index: int(data[i+1]),
+		})
+	}
+	return ops
+}
+
+// fuzzSummary is the item summarizer of the fuzzed trees, so that Sane also
+// checks the summary ranges.
+func fuzzSummary(item int) uint64 {
+	return uint64(item % 97)
+}
+
+func TestGenericFuzzer(t *testing.T) {
+	for _, degree := range []int{2, 3, 8, 0} {
+		f := newBTreeGFuzzerOptions(testLess, Options{Degree: degree})
+		f.tr.SetItemSummarizer(fuzzSummary)
+		ops := make([]FuzzOp[int], 10_000)
+		for i := range ops {
+			ops[i] = FuzzOp[int]{
+				Kind:  FuzzOpKind(rand.Intn(int(fuzzNumOps))),
+				Item:  rand.Intn(1000),
+				Index: rand.Intn(1000),
+			}
+			// favor sets and ordered loads so the tree grows
+			switch rand.Intn(4) {
+			case 0:
+				ops[i].Kind = FuzzSet
+			case 1:
+				ops[i].Kind = FuzzLoad
+				ops[i].Item = 1000 + i
+			}
+		}
+		if err := f.Apply(ops); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func FuzzBTreeG(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 2, 0, 3, 2, 2, 3, 0, 5, 0, 6, 0})
+	f.Add([]byte{0, 9, 0, 8, 0, 7, 0, 6, 0, 5, 0, 4, 4, 2, 1, 9})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fz := newBTreeGFuzzerOptions(testLess, Options{Degree: 2})
+		fz.tr.SetItemSummarizer(fuzzSummary)
+		if err := fz.Apply(fuzzDecodeOps(data)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestGenericWeighted(t *testing.T) {
+	weight := func(item int) int64 { return int64(item%7 + 1) }
+	tr := NewBTreeGWeighted(testLess, weight)
+	N := 10_000
+	var hint PathHint
+	for _, key := range randKeys(N) {
+		switch rand.Intn(3) {
+		case 0:
+			tr.Set(key)
+		case 1:
+			tr.SetHint(key, &hint)
+		case 2:
+			tr.Load(key)
+		}
+	}
+	tr.sane()
+	check := func() {
+		tr.sane()
+		items := tr.Items()
+		var total int64
+		for _, item := range items {
+			total += weight(item)
+		}
+		assert(tr.TotalWeight() == total)
+		var target int64
+		for _, item := range items {
+			for j := int64(0); j < weight(item); j++ {
+				v, ok := tr.SelectByWeight(target + j)
+				assert(ok && v == item)
+			}
+			target += weight(item)
+		}
+		_, ok := tr.SelectByWeight(total)
+		assert(!ok)
+		_, ok = tr.SelectByWeight(-1)
+		assert(!ok)
+		// prefix sums, where sums[i] is the weight of the items less
+		// than items[i]
+		sums := make([]int64, len(items)+1)
+		for i, item := range items {
+			sums[i+1] = sums[i] + weight(item)
+		}
+		for i := 0; i < 100 && len(items) > 0; i++ {
+			lo, hi := rand.Intn(len(items)), rand.Intn(len(items)+1)
+			var want int64
+			if lo < hi {
+				want = sums[hi] - sums[lo]
+			}
+			hiItem := items[len(items)-1] + 1
+			if hi < len(items) {
+				hiItem = items[hi]
+			}
+			assert(tr.WeightBetween(items[lo], hiItem) == want)
+		}
+	}
+	check()
+	// replacing items with a different weight
+	for i := 0; i < 100; i++ {
+		tr.Set(rand.Intn(N))
+	}
+	check()
+	tr2 := tr.Copy()
+	for tr.Len() > 0 {
+		switch rand.Intn(5) {
+		case 0:
+			tr.PopMin()
+		case 1:
+			tr.PopMax()
+		case 2:
+			tr.DeleteAt(rand.Intn(tr.Len()))
+		case 3:
+			item, _ := tr.GetAt(rand.Intn(tr.Len()))
+			tr.Delete(item)
+		case 4:
+			tr.Load(N + rand.Intn(N))
+		}
+		if rand.Intn(500) == 0 {
+			check()
+		}
+	}
+	check()
+	assert(tr.TotalWeight() == 0)
+	assert(tr2.Len() == N)
+	tr2.sane()
+
+	// non-weighted trees
+	tr3 := testNewBTree()
+	tr3.Set(1)
+	assert(tr3.TotalWeight() == 0)
+	_, ok := tr3.SelectByWeight(0)
+	assert(!ok)
+}
+
+func TestGenericSeekIter(t *testing.T) {
+	tr := testNewBTree()
+	_, ok := tr.SeekIter(0)
+	assert(!ok)
+	_, ok = tr.SeekIterLT(0)
+	assert(!ok)
+	for i := 0; i < 1000; i++ {
+		tr.Set(i * 2)
+	}
+	for i := -1; i < 2001; i++ {
+		iter, ok := tr.SeekIter(i)
+		if i > 1998 {
+			assert(!ok)
+		} else {
+			assert(ok && iter.Item() == (i+1)/2*2)
+			if ok = iter.Next(); i < 1997 {
+				assert(ok && iter.Item() == (i+1)/2*2+2)
+			}
+			iter.Release()
+		}
+		iter, ok = tr.SeekIterLT(i)
+		if i <= 0 {
+			assert(!ok)
+		} else {
+			assert(ok && iter.Item() == (i-1)/2*2)
+			iter.Release()
+		}
+	}
+	// the lock must be released on the not-found path
+	done := make(chan bool)
+	go func() {
+		tr.Set(-2)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("deadlock")
+	}
+
+	// with duplicates, SeekIter is at the first of the equal items, and
+	// SeekIterLT is before all of them
+	dups := NewBTreeGOptions(testLess, Options{Degree: 2,
+		AllowDuplicates: true})
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10; j++ {
+			dups.Set(i)
+		}
+	}
+	for i := 1; i < 100; i++ {
+		iter, ok := dups.SeekIter(i)
+		assert(ok && iter.Item() == i && iter.Prev() && iter.Item() == i-1)
+		iter.Release()
+		iter, ok = dups.SeekIterLT(i)
+		assert(ok && iter.Item() == i-1 && iter.Next() && iter.Item() == i)
+		iter.Release()
+	}
+}
+
+func BenchmarkGenericSeekIter(b *testing.B) {
+	tr := testNewBTree()
+	for i := 0; i < 100_000; i++ {
+		tr.Load(i)
+	}
+	// Half of the keys are past the last item, where SeekIter does not make
+	// an iterator.
+	b.Run("SeekIter", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			iter, ok := tr.SeekIter(i % 200_000)
+			if ok {
+				iter.Release()
+			}
+		}
+	})
+	b.Run("IterSeek", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			iter := tr.Iter()
+			iter.Seek(i % 200_000)
+			iter.Release()
+		}
+	})
+	b.Run("SeekIterLT", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			iter, ok := tr.SeekIterLT(i % 200_000)
+			if ok {
+				iter.Release()
+			}
+		}
+	})
+	b.Run("IterSeekPrev", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			iter := tr.Iter()
+			if iter.Seek(i % 200_000) {
+				iter.Prev()
+			} else {
+				iter.Last()
+			}
+			iter.Release()
+		}
+	})
+}
+
+func TestGenericIterReleaseCopy(t *testing.T) {
+	tr := testNewBTree()
+	for i := 0; i < 100; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	iter := tr.Iter()
+	assert(iter.First())
+	iter2 := iter
+	assert(iter2.Next() && iter2.Item() == testMakeItem(1))
+	iter.Release()
+	iter2.Release()
+	iter.Release()
+	// the lock was released once, so writers and readers may continue
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tr.Set(testMakeItem(100 + i*100 + j))
+				iter := tr.Iter()
+				assert(iter.First() && iter.Item() == testMakeItem(0))
+				iter.Release()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert(tr.Len() == 500)
+	iter = tr.IterMut()
+	iter2 = iter
+	iter2.Release()
+	iter.Release()
+	tr.Set(testMakeItem(1000))
+	assert(tr.Len() == 501)
+}
+
+func TestGenericIterValid(t *testing.T) {
+	tr := testNewBTree()
+	iter := tr.Iter()
+	assert(!iter.Valid() && !iter.Retreat())
+	assert(!iter.First() && !iter.Valid())
+	iter.Release()
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	iter = tr.Iter()
+	assert(!iter.Valid())
+	var n int
+	for iter.First(); iter.Valid(); iter.Advance() {
+		assert(iter.Item() == testMakeItem(n))
+		n++
+	}
+	assert(n == 1000 && !iter.Valid())
+	for iter.Last(); iter.Valid(); iter.Retreat() {
+		n--
+		assert(iter.Item() == testMakeItem(n))
+	}
+	assert(n == 0 && !iter.Valid())
+	assert(iter.Seek(testMakeItem(500)) && iter.Valid())
+	assert(!iter.Seek(testMakeItem(1000)) && !iter.Valid())
+	iter.Release()
+	assert(!iter.Valid())
+}
+
+func TestGenericIterNextDistinct(t *testing.T) {
+	type pair struct{ group, id int }
+	tr := NewBTreeG(func(a, b pair) bool {
+		if a.group != b.group {
+			return a.group < b.group
+		}
+		return a.id < b.id
+	})
+	sameGroup := func(a, b pair) bool { return a.group == b.group }
+	iter := tr.Iter()
+	assert(!iter.NextDistinct(sameGroup))
+	iter.Release()
+	for i := 0; i < 1000; i++ {
+		tr.Set(pair{i / 10, i})
+	}
+	var groups []int
+	iter = tr.Iter()
+	for ok := iter.NextDistinct(sameGroup); ok; ok = iter.NextDistinct(sameGroup) {
+		assert(iter.Item().id == iter.Item().group*10)
+		groups = append(groups, iter.Item().group)
+	}
+	iter.Release()
+	assert(len(groups) == 100)
+	for i := range groups {
+		assert(groups[i] == i)
+	}
+	iter = tr.Iter()
+	assert(iter.Seek(pair{50, 505}))
+	assert(iter.NextDistinct(sameGroup) && iter.Item() == pair{51, 510})
+	iter.Release()
+	assert(!iter.NextDistinct(sameGroup))
+}
+
+func TestGenericTotalOrderFloats(t *testing.T) {
+	nan := math.NaN()
+	negNaN := math.Copysign(nan, -1)
+	negZero := math.Copysign(0, -1)
+	inf := math.Inf(1)
+	ordered := []float64{math.Inf(-1), -1, negZero, 0, math.SmallestNonzeroFloat64,
+		1, math.MaxFloat64, inf}
+	for i := 0; i < len(ordered); i++ {
+		assert(!TotalOrderFloats(ordered[i], ordered[i]))
+		for j := i + 1; j < len(ordered); j++ {
+			assert(TotalOrderFloats(ordered[i], ordered[j]))
+			assert(!TotalOrderFloats(ordered[j], ordered[i]))
+		}
+		assert(TotalOrderFloats(ordered[i], nan))
+		assert(TotalOrderFloats(ordered[i], negNaN))
+		assert(!TotalOrderFloats(nan, ordered[i]))
+	}
+	assert(!TotalOrderFloats(nan, nan))
+	assert(TotalOrderFloats(float32(inf), float32(nan)))
+
+	tr := NewBTreeG(TotalOrderFloats[float64])
+	for i := 0; i < 3; i++ {
+		for _, f := range rand.Perm(len(ordered)) {
+			tr.Set(ordered[f])
+		}
+		tr.Set(nan)
+	}
+	tr.sane()
+	assert(tr.Len() == len(ordered)+1)
+	items := tr.Items()
+	for i := range ordered {
+		assert(math.Float64bits(items[i]) == math.Float64bits(ordered[i]))
+	}
+	assert(math.IsNaN(items[len(items)-1]))
+	_, ok := tr.Get(nan)
+	assert(ok)
+	v, ok := tr.Get(negZero)
+	assert(ok && math.Signbit(v))
+	_, ok = tr.Delete(nan)
+	assert(ok)
+	_, ok = tr.Delete(negZero)
+	assert(ok)
+	v, ok = tr.Get(0)
+	assert(ok && !math.Signbit(v))
+	tr.sane()
+}
+
+func TestGenericWalkNodes(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	tr.WalkNodes(func(level int, isLeaf bool, items []int) bool {
+		panic("empty")
+	})
+	for _, key := range randKeys(10_000) {
+		tr.Set(key)
+	}
+	var walked, nodes []int
+	tr.Walk(func(items []int) bool {
+		walked = append(walked, items...)
+		return true
+	})
+	height := tr.Height()
+	var leaves, count int
+	tr.WalkNodes(func(level int, isLeaf bool, items []int) bool {
+		assert(level < height && isLeaf == (level == height-1))
+		if isLeaf {
+			leaves++
+		}
+		count++
+		nodes = append(nodes, items...)
+		return true
+	})
+	sort.Ints(nodes)
+	assert(reflect.DeepEqual(walked, nodes))
+	assert(leaves > 1 && count > leaves)
+	count = 0
+	tr.WalkNodes(func(level int, isLeaf bool, items []int) bool {
+		count++
+		return count < 10
+	})
+	assert(count == 10)
+}
+
+func TestGenericRebuild(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 2})
+	tr2 := tr.Rebuild(8)
+	assert(tr2.Len() == 0 && tr2.Height() == 0)
+	for _, key := range randKeys(10000) {
+		tr.Set(key)
+	}
+	items := tr.Items()
+	for _, degree := range []int{0, 2, 3, 8, 128} {
+		tr2 := tr.Rebuild(degree)
+		assert(tr2.Sane() == nil)
+		assert(reflect.DeepEqual(tr2.Items(), items))
+		assert(tr2.Height() <= tr.Height())
+		if degree != 0 {
+			assert(tr2.max == degree*2-1)
+		}
+		// the trees are independent
+		tr2.Delete(items[0])
+		tr2.Set(testMakeItem(-1))
+		tr2.sane()
+		assert(tr.Len() == len(items))
+	}
+	tr.sane()
+	wtr := NewBTreeGWeighted(testLess, func(item testKind) int64 {
+		return int64(item)
+	})
+	for i := 0; i < 1000; i++ {
+		wtr.Set(testMakeItem(i))
+	}
+	wtr2 := wtr.Rebuild(3)
+	assert(wtr2.Sane() == nil && wtr2.TotalWeight() == wtr.TotalWeight())
+	func() {
+		defer func() { assert(recover() != nil) }()
+		tr.Rebuild(MaxDegree + 1)
+	}()
+}
+
+func TestGenericReverseWalk(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	tr.ReverseWalk(func(items []testKind) bool { panic("!") })
+	for _, key := range randKeys(1000) {
+		tr.Set(key)
+	}
+	var walked [][]testKind
+	tr.Walk(func(items []testKind) bool {
+		walked = append(walked, items)
+		return true
+	})
+	var count int
+	tr.ReverseWalk(func(items []testKind) bool {
+		assert(reflect.DeepEqual(items, walked[len(walked)-1-count]))
+		count++
+		return true
+	})
+	assert(count == len(walked))
+	count = 0
+	tr.ReverseWalk(func(items []testKind) bool {
+		count++
+		return count < 10
+	})
+	assert(count == 10)
+}
+
+func TestGenericForEachChunk(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	tr.ForEachChunk(10, func(chunk []testKind) bool { panic("!") })
+	for _, key := range randKeys(1003) {
+		tr.Set(key)
+	}
+	items := tr.Items()
+	var all []testKind
+	var sizes []int
+	tr.ForEachChunk(10, func(chunk []testKind) bool {
+		all = append(all, chunk...)
+		sizes = append(sizes, len(chunk))
+		return true
+	})
+	assert(reflect.DeepEqual(all, items))
+	assert(len(sizes) == 101 && sizes[0] == 10 && sizes[100] == 3)
+	all, sizes = nil, nil
+	var buf *testKind
+	tr.ForEachChunkReverse(10, func(chunk []testKind) bool {
+		// the buffer is reused
+		assert(buf == nil || buf == &chunk[0])
+		buf = &chunk[0]
+		all = append(all, chunk...)
+		sizes = append(sizes, len(chunk))
+		return true
+	})
+	for i := range all {
+		assert(all[i] == items[len(items)-1-i])
+	}
+	assert(len(sizes) == 101 && sizes[100] == 3)
+	var count int
+	tr.ForEachChunkReverse(100, func(chunk []testKind) bool {
+		count++
+		return count < 5
+	})
+	assert(count == 5)
+	func() {
+		defer func() { assert(recover() != nil) }()
+		tr.ForEachChunk(0, func(chunk []testKind) bool { return true })
+	}()
+}
+
+func TestGenericWalkNodeLayout(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	tr.WalkNodeLayout(func(items []int, counts []int, leaf bool,
+		level int) bool {
+		panic("empty")
+	})
+	keys := randKeys(10_000)
+	for _, key := range keys {
+		tr.Set(key)
+	}
+	// Rebuild the size of every node from the layout, where each node must
+	// hold exactly as many items as its parent reported.
+	var expect []int
+	var nodes []int
+	tr.WalkNodeLayout(func(items []int, counts []int, leaf bool,
+		level int) bool {
+		size := len(items)
+		if leaf {
+			assert(counts == nil)
+		} else {
+			assert(len(counts) == len(items)+1)
+			for _, count := range counts {
+				size += count
+			}
+		}
+		if level == 0 {
+			assert(size == len(keys))
+		} else {
+			assert(expect[0] == size)
+			expect = expect[1:]
+		}
+		expect = append(append([]int(nil), counts...), expect...)
+		nodes = append(nodes, items...)
+		return true
+	})
+	assert(len(expect) == 0)
+	sort.Ints(nodes)
+	assert(reflect.DeepEqual(nodes, tr.Items()))
+	var count int
+	tr.WalkNodeLayout(func(items []int, counts []int, leaf bool,
+		level int) bool {
+		count++
+		return count < 10
+	})
+	assert(count == 10)
+}
+
+func TestGenericVersion(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 2})
+	v := tr.Version()
+	changed := func() bool {
+		v2 := tr.Version()
+		ok := v2 > v
+		v = v2
+		return ok
+	}
+	for i := 0; i < 100; i++ {
+		tr.Set(i)
+		assert(changed())
+	}
+	tr.Set(50)
+	assert(changed())
+	tr.Load(100)
+	assert(changed())
+	tr.Load(0)
+	assert(changed())
+	tr.Get(1)
+	tr.GetMut(1)
+	tr.Scan(func(int) bool { return true })
+	tr2 := tr.Copy()
+	assert(!changed() && tr2.Version() == v)
+	tr.Delete(-1)
+	assert(!changed())
+	tr.Delete(1)
+	assert(changed())
+	for _, fn := range []func() (int, bool){tr.PopMin, tr.PopMax,
+		func() (int, bool) { return tr.DeleteAt(10) }} {
+		for i := 0; i < 10; i++ {
+			_, ok := fn()
+			assert(ok && changed())
+		}
+	}
+	tr.Clear()
+	assert(changed())
+	_, ok := tr.PopMin()
+	assert(!ok && !changed())
+	assert(tr2.Version() < v)
+}
+
+func TestGenericLoadFill(t *testing.T) {
+	N := 1_000_000
+	tr := testNewBTree()
+	for i := 0; i < N; i++ {
+		tr.Load(i)
+	}
+	assert(tr.sparseRight)
+	tr.sane()
+	var leaves int
+	tr.WalkNodes(func(level int, isLeaf bool, items []int) bool {
+		if isLeaf {
+			leaves++
+		}
+		return true
+	})
+	// nearly full leaves, rather than half full
+	assert(leaves < N/(tr.max-2))
+	for i := 0; i < N; i += 3 {
+		tr.Delete(i)
+	}
+	tr.sane()
+	for i := N; i < N*2; i++ {
+		tr.Load(i)
+	}
+	tr.sane()
+	for tr.Len() > 0 {
+		switch rand.Intn(3) {
+		case 0:
+			tr.PopMax()
+		case 1:
+			tr.PopMin()
+		case 2:
+			tr.DeleteAt(tr.Len() - 1 - rand.Intn(100))
+		}
+		if rand.Intn(10000) == 0 {
+			tr.sane()
+		}
+	}
+	tr.sane()
+}
+
+func TestGenericContains(t *testing.T) {
+	tr := testNewBTree()
+	assert(!tr.Contains(0))
+	for i := 0; i < 10000; i++ {
+		tr.Set(i * 2)
+	}
+	for i := -1; i < 20001; i++ {
+		assert(tr.Contains(i) == (i >= 0 && i < 20000 && i%2 == 0))
+	}
+}
+
+func TestGenericMaxDegree(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: MaxDegree})
+	N := tr.max * 2
+	for i := 0; i < N; i++ {
+		tr.Set(i)
+	}
+	tr.sane()
+	assert(tr.Height() == 2 && cap(*tr.root.children) < tr.max)
+	tr2 := tr.Copy()
+	tr2.Delete(0)
+	assert(cap(*tr2.root.children) < tr.max)
+	for i := N - 1; i >= 0; i-- {
+		tr.Delete(i)
+	}
+	tr.sane()
+	assert(tr.Len() == 0 && tr2.Len() == N-1)
+
+	func() {
+		defer func() {
+			msg, ok := recover().(string)
+			assert(ok && msg == "btree: degree exceeds MaxDegree")
+		}()
+		NewBTreeGOptions(testLess, Options{Degree: 1_000_000})
+	}()
+}
+
+func TestGenericLenRange(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	assert(tr.LenRange(testMakeItem(0), testMakeItem(100)) == 0)
+	for _, i := range rand.Perm(1000) {
+		tr.Set(testMakeItem(i * 3))
+	}
+	for i := 0; i < 1000; i++ {
+		lo, hi := rand.Intn(3100)-50, rand.Intn(3100)-50
+		var n int
+		tr.Ascend(testMakeItem(lo), func(item testKind) bool {
+			if !testLess(item, testMakeItem(hi)) {
+				return false
+			}
+			n++
+			return true
+		})
+		assert(tr.LenRange(testMakeItem(lo), testMakeItem(hi)) == n)
+	}
+}
+
+func TestGenericSelectFunc(t *testing.T) {
+	tr := testNewBTree()
+	even := func(item testKind) bool { return item%2 == 0 }
+	_, ok := tr.SelectFunc(0, even)
+	assert(!ok)
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	var visited int
+	item, ok := tr.SelectFunc(3, func(item testKind) bool {
+		visited++
+		return even(item)
+	})
+	assert(ok && item == testMakeItem(6) && visited == 7)
+	item, ok = tr.SelectFuncReverse(3, even)
+	assert(ok && item == testMakeItem(992))
+	item, ok = tr.SelectFunc(499, even)
+	assert(ok && item == testMakeItem(998))
+	_, ok = tr.SelectFunc(500, even)
+	assert(!ok)
+	_, ok = tr.SelectFuncReverse(-1, even)
+	assert(!ok)
+}
+
+func TestGenericAround(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 2})
+	assert(len(tr.Around(testMakeItem(0), 5, 5)) == 0)
+	for i := 0; i < 100; i++ {
+		tr.Set(testMakeItem(i * 2))
+	}
+	items := tr.Around(testMakeItem(50), 2, 3)
+	assert(len(items) == 6 && items[0] == testMakeItem(46) &&
+		items[2] == testMakeItem(50) && items[5] == testMakeItem(56))
+	items = tr.Around(testMakeItem(51), 2, 3)
+	assert(len(items) == 5 && items[0] == testMakeItem(48) &&
+		items[4] == testMakeItem(56))
+	items = tr.Around(testMakeItem(-10), 10, 2)
+	assert(len(items) == 2 && items[0] == testMakeItem(0))
+	items = tr.Around(testMakeItem(500), 3, 10)
+	assert(len(items) == 3 && items[2] == testMakeItem(198))
+	items = tr.Around(testMakeItem(2), 1000, 1000)
+	assert(len(items) == 100)
+}
+
+func TestGenericDeleteAndNeighbors(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 2})
+	_, hasPrev, _, hasNext, deleted := tr.DeleteAndNeighbors(testMakeItem(0))
+	assert(!hasPrev && !hasNext && !deleted)
+	for _, i := range rand.Perm(100) {
+		tr.Set(testMakeItem(i))
+	}
+	prev, hasPrev, next, hasNext, deleted := tr.DeleteAndNeighbors(
+		testMakeItem(50))
+	assert(deleted && hasPrev && hasNext)
+	assert(prev == testMakeItem(49) && next == testMakeItem(51))
+	_, hasPrev, next, hasNext, deleted = tr.DeleteAndNeighbors(testMakeItem(0))
+	assert(deleted && !hasPrev && hasNext && next == testMakeItem(1))
+	prev, hasPrev, _, hasNext, deleted = tr.DeleteAndNeighbors(
+		testMakeItem(99))
+	assert(deleted && hasPrev && !hasNext && prev == testMakeItem(98))
+	_, _, _, _, deleted = tr.DeleteAndNeighbors(testMakeItem(50))
+	assert(!deleted && tr.Len() == 97)
+	tr.sane()
+
+	// duplicates are neighbors of each other
+	type pair struct{ key, val int }
+	dtr := NewBTreeGOptions(func(a, b pair) bool { return a.key < b.key },
+		Options{Degree: 2, AllowDuplicates: true})
+	for i := 0; i < 100; i++ {
+		dtr.Set(pair{i / 10, i})
+	}
+	for dtr.Len() > 0 {
+		var all []pair
+		dtr.Scan(func(item pair) bool {
+			all = append(all, item)
+			return true
+		})
+		key := pair{key: rand.Intn(10)}
+		prev, hasPrev, next, hasNext, deleted := dtr.DeleteAndNeighbors(key)
+		if !deleted {
+			continue
+		}
+		var rem []pair
+		dtr.Scan(func(item pair) bool {
+			rem = append(rem, item)
+			return true
+		})
+		assert(len(rem) == len(all)-1)
+		j := 0
+		for j < len(rem) && rem[j] == all[j] {
+			j++
+		}
+		assert(all[j].key == key.key)
+		assert(hasPrev == (j > 0) && (!hasPrev || prev == all[j-1]))
+		assert(hasNext == (j < len(rem)) && (!hasNext || next == all[j+1]))
+	}
+	dtr.sane()
+}
+
+func TestGenericTargetNodeBytes(t *testing.T) {
+	type pair struct{ a, b int64 }
+	assert(NewBTreeGOptions(testLess, Options{}).Degree() == 32)
+	assert(NewBTreeGOptions(func(a, b int64) bool { return a < b },
+		Options{TargetNodeBytes: 4096}).Degree() == 256)
+	assert(NewBTreeGOptions(func(a, b pair) bool { return a.a < b.a },
+		Options{TargetNodeBytes: 1024}).Degree() == 32)
+	assert(NewBTreeGOptions(func(a, b [2048]byte) bool { return false },
+		Options{TargetNodeBytes: 4096}).Degree() == 2)
+	assert(NewBTreeGOptions(func(a, b struct{}) bool { return false },
+		Options{TargetNodeBytes: 1 << 30}).Degree() == MaxDegree)
+	// Degree takes precedence
+	assert(NewBTreeGOptions(testLess,
+		Options{Degree: 3, TargetNodeBytes: 4096}).Degree() == 3)
+	func() {
+		defer func() {
+			msg, ok := recover().(string)
+			assert(ok && msg == "btree: negative TargetNodeBytes")
+		}()
+		NewBTreeGOptions(testLess, Options{TargetNodeBytes: -1})
+	}()
+
+	for _, target := range []int{1, 64, 256, 4096} {
+		f := newBTreeGFuzzerOptions(testLess,
+			Options{TargetNodeBytes: target})
+		ops := make([]FuzzOp[int], 10_000)
+		for i := range ops {
+			ops[i] = FuzzOp[int]{
+				Kind:  FuzzOpKind(rand.Intn(int(fuzzNumOps))),
+				Item:  rand.Intn(1000),
+				Index: rand.Intn(1000),
+			}
+			if rand.Intn(2) == 0 {
+				ops[i].Kind = FuzzSet
+			}
+		}
+		if err := f.Apply(ops); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testHashItem(item int) uint64 {
+	return uint64(item) * 0x9E3779B97F4A7C15
+}
+
+func TestGenericChecksums(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	assert(tr.VerifyChecksums() == nil)
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	tr.SetItemHasher(testHashItem)
+	assert(tr.VerifyChecksums() == nil)
+	tr2 := tr.Copy()
+	tr2.Set(testMakeItem(5000))
+	assert(tr2.VerifyChecksums() == nil)
+	// flip a bit of an item in the second node of the second level
+	n := (*tr.root.children)[1]
+	n.items[0] ^= 1 << 3
+	err, ok := tr.VerifyChecksums().(*ChecksumError)
+	assert(ok && err.Depth == 1 && err.Index == 1)
+	assert(err.Error() == "btree: checksum mismatch at depth 1, index 1")
+	// the copy shares the node
+	_, ok = tr2.VerifyChecksums().(*ChecksumError)
+	assert(ok)
+	n.items[0] ^= 1 << 3
+	assert(tr.VerifyChecksums() == nil)
+	tr.SetItemHasher(nil)
+	n.items[0] ^= 1 << 3
+	assert(tr.VerifyChecksums() == nil)
+
+	// every kind of change keeps the checksums, which is verified by Sane
+	for _, degree := range []int{2, 3, 8} {
+		f := newBTreeGFuzzerOptions(testLess, Options{Degree: degree})
+		f.tr.SetItemHasher(testHashItem)
+		ops := make([]FuzzOp[int], 10_000)
+		for i := range ops {
+			ops[i] = FuzzOp[int]{
+				Kind:  FuzzOpKind(rand.Intn(int(fuzzNumOps))),
+				Item:  rand.Intn(1000),
+				Index: rand.Intn(1000),
+			}
+			switch rand.Intn(4) {
+			case 0:
+				ops[i].Kind = FuzzSet
+			case 1:
+				ops[i].Kind = FuzzLoad
+				ops[i].Item = 1000 + i
+			}
+		}
+		if err := f.Apply(ops); err != nil {
+			t.Fatal(err)
+		}
+		tr := f.tr.Rebuild(2)
+		assert(tr.VerifyChecksums() == nil)
+	}
+}
+
+func BenchmarkGenericSetChecksums(b *testing.B) {
+	keys := rand.Perm(100_000)
+	for _, hash := range []func(int) uint64{nil, testHashItem} {
+		name := "off"
+		if hash != nil {
+			name = "on"
+		}
+		b.Run(name, func(b *testing.B) {
+			tr := NewBTreeGOptions(testLess, Options{NoLocks: true})
+			tr.SetItemHasher(hash)
+			for i := 0; i < b.N; i++ {
+				tr.Set(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func TestGenericScanE(t *testing.T) {
+	tr := testNewBTree()
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	errStop := fmt.Errorf("stop")
+	var n int
+	err := tr.ScanE(func(item testKind) (bool, error) {
+		assert(item == testMakeItem(n))
+		n++
+		if n == 501 {
+			return true, errStop
+		}
+		return true, nil
+	})
+	assert(err == errStop && n == 501)
+	n = 0
+	err = tr.ScanMutE(func(item testKind) (bool, error) {
+		n++
+		return n < 11, nil
+	})
+	assert(err == nil && n == 11)
+}
+
+func TestGenericDetectReentrancy(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{DetectReentrancy: true})
+	for i := 0; i < 100; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	mustPanic := func(fn func()) {
+		defer func() {
+			msg, ok := recover().(string)
+			assert(ok &&
+				msg == "btree: tree modified from within an iterator callback")
+		}()
+		fn()
+		panic("!")
+	}
+	mustPanic(func() {
+		tr.Scan(func(item testKind) bool {
+			tr.Set(testMakeItem(-1))
+			return true
+		})
+	})
+	mustPanic(func() {
+		tr.Descend(testMakeItem(50), func(item testKind) bool {
+			tr.Delete(item)
+			return true
+		})
+	})
+	mustPanic(func() {
+		tr.Walk(func(items []testKind) bool {
+			tr.Load(testMakeItem(1000))
+			return true
+		})
+	})
+	tr.sane()
+	assert(tr.Len() == 100)
+	tr2 := tr.Copy()
+	tr.Ascend(testMakeItem(0), func(item testKind) bool {
+		_, ok := tr.Get(item)
+		assert(ok)
+		tr2.Delete(item)
+		return true
+	})
+	assert(tr2.Len() == 0)
+}
+
+func TestGenericAscendEqual(t *testing.T) {
+	type rec struct{ group, id int }
+	tr := NewBTreeG(func(a, b rec) bool { return a.group < b.group })
+	for i := 0; i < 100; i++ {
+		tr.Set(rec{i % 10, i})
+	}
+	assert(tr.Len() == 10)
+	for g := 0; g < 10; g++ {
+		var recs []rec
+		tr.AscendEqual(rec{group: g}, func(item rec) bool {
+			recs = append(recs, item)
+			return true
+		})
+		assert(len(recs) == 1 && recs[0] == rec{g, 90 + g})
+	}
+	tr.AscendEqual(rec{group: 10}, func(item rec) bool {
+		panic("!")
+	})
+	tr.AscendEqual(rec{group: -1}, func(item rec) bool {
+		panic("!")
+	})
+}
+
+func TestGenericAllowDuplicates(t *testing.T) {
+	type rec struct{ group, id int }
+	tr := NewBTreeGOptions(func(a, b rec) bool { return a.group < b.group },
+		Options{Degree: 2, AllowDuplicates: true})
+	N := 10_000
+	for i, j := range rand.Perm(N) {
+		_, replaced := tr.Set(rec{j % 10, i})
+		assert(!replaced)
+	}
+	tr.sane()
+	assert(tr.Len() == N)
+	// the equal items are in insertion order
+	last := rec{-1, -1}
+	tr.Scan(func(item rec) bool {
+		assert(item.group > last.group ||
+			(item.group == last.group && item.id > last.id))
+		last = item
+		return true
+	})
+	for g := 0; g < 10; g++ {
+		recs := tr.GetAll(rec{group: g})
+		assert(len(recs) == N/10)
+		assert(tr.LenRange(rec{group: g}, rec{group: g + 1}) == N/10)
+		item, ok := tr.Get(rec{group: g})
+		assert(ok && item == recs[0])
+		var n int
+		tr.Descend(rec{group: g}, func(item rec) bool {
+			if n < N/10 {
+				assert(item == recs[len(recs)-1-n])
+			} else {
+				assert(item.group < g)
+			}
+			n++
+			return true
+		})
+		assert(n == (g+1)*N/10)
+		iter := tr.Iter()
+		assert(iter.Seek(rec{group: g}) && iter.Item() == recs[0])
+		iter.Release()
+	}
+	_, ok := tr.Get(rec{group: 10})
+	assert(!ok)
+	for i := 0; i < N; i++ {
+		_, ok := tr.Delete(rec{group: i % 10})
+		assert(ok)
+		if i%1000 == 0 {
+			tr.sane()
+		}
+	}
+	assert(tr.Len() == 0)
+	// Load appends equal items
+	for i := 0; i < 100; i++ {
+		tr.Load(rec{i / 10, i})
+	}
+	tr.sane()
+	assert(tr.Len() == 100 && len(tr.GetAll(rec{group: 5})) == 10)
+}
+
+func TestGenericAllowDuplicatesPop(t *testing.T) {
+	type rec struct{ group, id int }
+	for _, degree := range []int{2, 3, 0} {
+		for _, N := range []int{50, 1000} {
+			newTree := func() *BTreeG[rec] {
+				tr := NewBTreeGOptions(func(a, b rec) bool {
+					return a.group < b.group
+				}, Options{Degree: degree, AllowDuplicates: true})
+				for i := 0; i < N; i++ {
+					tr.Set(rec{i / 10, i})
+				}
+				return tr
+			}
+			// the equal items come out in insertion order
+			for _, pop := range []func(tr *BTreeG[rec]) (rec, bool){
+				(*BTreeG[rec]).PopMin,
+				func(tr *BTreeG[rec]) (rec, bool) { return tr.DeleteAt(0) },
+			} {
+				tr := newTree()
+				for i := 0; i < N; i++ {
+					item, ok := pop(tr)
+					assert(ok && item.id == i)
+					if i%100 == 0 {
+						tr.sane()
+					}
+				}
+				assert(tr.Len() == 0)
+			}
+			for _, pop := range []func(tr *BTreeG[rec]) (rec, bool){
+				(*BTreeG[rec]).PopMax,
+				func(tr *BTreeG[rec]) (rec, bool) {
+					return tr.DeleteAt(tr.Len() - 1)
+				},
+			} {
+				tr := newTree()
+				for i := N - 1; i >= 0; i-- {
+					item, ok := pop(tr)
+					assert(ok && item.id == i)
+					if i%100 == 0 {
+						tr.sane()
+					}
+				}
+				assert(tr.Len() == 0)
+			}
+			// deleting from the middle keeps the order of the others
+			tr := newTree()
+			ids := make([]int, N)
+			for i := range ids {
+				ids[i] = i
+			}
+			for len(ids) > 0 {
+				i := len(ids) / 2
+				item, ok := tr.DeleteAt(i)
+				assert(ok && item.id == ids[i])
+				ids = append(ids[:i], ids[i+1:]...)
+			}
+			tr.sane()
+		}
+	}
+}
+
+func TestGenericGetAll(t *testing.T) {
+	type rec struct{ group, id int }
+	tr := NewBTreeG(func(a, b rec) bool { return a.group < b.group })
+	assert(len(tr.GetAll(rec{})) == 0)
+	for i := 0; i < 100; i++ {
+		tr.Set(rec{i % 10, i})
+	}
+	recs := tr.GetAll(rec{group: 3})
+	assert(len(recs) == 1 && recs[0] == rec{3, 93})
+	assert(len(tr.GetAll(rec{group: 10})) == 0)
+	buf := make([]rec, 0, 10)
+	for g := 0; g < 10; g++ {
+		buf = tr.GetAllAppend(buf, rec{group: g})
+	}
+	assert(len(buf) == 10 && cap(buf) == 10)
+	for g, r := range buf {
+		assert(r == rec{g, 90 + g})
+	}
+	buf = tr.GetAllAppend(buf[:0], rec{group: -1})
+	assert(len(buf) == 0)
+}
+
+func TestGenericAscendE(t *testing.T) {
+	tr := testNewBTree()
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	errStop := fmt.Errorf("stop")
+	var n int
+	err := tr.AscendE(testMakeItem(500), func(item testKind) (bool, error) {
+		assert(item == testMakeItem(500+n))
+		if n++; n == 10 {
+			return false, errStop
+		}
+		return true, nil
+	})
+	assert(err == errStop && n == 10)
+	n = 0
+	err = tr.DescendE(testMakeItem(500), func(item testKind) (bool, error) {
+		assert(item == testMakeItem(500-n))
+		n++
+		return true, nil
+	})
+	assert(err == nil && n == 501)
+}
+
+func TestGenericOnCopy(t *testing.T) {
+	var levels []int
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3,
+		OnCopy: func(level int) { levels = append(levels, level) },
+	})
+	for i := 0; i < 10000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	assert(len(levels) == 0)
+	height := tr.Height()
+	tr2 := tr.Copy()
+	// The minimum item is always in a leaf.
+	tr2.Set(testMakeItem(0))
+	assert(len(levels) == height)
+	for i, level := range levels {
+		assert(level == height-1-i)
+	}
+	levels = levels[:0]
+	tr2.Set(testMakeItem(0))
+	tr2.Get(testMakeItem(100))
+	assert(len(levels) == 0)
+	tr.Delete(testMakeItem(100))
+	assert(len(levels) >= height)
+}
+
+func TestGenericPopFirstN(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	assert(tr.PopFirstN(10) == nil && tr.PopLastN(10) == nil)
+	for _, i := range rand.Perm(1000) {
+		tr.Set(testMakeItem(i))
+	}
+	items := tr.PopFirstN(300)
+	assert(len(items) == 300 && cap(items) == 300)
+	for i, item := range items {
+		assert(item == testMakeItem(i))
+	}
+	items = tr.PopLastN(300)
+	assert(len(items) == 300)
+	for i, item := range items {
+		assert(item == testMakeItem(700+i))
+	}
+	tr.sane()
+	assert(tr.Len() == 400 && tr.PopLastN(-1) == nil)
+	items = tr.PopFirstN(1000)
+	assert(len(items) == 400 && items[399] == testMakeItem(699))
+	assert(tr.Len() == 0)
+}
+
+func TestGenericMaxLen(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3, MaxLen: 100})
+	for _, i := range rand.Perm(1000) {
+		tr.Set(testMakeItem(i))
+		assert(tr.Len() <= 100)
+	}
+	tr.sane()
+	min, _ := tr.Min()
+	max, _ := tr.Max()
+	assert(tr.Len() == 100 && min == testMakeItem(900))
+	assert(max == testMakeItem(999))
+	// The new item is inserted first, so a new minimum is evicted itself.
+	evicted, ok, _, replaced := tr.SetEvict(testMakeItem(-1))
+	assert(ok && !replaced && evicted == testMakeItem(-1))
+	evicted, ok, _, _ = tr.SetEvict(testMakeItem(1000))
+	assert(ok && evicted == testMakeItem(900))
+	// Replacing an item never evicts.
+	_, ok, prev, replaced := tr.SetEvict(testMakeItem(1000))
+	assert(!ok && replaced && prev == testMakeItem(1000))
+	tr.Load(testMakeItem(1001))
+	assert(tr.Len() == 100)
+	tr = NewBTreeGOptions(testLess, Options{MaxLen: 10,
+		EvictPolicy: EvictMax})
+	for i := 0; i < 100; i++ {
+		tr.Load(testMakeItem(i))
+	}
+	assert(tr.Len() == 10)
+	max, _ = tr.Max()
+	assert(max == testMakeItem(9))
+	evicted, ok, _, _ = tr.SetEvict(testMakeItem(-1))
+	assert(ok && evicted == testMakeItem(9))
+	tr = NewBTreeG(testLess)
+	_, ok, _, _ = tr.SetEvict(testMakeItem(1))
+	assert(!ok && tr.Len() == 1)
+	func() {
+		defer func() { assert(recover() != nil) }()
+		NewBTreeGOptions(testLess, Options{MaxLen: -1})
+	}()
+}
+
+func BenchmarkGenericSetEvict(b *testing.B) {
+	tr := NewBTreeGOptions(testLess, Options{MaxLen: 1000})
+	keys := randKeys(b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Set(keys[i])
+	}
+}
+
+func BenchmarkGenericSetPopMin(b *testing.B) {
+	tr := testNewBTree()
+	keys := randKeys(b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Set(keys[i])
+		if tr.Len() > 1000 {
+			tr.PopMin()
+		}
+	}
+}
+
+func TestGenericMultiGet(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	for i := 0; i < 10000; i++ {
+		tr.Set(testMakeItem(i * 2))
+	}
+	var keys []testKind
+	for _, i := range rand.Perm(20010) {
+		keys = append(keys, testMakeItem(i))
+	}
+	keys = append(keys, keys[:100]...)
+	orig := append([]testKind(nil), keys...)
+	items, found := tr.MultiGet(keys)
+	assert(reflect.DeepEqual(keys, orig))
+	for i, key := range keys {
+		item, ok := tr.Get(key)
+		assert(found[i] == ok && items[i] == item)
+	}
+}
+
+func TestGenericIsEmpty(t *testing.T) {
+	tr := testNewBTree()
+	assert(tr.IsEmpty() && tr.Len() == 0)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			tr.Set(testMakeItem(i))
+		}
+	}()
+	for last := 0; last < 1000; {
+		n := tr.Len()
+		assert(n >= last && n <= 1000)
+		last = n
+	}
+	wg.Wait()
+	assert(!tr.IsEmpty())
+	tr2 := tr.CopyWithFilter(func(item testKind) bool {
+		return item == testMakeItem(1)
+	})
+	assert(tr2.Len() == 1 && !tr2.IsEmpty())
+	tr.Clear()
+	assert(tr.IsEmpty() && tr.Len() == 0)
+	tr = NewBTreeGOptions(testLess, Options{NoLocks: true})
+	tr.Set(testMakeItem(1))
+	assert(!tr.IsEmpty() && tr.Len() == 1)
+}
+
+func TestGenericScanContext(t *testing.T) {
+	tr := testNewBTree()
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var n int
+	err := tr.ScanContext(ctx, func(item testKind) bool {
+		assert(item == testMakeItem(n))
+		n++
+		return true
+	})
+	assert(err == nil && n == 1000)
+	n = 0
+	err = tr.AscendContext(ctx, testMakeItem(500), func(item testKind) bool {
+		if n++; n == 100 {
+			cancel()
+		}
+		return true
+	})
+	assert(err == context.Canceled && n < 100+contextCheckInterval)
+	err = tr.DescendContext(ctx, testMakeItem(500), func(item testKind) bool {
+		panic("!")
+	})
+	assert(err == context.Canceled)
+	err = tr.ReverseContext(ctx, func(item testKind) bool { panic("!") })
+	assert(err == context.Canceled)
+	n = 0
+	err = tr.ReverseContext(context.Background(), func(item testKind) bool {
+		n++
+		return n < 10
+	})
+	assert(err == nil && n == 10)
+}
+
+func TestGenericNewPathHint(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 2})
+	hint := NewPathHint(32)
+	N := 100000
+	for i := 0; i < N; i++ {
+		tr.SetHint(testMakeItem(i), hint)
+	}
+	tr.sane()
+	assert(tr.Height() > 8 && tr.Height() <= 32)
+	for i := 0; i < N; i++ {
+		item, ok := tr.GetHint(testMakeItem(i), hint)
+		assert(ok && item == testMakeItem(i))
+	}
+	// the hint is in use below the first 8 levels
+	for i := 8; i < tr.Height(); i++ {
+		used, _ := hint.level(i)
+		assert(used != nil && *used)
+	}
+	used, _ := hint.level(32)
+	assert(used == nil)
+	for i := 0; i < N; i += 2 {
+		tr.DeleteHint(testMakeItem(i), hint)
+	}
+	tr.sane()
+	assert(tr.Len() == N/2)
+
+	// the zero-value hint covers 8 levels, without allocating
+	var hint2 PathHint
+	allocs := testing.AllocsPerRun(100, func() {
+		tr.GetHint(testMakeItem(1), &hint2)
+	})
+	assert(allocs == 0)
+	assert(hint2.deep == nil && hint2.used[7])
+	used, _ = hint2.level(8)
+	assert(used == nil)
+	assert(NewPathHint(0).deep == nil && NewPathHint(8).deep == nil)
+
+	// hints are comparable, and copies of a zero-value hint are independent
+	hint3 := hint2
+	assert(hint3 == hint2)
+	hints := map[PathHint]int{hint2: 1}
+	assert(hints[hint3] == 1)
+	tr.GetHint(testMakeItem(N-1), &hint3)
+	assert(hint3 != hint2)
+	hint4 := hint2
+	tr.GetHint(testMakeItem(1), &hint4)
+	assert(hint4 == hint2)
+}
+
+func TestGenericHintOwner(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	var hint PathHint
+	tr.GetHint(testMakeItem(500), &hint)
+	assert(hint.owner == tr.id && hint.used[0])
+	saved := hint.path
+
+	// the copy ignores the hint, and leaves it unchanged
+	tr2 := tr.Copy()
+	item, ok := tr2.GetHint(testMakeItem(10), &hint)
+	assert(ok && item == testMakeItem(10))
+	tr2.SetHint(testMakeItem(2000), &hint)
+	tr2.DeleteHint(testMakeItem(20), &hint)
+	assert(hint.owner == tr.id && hint.path == saved)
+
+	// rebinding clears the path
+	tr2.ResetHint(&hint)
+	assert(hint.owner == tr2.id && !hint.used[0])
+	tr2.GetHint(testMakeItem(10), &hint)
+	assert(hint.used[0] && hint.path != saved)
+	var hint2 PathHint
+	tr.ResetHint(&hint2)
+	assert(hint2.owner == tr.id && hint2.deep == nil)
+
+	// One shared hint is used alternately against a tree and its diverging
+	// copy, and the results must match a reference without hints.
+	const N = 1_000_000
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	trs := [2]*BTreeG[testKind]{tr, tr2}
+	var refs [2]map[testKind]bool
+	for i := range trs {
+		refs[i] = make(map[testKind]bool)
+		trs[i].Scan(func(item testKind) bool {
+			refs[i][item] = true
+			return true
+		})
+	}
+	hint = PathHint{}
+	pos := 0
+	for i := 0; i < N; i++ {
+		j := i & 1
+		tr, ref := trs[j], refs[j]
+		if i%1001 == 0 {
+			// occasionally rebind the hint to either tree
+			tr.ResetHint(&hint)
+		}
+		// clustered keys around a moving position
+		pos += rng.Intn(7) - 3
+		item := testMakeItem(pos + rng.Intn(16))
+		switch rng.Intn(3) {
+		case 0:
+			_, replaced := tr.SetHint(item, &hint)
+			assert(replaced == ref[item])
+			ref[item] = true
+		case 1:
+			_, deleted := tr.DeleteHint(item, &hint)
+			assert(deleted == ref[item])
+			delete(ref, item)
+		default:
+			_, ok := tr.GetHint(item, &hint)
+			assert(ok == ref[item])
+		}
+	}
+	for i := range trs {
+		trs[i].sane()
+		assert(trs[i].Len() == len(refs[i]))
+	}
+}
+
+func BenchmarkGenericDeepHint(b *testing.B) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 2, NoLocks: true})
+	N := 1000000
+	for i := 0; i < N; i++ {
+		tr.Set(testMakeItem(i * 2))
+	}
+	bench := func(b *testing.B, hint *PathHint) {
+		for i := 0; i < b.N; i++ {
+			tr.GetHint(testMakeItem(i%N*2), hint)
+		}
+	}
+	b.Run("PathHint", func(b *testing.B) {
+		bench(b, new(PathHint))
+	})
+	b.Run("NewPathHint", func(b *testing.B) {
+		bench(b, NewPathHint(64))
+	})
+}
+
+func TestGenericGetMutMissing(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{NoLocks: true})
+	for i := 0; i < 10000; i++ {
+		tr.Set(testMakeItem(i * 2))
+	}
+	tr2 := tr.Copy()
+	var hint PathHint
+	allocs := testing.AllocsPerRun(100, func() {
+		_, ok := tr2.GetMut(testMakeItem(-1))
+		assert(!ok)
+		_, ok = tr2.GetHintMut(testMakeItem(5001), &hint)
+		assert(!ok)
+	})
+	assert(allocs == 0 && tr2.root.isoid != tr2.isoid)
+	item, ok := tr2.GetHintMut(testMakeItem(5000), &hint)
+	assert(ok && item == testMakeItem(5000) && tr2.root.isoid == tr2.isoid)
+	tr.sane()
+	tr2.sane()
+}
+
+func TestGenericCopyWithFilter(t *testing.T) {
+	for _, N := range []int{0, 1, 10, 1000, 10000} {
+		tr := NewBTreeGWeighted(testLess, func(item testKind) int64 {
+			return int64(item)
+		})
+		for _, key := range randKeys(N) {
+			tr.Set(key)
+		}
+		tr2 := tr.CopyWithFilter(func(item testKind) bool {
+			return item%3 == 0
+		})
+		tr.sane()
+		tr2.sane()
+		assert(tr.Len() == N && tr2.Len() == (N+2)/3)
+		var weight int64
+		for i, item := range tr2.Items() {
+			assert(item == testMakeItem(i*3))
+			weight += int64(item)
+		}
+		assert(tr2.TotalWeight() == weight)
+		// the trees are independent
+		tr2.Set(testMakeItem(-1))
+		_, ok := tr.Get(testMakeItem(-1))
+		assert(!ok)
+	}
+
+	// the copy of a tree with atomic reads is visible to its readers
+	tr := NewBTreeGOptions(testLess, Options{AtomicReads: true})
+	for i := 0; i < 100; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	tr2 := tr.CopyWithFilter(func(item testKind) bool {
+		return item%2 == 0
+	})
+	tr2.sane()
+	assert(tr2.Len() == 50)
+	_, ok := tr2.Get(testMakeItem(10))
+	assert(ok)
+	var n int
+	tr2.Scan(func(item testKind) bool {
+		assert(item == testMakeItem(n*2))
+		n++
+		return true
+	})
+	assert(n == 50)
+}
+
+func TestGenericMergeScan(t *testing.T) {
+	for _, N := range []int{0, 1, 10, 1000} {
+		a, b := testNewBTree(), testNewBTree()
+		for _, key := range randKeys(N) {
+			if key%2 == 0 {
+				a.Set(key)
+			}
+			if key%3 == 0 {
+				b.Set(key)
+			}
+		}
+		// brute-force merge of the items
+		var expect []testKind
+		var expectFrom []int
+		items1, items2 := a.Items(), b.Items()
+		for i, j := 0, 0; i < len(items1) || j < len(items2); {
+			if j == len(items2) || i < len(items1) && items1[i] < items2[j] {
+				expect = append(expect, items1[i])
+				expectFrom = append(expectFrom, 0)
+				i++
+			} else if i == len(items1) || items2[j] < items1[i] {
+				expect = append(expect, items2[j])
+				expectFrom = append(expectFrom, 1)
+				j++
+			} else {
+				expect = append(expect, items1[i])
+				expectFrom = append(expectFrom, 2)
+				i++
+				j++
+			}
+		}
+		var items []testKind
+		var from []int
+		MergeScan(a, b, testLess, func(item testKind, f int) bool {
+			items = append(items, item)
+			from = append(from, f)
+			return true
+		})
+		assert(reflect.DeepEqual(items, expect))
+		assert(reflect.DeepEqual(from, expectFrom))
+
+		// stop early
+		var count int
+		MergeScan(a, b, testLess, func(item testKind, f int) bool {
+			count++
+			return count < 5
+		})
+		assert(count == len(expect) || count == 5)
+
+		// the same tree is in both
+		count = 0
+		MergeScan(a, a, testLess, func(item testKind, f int) bool {
+			assert(f == 2)
+			count++
+			return true
+		})
+		assert(count == a.Len())
+	}
+}
+
+func TestGenericMergeScanLockOrder(t *testing.T) {
+	a, b := testNewBTree(), testNewBTree()
+	for i := 0; i < 100; i++ {
+		a.Set(testMakeItem(i))
+		b.Set(testMakeItem(i))
+	}
+	// Merges in both orders, with writers waiting on both trees, must not
+	// deadlock.
+	done := make(chan bool)
+	go func() {
+		var wg sync.WaitGroup
+		for _, pair := range [][2]*BTreeG[testKind]{{a, b}, {b, a}} {
+			wg.Add(1)
+			go func(x, y *BTreeG[testKind]) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					MergeScan(x, y, testLess, func(testKind, int) bool {
+						return true
+					})
+				}
+			}(pair[0], pair[1])
+		}
+		for _, tr := range []*BTreeG[testKind]{a, b} {
+			wg.Add(1)
+			go func(tr *BTreeG[testKind]) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					tr.Set(testMakeItem(i % 100))
+				}
+			}(tr)
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("deadlock")
+	}
+}
+
+func TestGenericDiff(t *testing.T) {
+	for _, N := range []int{0, 1, 10, 1000, 10000} {
+		prev := testNewBTree()
+		for _, key := range randKeys(N) {
+			prev.Set(key)
+		}
+		// overlapping random keys
+		next := prev.Copy()
+		want := make(map[testKind]int)
+		for i := 0; i < N/2; i++ {
+			key := testMakeItem(rand.Intn(N * 2))
+			if _, ok := next.Delete(key); !ok {
+				next.Set(key)
+			}
+		}
+		for _, item := range prev.Items() {
+			want[item]--
+		}
+		for _, item := range next.Items() {
+			want[item]++
+		}
+		added, removed := Diff(prev, next, testLess)
+		assert(sort.SliceIsSorted(added, func(i, j int) bool {
+			return added[i] < added[j]
+		}))
+		for _, item := range added {
+			assert(want[item] == 1)
+			delete(want, item)
+		}
+		for _, item := range removed {
+			assert(want[item] == -1)
+			delete(want, item)
+		}
+		for _, v := range want {
+			assert(v == 0)
+		}
+
+		// reuse the buffers
+		added2, removed2 := AppendDiff(added[:0], removed[:0], prev, next,
+			testLess)
+		assert(reflect.DeepEqual(added2, added))
+		assert(reflect.DeepEqual(removed2, removed))
+		assert(len(added2) == 0 || &added2[0] == &added[0])
+	}
+}
+
+func TestGenericAscendFiltered(t *testing.T) {
+	for _, N := range []int{0, 1, 10, 1000, 100000} {
+		tr := NewBTreeGOptions(testLess, Options{Degree: 4})
+		for _, key := range randKeys(N) {
+			tr.Set(key)
+		}
+		lo, hi := testMakeItem(N/3), testMakeItem(N/3+N/100)
+		var calls int
+		var items []testKind
+		tr.AscendFiltered(testMakeItem(N/10),
+			func(min, max testKind) bool {
+				return max < lo || min > hi
+			},
+			func(item testKind) bool {
+				calls++
+				if item >= lo && item <= hi {
+					items = append(items, item)
+				}
+				return true
+			},
+		)
+		var expect []testKind
+		tr.Ascend(testMakeItem(N/10), func(item testKind) bool {
+			if item >= lo && item <= hi {
+				expect = append(expect, item)
+			}
+			return true
+		})
+		assert(reflect.DeepEqual(items, expect))
+		if N == 100000 {
+			assert(calls < len(expect)*2)
+		}
+
+		// the bounds always contain the items of the subtree
+		tr.AscendFiltered(testMakeItem(0),
+			func(min, max testKind) bool {
+				assert(!(max < min))
+				return false
+			},
+			func(item testKind) bool {
+				return true
+			},
+		)
+	}
+}
+
+func BenchmarkGenericAscendFiltered(b *testing.B) {
+	tr := NewBTreeGOptions(testLess, Options{NoLocks: true})
+	N := 1000000
+	for i := 0; i < N; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	// a time window of 1% of the items
+	lo, hi := testMakeItem(N/2), testMakeItem(N/2+N/100)
+	var calls int
+	iter := func(item testKind) bool {
+		calls++
+		return !(item > hi)
+	}
+	b.Run("Ascend", func(b *testing.B) {
+		calls = 0
+		for i := 0; i < b.N; i++ {
+			tr.Ascend(testMakeItem(0), iter)
+		}
+		b.ReportMetric(float64(calls)/float64(b.N), "calls/op")
+	})
+	b.Run("AscendFiltered", func(b *testing.B) {
+		calls = 0
+		for i := 0; i < b.N; i++ {
+			tr.AscendFiltered(testMakeItem(0),
+				func(min, max testKind) bool {
+					return max < lo || min > hi
+				}, iter)
+		}
+		b.ReportMetric(float64(calls)/float64(b.N), "calls/op")
+	})
+}
+
+func TestGenericPeek(t *testing.T) {
+	tr := testNewBTree()
+	for _, msg := range []string{"PeekMin", "PeekMax"} {
+		func() {
+			defer func() {
+				assert(recover() == "btree: "+msg+" on empty BTreeG")
+			}()
+			if msg == "PeekMin" {
+				tr.PeekMin()
+			} else {
+				tr.PeekMax()
+			}
+		}()
+	}
+	for i := 1; i <= 100; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	assert(tr.PeekMin() == testMakeItem(1))
+	assert(tr.PeekMax() == testMakeItem(100))
+}
+
+func TestGenericReset(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	for i := 0; i < 100; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	func() {
+		defer func() {
+			assert(recover() == "btree: Reset on non-empty BTreeG")
+		}()
+		tr.Reset(func(a, b testKind) bool { return a > b })
+	}()
+	assert(tr.PeekMin() == testMakeItem(0))
+	tr.Clear()
+	tr.Reset(func(a, b testKind) bool { return a > b })
+	for i := 0; i < 100; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	tr.sane()
+	assert(tr.PeekMin() == testMakeItem(99) && tr.max == 5)
+}
+
+func TestGenericMutLocks(t *testing.T) {
+	// Mut methods perform copy-on-write, which is a write to the tree even
+	// when no items change, so they must take the write lock. Mix them with
+	// readers and copies, and run with -race.
+	tr := testNewBTree()
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	var copies atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				tr.Scan(func(item testKind) bool { return true })
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				tr.ScanMut(func(item testKind) bool { return true })
+				tr.GetMut(testMakeItem(j))
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				tr.Set(testMakeItem(1000 + i*20 + j))
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				tr2 := tr.Copy()
+				tr2.ScanMut(func(item testKind) bool { return true })
+				tr2.Set(testMakeItem(-1))
+				copies.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	tr.sane()
+	assert(tr.Len() == 1080 && copies.Load() == 80)
+	_, ok := tr.Get(testMakeItem(-1))
+	assert(!ok)
+}
+
+func TestGenericSnapshotItems(t *testing.T) {
+	tr := testNewBTree()
+	assert(len(tr.SnapshotItems()) == 0)
+	for i := 0; i < 10000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			tr.Delete(testMakeItem(i))
+			tr.Set(testMakeItem(i + 10000))
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		items := tr.SnapshotItems()
+		// every snapshot is consistent
+		assert(len(items) == 10000)
+		for j := 1; j < len(items); j++ {
+			assert(items[j-1] < items[j])
+		}
+	}
+	wg.Wait()
+	assert(reflect.DeepEqual(tr.SnapshotItems(), tr.Items()))
+}
+
+func BenchmarkGenericSnapshotItems(b *testing.B) {
+	// Measures how long a writer stalls while other goroutines export items.
+	bench := func(b *testing.B, export func(tr *BTreeG[testKind]) []testKind) {
+		tr := testNewBTree()
+		for i := 0; i < 100000; i++ {
+			tr.Set(testMakeItem(i))
+		}
+		// export periodically
+		done := make(chan bool)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+					export(tr)
+				}
+			}
+		}()
+		var stall time.Duration
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			start := time.Now()
+			tr.Set(testMakeItem(i))
+			if dur := time.Since(start); dur > stall {
+				stall = dur
+			}
+		}
+		b.StopTimer()
+		close(done)
+		wg.Wait()
+		b.ReportMetric(float64(stall.Microseconds()), "max-stall-us")
+	}
+	b.Run("Items", func(b *testing.B) {
+		bench(b, (*BTreeG[testKind]).Items)
+	})
+	b.Run("SnapshotItems", func(b *testing.B) {
+		bench(b, (*BTreeG[testKind]).SnapshotItems)
+	})
+}
+
+func TestGenericNoLocksCopy(t *testing.T) {
+	// Run with -race. Copy must not race with readers of a NoLocks tree.
+	tr := NewBTreeGOptions(testLess, Options{NoLocks: true})
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	var wg sync.WaitGroup
+	wg.Add(3)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				item, ok := tr.Get(testMakeItem(j))
+				assert(ok && item == testMakeItem(j))
+				var n int
+				tr.Scan(func(item testKind) bool {
+					n++
+					return true
+				})
+				assert(n == 1000 && tr.Len() == 1000)
+				iter := tr.Iter()
+				assert(iter.Last() && iter.Item() == testMakeItem(999))
+				iter.Release()
+			}
+		}()
+	}
+	copies := make([]*BTreeG[testKind], 100)
+	go func() {
+		defer wg.Done()
+		for i := range copies {
+			copies[i] = tr.Copy()
+		}
+	}()
+	wg.Wait()
+	for _, tr2 := range copies {
+		tr2.Delete(testMakeItem(0))
+		assert(tr2.Len() == 999)
+	}
+	assert(tr.Len() == 1000)
+	tr.sane()
+}
+
+func TestGenericQuantile(t *testing.T) {
+	tr := NewBTreeG(func(a, b int) bool { return a < b })
+	_, ok := tr.Quantile(0.5)
+	assert(!ok)
+	for i := 0; i < 200; i++ {
+		tr.Set(i * 10)
+	}
+	for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+		_, ok := tr.Quantile(q)
+		assert(!ok)
+	}
+	for _, q := range []float64{0, 0.001, 0.25, 0.5, 0.999} {
+		item, ok := tr.Quantile(q)
+		assert(ok && item == int(q*200)*10)
+	}
+	item, ok := tr.Quantile(1)
+	assert(ok && item == 1990)
+	item, ok = tr.Percentile(90)
+	assert(ok && item == 1800)
+	_, ok = tr.Percentile(101)
+	assert(!ok)
+}
+
+func TestGenericQuantiles(t *testing.T) {
+	tr := NewBTreeG(func(a, b int) bool { return a < b })
+	assert(tr.Quantiles([]float64{0.5}) == nil)
+	for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+		func() {
+			defer func() {
+				assert(recover() == "btree: quantile must be within the range "+
+					"[0, 1]")
+			}()
+			tr.Quantiles([]float64{q})
+		}()
+	}
+	for _, N := range []int{1, 2, 10, 1000, 100_000} {
+		// skewed data, with most of the items clustered near zero
+		tr.Clear()
+		for tr.Len() < N {
+			tr.Set(int(math.Exp(rand.Float64() * 20)))
+		}
+		all := tr.Items()
+		var qs []float64
+		for i := 0; i < 50; i++ {
+			qs = append(qs, rand.Float64())
+		}
+		qs = append(qs, 0, 1, 0.5, 0.5, 0.99, 0.01)
+		items := tr.Quantiles(qs)
+		assert(len(items) == len(qs))
+		for i, q := range qs {
+			assert(items[i] == all[int(math.Round(q*float64(N-1)))])
+		}
+	}
+}
+
+func TestGenericShrink(t *testing.T) {
+	tr := testNewBTree()
+	tr.Shrink()
+	for i := 0; i < 100_000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	tr2 := tr.Copy()
+	for i := 0; i < 100_000; i++ {
+		if i%10 != 0 {
+			tr.Delete(testMakeItem(i))
+		}
+	}
+	tr.Shrink()
+	tr.sane()
+	var nodes int
+	var walk func(n *node[testKind])
+	walk = func(n *node[testKind]) {
+		nodes++
+		assert(n.isoid == tr.isoid)
+		assert(cap(n.items) == len(n.items))
+		if !n.leaf() {
+			assert(cap(*n.children) == len(*n.children))
+			for _, child := range *n.children {
+				walk(child)
+			}
+		}
+	}
+	walk(tr.root)
+	assert(nodes > 1)
+	assert(tr.Len() == 10_000 && tr2.Len() == 100_000)
+	tr2.sane()
+	for i := 0; i < 100_000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	tr.sane()
+	assert(tr.Len() == 100_000)
+}
+
+func TestGenericCapacity(t *testing.T) {
+	func() {
+		defer func() { assert(recover() == "btree: negative capacity") }()
+		NewBTreeGOptions(testLess, Options{Capacity: -1})
+	}()
+	for _, capacity := range []int{0, 5, 1_000_000} {
+		tr := NewBTreeGOptions(testLess, Options{Capacity: capacity})
+		tr.Set(testMakeItem(1))
+		switch capacity {
+		case 0:
+			assert(cap(tr.root.items) == 1)
+		case 5:
+			assert(cap(tr.root.items) == 5)
+		default:
+			assert(cap(tr.root.items) == tr.max)
+		}
+		for i := 0; i < 10_000; i++ {
+			tr.Set(testMakeItem(i))
+		}
+		tr.sane()
+		assert(tr.Len() == 10_000)
+	}
+}
+
+func TestGenericScanLimit(t *testing.T) {
+	tr := testNewBTree()
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i * 2))
+	}
+	var all []testKind
+	var resume *testKind
+	for {
+		var n int
+		next, done := tr.ScanLimit(30, resume, func(item testKind) bool {
+			all = append(all, item)
+			n++
+			return true
+		})
+		assert(n <= 30)
+		if done {
+			break
+		}
+		assert(n == 30 && *next == all[len(all)-1]+2)
+		// an item inserted ahead of the cursor is visited
+		tr.Set(*next + 1)
+		resume = next
+	}
+	assert(len(all) == tr.Len())
+	assert(reflect.DeepEqual(all, tr.Items()))
+}
+
+func TestGenericUnsafeIter(t *testing.T) {
+	tr := testNewBTree()
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	iter := tr.UnsafeIter()
+	var i int
+	for ok := iter.First(); ok; ok = iter.Next() {
+		assert(iter.Item() == testMakeItem(i))
+		i++
+	}
+	assert(i == 1000)
+	// no lock is held, so writes do not block
+	tr.Set(testMakeItem(1000))
+	assert(iter.Seek(testMakeItem(1000)) && iter.Item() == testMakeItem(1000))
+	iter.Release()
+}
+
+func BenchmarkGenericUnsafeIter(b *testing.B) {
+	tr := testNewBTree()
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	b.Run("Iter", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			iter := tr.Iter()
+			iter.Seek(testMakeItem(i % 1000))
+			iter.Release()
+		}
+	})
+	b.Run("UnsafeIter", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			iter := tr.UnsafeIter()
+			iter.Seek(testMakeItem(i % 1000))
+		}
+	})
+}
+
+func TestGenericAscendN(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 4})
+	for i := 0; i < 200; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	for pivot := -1; pivot < 201; pivot += 3 {
+		for n := -1; n < 30; n++ {
+			var items []testKind
+			iter := func(item testKind) bool {
+				items = append(items, item)
+				return true
+			}
+			count := tr.AscendN(testMakeItem(pivot), n, iter)
+			assert(count == len(items))
+			for i := 0; i < n; i++ {
+				item := pivot + i
+				if pivot < 0 {
+					item = i
+				}
+				if item >= 200 {
+					break
+				}
+				assert(i < len(items) && items[i] == testMakeItem(item))
+			}
+			assert(n >= 0 || count == 0)
+			items = nil
+			count = tr.DescendN(testMakeItem(pivot), n, iter)
+			assert(count == len(items) && count <= n+1)
+			for i := 0; i < n; i++ {
+				item := pivot - i
+				if pivot > 199 {
+					item = 199 - i
+				}
+				if item < 0 {
+					break
+				}
+				assert(i < len(items) && items[i] == testMakeItem(item))
+			}
+		}
+	}
+	assert(tr.DescendN(testMakeItem(199), 500, func(testKind) bool {
+		return true
+	}) == 200)
+}
+
+func TestGenericScanN(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 4})
+	for i := 0; i < 200; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	for _, limit := range []int{-1, 0, 1, 7, 199, 200, 201, 1000} {
+		var items []testKind
+		tr.ScanN(limit, func(item testKind) bool {
+			items = append(items, item)
+			return true
+		})
+		expect := limit
+		if expect < 0 {
+			expect = 0
+		} else if expect > tr.Len() {
+			expect = tr.Len()
+		}
+		assert(len(items) == expect)
+		for i := range items {
+			assert(items[i] == testMakeItem(i))
+		}
+	}
+	var count int
+	tr.ScanN(100, func(item testKind) bool {
+		count++
+		return item != testMakeItem(9)
+	})
+	assert(count == 10)
+}
+
+func TestGenericFreeze(t *testing.T) {
+	tr := testNewBTree()
+	for i := 0; i < 100; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	tr.Freeze()
+	assert(tr.Frozen())
+	item := testMakeItem(0)
+	for _, f := range []func(){
+		func() { tr.Set(testMakeItem(1000)) },
+		func() { tr.SetHint(testMakeItem(1000), nil) },
+		func() { tr.SetEvict(testMakeItem(1000)) },
+		func() { tr.Load(testMakeItem(1000)) },
+		func() { tr.Delete(item) },
+		func() { tr.DeleteHint(item, nil) },
+		func() { tr.DeleteAndNeighbors(item) },
+		func() { tr.DeleteAt(0) },
+		func() { tr.PopMin() },
+		func() { tr.PopMax() },
+		func() { tr.PopFirstN(1) },
+		func() { tr.PopLastN(1) },
+		func() { tr.Clear() },
+		func() { tr.Shrink() },
+		func() { tr.GetMut(item) },
+		func() { tr.GetHintMut(item, nil) },
+		func() { tr.GetAtMut(0) },
+		func() { tr.MinMut() },
+		func() { tr.MaxMut() },
+		func() { tr.ItemsMut() },
+		func() { tr.ScanMut(func(testKind) bool { return true }) },
+		func() { tr.AscendMut(item, func(testKind) bool { return true }) },
+		func() { tr.DescendMut(item, func(testKind) bool { return true }) },
+		func() { tr.ReverseMut(func(testKind) bool { return true }) },
+		func() { tr.WalkMut(func([]testKind) bool { return true }) },
+		func() { tr.IterMut() },
+		func() { tr.Cursor().Set(item) },
+	} {
+		assertFrozen(f)
+	}
+	assert(tr.Len() == 100)
+	tr.sane()
+
+	// reads do not take the lock, so they are not blocked by a held lock
+	tr.mu.Lock()
+	v, ok := tr.Get(testMakeItem(50))
+	assert(ok && v == testMakeItem(50))
+	iter := tr.Iter()
+	assert(iter.Last() && iter.Item() == testMakeItem(99))
+	iter.Release()
+	assert(len(tr.Items()) == 100)
+	tr.mu.Unlock()
+
+	tr2 := tr.Copy()
+	assert(!tr2.Frozen())
+	tr2.Delete(item)
+	tr2.sane()
+	assert(tr2.Len() == 99 && tr.Len() == 100 && tr.Contains(item))
+	tr.sane()
+}
+
+func BenchmarkGenericFreeze(b *testing.B) {
+	tr := testNewBTree()
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	b.Run("Locked", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tr.Get(testMakeItem(i % 1000))
+		}
+	})
+	tr.Freeze()
+	b.Run("Frozen", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tr.Get(testMakeItem(i % 1000))
+		}
+	})
+}
+
+func TestGenericIterToken(t *testing.T) {
+	for _, degree := range []int{2, 32} {
+		tr := NewBTreeGOptions(testLess, Options{Degree: degree})
+		_, ok := tr.IterFromToken(0)
+		assert(!ok)
+		N := 1000
+		for _, i := range rand.Perm(N) {
+			tr.Set(testMakeItem(i))
+		}
+		iter := tr.Iter()
+		// no position before the first move, and after the ends
+		_, ok = iter.Token()
+		assert(!ok)
+		for ok := iter.First(); ok; ok = iter.Next() {
+			tok, ok := iter.Token()
+			assert(ok && tok == uint64(iter.Item()))
+		}
+		_, ok = iter.Token()
+		assert(!ok)
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			tok, ok := iter.Token()
+			assert(ok && tok == uint64(iter.Item()))
+		}
+		_, ok = iter.Token()
+		assert(!ok)
+		iter.Release()
+		for i := 0; i < N; i++ {
+			iter, ok := tr.IterFromToken(uint64(i))
+			assert(ok && iter.Item() == testMakeItem(i))
+			tok, ok := iter.Token()
+			assert(ok && tok == uint64(i))
+			if iter.Next() {
+				assert(iter.Item() == testMakeItem(i+1))
+				assert(iter.Prev() && iter.Prev() == (i > 0))
+			} else {
+				assert(i == N-1)
+			}
+			iter.Release()
+		}
+		_, ok = tr.IterFromToken(uint64(N))
+		assert(!ok)
+		// the lock was released on failure
+		tr.Set(testMakeItem(N))
+		iter, ok = tr.IterFromToken(uint64(N))
+		assert(ok && iter.Item() == testMakeItem(N))
+		iter.Release()
+	}
+}
+
+func TestGenericEnumerate(t *testing.T) {
+	tr := testNewBTree()
+	tr.Enumerate(0, func(index int, item testKind) bool {
+		panic("!")
+	})
+	for _, i := range rand.Perm(1000) {
+		tr.Set(testMakeItem(i))
+	}
+	var n int
+	tr.Enumerate(0, func(index int, item testKind) bool {
+		assert(index == n && item == testMakeItem(n))
+		n++
+		return true
+	})
+	assert(n == 1000)
+	n = 0
+	tr.Enumerate(100, func(index int, item testKind) bool {
+		assert(index == n+100 && item == testMakeItem(n))
+		n++
+		return n < 10
+	})
+	assert(n == 10)
+}
+
+func TestGenericLessPanic(t *testing.T) {
+	// the less function panics when an odd item is compared to one of its
+	// neighbors, which only happens deep in the tree
+	less := func(a, b int) bool {
+		if (a|b)&1 == 1 && a-b >= -1 && a-b <= 1 {
+			panic("bad item")
+		}
+		return a < b
+	}
+	N := 10_000
+	for _, degree := range []int{2, 32} {
+		tr := NewBTreeGOptions(less, Options{Degree: degree})
+		for i := 0; i < N; i++ {
+			tr.Set(i * 2)
+		}
+		items := tr.Items()
+		var hint PathHint
+		ops := []func(item int){
+			func(item int) { tr.Set(item) },
+			func(item int) { tr.SetHint(item, &hint) },
+			func(item int) { tr.Delete(item) },
+			func(item int) { tr.DeleteHint(item, &hint) },
+			func(item int) { tr.Load(item) },
+		}
+		for i := 0; i < 1000; i++ {
+			item := rand.Intn(N)*2 + 1
+			if i%10 == 0 {
+				// greater than all other items
+				item = N*2 - 1
+			}
+			func() {
+				defer func() { assert(recover() == "bad item") }()
+				ops[i%len(ops)](item)
+			}()
+		}
+		tr.sane()
+		assert(reflect.DeepEqual(tr.Items(), items))
+		for i := 0; i < N; i++ {
+			item, ok := tr.GetAt(i)
+			assert(ok && item == i*2)
+		}
+	}
+}
+
+func TestGenericToSortedSlice(t *testing.T) {
+	tr := testNewBTree()
+	for _, i := range rand.Perm(1000) {
+		tr.Set(testMakeItem(i))
+	}
+	items := tr.ToSortedSlice()
+	assert(reflect.DeepEqual(items, tr.Items()) && len(items) == 1000)
+}
+
+// testCheckSummaries asserts that the summary range of every node is the
+// range of the summaries of the items in its subtree.
+func testCheckSummaries[T any](tr *BTreeG[T], n *node[T]) (lo, hi uint64) {
+	lo, hi = math.MaxUint64, 0
+	extend := func(s uint64) {
+		if s < lo {
+			lo = s
+		}
+		if s > hi {
+			hi = s
+		}
+	}
+	for _, item := range n.items {
+		extend(tr.summary(item))
+	}
+	if !n.leaf() {
+		for _, child := range *n.children {
+			clo, chi := testCheckSummaries(tr, child)
+			extend(clo)
+			extend(chi)
+		}
+	}
+	assert(n.summin == lo && n.summax == hi)
+	return lo, hi
+}
+
+func TestGenericSummaryRange(t *testing.T) {
+	summary := func(item int) uint64 { return uint64(item*7919) % 1000 }
+	check := func(tr *BTreeG[int]) {
+		tr.sane()
+		if tr.root != nil {
+			testCheckSummaries(tr, tr.root)
+		}
+		items := tr.Items()
+		for i := 0; i < 10; i++ {
+			lo := uint64(rand.Intn(1000))
+			hi := lo + uint64(rand.Intn(100))
+			var want, got []int
+			for _, item := range items {
+				if s := summary(item); s >= lo && s <= hi {
+					want = append(want, item)
+				}
+			}
+			tr.AscendSummaryRange(lo, hi, func(item int) bool {
+				got = append(got, item)
+				return true
+			})
+			assert(reflect.DeepEqual(got, want))
+		}
+	}
+	for _, degree := range []int{2, 4, 32} {
+		tr := NewBTreeGOptions(func(a, b int) bool { return a < b },
+			Options{Degree: degree})
+		// the summarizer may be set on a tree with items
+		for i := 0; i < 100; i++ {
+			tr.Set(rand.Intn(10_000))
+		}
+		tr.SetItemSummarizer(summary)
+		check(tr)
+		var copies []*BTreeG[int]
+		var hint PathHint
+		next := 10_000
+		for i := 0; i < 20_000; i++ {
+			switch rand.Intn(9) {
+			case 0, 1:
+				tr.Set(rand.Intn(10_000))
+			case 2:
+				tr.SetHint(rand.Intn(10_000), &hint)
+			case 3:
+				tr.Load(next)
+				next++
+			case 4, 5:
+				tr.Delete(rand.Intn(10_000))
+			case 6:
+				tr.PopMin()
+			case 7:
+				tr.PopMax()
+			case 8:
+				tr.DeleteAt(rand.Intn(tr.Len() + 1))
+			}
+			if i%1000 == 0 {
+				check(tr)
+				copies = append(copies, tr.Copy())
+			}
+		}
+		check(tr)
+		for _, tr2 := range copies {
+			check(tr2)
+			tr2.Set(-1)
+			check(tr2)
+		}
+		tr2 := tr.CopyWithFilter(func(item int) bool { return item%2 == 0 })
+		check(tr2)
+		// stop early
+		var n int
+		tr.AscendSummaryRange(0, math.MaxUint64, func(item int) bool {
+			n++
+			return n < 10
+		})
+		assert(n == 10)
+		tr.SetItemSummarizer(nil)
+		func() {
+			defer func() { assert(recover() == "btree: no item summarizer") }()
+			tr.AscendSummaryRange(0, 0, nil)
+		}()
+	}
+}
+
+func TestGenericAtomicReads(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 4, AtomicReads: true})
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	// The writer adds and removes the top items, so that every read sees
+	// all items below some number.
+	var readers int32 = 4
+	var wg sync.WaitGroup
+	for i := 0; i < int(readers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt32(&readers, -1)
+			for j := 0; j < 100; j++ {
+				var n int
+				tr.Scan(func(item testKind) bool {
+					assert(item == testMakeItem(n))
+					n++
+					return true
+				})
+				assert(n >= 500 && n <= 1500)
+				item, ok := tr.Get(testMakeItem(rand.Intn(500)))
+				assert(ok && item < 500)
+				_, ok = tr.GetHint(testMakeItem(2000), nil)
+				assert(!ok)
+				runtime.Gosched()
+			}
+		}()
+	}
+	for i := 0; atomic.LoadInt32(&readers) > 0; i++ {
+		if i%2 == 0 {
+			tr.Set(testMakeItem(tr.Len()))
+		} else {
+			tr.PopMax()
+		}
+		if i%50 == 0 {
+			tr2 := tr.Copy()
+			tr2.Set(testMakeItem(5000))
+			assert(tr2.Len() == tr.Len()+1)
+		}
+		runtime.Gosched()
+	}
+	for tr.Len() > 500 {
+		tr.PopMax()
+	}
+	wg.Wait()
+	assert(tr.Len() == 500)
+	tr.sane()
+	tr.Clear()
+	_, ok := tr.Get(testMakeItem(0))
+	assert(!ok)
+	// ignored without locks
+	tr = NewBTreeGOptions(testLess, Options{AtomicReads: true, NoLocks: true})
+	assert(tr.atomicRoot == nil)
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package btree
+
+// Cursor is a tree along with a PathHint, for a series of operations that
+// are clustered around a moving position, without managing the hint
+// separately. A Cursor is created with BTreeG.Cursor.
+//
+// A Cursor is not safe for concurrent use, though the tree it uses may be.
+type Cursor[T any] struct {
+	tr   *BTreeG[T]
+	hint PathHint
+}
+
+// Cursor returns a new cursor for the tree.
+func (tr *BTreeG[T]) Cursor() *Cursor[T] {
+	return &Cursor[T]{tr: tr}
+}
+
+// Set an item, like BTreeG.SetHint, using the cursor hint.
+func (c *Cursor[T]) Set(item T) (T, bool) {
+	return c.tr.SetHint(item, &c.hint)
+}
+
+// Get a value for key, like BTreeG.GetHint, using the cursor hint.
+func (c *Cursor[T]) Get(key T) (T, bool) {
+	return c.tr.GetHint(key, &c.hint)
+}
+
+// Delete a value for a key, like BTreeG.DeleteHint, using the cursor hint.
+func (c *Cursor[T]) Delete(key T) (T, bool) {
+	return c.tr.DeleteHint(key, &c.hint)
+}
+
+// MapCursor is a map along with a PathHint, like Cursor. A MapCursor is
+// created with Map.Cursor.
+//
+// A MapCursor is not safe for concurrent use, though the map it uses may be.
+type MapCursor[K ordered, V any] struct {
+	tr   *Map[K, V]
+	hint PathHint
+	key  K    // last key used by the cursor
+	ok   bool // key is valid
+}
+
+// Cursor returns a new cursor for the map.
+func (tr *Map[K, V]) Cursor() *MapCursor[K, V] {
+	return &MapCursor[K, V]{tr: tr}
+}
+
+// Set or replace a value for a key, like Map.Set, using the cursor hint.
+func (c *MapCursor[K, V]) Set(key K, value V) (V, bool) {
+	tr := c.tr
+	if tr.rejectNaN && key != key {
+		panic(ErrNaNKey)
+	}
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("Set", tr.restructs)
+	}
+	c.key, c.ok = key, true
+	prev, replaced := tr.setHint(key, value, &c.hint)
+	if tr.maxLen > 0 {
+		tr.evict()
+	}
+	return prev, replaced
+}
+
+// Get a value for key, like Map.Get, using the cursor hint.
+func (c *MapCursor[K, V]) Get(key K) (V, bool) {
+	c.key, c.ok = key, true
+	return c.tr.getHint(key, &c.hint, false)
+}
+
+// Delete a value for a key, like Map.Delete, using the cursor hint.
+func (c *MapCursor[K, V]) Delete(key K) (V, bool) {
+	tr := c.tr
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("Delete", tr.restructs)
+	}
+	c.key, c.ok = key, true
+	return tr.deleteHint(key, &c.hint)
+}
+
+// SeekIter returns a read-only iterator that is positioned at the first item
+// that is greater-or-equal-to the last key used by the cursor, or at the
+// first item if the cursor has not been used. The iterator is not positioned
+// at an item if there is no such item.
+// The Release method must be called for the iterator of a map with locks.
+func (c *MapCursor[K, V]) SeekIter() MapIter[K, V] {
+	iter := c.tr.Iter()
+	if c.ok {
+		iter.Seek(c.key)
+	} else {
+		iter.First()
+	}
+	return iter
+}
@@ -0,0 +1,120 @@
+package btree
+
+import "testing"
+
+func TestCursor(t *testing.T) {
+	tr := NewBTreeG(testLess)
+	c := tr.Cursor()
+	_, ok := c.Get(testMakeItem(0))
+	assert(!ok)
+	for i := 0; i < 1000; i++ {
+		_, replaced := c.Set(testMakeItem(i))
+		assert(!replaced)
+	}
+	prev, replaced := c.Set(testMakeItem(500))
+	assert(replaced && prev == testMakeItem(500))
+	for i := 0; i < 1000; i++ {
+		item, ok := c.Get(testMakeItem(i))
+		assert(ok && item == testMakeItem(i))
+	}
+	assert(c.hint.used[0])
+	for i := 0; i < 1000; i += 2 {
+		item, ok := c.Delete(testMakeItem(i))
+		assert(ok && item == testMakeItem(i))
+	}
+	_, ok = c.Delete(testMakeItem(0))
+	assert(!ok)
+	assert(tr.Len() == 500)
+	tr.sane()
+}
+
+func BenchmarkCursor(b *testing.B) {
+	tr := NewBTreeGOptions(testLess, Options{NoLocks: true})
+	N := 1000000
+	for i := 0; i < N; i++ {
+		tr.Set(testMakeItem(i * 2))
+	}
+	b.Run("Cursor", func(b *testing.B) {
+		c := tr.Cursor()
+		for i := 0; i < b.N; i++ {
+			c.Set(testMakeItem(i%N*2 + 1))
+			c.Get(testMakeItem(i % N * 2))
+			c.Delete(testMakeItem(i%N*2 + 1))
+		}
+	})
+	b.Run("PathHint", func(b *testing.B) {
+		var hint PathHint
+		for i := 0; i < b.N; i++ {
+			tr.SetHint(testMakeItem(i%N*2+1), &hint)
+			tr.GetHint(testMakeItem(i%N*2), &hint)
+			tr.DeleteHint(testMakeItem(i%N*2+1), &hint)
+		}
+	})
+}
+
+func TestMapCursor(t *testing.T) {
+	for _, degree := range []int{2, 3, 16, 0} {
+		tr := NewMap[int, int](degree)
+		c := tr.Cursor()
+		iter := c.SeekIter()
+		assert(!iter.Next())
+		_, ok := c.Get(0)
+		assert(!ok)
+		keys := randMapKeys(1000)
+		for _, key := range keys {
+			_, replaced := c.Set(key, key*10)
+			assert(!replaced)
+		}
+		tr.sane()
+		prev, replaced := c.Set(500, 1)
+		assert(replaced && prev == 5000)
+		c.Set(500, 5000)
+		for i := 0; i < 1000; i++ {
+			value, ok := c.Get(i)
+			assert(ok && value == i*10)
+		}
+		assert(c.hint.used[0])
+		iter = c.SeekIter()
+		assert(iter.Key() == 999 && !iter.Next())
+		c.Get(998)
+		iter = c.SeekIter()
+		assert(iter.Key() == 998 && iter.Next() && iter.Key() == 999)
+		for i := 0; i < 1000; i += 2 {
+			value, ok := c.Delete(i)
+			assert(ok && value == i*10)
+		}
+		_, ok = c.Delete(0)
+		assert(!ok)
+		assert(tr.Len() == 500)
+		tr.sane()
+		c.Get(501)
+		iter = c.SeekIter()
+		assert(iter.Key() == 501 && iter.Next() && iter.Key() == 503)
+		c.Get(1000)
+		iter = c.SeekIter()
+		assert(!iter.Next())
+	}
+}
+
+func BenchmarkMapCursor(b *testing.B) {
+	tr := NewMapOptions[int, int](Options{NoLocks: true})
+	N := 1000000
+	for i := 0; i < N; i++ {
+		tr.Set(i*2, i)
+	}
+	b.Run("Cursor", func(b *testing.B) {
+		c := tr.Cursor()
+		for i := 0; i < b.N; i++ {
+			c.Set(i%N*2+1, i)
+			c.Get(i % N * 2)
+			c.Delete(i%N*2 + 1)
+		}
+	})
+	b.Run("NoHint", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tr.Set(i%N*2+1, i)
+			tr.Get(i % N * 2)
+			tr.Delete(i%N*2 + 1)
+		}
+	})
+}
@@ -0,0 +1,644 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"sort"
+)
+
+// MarshalCSV writes the map to w as two-column CSV, one key,value row per
+// item, in ascending key order.
+func MarshalCSV(tr *Map[string, string], w io.Writer) error {
+	cw := csv.NewWriter(w)
+	var err error
+	tr.Scan(func(key, value string) bool {
+		err = cw.Write([]string{key, value})
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// UnmarshalCSV reads two-column CSV from r and returns a new map using the
+// provided degree. The rows do not need to be sorted. When a key appears more
+// than once, the last row wins.
+func UnmarshalCSV(r io.Reader, degree int) (*Map[string, string], error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.ReuseRecord = true
+	var items []mapPair[string, string]
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items,
+			mapPair[string, string]{key: rec[0], value: rec[1]})
+	}
+	tr := NewMap[string, string](degree)
+	tr.build(sortPairs(items))
+	return tr, nil
+}
+
+// sortPairs sorts the items by key and removes duplicates, keeping the last
+// occurrence of each key.
+func sortPairs[K ordered, V any](items []mapPair[K, V]) []mapPair[K, V] {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+	j := 0
+	for i := 0; i < len(items); i++ {
+		if i+1 < len(items) && !(items[i].key < items[i+1].key) {
+			continue
+		}
+		items[j] = items[i]
+		j++
+	}
+	return items[:j]
+}
+
+// gobHeader precedes the items of a gob encoded tree.
+type gobHeader struct {
+	Count  int
+	Degree int
+}
+
+// gobPrealloc returns the number of items to preallocate for the count of a
+// gob header.
+func gobPrealloc(count int) int {
+	if count > 1024 {
+		return 1024
+	}
+	return count
+}
+
+func maxToDegree(max int) int {
+	if max == 0 {
+		return 0
+	}
+	return (max + 1) / 2
+}
+
+// GobEncode implements the gob.GobEncoder interface.
+// The items are written in order following a header with the item count and
+// the degree. When K or V is an interface type, each concrete type stored in
+// the map must first be registered using gob.Register.
+func (tr *Map[K, V]) GobEncode() ([]byte, error) {
+	return tr.gobEncode(true)
+}
+
+func (tr *Map[K, V]) gobEncode(values bool) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(gobHeader{Count: tr.Len(), Degree: maxToDegree(tr.max)})
+	if err != nil {
+		return nil, err
+	}
+	tr.Scan(func(key K, value V) bool {
+		if err = enc.Encode(&key); err == nil && values {
+			err = enc.Encode(&value)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements the gob.GobDecoder interface.
+// Replaces all of the items in the map with the decoded items.
+func (tr *Map[K, V]) GobDecode(data []byte) error {
+	return tr.gobDecode(data, true)
+}
+
+func (tr *Map[K, V]) gobDecode(data []byte, values bool) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var hdr gobHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return err
+	}
+	if hdr.Count < 0 {
+		return errors.New("btree: invalid item count")
+	}
+	if hdr.Degree > MaxDegree {
+		return errors.New("btree: invalid degree")
+	}
+	// The items are decoded into a temporary map, which replaces the items
+	// of the map once all of them are decoded, so that an error leaves the
+	// map unchanged. The degree of a map that's already initialized is kept.
+	tr.init(hdr.Degree)
+	locked := tr.lock(false)
+	max := tr.max
+	if locked {
+		tr.unlock(false)
+	}
+	tmp := new(Map[K, V])
+	tmp.isoid = newIsoID()
+	tmp.init(maxToDegree(max))
+	for i := 0; i < hdr.Count; i++ {
+		var key K
+		var value V
+		if err := dec.Decode(&key); err != nil {
+			return err
+		}
+		if values {
+			if err := dec.Decode(&value); err != nil {
+				return err
+			}
+		}
+		if tr.rejectNaN && key != key {
+			return ErrNaNKey
+		}
+		tmp.load(key, value)
+	}
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("GobDecode", tr.restructs)
+	}
+	// The nodes of the temporary map are owned by the map, and the replaced
+	// nodes are no longer used.
+	tr.isoid = tmp.isoid
+	tr.root, tr.count = tmp.root, tmp.count
+	tr.sparseRight = tmp.sparseRight
+	tr.restructs++
+	for tr.maxLen > 0 && tr.count > tr.maxLen {
+		tr.evict()
+	}
+	return nil
+}
+
+// GobEncode implements the gob.GobEncoder interface.
+// The keys are written in order following a header with the item count and
+// the degree.
+func (tr *Set[K]) GobEncode() ([]byte, error) {
+	return tr.base.gobEncode(false)
+}
+
+// GobDecode implements the gob.GobDecoder interface.
+// Replaces all of the items in the set with the decoded items.
+func (tr *Set[K]) GobDecode(data []byte) error {
+	return tr.base.gobDecode(data, false)
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+// The set is written as an array of its keys in ascending order, and an
+// empty set is written as [].
+func (tr *Set[K]) MarshalJSON() ([]byte, error) {
+	keys := tr.Keys()
+	if keys == nil {
+		keys = []K{}
+	}
+	return json.Marshal(keys)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+// Replaces all of the items in the set with the keys of a JSON array, which
+// do not need to be sorted or unique. A JSON null clears the set.
+func (tr *Set[K]) UnmarshalJSON(data []byte) error {
+	var keys []K
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	tr.Clear()
+	for _, key := range keys {
+		tr.Load(key)
+	}
+	return nil
+}
+
+// GobEncode implements the gob.GobEncoder interface.
+// The items are written in order following a header with the item count and
+// the degree. When T is an interface type, such as with BTree, each concrete
+// type stored in the tree must first be registered using gob.Register.
+func (tr *BTreeG[T]) GobEncode() ([]byte, error) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(gobHeader{Count: tr.count, Degree: maxToDegree(tr.max)})
+	if err != nil {
+		return nil, err
+	}
+	if tr.root != nil {
+		tr.nodeScan(&tr.root, func(item T) bool {
+			err = enc.Encode(&item)
+			return err == nil
+		}, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements the gob.GobDecoder interface.
+// Replaces all of the items in the tree with the decoded items. The tree must
+// have been created with one of the New functions, which provides the less
+// function that orders the items.
+func (tr *BTreeG[T]) GobDecode(data []byte) error {
+	if tr.less == nil {
+		return errors.New("btree: missing less function")
+	}
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var hdr gobHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return err
+	}
+	if hdr.Count < 0 {
+		return errors.New("btree: invalid item count")
+	}
+	// The count is not trusted for the capacity, which would otherwise
+	// allow a small input to allocate a lot of memory.
+	items := make([]T, 0, gobPrealloc(hdr.Count))
+	for i := 0; i < hdr.Count; i++ {
+		var item T
+		if err := dec.Decode(&item); err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+	tr.Clear()
+	for _, item := range items {
+		tr.Load(item)
+	}
+	return nil
+}
+
+// patchVersion is the first byte of every patch written by DiffEncode.
+const patchVersion = 1
+
+// The operations of a patch.
+const (
+	patchSet    = 1
+	patchDelete = 2
+)
+
+// patchHasBase is set in the flags of a patch that records the base of the
+// map it applies to. See DiffEncodeBase.
+const patchHasBase = 1
+
+var (
+	// ErrInvalidPatch is returned by ApplyPatch when the patch is malformed.
+	ErrInvalidPatch = errors.New("btree: invalid patch")
+	// ErrPatchBase is returned by ApplyPatch when the patch was not encoded
+	// against the current contents of the map.
+	ErrPatchBase = errors.New("btree: patch does not apply to this map")
+)
+
+// DiffEncode writes a patch to w that, when applied to prev using
+// ApplyPatch, makes prev equal to tr. The patch is a sorted sequence of sets
+// and deletes, which is found by a structural diff of the two maps. Nodes
+// that are shared by both maps, such as after a Copy, are skipped, making the
+// patch proportional to the changes rather than to the size of the maps.
+//
+// The patch records the number of items in prev, which allows ApplyPatch to
+// detect some attempts to apply the patch to the wrong map. Use
+// DiffEncodeBase to detect the others.
+func (tr *Map[K, V]) DiffEncode(prev *Map[K, V], w io.Writer,
+	encKey func(w io.Writer, key K) error,
+	encValue func(w io.Writer, value V) error,
+) error {
+	return tr.diffEncode(prev, nil, w, encKey, encValue)
+}
+
+// DiffEncodeBase is like DiffEncode, but also records base in the patch,
+// which is a checksum or a version that identifies the contents of prev,
+// such as the one returned by prev.Checksum. Use ApplyPatchBase to apply
+// the patch only to a map with the same base.
+func (tr *Map[K, V]) DiffEncodeBase(prev *Map[K, V], base uint64,
+	w io.Writer, encKey func(w io.Writer, key K) error,
+	encValue func(w io.Writer, value V) error,
+) error {
+	return tr.diffEncode(prev, &base, w, encKey, encValue)
+}
+
+func (tr *Map[K, V]) diffEncode(prev *Map[K, V], base *uint64, w io.Writer,
+	encKey func(w io.Writer, key K) error,
+	encValue func(w io.Writer, value V) error,
+) error {
+	tr.lockPair(prev)
+	defer tr.unlockPair(prev)
+	items, prevItems := tr.diffItems(prev)
+	var nops int
+	diffMerge(items, prevItems, func(item mapPair[K, V], deleted bool) error {
+		nops++
+		return nil
+	})
+	var buf []byte
+	buf = append(buf, patchVersion)
+	if base != nil {
+		buf = append(buf, patchHasBase)
+		buf = binary.BigEndian.AppendUint64(buf, *base)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(prev.count))
+	buf = binary.AppendUvarint(buf, uint64(tr.count))
+	buf = binary.AppendUvarint(buf, uint64(nops))
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+	err := diffMerge(items, prevItems,
+		func(item mapPair[K, V], deleted bool) error {
+			if deleted {
+				if err := bw.WriteByte(patchDelete); err != nil {
+					return err
+				}
+				return encKey(bw, item.key)
+			}
+			if err := bw.WriteByte(patchSet); err != nil {
+				return err
+			}
+			if err := encKey(bw, item.key); err != nil {
+				return err
+			}
+			return encValue(bw, item.value)
+		})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// diffMerge merges the sorted items of diffItems into the operations of a
+// patch. Every item in items may have been added or changed, and every item
+// that is only in prevItems was deleted.
+func diffMerge[K ordered, V any](items, prevItems []mapPair[K, V],
+	fn func(item mapPair[K, V], deleted bool) error,
+) error {
+	var i, j int
+	for i < len(items) || j < len(prevItems) {
+		var err error
+		if j == len(prevItems) ||
+			(i < len(items) && !(prevItems[j].key < items[i].key)) {
+			if j < len(prevItems) && !(items[i].key < prevItems[j].key) {
+				j++
+			}
+			err = fn(items[i], false)
+			i++
+		} else {
+			err = fn(prevItems[j], true)
+			j++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffItems returns the items of the nodes in tr that are not shared with
+// prev, and the items of the nodes in prev that are not shared with tr, each
+// sorted by key. Any item that differs between the two maps is in one of
+// those nodes.
+func (tr *Map[K, V]) diffItems(prev *Map[K, V],
+) (items, prevItems []mapPair[K, V]) {
+	var nodes, prevNodes []*mapNode[K, V]
+	var height, prevHeight int
+	if tr.root != nil {
+		nodes = append(nodes, tr.root)
+		height = tr.root.height()
+	}
+	if prev.root != nil {
+		prevNodes = append(prevNodes, prev.root)
+		prevHeight = prev.root.height()
+	}
+	// Walk both trees one level at a time, from the top down. All leaves are
+	// at the same depth, so a shared node is at the same height in both.
+	for height > 0 || prevHeight > 0 {
+		if height == prevHeight {
+			nodes, prevNodes = unsharedNodes(nodes, prevNodes)
+		}
+		h := height
+		if prevHeight > h {
+			h = prevHeight
+		}
+		if height == h {
+			items, nodes = appendLevel(items, nodes)
+			height--
+		}
+		if prevHeight == h {
+			prevItems, prevNodes = appendLevel(prevItems, prevNodes)
+			prevHeight--
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+	sort.Slice(prevItems, func(i, j int) bool {
+		return prevItems[i].key < prevItems[j].key
+	})
+	return items, prevItems
+}
+
+func (n *mapNode[K, V]) height() int {
+	height := 1
+	for !n.leaf() {
+		n = (*n.children)[0]
+		height++
+	}
+	return height
+}
+
+// unsharedNodes removes the nodes that are in both a and b.
+func unsharedNodes[K ordered, V any](a, b []*mapNode[K, V],
+) ([]*mapNode[K, V], []*mapNode[K, V]) {
+	shared := make(map[*mapNode[K, V]]bool, len(b))
+	for _, n := range b {
+		shared[n] = false
+	}
+	var j int
+	for _, n := range a {
+		if _, ok := shared[n]; ok {
+			shared[n] = true
+		} else {
+			a[j] = n
+			j++
+		}
+	}
+	a = a[:j]
+	j = 0
+	for _, n := range b {
+		if !shared[n] {
+			b[j] = n
+			j++
+		}
+	}
+	return a, b[:j]
+}
+
+// appendLevel appends the items of the nodes to items, and returns the
+// children of the nodes.
+func appendLevel[K ordered, V any](items []mapPair[K, V],
+	nodes []*mapNode[K, V],
+) ([]mapPair[K, V], []*mapNode[K, V]) {
+	var children []*mapNode[K, V]
+	for _, n := range nodes {
+		items = append(items, n.items...)
+		if !n.leaf() {
+			children = append(children, *n.children...)
+		}
+	}
+	return items, children
+}
+
+// Checksum returns an FNV-1a hash of the keys and values of the map, in
+// order, as they are written by encKey and encValue. It's meant for
+// DiffEncodeBase and ApplyPatchBase.
+func (tr *Map[K, V]) Checksum(encKey func(w io.Writer, key K) error,
+	encValue func(w io.Writer, value V) error,
+) (uint64, error) {
+	h := fnv.New64a()
+	var err error
+	tr.Scan(func(key K, value V) bool {
+		if err = encKey(h, key); err == nil {
+			err = encValue(h, value)
+		}
+		return err == nil
+	})
+	return h.Sum64(), err
+}
+
+// ApplyPatch applies a patch that was written by DiffEncode. The map must
+// have the same contents as the prev map that was passed to DiffEncode.
+// Returns ErrPatchBase if the patch was found not to apply to the map, in
+// which case the map is left unchanged. The base that's recorded by
+// DiffEncodeBase is not checked.
+//
+// The reader is buffered, and may read past the end of the patch, unless it
+// is an io.ByteReader.
+func (tr *Map[K, V]) ApplyPatch(r io.Reader,
+	decKey func(r io.Reader) (K, error),
+	decValue func(r io.Reader) (V, error),
+) error {
+	return tr.applyPatchBase(nil, r, decKey, decValue)
+}
+
+// ApplyPatchBase is like ApplyPatch, but returns ErrPatchBase, leaving the
+// map unchanged, unless the patch was written by DiffEncodeBase with the
+// same base.
+func (tr *Map[K, V]) ApplyPatchBase(base uint64, r io.Reader,
+	decKey func(r io.Reader) (K, error),
+	decValue func(r io.Reader) (V, error),
+) error {
+	return tr.applyPatchBase(&base, r, decKey, decValue)
+}
+
+func (tr *Map[K, V]) applyPatchBase(base *uint64, r io.Reader,
+	decKey func(r io.Reader) (K, error),
+	decValue func(r io.Reader) (V, error),
+) error {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	br, ok := r.(interface {
+		io.Reader
+		io.ByteReader
+	})
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	version, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != patchVersion {
+		return ErrInvalidPatch
+	}
+	flags, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if flags&^patchHasBase != 0 {
+		return ErrInvalidPatch
+	}
+	if flags&patchHasBase != 0 {
+		var b [8]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return err
+		}
+		if base != nil && binary.BigEndian.Uint64(b[:]) != *base {
+			return ErrPatchBase
+		}
+	} else if base != nil {
+		return ErrPatchBase
+	}
+	var hdr [3]uint64 // base count, count, and number of operations
+	for i := range hdr {
+		if hdr[i], err = binary.ReadUvarint(br); err != nil {
+			return err
+		}
+	}
+	if hdr[0] != uint64(tr.count) {
+		return ErrPatchBase
+	}
+	// Apply the patch in isolation, so that the map can be restored when the
+	// patch fails partway through.
+	root, count := tr.root, tr.count
+	tr.isoid = newIsoID()
+	err = tr.applyPatch(br, hdr[2], decKey, decValue)
+	if err == nil && uint64(tr.count) != hdr[1] {
+		err = ErrPatchBase
+	}
+	if err != nil {
+		tr.root, tr.count = root, count
+	}
+	return err
+}
+
+func (tr *Map[K, V]) applyPatch(br io.ByteReader, nops uint64,
+	decKey func(r io.Reader) (K, error),
+	decValue func(r io.Reader) (V, error),
+) error {
+	r := br.(io.Reader)
+	for i := uint64(0); i < nops; i++ {
+		op, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		key, err := decKey(r)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case patchSet:
+			value, err := decValue(r)
+			if err != nil {
+				return err
+			}
+			if tr.rejectNaN && key != key {
+				return ErrNaNKey
+			}
+			tr.set(key, value)
+		case patchDelete:
+			if _, deleted := tr.deleteKey(key); !deleted {
+				return ErrPatchBase
+			}
+		default:
+			return ErrInvalidPatch
+		}
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCSV(t *testing.T) {
+	for _, N := range []int{0, 1, 10, 1000} {
+		tr := NewMap[string, string](4)
+		for _, i := range randMapKeys(N) {
+			tr.Set(fmt.Sprintf("key:%d", i), fmt.Sprintf("val,\"%d\"\n", i))
+		}
+		var buf bytes.Buffer
+		if err := MarshalCSV(tr, &buf); err != nil {
+			t.Fatal(err)
+		}
+		tr2, err := UnmarshalCSV(&buf, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr2.sane()
+		k1, v1 := tr.KeyValues()
+		k2, v2 := tr2.KeyValues()
+		assert(len(k1) == len(k2))
+		for i := range k1 {
+			assert(k1[i] == k2[i] && v1[i] == v2[i])
+		}
+	}
+	// unsorted input with duplicates
+	tr, err := UnmarshalCSV(strings.NewReader("b,1\na,2\nb,3\n"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.sane()
+	assert(tr.Len() == 2)
+	v, _ := tr.Get("a")
+	assert(v == "2")
+	v, _ = tr.Get("b")
+	assert(v == "3")
+	// wrong number of fields
+	_, err = UnmarshalCSV(strings.NewReader("a,1\nb\n"), 0)
+	assert(err != nil)
+}
+
+func TestGob(t *testing.T) {
+	type doc struct {
+		Name  string
+		Users *Map[string, int]
+		Tags  *Set[string]
+		Items *BTreeG[int]
+	}
+	for _, N := range []int{0, 1, 1000} {
+		d1 := doc{
+			Name:  "hello",
+			Users: NewMap[string, int](3),
+			Tags:  new(Set[string]),
+			Items: NewBTreeG(testLess),
+		}
+		for _, i := range randMapKeys(N) {
+			d1.Users.Set(fmt.Sprintf("user:%d", i), i)
+			d1.Tags.Insert(fmt.Sprintf("tag:%d", i))
+			d1.Items.Set(i)
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(d1); err != nil {
+			t.Fatal(err)
+		}
+		d2 := doc{Items: NewBTreeG(testLess)}
+		if err := gob.NewDecoder(&buf).Decode(&d2); err != nil {
+			t.Fatal(err)
+		}
+		assert(d2.Name == d1.Name)
+		d2.Users.sane()
+		d2.Tags.base.sane()
+		d2.Items.sane()
+		assert(d2.Users.max == d1.Users.max)
+		k1, v1 := d1.Users.KeyValues()
+		k2, v2 := d2.Users.KeyValues()
+		assert(reflect.DeepEqual(k1, k2) && reflect.DeepEqual(v1, v2))
+		assert(reflect.DeepEqual(d1.Tags.Keys(), d2.Tags.Keys()))
+		assert(reflect.DeepEqual(d1.Items.Items(), d2.Items.Items()))
+	}
+	// interface items must be registered
+	gob.Register(testGobItem{})
+	tr := New(func(a, b any) bool {
+		return a.(testGobItem).Key < b.(testGobItem).Key
+	})
+	tr.Set(testGobItem{Key: "b"})
+	tr.Set(testGobItem{Key: "a"})
+	data, err := tr.base.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2 := New(tr.base.less)
+	if err := tr2.base.GobDecode(data); err != nil {
+		t.Fatal(err)
+	}
+	assert(tr2.Len() == 2 && tr2.Min().(testGobItem).Key == "a")
+
+	var tr3 BTreeG[int]
+	assert(tr3.GobDecode(data) != nil)
+	var m Map[string, int]
+	assert(m.GobDecode([]byte("garbage")) != nil)
+
+	// a huge count in the header is not preallocated
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	assert(enc.Encode(gobHeader{Count: 1 << 62}) == nil)
+	assert(enc.Encode(1) == nil)
+	items := NewBTreeG(testLess)
+	items.Set(5)
+	assert(items.GobDecode(buf.Bytes()) != nil)
+	assert(items.Len() == 1)
+
+	// an error leaves the map unchanged
+	m.Set("a", 1)
+	m.Set("b", 2)
+	data, err = m.GobEncode()
+	assert(err == nil)
+	var m2 Map[string, int]
+	for i := 0; i < 100; i++ {
+		m2.Set(fmt.Sprint(i), i)
+	}
+	assert(m2.GobDecode(data[:len(data)-1]) != nil)
+	assert(m2.Len() == 100)
+	m2.sane()
+	assert(m2.GobDecode(data) == nil)
+	m2.sane()
+	k1, v1 := m.KeyValues()
+	k2, v2 := m2.KeyValues()
+	assert(reflect.DeepEqual(k1, k2) && reflect.DeepEqual(v1, v2))
+	m3 := NewMapOptions[string, int](Options{MaxLen: 1})
+	assert(m3.GobDecode(data) == nil)
+	k3, _ := m3.KeyValues()
+	assert(reflect.DeepEqual(k3, []string{"b"}))
+}
+
+type testGobItem struct {
+	Key string
+}
+
+func testEncInt(w io.Writer, x int) error {
+	return binary.Write(w, binary.LittleEndian, int64(x))
+}
+
+func testDecInt(r io.Reader) (int, error) {
+	var x int64
+	err := binary.Read(r, binary.LittleEndian, &x)
+	return int(x), err
+}
+
+func testMapEqual(a, b *Map[int, int]) bool {
+	k1, v1 := a.KeyValues()
+	k2, v2 := b.KeyValues()
+	return reflect.DeepEqual(k1, k2) && reflect.DeepEqual(v1, v2)
+}
+
+func TestPatch(t *testing.T) {
+	N := 1000000
+	var tr Map[int, int]
+	for i := 0; i < N; i++ {
+		tr.Load(i*2, i)
+	}
+	for _, k := range []int{0, 1, 10, 100} {
+		// mutate k random keys of a copy with sets, replaces and deletes
+		tr2 := tr.Copy()
+		for i := 0; i < k; i++ {
+			key := rand.Intn(N * 2)
+			switch rand.Intn(3) {
+			case 0:
+				tr2.Set(key, -key)
+			case 1:
+				tr2.Delete(key)
+			case 2:
+				tr2.Set(N*2+i, i)
+			}
+		}
+		var buf bytes.Buffer
+		err := tr2.DiffEncode(&tr, &buf, testEncInt, testEncInt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the patch only includes the nodes on the changed paths
+		assert(buf.Len() <= 20+k*tr.Height()*tr.max*17)
+		tr3 := tr.Copy()
+		patch := buf.Bytes()
+		err = tr3.ApplyPatch(bytes.NewReader(patch), testDecInt, testDecInt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr3.sane()
+		assert(testMapEqual(tr3, tr2))
+
+		if k != 10 {
+			continue
+		}
+		// a patch from an unrelated map with different nodes
+		tr4 := NewMap[int, int](4)
+		tr2.Scan(func(key, value int) bool {
+			tr4.Set(key, value)
+			return true
+		})
+		buf.Reset()
+		err = tr4.DiffEncode(&tr, &buf, testEncInt, testEncInt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr3 = tr.Copy()
+		err = tr3.ApplyPatch(&buf, testDecInt, testDecInt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(testMapEqual(tr3, tr2))
+
+	}
+
+	// a map with the same count, but missing a deleted key
+	var m1, m3 Map[int, int]
+	for i := 0; i < 100; i++ {
+		m1.Set(i, i)
+		m3.Set(i+1, i)
+	}
+	m2 := m1.Copy()
+	m2.Delete(0)
+	var buf bytes.Buffer
+	if err := m2.DiffEncode(&m1, &buf, testEncInt, testEncInt); err != nil {
+		t.Fatal(err)
+	}
+	keys := m3.Keys()
+	err := m3.ApplyPatch(&buf, testDecInt, testDecInt)
+	assert(err == ErrPatchBase)
+	assert(reflect.DeepEqual(m3.Keys(), keys))
+	m3.sane()
+
+	err = m3.ApplyPatch(strings.NewReader("\x09"), testDecInt, testDecInt)
+	assert(err == ErrInvalidPatch)
+
+	// a map with the same keys, but a different value, has another checksum
+	m4 := m1.Copy()
+	m4.Set(50, -50)
+	base, err := m1.Checksum(testEncInt, testEncInt)
+	assert(err == nil)
+	base4, err := m4.Checksum(testEncInt, testEncInt)
+	assert(err == nil && base4 != base)
+	buf.Reset()
+	err = m2.DiffEncodeBase(&m1, base, &buf, testEncInt, testEncInt)
+	assert(err == nil)
+	patch := buf.Bytes()
+	err = m4.ApplyPatchBase(base4, bytes.NewReader(patch), testDecInt,
+		testDecInt)
+	assert(err == ErrPatchBase)
+	v, _ := m4.Get(50)
+	assert(m4.Len() == 100 && v == -50)
+	m5 := m1.Copy()
+	err = m5.ApplyPatchBase(base, bytes.NewReader(patch), testDecInt,
+		testDecInt)
+	assert(err == nil && testMapEqual(m5, m2))
+	// the base is optional when applying, but not when checking
+	m5 = m1.Copy()
+	err = m5.ApplyPatch(bytes.NewReader(patch), testDecInt, testDecInt)
+	assert(err == nil && testMapEqual(m5, m2))
+	buf.Reset()
+	err = m2.DiffEncode(&m1, &buf, testEncInt, testEncInt)
+	assert(err == nil)
+	m5 = m1.Copy()
+	err = m5.ApplyPatchBase(base, &buf, testDecInt, testDecInt)
+	assert(err == ErrPatchBase && testMapEqual(m5, &m1))
+}
+
+func TestSetJSON(t *testing.T) {
+	type config struct {
+		Names *Set[string]
+		Ports Set[int]
+	}
+	var c1 config
+	c1.Names = new(Set[string])
+	data, err := json.Marshal(&c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(string(data) == `{"Names":[],"Ports":[]}`)
+	for _, i := range randMapKeys(1000) {
+		c1.Names.Insert(fmt.Sprintf("name:%d", i))
+		c1.Ports.Insert(i)
+	}
+	data, err = json.Marshal(&c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c2 config
+	c2.Ports.Insert(-1)
+	if err := json.Unmarshal(data, &c2); err != nil {
+		t.Fatal(err)
+	}
+	c2.Names.base.sane()
+	c2.Ports.base.sane()
+	assert(reflect.DeepEqual(c1.Names.Keys(), c2.Names.Keys()))
+	assert(reflect.DeepEqual(c1.Ports.Keys(), c2.Ports.Keys()))
+
+	// unsorted with duplicates
+	var s Set[int]
+	assert(json.Unmarshal([]byte(`[3, 1, 2, 3, 1]`), &s) == nil)
+	assert(reflect.DeepEqual(s.Keys(), []int{1, 2, 3}))
+	data, _ = json.Marshal(&s)
+	assert(string(data) == `[1,2,3]`)
+	assert(json.Unmarshal([]byte(`null`), &s) == nil && s.Len() == 0)
+	assert(json.Unmarshal([]byte(`["a"]`), &s) != nil)
+}
@@ -0,0 +1,32 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build tinygo
+
+// This program is a smoke test for TinyGo builds, which is only built by
+// TinyGo. From the root of the repository, run:
+//
+//	tinygo build -target=wasm -o /tmp/smoke.wasm ./internal/tinygotest
+package main
+
+import "github.com/tidwall/btree"
+
+func main() {
+	var set btree.Set[string]
+	var m btree.Map[string, struct{}]
+	for _, key := range []string{"c", "a", "b", "a"} {
+		set.Insert(key)
+		m.Set(key, struct{}{})
+	}
+	if set.Len() != 3 || m.Len() != 3 {
+		panic("wrong length")
+	}
+	set.Delete("b")
+	m.Delete("b")
+	if keys := set.Keys(); len(keys) != 2 || keys[0] != "a" ||
+		keys[1] != "c" {
+		panic("wrong keys")
+	}
+	println("ok")
+}
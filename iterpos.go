@@ -0,0 +1,195 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+)
+
+// ErrInvalidIterPos is returned when decoding an IterPos from invalid data.
+var ErrInvalidIterPos = errors.New("btree: invalid iterator position")
+
+const (
+	iterPosPath = 1 << iota // the position has a path
+	iterPosItem             // the position has an item
+)
+
+// IterPos is a saved iterator position, which is returned by IterG.Pos and
+// MapIter.Pos, and is restored by SeekPos. It can be encoded for transport
+// with MarshalBinary.
+//
+// A position holds the path to the item in the tree, which is only used when
+// the tree has not changed since the position was saved, and the item itself,
+// which is used to seek to the first item that is greater-or-equal-to it
+// otherwise.
+type IterPos[T any] struct {
+	flags   byte
+	version uint64 // version of the tree, for the path
+	path    []int  // child and item indexes from the root
+	item    T
+}
+
+// Pos returns the position of the iterator, for restoring with SeekPos.
+// Returns an empty position if the iterator is not at an item.
+func (iter *IterG[T]) Pos() IterPos[T] {
+	var pos IterPos[T]
+	if iter.tr == nil || !iter.seeked || len(iter.stack) == 0 {
+		return pos
+	}
+	pos.flags = iterPosPath | iterPosItem
+	pos.version = iter.tr.version
+	pos.path = make([]int, len(iter.stack))
+	for i, s := range iter.stack {
+		pos.path[i] = s.i
+	}
+	pos.item = iter.item
+	return pos
+}
+
+// SeekPos moves the iterator to a position from Pos. When the tree has not
+// changed since the position was saved, the iterator is moved directly to the
+// same item. Otherwise it's moved to the first item that is
+// greater-or-equal-to the saved item, like Seek.
+// Returns false if there was no item found, or the position is empty.
+func (iter *IterG[T]) SeekPos(pos IterPos[T]) bool {
+	if iter.tr == nil {
+		return false
+	}
+	if pos.flags&iterPosPath != 0 && pos.version == iter.tr.version &&
+		iter.seekPath(pos) {
+		return true
+	}
+	if pos.flags&iterPosItem != 0 {
+		return iter.Seek(pos.item)
+	}
+	iter.seeked = true
+	iter.stack = iter.stack[:0]
+	return false
+}
+
+// seekPath moves the iterator to the item at the path of the position, which
+// must be within the bounds of the nodes, and must lead to an item that is
+// equal to the saved item.
+func (iter *IterG[T]) seekPath(pos IterPos[T]) bool {
+	if iter.tr.root == nil || len(pos.path) == 0 {
+		return false
+	}
+	stack := iter.stack[:0]
+	n := iter.tr.isoLoad(&iter.tr.root, iter.mut)
+	for j, i := range pos.path {
+		stack = append(stack, iterStackItemG[T]{n, i})
+		if j == len(pos.path)-1 {
+			if i < 0 || i >= len(n.items) {
+				return false
+			}
+			break
+		}
+		if n.leaf() || i < 0 || i > len(n.items) {
+			return false
+		}
+		n = iter.tr.isoLoad(&(*n.children)[i], iter.mut)
+	}
+	item := n.items[pos.path[len(pos.path)-1]]
+	if pos.flags&iterPosItem != 0 &&
+		(iter.tr.less(item, pos.item) || iter.tr.less(pos.item, item)) {
+		return false
+	}
+	iter.seeked = true
+	iter.atstart, iter.atend = false, false
+	iter.stack = stack
+	iter.item = item
+	return true
+}
+
+// Pos returns the position of the iterator, for restoring with SeekPos.
+// The position only holds the key, so SeekPos always seeks to the first key
+// that is greater-or-equal-to it, even when the map has changed.
+// Returns an empty position if the iterator is not at an item.
+func (iter *MapIter[K, V]) Pos() IterPos[K] {
+	var pos IterPos[K]
+	if iter.tr == nil || !iter.seeked || len(iter.stack) == 0 {
+		return pos
+	}
+	pos.flags = iterPosItem
+	pos.item = iter.item.key
+	return pos
+}
+
+// SeekPos moves the iterator to the first key that is greater-or-equal-to the
+// key of a position from Pos.
+// Returns false if there was no item found, or the position is empty.
+func (iter *MapIter[K, V]) SeekPos(pos IterPos[K]) bool {
+	if pos.flags&iterPosItem == 0 {
+		if iter.tr != nil {
+			iter.seeked = true
+			iter.stack = iter.stack[:0]
+		}
+		return false
+	}
+	return iter.Seek(pos.item)
+}
+
+// MarshalBinary encodes the position. The item is encoded using
+// encoding/gob.
+func (pos IterPos[T]) MarshalBinary() ([]byte, error) {
+	data := []byte{pos.flags}
+	if pos.flags&iterPosPath != 0 {
+		data = binary.AppendUvarint(data, pos.version)
+		data = binary.AppendUvarint(data, uint64(len(pos.path)))
+		for _, i := range pos.path {
+			data = binary.AppendUvarint(data, uint64(i))
+		}
+	}
+	if pos.flags&iterPosItem != 0 {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&pos.item); err != nil {
+			return nil, err
+		}
+		data = append(data, buf.Bytes()...)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes a position from MarshalBinary.
+// Returns ErrInvalidIterPos if the data is not a valid position.
+func (pos *IterPos[T]) UnmarshalBinary(data []byte) error {
+	var pos2 IterPos[T]
+	r := bytes.NewReader(data)
+	flags, err := r.ReadByte()
+	if err != nil || flags&^(iterPosPath|iterPosItem) != 0 {
+		return ErrInvalidIterPos
+	}
+	pos2.flags = flags
+	if flags&iterPosPath != 0 {
+		pos2.version, err = binary.ReadUvarint(r)
+		if err != nil {
+			return ErrInvalidIterPos
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return ErrInvalidIterPos
+		}
+		pos2.path = make([]int, n)
+		for i := range pos2.path {
+			v, err := binary.ReadUvarint(r)
+			if err != nil || v > MaxDegree*2 {
+				return ErrInvalidIterPos
+			}
+			pos2.path[i] = int(v)
+		}
+	}
+	if flags&iterPosItem != 0 {
+		if err := gob.NewDecoder(r).Decode(&pos2.item); err != nil {
+			return ErrInvalidIterPos
+		}
+	}
+	if r.Len() != 0 {
+		return ErrInvalidIterPos
+	}
+	*pos = pos2
+	return nil
+}
@@ -0,0 +1,122 @@
+package btree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIterPos(t *testing.T) {
+	tr := NewBTreeGOptions(testLess, Options{Degree: 3})
+	for i := 0; i < 1000; i++ {
+		tr.Set(testMakeItem(i * 2))
+	}
+	iter := tr.Iter()
+	assert(iter.Pos().flags == 0)
+	assert(iter.Seek(testMakeItem(500)))
+	pos := iter.Pos()
+	iter.Release()
+
+	// unchanged tree, restored from the path
+	iter = tr.Iter()
+	assert(iter.SeekPos(pos) && iter.Item() == testMakeItem(500))
+	assert(iter.Next() && iter.Item() == testMakeItem(502))
+	assert(iter.Prev() && iter.Prev() && iter.Item() == testMakeItem(498))
+	iter.Release()
+
+	// encoded and decoded
+	data, err := pos.MarshalBinary()
+	assert(err == nil)
+	var pos2 IterPos[testKind]
+	assert(pos2.UnmarshalBinary(data) == nil)
+	iter = tr.Iter()
+	assert(iter.SeekPos(pos2) && iter.Item() == testMakeItem(500))
+	iter.Release()
+
+	// inserts around the cursor
+	tr.Set(testMakeItem(499))
+	tr.Set(testMakeItem(501))
+	iter = tr.Iter()
+	assert(iter.SeekPos(pos2) && iter.Item() == testMakeItem(500))
+	assert(iter.Next() && iter.Item() == testMakeItem(501))
+	iter.Release()
+
+	// the cursor item is deleted
+	tr.Delete(testMakeItem(500))
+	iter = tr.Iter()
+	assert(iter.SeekPos(pos2) && iter.Item() == testMakeItem(501))
+	iter.Release()
+
+	// a copy with the same version, but a different layout
+	tr2 := tr.Copy()
+	iter = tr2.Iter()
+	assert(iter.Seek(testMakeItem(1000)))
+	pos = iter.Pos()
+	iter.Release()
+	tr2.Delete(testMakeItem(0))
+	tr.Delete(testMakeItem(1998))
+	assert(tr.Version() == tr2.Version())
+	iter = tr.Iter()
+	assert(iter.SeekPos(pos) && iter.Item() == testMakeItem(1000))
+	iter.Release()
+
+	// past the end
+	iter = tr.Iter()
+	assert(iter.Last())
+	pos = iter.Pos()
+	iter.Release()
+	tr.Delete(pos.item)
+	iter = tr.Iter()
+	assert(!iter.SeekPos(pos))
+	assert(!iter.SeekPos(IterPos[testKind]{}))
+	iter.Release()
+}
+
+func TestIterPosInvalid(t *testing.T) {
+	var pos IterPos[int]
+	for _, data := range [][]byte{
+		nil, {4}, {1}, {1, 0, 200}, {1, 0, 1, 0, 0}, {2}, {2, 1, 2, 3},
+	} {
+		assert(pos.UnmarshalBinary(data) == ErrInvalidIterPos)
+	}
+	data, err := pos.MarshalBinary()
+	assert(err == nil)
+	assert(pos.UnmarshalBinary(data) == nil && pos.flags == 0)
+	// a path that is out of range is ignored
+	tr := NewBTreeG(testLess)
+	for i := 0; i < 100; i++ {
+		tr.Set(testMakeItem(i))
+	}
+	pos = IterPos[int]{flags: iterPosPath, version: tr.Version(),
+		path: []int{1000}}
+	iter := tr.Iter()
+	assert(!iter.SeekPos(pos))
+	pos.path = []int{5, 5}
+	assert(!iter.SeekPos(pos))
+	assert(iter.Seek(testMakeItem(5)))
+	pos = iter.Pos()
+	pos.flags = iterPosPath
+	assert(iter.First() && iter.SeekPos(pos))
+	assert(iter.Item() == testMakeItem(5))
+	iter.Release()
+}
+
+func TestMapIterPos(t *testing.T) {
+	var tr Map[string, int]
+	for i := 0; i < 1000; i++ {
+		tr.Set(fmt.Sprintf("key:%04d", i), i)
+	}
+	iter := tr.Iter()
+	assert(iter.Pos().flags == 0 && !iter.SeekPos(IterPos[string]{}))
+	assert(iter.Seek("key:0500"))
+	data, err := iter.Pos().MarshalBinary()
+	assert(err == nil)
+	var pos IterPos[string]
+	assert(pos.UnmarshalBinary(data) == nil && pos.item == "key:0500")
+	tr.Delete("key:0500")
+	tr.Set("key:0499a", -1)
+	iter = tr.Iter()
+	assert(iter.SeekPos(pos) && iter.Key() == "key:0501")
+	assert(iter.Prev() && iter.Key() == "key:0499a")
+	tr.Set("key:0500", 500)
+	assert(iter.SeekPos(pos) && iter.Key() == "key:0500")
+}
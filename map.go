@@ -3,7 +3,17 @@
 // license that can be found in the LICENSE file.
 package btree
 
-import "sync/atomic"
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
 
 type ordered interface {
 	~int | ~int8 | ~int16 | ~int32 | ~int64 |
@@ -19,7 +29,15 @@ type isoCopier[T any] interface {
 	IsoCopy() T
 }
 
+// MaxDegree is the largest degree accepted by the New functions. Each node
+// may hold up to twice as many items, so larger degrees produce nodes that
+// are far too large to copy or split efficiently.
+const MaxDegree = 1 << 16
+
 func degreeToMinMax(deg int) (min, max int) {
+	if deg > MaxDegree {
+		panic("btree: degree exceeds MaxDegree")
+	}
 	if deg <= 0 {
 		deg = 32
 	} else if deg == 1 {
@@ -30,22 +48,72 @@ func degreeToMinMax(deg int) (min, max int) {
 	return min, max
 }
 
+// degreeOption returns the degree from the options, which is computed from
+// TargetNodeBytes for items that are size bytes when no Degree is set.
+func degreeOption(opts Options, size uintptr) int {
+	if opts.TargetNodeBytes < 0 {
+		panic("btree: negative TargetNodeBytes")
+	}
+	if opts.Degree != 0 || opts.TargetNodeBytes == 0 {
+		return opts.Degree
+	}
+	if size == 0 {
+		size = 1
+	}
+	// a full node has deg*2-1 items
+	items := uint64(opts.TargetNodeBytes) / uint64(size)
+	if items >= MaxDegree*2 {
+		return MaxDegree
+	}
+	deg := int(items+1) / 2
+	if deg < 2 {
+		deg = 2
+	}
+	return deg
+}
+
 var gisoid uint64
 
-func newIsoID() uint64 {
-	return atomic.AddUint64(&gisoid, 1)
+// The states of a tree's lazy initialization. A zero-value tree is initialized
+// on first write, and these ensure that only one goroutine ever performs that
+// initialization, even when the caller races the first writes.
+const (
+	initStateNone int32 = iota
+	initStateBusy
+	initStateDone
+)
+
+// beginInit returns true if the caller should perform the initialization,
+// after which it must call endInit. Returns false if the tree has already
+// been initialized, possibly after waiting for another goroutine to finish.
+func beginInit(state *int32) bool {
+	if atomic.LoadInt32(state) == initStateDone {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(state, initStateNone, initStateBusy) {
+		for atomic.LoadInt32(state) != initStateDone {
+			runtime.Gosched()
+		}
+		return false
+	}
+	return true
+}
+
+func endInit(state *int32) {
+	atomic.StoreInt32(state, initStateDone)
 }
 
-type mapPair[K ordered, V any] struct {
-	// The `value` field should be before the `key` field because doing so
-	// allows for the Go compiler to optimize away the `value` field when
-	// it's a `struct{}`, which is the case for `btree.Set`.
-	value V
-	key   K
+func newIsoID() uint64 {
+	return atomic.AddUint64(&gisoid, 1)
 }
 
 type Map[K ordered, V any] struct {
 	isoid         uint64
+	length        int64 // count for Len, stored atomically on write unlocks
+	mu            *sync.RWMutex
+	id            uint64 // identity of the map for path hints, see PathHint
+	locks         bool
+	reentry       *reentryDetector
 	root          *mapNode[K, V]
 	count         int
 	empty         mapPair[K, V]
@@ -53,6 +121,17 @@ type Map[K ordered, V any] struct {
 	max           int // max items
 	copyValues    bool
 	isoCopyValues bool
+	rejectNaN     bool
+	capacity      int // see Options.Capacity
+	maxLen        int // see Options.MaxLen
+	evictPolicy   EvictPolicy
+	sparseRight   bool // see appendSplit
+	onCopy        func(level int)
+	restructs     uint64 // number of node creations and removals
+	onStructure   func(op string)
+	initState     int32  // see initState* constants
+	frozen        int32  // see Freeze
+	gen           uint64 // copy generation
 }
 
 func NewMap[K ordered, V any](degree int) *Map[K, V] {
@@ -61,6 +140,69 @@ func NewMap[K ordered, V any](degree int) *Map[K, V] {
 	return m
 }
 
+// NewMapOptions returns a new Map using the provided options.
+//
+// Unlike a Map from NewMap or a zero-value Map, which are not safe for
+// concurrent use, this map uses a sync.RWMutex to ensure all operations are
+// safe across multiple goroutines, unless the NoLocks option is set.
+// The Release method must be called for each iterator of a map with locks.
+func NewMapOptions[K ordered, V any](opts Options) *Map[K, V] {
+	m := new(Map[K, V])
+	m.mu = new(sync.RWMutex)
+	m.locks = !opts.NoLocks
+	if opts.DetectReentrancy {
+		m.reentry = new(reentryDetector)
+	}
+	m.rejectNaN = opts.RejectNaN
+	m.init(degreeOption(opts, unsafe.Sizeof(m.empty)))
+	m.capacity = capacityHint(opts.Capacity, m.max)
+	m.maxLen = maxLenOption(opts.MaxLen)
+	m.evictPolicy = opts.EvictPolicy
+	m.onCopy = opts.OnCopy
+	m.onStructure = opts.OnStructureChange
+	return m
+}
+
+// NewMapFromSlice returns a new Map that contains the provided keys and
+// values. The items are sorted and the map is bulk constructed, which is much
+// faster than setting each key. When a key appears more than once, the last
+// value wins, like with Set.
+// Panics if keys and values do not have the same length.
+func NewMapFromSlice[K ordered, V any](keys []K, values []V) *Map[K, V] {
+	if len(keys) != len(values) {
+		panic("btree: keys and values have different lengths")
+	}
+	items := make([]mapPair[K, V], len(keys))
+	for i := range keys {
+		items[i] = mapPair[K, V]{key: keys[i], value: values[i]}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+	m := new(Map[K, V])
+	m.build(dedupPairs(items))
+	return m
+}
+
+// dedupPairs removes the items with duplicate keys from the sorted items,
+// keeping the last one of each key.
+func dedupPairs[K ordered, V any](items []mapPair[K, V]) []mapPair[K, V] {
+	j := 0
+	for i := 0; i < len(items); i++ {
+		if j > 0 && !(items[j-1].key < items[i].key) {
+			items[j-1] = items[i]
+			continue
+		}
+		items[j] = items[i]
+		j++
+	}
+	return items[:j]
+}
+
+// ErrNaNKey is returned, or used as the panic value, when a NaN key is added
+// to a Map that was created with the RejectNaN option.
+var ErrNaNKey = errors.New("btree: NaN key")
+
 type mapNode[K ordered, V any] struct {
 	isoid    uint64
 	count    int
@@ -70,6 +212,9 @@ type mapNode[K ordered, V any] struct {
 
 // Copy the node for safe isolation.
 func (tr *Map[K, V]) copy(n *mapNode[K, V]) *mapNode[K, V] {
+	if tr.onCopy != nil {
+		tr.onCopy(n.level())
+	}
 	n2 := new(mapNode[K, V])
 	n2.isoid = tr.isoid
 	n2.count = n.count
@@ -88,7 +233,8 @@ func (tr *Map[K, V]) copy(n *mapNode[K, V]) *mapNode[K, V] {
 	}
 	if !n.leaf() {
 		n2.children = new([]*mapNode[K, V])
-		*n2.children = make([]*mapNode[K, V], len(*n.children), tr.max+1)
+		*n2.children = make([]*mapNode[K, V], len(*n.children),
+			cap(*n.children))
 		copy(*n2.children, *n.children)
 	}
 	return n2
@@ -102,19 +248,120 @@ func (tr *Map[K, V]) isoLoad(cn **mapNode[K, V], mut bool) *mapNode[K, V] {
 	return *cn
 }
 
+// Copy returns a copy of the map, which shares its nodes with the map until
+// either one is changed. The copy changes the map, so unless the map was
+// created by NewMapOptions with locks, it must not be used by any other
+// goroutine during the copy. See ThreadSafeCopy.
 func (tr *Map[K, V]) Copy() *Map[K, V] {
 	return tr.IsoCopy()
 }
 
+// ThreadSafeCopy is like Copy, but holds the write lock of mu during the
+// copy. This is for a map without locks of its own, such as a zero-value
+// map, that is guarded by mu. The copy is not guarded by mu.
+func (tr *Map[K, V]) ThreadSafeCopy(mu *sync.RWMutex) *Map[K, V] {
+	mu.Lock()
+	defer mu.Unlock()
+	return tr.IsoCopy()
+}
+
 func (tr *Map[K, V]) IsoCopy() *Map[K, V] {
+	// A frozen map is never changed, so it can share its nodes without
+	// taking a new isoid.
+	frozen := tr.Frozen()
+	if !frozen {
+		if tr.lock(true) {
+			defer tr.unlock(true)
+		}
+		tr.gen++
+	}
 	tr2 := new(Map[K, V])
 	*tr2 = *tr
+	if tr.mu != nil {
+		tr2.mu = new(sync.RWMutex)
+	}
+	if tr.reentry != nil {
+		tr2.reentry = new(reentryDetector)
+	}
+	tr2.frozen = 0
+	tr2.id = newIsoID()
 	tr2.isoid = newIsoID()
-	tr.isoid = newIsoID()
+	if !frozen {
+		tr.isoid = newIsoID()
+	}
 	return tr2
 }
 
+// ErrFrozen is the panic value for a change to a frozen tree. See Freeze.
+var ErrFrozen = errors.New("btree: tree is frozen")
+
+// Freeze makes the map immutable. Any following change to the map, including
+// the Mut methods and IterMut, panics with ErrFrozen. Reads are not affected,
+// and skip the lock of a map with locks, as there are no writes to wait for.
+// A copy of a frozen map is not frozen.
+func (tr *Map[K, V]) Freeze() {
+	if tr.reentry != nil {
+		tr.reentry.check()
+	}
+	if tr.locks {
+		// Wait for the writes that are in progress.
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+	}
+	atomic.StoreInt32(&tr.frozen, 1)
+}
+
+// Frozen returns true if the map is frozen. See Freeze.
+func (tr *Map[K, V]) Frozen() bool {
+	return atomic.LoadInt32(&tr.frozen) != 0
+}
+
+func (tr *Map[K, V]) lock(write bool) bool {
+	if tr.Frozen() {
+		if write {
+			panic(ErrFrozen)
+		}
+		return false
+	}
+	if write && tr.reentry != nil {
+		tr.reentry.check()
+	}
+	if tr.locks {
+		if write {
+			tr.mu.Lock()
+		} else {
+			tr.mu.RLock()
+		}
+	}
+	return tr.locks
+}
+
+func (tr *Map[K, V]) unlock(write bool) {
+	if write {
+		atomic.StoreInt64(&tr.length, int64(tr.count))
+		tr.mu.Unlock()
+	} else {
+		tr.mu.RUnlock()
+	}
+}
+
+// structureChanged calls the OnStructureChange hook if nodes were created or
+// removed since restructs was read, at the start of the operation.
+func (tr *Map[K, V]) structureChanged(op string, restructs uint64) {
+	if tr.restructs != restructs {
+		tr.onStructure(op)
+	}
+}
+
+// CopyVersioned copies the tree, just like Copy, and also returns the version
+// of the copy. Versions increase each time the tree is copied.
+func (tr *Map[K, V]) CopyVersioned() (snap *Map[K, V], version uint64) {
+	snap = tr.IsoCopy()
+	return snap, snap.gen
+}
+
 func (tr *Map[K, V]) newNode(leaf bool) *mapNode[K, V] {
+	tr.restructs++
 	n := new(mapNode[K, V])
 	n.isoid = tr.isoid
 	if !leaf {
@@ -128,6 +375,15 @@ func (n *mapNode[K, V]) leaf() bool {
 	return n.children == nil
 }
 
+// level returns the number of levels below the node.
+func (n *mapNode[K, V]) level() int {
+	var level int
+	for ; !n.leaf(); n = (*n.children)[0] {
+		level++
+	}
+	return level
+}
+
 func (tr *Map[K, V]) search(n *mapNode[K, V], key K) (index int, found bool) {
 	low, high := 0, len(n.items)
 	for low < high {
@@ -144,38 +400,258 @@ func (tr *Map[K, V]) search(n *mapNode[K, V], key K) (index int, found bool) {
 	return low, false
 }
 
+func (tr *Map[K, V]) find(n *mapNode[K, V], key K, hint *PathHint,
+	depth int,
+) (index int, found bool) {
+	if hint == nil {
+		return tr.search(n, key)
+	}
+	return tr.searchHint(n, key, hint, depth)
+}
+
+// searchHint is search using a path hint. See BTreeG.hintsearch.
+func (tr *Map[K, V]) searchHint(n *mapNode[K, V], key K, hint *PathHint,
+	depth int,
+) (index int, found bool) {
+	low := 0
+	high := len(n.items) - 1
+	if hint.owner != tr.id {
+		if hint.owner != 0 {
+			// The hint belongs to another map, and its path is of no use.
+			return tr.search(n, key)
+		}
+		hint.owner = tr.id
+	}
+	used, path := hint.level(depth)
+	if used != nil && *used {
+		index = int(*path)
+		if index >= len(n.items) {
+			// tail item
+			if n.items[len(n.items)-1].key < key {
+				index = len(n.items)
+				goto path_match
+			}
+			index = len(n.items) - 1
+		}
+		if key < n.items[index].key {
+			if index == 0 || n.items[index-1].key < key {
+				goto path_match
+			}
+			high = index - 1
+		} else if n.items[index].key < key {
+			low = index + 1
+		} else {
+			found = true
+			goto path_match
+		}
+	}
+	for low <= high {
+		mid := low + ((high+1)-low)/2
+		if !(key < n.items[mid].key) {
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+	if low > 0 && !(n.items[low-1].key < key) {
+		index = low - 1
+		found = true
+	} else {
+		index = low
+		found = false
+	}
+
+path_match:
+	if used != nil {
+		*used = true
+		var pathIndex uint8
+		if n.leaf() && found {
+			pathIndex = uint8(index + 1)
+		} else {
+			pathIndex = uint8(index)
+		}
+		if pathIndex != *path {
+			*path = pathIndex
+			hint.unuse(depth + 1)
+		}
+	}
+	return index, found
+}
+
+// ResetHint clears the path of the hint and binds it to the map. See
+// PathHint.
+func (tr *Map[K, V]) ResetHint(hint *PathHint) {
+	hint.unuse(0)
+	hint.owner = tr.id
+}
+
 func (tr *Map[K, V]) init(degree int) {
-	if tr.min != 0 {
+	min, max := degreeToMinMax(degree)
+	if !beginInit(&tr.initState) {
 		return
 	}
-	tr.min, tr.max = degreeToMinMax(degree)
+	tr.id = newIsoID()
+	tr.configure(min, max)
+	endInit(&tr.initState)
+}
+
+// configure sets the node sizes and detects if the values implement the
+// Copy or IsoCopy methods.
+func (tr *Map[K, V]) configure(min, max int) {
+	tr.min, tr.max = min, max
 	_, tr.copyValues = ((interface{})(tr.empty.value)).(copier[V])
+	tr.isoCopyValues = false
 	if !tr.copyValues {
 		_, tr.isoCopyValues = ((interface{})(tr.empty.value)).(isoCopier[V])
 	}
 }
 
+// ErrNotEmpty is returned by Reinit when the map is not empty.
+var ErrNotEmpty = errors.New("btree: map is not empty")
+
+// Reinit initializes an empty map again using the provided degree, like
+// NewMap. This restores the node sizes, and the detection of values that
+// implement Copy or IsoCopy, for a map that was reconstructed without using
+// a constructor. The other options of the map are kept.
+// Returns ErrNotEmpty if the map is not empty.
+func (tr *Map[K, V]) Reinit(degree int) error {
+	min, max := degreeToMinMax(degree)
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.count != 0 {
+		return ErrNotEmpty
+	}
+	tr.configure(min, max)
+	atomic.StoreInt32(&tr.initState, initStateDone)
+	return nil
+}
+
 // Set or replace a value for a key
+// Panics with ErrNaNKey if the key is NaN and the map was created with the
+// RejectNaN option.
 func (tr *Map[K, V]) Set(key K, value V) (V, bool) {
+	if tr.rejectNaN && key != key {
+		panic(ErrNaNKey)
+	}
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("Set", tr.restructs)
+	}
+	prev, replaced := tr.set(key, value)
+	if tr.maxLen > 0 {
+		tr.evict()
+	}
+	return prev, replaced
+}
+
+// SetE is like Set but returns ErrNaNKey, rather than panicking, if the key is
+// NaN and the map was created with the RejectNaN option.
+func (tr *Map[K, V]) SetE(key K, value V) (V, bool, error) {
+	if tr.rejectNaN && key != key {
+		return tr.empty.value, false, ErrNaNKey
+	}
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("SetE", tr.restructs)
+	}
+	prev, replaced := tr.set(key, value)
+	if tr.maxLen > 0 {
+		tr.evict()
+	}
+	return prev, replaced, nil
+}
+
+// SetEvict is like Set, but also returns the item that was evicted, if any,
+// when the map was created with the MaxLen option. See BTreeG.SetEvict.
+func (tr *Map[K, V]) SetEvict(key K, value V) (evictedKey K,
+	evictedValue V, hadEviction bool, prev V, replaced bool,
+) {
+	if tr.rejectNaN && key != key {
+		panic(ErrNaNKey)
+	}
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("SetEvict", tr.restructs)
+	}
+	prev, replaced = tr.set(key, value)
+	evictedKey, evictedValue, hadEviction = tr.evict()
+	return evictedKey, evictedValue, hadEviction, prev, replaced
+}
+
+// SetWith is like Set, but calls onReplace with the previous value when the
+// key already existed, while the map is still locked. It's not called when
+// the key is new. The map must not be modified from within onReplace.
+func (tr *Map[K, V]) SetWith(key K, value V, onReplace func(old V)) {
+	if tr.rejectNaN && key != key {
+		panic(ErrNaNKey)
+	}
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("SetWith", tr.restructs)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	prev, replaced := tr.set(key, value)
+	if tr.maxLen > 0 {
+		tr.evict()
+	}
+	if replaced {
+		onReplace(prev)
+	}
+}
+
+// evict deletes an item, chosen by the evict policy, if the map has more
+// than maxLen items.
+func (tr *Map[K, V]) evict() (K, V, bool) {
+	if tr.maxLen == 0 || tr.count <= tr.maxLen {
+		return tr.empty.key, tr.empty.value, false
+	}
+	if tr.evictPolicy == EvictMax {
+		return tr.popMax()
+	}
+	return tr.popMin()
+}
+
+func (tr *Map[K, V]) set(key K, value V) (V, bool) {
+	return tr.setHint(key, value, nil)
+}
+
+func (tr *Map[K, V]) setHint(key K, value V, hint *PathHint) (V, bool) {
 	item := mapPair[K, V]{key: key, value: value}
 	if tr.root == nil {
 		tr.init(0)
 		tr.root = tr.newNode(true)
-		tr.root.items = append([]mapPair[K, V]{}, item)
+		tr.root.items = append(make([]mapPair[K, V], 0, tr.capacity),
+			item)
 		tr.root.count = 1
 		tr.count = 1
 		return tr.empty.value, false
 	}
-	prev, replaced, split := tr.nodeSet(&tr.root, item)
+	if tr.max == 0 {
+		// The tree has items but was never initialized. This only happens
+		// when the first writes to a zero-value Map raced each other.
+		panic("btree: map is corrupt, concurrent first write detected")
+	}
+	prev, replaced, split := tr.nodeSet(&tr.root, item, hint, 0)
 	if split {
 		left := tr.root
 		right, median := tr.nodeSplit(left)
 		tr.root = tr.newNode(false)
-		*tr.root.children = make([]*mapNode[K, V], 0, tr.max+1)
 		*tr.root.children = append([]*mapNode[K, V]{}, left, right)
 		tr.root.items = append([]mapPair[K, V]{}, median)
 		tr.root.updateCount()
-		return tr.Set(item.key, item.value)
+		return tr.setHint(item.key, item.value, hint)
 	}
 	if replaced {
 		return prev, true
@@ -217,9 +693,10 @@ func (n *mapNode[K, V]) updateCount() {
 }
 
 func (tr *Map[K, V]) nodeSet(pn **mapNode[K, V], item mapPair[K, V],
+	hint *PathHint, depth int,
 ) (prev V, replaced bool, split bool) {
 	n := tr.isoLoad(pn, true)
-	i, found := tr.search(n, item.key)
+	i, found := tr.find(n, item.key, hint, depth)
 	if found {
 		prev = n.items[i].value
 		n.items[i] = item
@@ -235,7 +712,8 @@ func (tr *Map[K, V]) nodeSet(pn **mapNode[K, V], item mapPair[K, V],
 		n.count++
 		return tr.empty.value, false, false
 	}
-	prev, replaced, split = tr.nodeSet(&(*n.children)[i], item)
+	prev, replaced, split = tr.nodeSet(&(*n.children)[i], item, hint,
+		depth+1)
 	if split {
 		if len(n.items) == tr.max {
 			return tr.empty.value, false, true
@@ -247,7 +725,7 @@ func (tr *Map[K, V]) nodeSet(pn **mapNode[K, V], item mapPair[K, V],
 		n.items = append(n.items, tr.empty)
 		copy(n.items[i+1:], n.items[i:])
 		n.items[i] = median
-		return tr.nodeSet(&n, item)
+		return tr.nodeSet(&n, item, hint, depth)
 	}
 	if !replaced {
 		n.count++
@@ -263,7 +741,203 @@ func (tr *Map[K, V]) ScanMut(iter func(key K, value V) bool) {
 	tr.scan(iter, true)
 }
 
+// ScanN is like Scan, but stops after limit items. Nothing is visited if
+// limit is zero or less.
+func (tr *Map[K, V]) ScanN(limit int, iter func(key K, value V) bool) {
+	var count int
+	if limit > 0 {
+		tr.scan(mapIterN(limit, iter, &count), false)
+	}
+}
+
+// ScanE is like Scan, but the iterator may also return an error, which stops
+// the iteration and is returned by ScanE.
+func (tr *Map[K, V]) ScanE(iter func(key K, value V) (bool, error)) error {
+	return tr.scanE(iter, false)
+}
+
+// ScanMutE is like ScanMut, but the iterator may also return an error, which
+// stops the iteration and is returned by ScanMutE.
+func (tr *Map[K, V]) ScanMutE(iter func(key K, value V) (bool, error)) error {
+	return tr.scanE(iter, true)
+}
+
+func (tr *Map[K, V]) scanE(iter func(key K, value V) (bool, error), mut bool,
+) error {
+	var err error
+	tr.scan(mapIterE(iter, &err), mut)
+	return err
+}
+
+// ScanBatch visits all items in ascending order, in batches of batchSize
+// items, except for the last batch, which may be smaller. The keys and values
+// slices are reused for every batch, so they must not be retained after iter
+// returns.
+// Return false to stop iterating.
+func (tr *Map[K, V]) ScanBatch(batchSize int,
+	iter func(keys []K, values []V) bool,
+) {
+	if batchSize < 1 {
+		panic("btree: batch size must be positive")
+	}
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root == nil {
+		return
+	}
+	size := batchSize
+	if size > tr.count {
+		size = tr.count
+	}
+	keys, values := make([]K, 0, size), make([]V, 0, size)
+	ok := tr.root.walk(func(items []mapPair[K, V]) bool {
+		for len(items) > 0 {
+			n := batchSize - len(keys)
+			if n > len(items) {
+				n = len(items)
+			}
+			for _, item := range items[:n] {
+				keys = append(keys, item.key)
+				values = append(values, item.value)
+			}
+			items = items[n:]
+			if len(keys) == batchSize {
+				if !iter(keys, values) {
+					return false
+				}
+				keys, values = keys[:0], values[:0]
+			}
+		}
+		return true
+	})
+	if ok && len(keys) > 0 {
+		iter(keys, values)
+	}
+}
+
+// walk passes the items of the nodes to iter in ascending order, where the
+// items of a leaf are passed together, and the items of a branch are passed
+// one at a time, between the items of its children.
+func (n *mapNode[K, V]) walk(iter func(items []mapPair[K, V]) bool) bool {
+	if n.leaf() {
+		return iter(n.items)
+	}
+	for i := 0; i < len(n.items); i++ {
+		if !(*n.children)[i].walk(iter) || !iter(n.items[i:i+1]) {
+			return false
+		}
+	}
+	return (*n.children)[len(n.items)].walk(iter)
+}
+
+// Enumerate visits all items in ascending order, passing each item with its
+// index, which is counted up from start.
+// Return false to stop iterating.
+func (tr *Map[K, V]) Enumerate(start int,
+	iter func(index int, key K, value V) bool,
+) {
+	index := start
+	tr.Scan(func(key K, value V) bool {
+		index++
+		return iter(index-1, key, value)
+	})
+}
+
+// ScanLimit visits at most limit items in ascending order, starting with the
+// first item that is greater-or-equal-to the resume key, or with the first
+// item when resume is nil. It returns the key to resume from, or done when
+// there are no more items or the iterator returned false.
+//
+// Unlike Scan, the tree is only locked while each chunk of items is visited,
+// allowing writers to make changes between calls. Each call visits the items
+// that are greater-or-equal-to the resume key at the time of the call.
+func (tr *Map[K, V]) ScanLimit(limit int, resume *K,
+	iter func(key K, value V) bool,
+) (next *K, done bool) {
+	if limit < 1 {
+		panic("btree: limit must be positive")
+	}
+	var n int
+	chunk := func(key K, value V) bool {
+		if n == limit {
+			next = &key
+			return false
+		}
+		n++
+		return iter(key, value)
+	}
+	if resume == nil {
+		tr.Scan(chunk)
+	} else {
+		tr.Ascend(*resume, chunk)
+	}
+	return next, next == nil
+}
+
+// mapIterE adapts an iterator that may return an error for the iterating
+// functions. The error is stored in err, and stops the iteration.
+func mapIterE[K ordered, V any](iter func(key K, value V) (bool, error),
+	err *error,
+) func(key K, value V) bool {
+	return func(key K, value V) bool {
+		var ok bool
+		ok, *err = iter(key, value)
+		return ok && *err == nil
+	}
+}
+
+// mapIterContext adapts an iterator for the Context iterating functions.
+// See iterContext.
+func mapIterContext[K ordered, V any](ctx context.Context,
+	iter func(key K, value V) bool, err *error,
+) func(key K, value V) bool {
+	var n int
+	return func(key K, value V) bool {
+		if n++; n%contextCheckInterval == 0 {
+			if *err = ctx.Err(); *err != nil {
+				return false
+			}
+		}
+		return iter(key, value)
+	}
+}
+
+// mapIterN adapts an iterator for the N iterating functions. See iterN.
+func mapIterN[K ordered, V any](n int, iter func(key K, value V) bool,
+	count *int,
+) func(key K, value V) bool {
+	return func(key K, value V) bool {
+		*count++
+		return iter(key, value) && *count < n
+	}
+}
+
+// ScanContext is like Scan, but stops early when ctx is cancelled, returning
+// ctx.Err(). The context is checked before the first item, and then once
+// every 64 items.
+func (tr *Map[K, V]) ScanContext(ctx context.Context,
+	iter func(key K, value V) bool,
+) error {
+	err := ctx.Err()
+	if err == nil {
+		tr.scan(mapIterContext(ctx, iter, &err), false)
+	}
+	return err
+}
+
 func (tr *Map[K, V]) scan(iter func(key K, value V) bool, mut bool) {
+	if tr.lock(mut) {
+		defer tr.unlock(mut)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
 	if tr.root == nil {
 		return
 	}
@@ -293,6 +967,67 @@ func (tr *Map[K, V]) nodeScan(cn **mapNode[K, V],
 	return tr.nodeScan(&(*n.children)[len(*n.children)-1], iter, mut)
 }
 
+// ScanMutIf visits all items in ascending order, passing a pointer to a copy
+// of each value. The value is only stored in the map when the iterator
+// returns true.
+//
+// Unlike ScanMut, which copies every node that is still shared with a copy
+// of the map, a node is only copied when one of its values is written. This
+// keeps the memory used by a selective update of a copied map proportional
+// to the number of nodes that are actually changed.
+func (tr *Map[K, V]) ScanMutIf(iter func(key K, value *V) (write bool)) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root == nil {
+		return
+	}
+	tr.nodeScanMutIf(tr.root, nil, iter)
+}
+
+// nodeScanMutIf scans the node at path, which is only copied once one of its
+// values, or a value of one of its descendants, is written.
+func (tr *Map[K, V]) nodeScanMutIf(n *mapNode[K, V], path []int,
+	iter func(key K, value *V) bool,
+) {
+	for i := 0; ; i++ {
+		if !n.leaf() {
+			tr.nodeScanMutIf((*n.children)[i], append(path, i), iter)
+			if n.isoid != tr.isoid {
+				// A write to a descendant may have copied this node.
+				n = tr.nodeAtPath(path, false)
+			}
+		}
+		if i == len(n.items) {
+			return
+		}
+		value := n.items[i].value
+		if tr.isoCopyValues && n.isoid != tr.isoid {
+			value = ((interface{})(value)).(isoCopier[V]).IsoCopy()
+		}
+		if iter(n.items[i].key, &value) {
+			if n.isoid != tr.isoid {
+				n = tr.nodeAtPath(path, true)
+			}
+			n.items[i].value = value
+		}
+	}
+}
+
+// nodeAtPath returns the node at the path of child indexes from the root,
+// copying the nodes along the path when mut is true.
+func (tr *Map[K, V]) nodeAtPath(path []int, mut bool) *mapNode[K, V] {
+	n := tr.isoLoad(&tr.root, mut)
+	for _, i := range path {
+		n = tr.isoLoad(&(*n.children)[i], mut)
+	}
+	return n
+}
+
 // Get a value for key.
 func (tr *Map[K, V]) Get(key K) (V, bool) {
 	return tr.get(key, false)
@@ -313,49 +1048,354 @@ func (tr *Map[K, V]) GetMut(key K) (V, bool) {
 	return tr.get(key, true)
 }
 
+// MultiGet returns the values for keys, along with whether each key was
+// found, in the same order as keys. The keys are looked up in sorted order,
+// in a single descent of the tree, so that nearby keys share the search of
+// the upper nodes. The keys slice is not modified, and may have duplicates.
+func (tr *Map[K, V]) MultiGet(keys []K) ([]V, []bool) {
+	values := make([]V, len(keys))
+	found := make([]bool, len(keys))
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return keys[order[i]] < keys[order[j]]
+	})
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.root != nil {
+		tr.nodeMultiGet(tr.root, keys, order, values, found)
+	}
+	return values, found
+}
+
+// nodeMultiGet looks up the keys at the sorted indexes in order, which are
+// all within the range of the node.
+func (tr *Map[K, V]) nodeMultiGet(n *mapNode[K, V], keys []K, order []int,
+	values []V, found []bool,
+) {
+	var lo int
+	for len(order) > 0 {
+		// The keys are sorted, so each search starts where the last one
+		// ended.
+		key := keys[order[0]]
+		i, high := lo, len(n.items)
+		for i < high {
+			h := (i + high) / 2
+			if !(key < n.items[h].key) {
+				i = h + 1
+			} else {
+				high = h
+			}
+		}
+		if i > 0 && !(n.items[i-1].key < key) {
+			values[order[0]], found[order[0]] = n.items[i-1].value, true
+			order = order[1:]
+			lo = i - 1
+			continue
+		}
+		lo = i
+		if n.leaf() {
+			order = order[1:]
+			continue
+		}
+		// Pass down all the keys that belong to the same child.
+		j := 1
+		if i < len(n.items) {
+			for j < len(order) && keys[order[j]] < n.items[i].key {
+				j++
+			}
+		} else {
+			j = len(order)
+		}
+		tr.nodeMultiGet((*n.children)[i], keys, order[:j], values, found)
+		order = order[j:]
+	}
+}
+
+// GetOr returns the value for key, or def if the key is not found.
+func (tr *Map[K, V]) GetOr(key K, def V) V {
+	if value, ok := tr.get(key, false); ok {
+		return value
+	}
+	return def
+}
+
+// GetOrFunc returns the value for key, or the result of def if the key is
+// not found. The def function is only called when needed, and after the map
+// is unlocked.
+func (tr *Map[K, V]) GetOrFunc(key K, def func() V) V {
+	if value, ok := tr.get(key, false); ok {
+		return value
+	}
+	return def()
+}
+
 func (tr *Map[K, V]) get(key K, mut bool) (V, bool) {
+	return tr.getHint(key, nil, mut)
+}
+
+func (tr *Map[K, V]) getHint(key K, hint *PathHint, mut bool) (V, bool) {
+	if tr.lock(mut) {
+		defer tr.unlock(mut)
+	}
 	if tr.root == nil {
 		return tr.empty.value, false
 	}
-	n := tr.isoLoad(&tr.root, mut)
-	for {
-		i, found := tr.search(n, key)
+	// Search without copying, so that a missing key never performs a
+	// copy-on-write of the path. The path is only copied if the key is found
+	// in, or under, a node that is shared with another tree.
+	var shared bool
+	n := tr.root
+	for depth := 0; ; depth++ {
+		if mut && n.isoid != tr.isoid {
+			shared = true
+		}
+		i, found := tr.find(n, key, hint, depth)
 		if found {
+			if shared {
+				return tr.isoGet(key, hint)
+			}
 			return n.items[i].value, true
 		}
 		if n.leaf() {
 			return tr.empty.value, false
 		}
-		n = tr.isoLoad(&(*n.children)[i], mut)
+		n = (*n.children)[i]
+	}
+}
+
+// ApplyFunc calls f with a pointer to the value for key, allowing the value to
+// be modified in place using a single search of the tree. The exists argument
+// is false if the key was not found, in which case f is given a pointer to a
+// zero value, and that value is inserted after f returns.
+//
+// The pointer is only valid until f returns. The tree must not be modified
+// from within f.
+func (tr *Map[K, V]) ApplyFunc(key K, f func(value *V, exists bool)) {
+	if tr.rejectNaN && key != key {
+		panic(ErrNaNKey)
+	}
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("ApplyFunc", tr.restructs)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root != nil {
+		n := tr.isoLoad(&tr.root, true)
+		for {
+			i, found := tr.search(n, key)
+			if found {
+				f(&n.items[i].value, true)
+				return
+			}
+			if n.leaf() {
+				break
+			}
+			n = tr.isoLoad(&(*n.children)[i], true)
+		}
+	}
+	value := tr.empty.value
+	f(&value, false)
+	tr.set(key, value)
+	if tr.maxLen > 0 {
+		tr.evict()
+	}
+}
+
+// CompareAndSwap replaces the value for key with new, only if the key exists
+// and eq reports that its current value is equal to old. Returns true if the
+// value was replaced. The search and the swap happen while the map is
+// locked. The map must not be modified from within eq.
+func (tr *Map[K, V]) CompareAndSwap(key K, old, new V, eq func(a, b V) bool,
+) bool {
+	if tr.rejectNaN && key != key {
+		panic(ErrNaNKey)
+	}
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root == nil {
+		return false
+	}
+	// Search without copying, like getHint, so that only a swap performs a
+	// copy-on-write of the path.
+	var shared bool
+	n := tr.root
+	for {
+		if n.isoid != tr.isoid {
+			shared = true
+		}
+		i, found := tr.search(n, key)
+		if found {
+			if !eq(n.items[i].value, old) {
+				return false
+			}
+			if shared {
+				n = tr.isoLoad(&tr.root, true)
+				for i, found = tr.search(n, key); !found; {
+					n = tr.isoLoad(&(*n.children)[i], true)
+					i, found = tr.search(n, key)
+				}
+			}
+			n.items[i].value = new
+			return true
+		}
+		if n.leaf() {
+			return false
+		}
+		n = (*n.children)[i]
+	}
+}
+
+// isoGet returns the value for an existing key, copying the path to the key.
+func (tr *Map[K, V]) isoGet(key K, hint *PathHint) (V, bool) {
+	n := tr.isoLoad(&tr.root, true)
+	for depth := 0; ; depth++ {
+		i, found := tr.find(n, key, hint, depth)
+		if found {
+			return n.items[i].value, true
+		}
+		n = tr.isoLoad(&(*n.children)[i], true)
 	}
 }
 
 // Len returns the number of items in the tree
 func (tr *Map[K, V]) Len() int {
+	if tr.locks {
+		// Writers store the count when releasing the lock, so it can be
+		// read without taking the lock.
+		return int(atomic.LoadInt64(&tr.length))
+	}
 	return tr.count
 }
 
+// IsEmpty returns true if the map has no items. Like Len, it does not take
+// the lock.
+func (tr *Map[K, V]) IsEmpty() bool {
+	return tr.Len() == 0
+}
+
 // Delete a value for a key and returns the deleted value.
 // Returns false if there was no value by that key found.
 func (tr *Map[K, V]) Delete(key K) (V, bool) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("Delete", tr.restructs)
+	}
+	return tr.deleteKey(key)
+}
+
+// DeleteAndNeighbors deletes the value for a key, like Delete, and returns
+// the items that were before and after the key, which are its neighbors after
+// the deletion. The neighbors are found along the search path of the key,
+// and the map is locked once.
+// Returns false for deleted, and no neighbors, if the key was not found.
+func (tr *Map[K, V]) DeleteAndNeighbors(key K) (prevKey K, prevValue V,
+	hasPrev bool, nextKey K, nextValue V, hasNext bool, deleted bool,
+) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("DeleteAndNeighbors", tr.restructs)
+	}
+	prev, next, hasPrev, hasNext, found := tr.neighbors(key)
+	if !found {
+		return tr.empty.key, tr.empty.value, false, tr.empty.key,
+			tr.empty.value, false, false
+	}
+	tr.deleteKey(key)
+	return prev.key, prev.value, hasPrev, next.key, next.value, hasNext, true
+}
+
+// neighbors returns the items that are before and after key, without
+// copying, if the key exists.
+func (tr *Map[K, V]) neighbors(key K) (prev, next mapPair[K, V], hasPrev,
+	hasNext, found bool,
+) {
+	n := tr.root
+	for n != nil {
+		var i int
+		i, found = tr.search(n, key)
+		if found {
+			if n.leaf() {
+				if i > 0 {
+					prev, hasPrev = n.items[i-1], true
+				}
+				if i < len(n.items)-1 {
+					next, hasNext = n.items[i+1], true
+				}
+				return prev, next, hasPrev, hasNext, true
+			}
+			// The neighbors are the max of the left child and the min of
+			// the right child.
+			c := (*n.children)[i]
+			for !c.leaf() {
+				c = (*c.children)[len(*c.children)-1]
+			}
+			prev, hasPrev = c.items[len(c.items)-1], true
+			c = (*n.children)[i+1]
+			for !c.leaf() {
+				c = (*c.children)[0]
+			}
+			next, hasNext = c.items[0], true
+			return prev, next, hasPrev, hasNext, true
+		}
+		if n.leaf() {
+			break
+		}
+		// The items around the child are the nearest neighbors so far.
+		if i > 0 {
+			prev, hasPrev = n.items[i-1], true
+		}
+		if i < len(n.items) {
+			next, hasNext = n.items[i], true
+		}
+		n = (*n.children)[i]
+	}
+	return tr.empty, tr.empty, false, false, false
+}
+
+func (tr *Map[K, V]) deleteKey(key K) (V, bool) {
+	return tr.deleteHint(key, nil)
+}
+
+func (tr *Map[K, V]) deleteHint(key K, hint *PathHint) (V, bool) {
 	if tr.root == nil {
 		return tr.empty.value, false
 	}
-	prev, deleted := tr.delete(&tr.root, false, key)
+	prev, deleted := tr.delete(&tr.root, false, key, hint, 0)
 	if !deleted {
 		return tr.empty.value, false
 	}
 	if len(tr.root.items) == 0 && !tr.root.leaf() {
 		tr.root = (*tr.root.children)[0]
+		tr.restructs++
 	}
 	tr.count--
 	if tr.count == 0 {
 		tr.root = nil
+		tr.restructs++
 	}
 	return prev.value, true
 }
 
 func (tr *Map[K, V]) delete(pn **mapNode[K, V], max bool, key K,
+	hint *PathHint, depth int,
 ) (mapPair[K, V], bool) {
 	n := tr.isoLoad(pn, true)
 	var i int
@@ -363,7 +1403,7 @@ func (tr *Map[K, V]) delete(pn **mapNode[K, V], max bool, key K,
 	if max {
 		i, found = len(n.items)-1, true
 	} else {
-		i, found = tr.search(n, key)
+		i, found = tr.find(n, key, hint, depth)
 	}
 	if n.leaf() {
 		if found {
@@ -383,15 +1423,17 @@ func (tr *Map[K, V]) delete(pn **mapNode[K, V], max bool, key K,
 	if found {
 		if max {
 			i++
-			prev, deleted = tr.delete(&(*n.children)[i], true, tr.empty.key)
+			prev, deleted = tr.delete(&(*n.children)[i], true, tr.empty.key,
+				nil, 0)
 		} else {
 			prev = n.items[i]
-			maxItem, _ := tr.delete(&(*n.children)[i], true, tr.empty.key)
+			maxItem, _ := tr.delete(&(*n.children)[i], true, tr.empty.key,
+				nil, 0)
 			deleted = true
 			n.items[i] = maxItem
 		}
 	} else {
-		prev, deleted = tr.delete(&(*n.children)[i], max, key)
+		prev, deleted = tr.delete(&(*n.children)[i], max, key, hint, depth+1)
 	}
 	if !deleted {
 		return tr.empty, false
@@ -422,6 +1464,7 @@ func (tr *Map[K, V]) nodeRebalance(n *mapNode[K, V], i int) {
 		// following items and child nodes to the left by one slot.
 
 		// merge (left,item,right)
+		tr.restructs++
 		left.items = append(left.items, n.items[i])
 		left.items = append(left.items, right.items...)
 		if !left.leaf() {
@@ -497,7 +1540,63 @@ func (tr *Map[K, V]) AscendMut(pivot K, iter func(key K, value V) bool) {
 	tr.ascend(pivot, iter, true)
 }
 
+// AscendE is like Ascend, but the iterator may also return an error, which
+// stops the iteration and is returned by AscendE.
+func (tr *Map[K, V]) AscendE(pivot K,
+	iter func(key K, value V) (bool, error),
+) error {
+	var err error
+	tr.ascend(pivot, mapIterE(iter, &err), false)
+	return err
+}
+
+// AscendContext is like Ascend, but stops early when ctx is cancelled,
+// returning ctx.Err(). See ScanContext.
+func (tr *Map[K, V]) AscendContext(ctx context.Context, pivot K,
+	iter func(key K, value V) bool,
+) error {
+	err := ctx.Err()
+	if err == nil {
+		tr.ascend(pivot, mapIterContext(ctx, iter, &err), false)
+	}
+	return err
+}
+
+// AscendN is like Ascend, but stops after n items, and returns the number of
+// items visited. Nothing is visited if n is zero or less.
+func (tr *Map[K, V]) AscendN(pivot K, n int, iter func(key K, value V) bool,
+) int {
+	var count int
+	if n > 0 {
+		tr.ascend(pivot, mapIterN(n, iter, &count), false)
+	}
+	return count
+}
+
+// AscendPrefix calls iter, in ascending order, for each key in a map with
+// string keys that starts with prefix. The iteration starts at the first key
+// that is greater-or-equal-to prefix, and stops at the first key that does
+// not start with prefix.
+// Return false from iter to stop iterating.
+func AscendPrefix[K ~string, V any](tr *Map[K, V], prefix K,
+	iter func(key K, value V) bool,
+) {
+	tr.ascend(prefix, func(key K, value V) bool {
+		if !strings.HasPrefix(string(key), string(prefix)) {
+			return false
+		}
+		return iter(key, value)
+	}, false)
+}
+
 func (tr *Map[K, V]) ascend(pivot K, iter func(key K, value V) bool, mut bool) {
+	if tr.lock(mut) {
+		defer tr.unlock(mut)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
 	if tr.root == nil {
 		return
 	}
@@ -543,7 +1642,26 @@ func (tr *Map[K, V]) ReverseMut(iter func(key K, value V) bool) {
 	tr.reverse(iter, true)
 }
 
+// ReverseContext is like Reverse, but stops early when ctx is cancelled,
+// returning ctx.Err(). See ScanContext.
+func (tr *Map[K, V]) ReverseContext(ctx context.Context,
+	iter func(key K, value V) bool,
+) error {
+	err := ctx.Err()
+	if err == nil {
+		tr.reverse(mapIterContext(ctx, iter, &err), false)
+	}
+	return err
+}
+
 func (tr *Map[K, V]) reverse(iter func(key K, value V) bool, mut bool) {
+	if tr.lock(mut) {
+		defer tr.unlock(mut)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
 	if tr.root == nil {
 		return
 	}
@@ -587,11 +1705,51 @@ func (tr *Map[K, V]) DescendMut(pivot K, iter func(key K, value V) bool) {
 	tr.descend(pivot, iter, true)
 }
 
+// DescendE is like Descend, but the iterator may also return an error, which
+// stops the iteration and is returned by DescendE.
+func (tr *Map[K, V]) DescendE(pivot K,
+	iter func(key K, value V) (bool, error),
+) error {
+	var err error
+	tr.descend(pivot, mapIterE(iter, &err), false)
+	return err
+}
+
+// DescendContext is like Descend, but stops early when ctx is cancelled,
+// returning ctx.Err(). See ScanContext.
+func (tr *Map[K, V]) DescendContext(ctx context.Context, pivot K,
+	iter func(key K, value V) bool,
+) error {
+	err := ctx.Err()
+	if err == nil {
+		tr.descend(pivot, mapIterContext(ctx, iter, &err), false)
+	}
+	return err
+}
+
+// DescendN is like Descend, but stops after n items, and returns the number
+// of items visited. Nothing is visited if n is zero or less.
+func (tr *Map[K, V]) DescendN(pivot K, n int, iter func(key K, value V) bool,
+) int {
+	var count int
+	if n > 0 {
+		tr.descend(pivot, mapIterN(n, iter, &count), false)
+	}
+	return count
+}
+
 func (tr *Map[K, V]) descend(
 	pivot K,
 	iter func(key K, value V) bool,
 	mut bool,
 ) {
+	if tr.lock(mut) {
+		defer tr.unlock(mut)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
 	if tr.root == nil {
 		return
 	}
@@ -625,21 +1783,42 @@ func (tr *Map[K, V]) nodeDescend(cn **mapNode[K, V], pivot K,
 }
 
 // Load is for bulk loading pre-sorted items
+// Panics with ErrNaNKey if the key is NaN and the map was created with the
+// RejectNaN option.
 func (tr *Map[K, V]) Load(key K, value V) (V, bool) {
+	if tr.rejectNaN && key != key {
+		panic(ErrNaNKey)
+	}
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("Load", tr.restructs)
+	}
+	prev, replaced := tr.load(key, value)
+	if tr.maxLen > 0 {
+		tr.evict()
+	}
+	return prev, replaced
+}
+
+func (tr *Map[K, V]) load(key K, value V) (V, bool) {
 	item := mapPair[K, V]{key: key, value: value}
 	if tr.root == nil {
-		return tr.Set(item.key, item.value)
+		return tr.set(item.key, item.value)
 	}
 	n := tr.isoLoad(&tr.root, true)
+	var full bool
 	for {
 		n.count++ // optimistically update counts
 		if n.leaf() {
-			if len(n.items) < tr.max {
-				if n.items[len(n.items)-1].key < item.key {
+			if n.items[len(n.items)-1].key < item.key {
+				if len(n.items) < tr.max {
 					n.items = append(n.items, item)
 					tr.count++
 					return tr.empty.value, false
 				}
+				full = true
 			}
 			break
 		}
@@ -654,7 +1833,114 @@ func (tr *Map[K, V]) Load(key K, value V) (V, bool) {
 		}
 		n = (*n.children)[len(*n.children)-1]
 	}
-	return tr.Set(item.key, item.value)
+	if full {
+		// The item is greater than all other items, but the rightmost leaf
+		// is full.
+		tr.appendSplit(item)
+		return tr.empty.value, false
+	}
+	return tr.set(item.key, item.value)
+}
+
+// appendSplit adds an item that is greater than all other items to a tree
+// where the rightmost leaf is full.
+//
+// Rather than splitting the full nodes on the right spine in half, which
+// would leave the nodes behind the right spine half empty forever when items
+// are loaded in order, each full node keeps all but its last item, and the
+// new right node starts out with just one item. This means the nodes on the
+// right spine may have fewer than the minimum number of items, but the nodes
+// behind it are nearly full. The map is then marked as sparseRight, which
+// is the only case where Sane allows it.
+func (tr *Map[K, V]) appendSplit(item mapPair[K, V]) {
+	tr.sparseRight = true
+	right, median, split := tr.nodeAppend(tr.isoLoad(&tr.root, true), item)
+	if split {
+		left := tr.root
+		tr.root = tr.newNode(false)
+		*tr.root.children = append([]*mapNode[K, V]{}, left, right)
+		tr.root.items = append([]mapPair[K, V]{}, median)
+		tr.root.updateCount()
+	}
+	tr.count++
+}
+
+func (tr *Map[K, V]) nodeAppend(n *mapNode[K, V], item mapPair[K, V],
+) (right *mapNode[K, V], median mapPair[K, V], split bool) {
+	if n.leaf() {
+		if len(n.items) < tr.max {
+			n.items = append(n.items, item)
+			n.count++
+			return nil, tr.empty, false
+		}
+		median = n.items[len(n.items)-1]
+		n.items[len(n.items)-1] = tr.empty
+		n.items = n.items[:len(n.items)-1]
+		right = tr.newNode(true)
+		right.items = append([]mapPair[K, V]{}, item)
+		n.updateCount()
+		right.updateCount()
+		return right, median, true
+	}
+	child := tr.isoLoad(&(*n.children)[len(*n.children)-1], true)
+	cright, cmedian, split := tr.nodeAppend(child, item)
+	if !split {
+		n.count++
+		return nil, tr.empty, false
+	}
+	if len(n.items) < tr.max {
+		n.items = append(n.items, cmedian)
+		*n.children = append(*n.children, cright)
+		n.count++
+		return nil, tr.empty, false
+	}
+	// The node is full. Move its last item up and its last child, which is
+	// the child that was just split, to the new right node.
+	median = n.items[len(n.items)-1]
+	n.items[len(n.items)-1] = tr.empty
+	n.items = n.items[:len(n.items)-1]
+	(*n.children)[len(*n.children)-1] = nil
+	*n.children = (*n.children)[:len(*n.children)-1]
+	right = tr.newNode(false)
+	right.items = append([]mapPair[K, V]{}, cmedian)
+	*right.children = append([]*mapNode[K, V]{}, child, cright)
+	n.updateCount()
+	right.updateCount()
+	return right, median, true
+}
+
+// UpdateRange replaces each value within the range [lo, hi) with the value
+// returned by fn. The values are updated in place, in ascending order, and
+// only the nodes that hold or lead to those values are copied, when needed,
+// for copy-on-write.
+func (tr *Map[K, V]) UpdateRange(lo, hi K, fn func(key K, value V) V) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root == nil || !(lo < hi) {
+		return
+	}
+	tr.nodeUpdateRange(&tr.root, lo, hi, fn)
+}
+
+func (tr *Map[K, V]) nodeUpdateRange(cn **mapNode[K, V], lo, hi K,
+	fn func(key K, value V) V,
+) {
+	n := tr.isoLoad(cn, true)
+	i, found := tr.search(n, lo)
+	if !found && !n.leaf() {
+		tr.nodeUpdateRange(&(*n.children)[i], lo, hi, fn)
+	}
+	for ; i < len(n.items) && n.items[i].key < hi; i++ {
+		n.items[i].value = fn(n.items[i].key, n.items[i].value)
+		if !n.leaf() {
+			tr.nodeUpdateRange(&(*n.children)[i+1], lo, hi, fn)
+		}
+	}
 }
 
 // Min returns the minimum item in tree.
@@ -668,6 +1954,9 @@ func (tr *Map[K, V]) MinMut() (K, V, bool) {
 }
 
 func (tr *Map[K, V]) minMut(mut bool) (key K, value V, ok bool) {
+	if tr.lock(mut) {
+		defer tr.unlock(mut)
+	}
 	if tr.root == nil {
 		return key, value, false
 	}
@@ -691,23 +1980,193 @@ func (tr *Map[K, V]) MaxMut() (K, V, bool) {
 	return tr.maxMut(true)
 }
 
-func (tr *Map[K, V]) maxMut(mut bool) (K, V, bool) {
+// PeekMin returns the minimum item in tree, and panics if the tree has no
+// items. The Peek methods are for maps that are known to be non-empty, and
+// are otherwise the same as Min and Max.
+func (tr *Map[K, V]) PeekMin() (K, V) {
+	key, value, ok := tr.Min()
+	if !ok {
+		panic("btree: PeekMin on empty Map")
+	}
+	return key, value
+}
+
+// PeekMax returns the maximum item in tree, and panics if the tree has no
+// items.
+func (tr *Map[K, V]) PeekMax() (K, V) {
+	key, value, ok := tr.Max()
+	if !ok {
+		panic("btree: PeekMax on empty Map")
+	}
+	return key, value
+}
+
+func (tr *Map[K, V]) maxMut(mut bool) (K, V, bool) {
+	if tr.lock(mut) {
+		defer tr.unlock(mut)
+	}
+	if tr.root == nil {
+		return tr.empty.key, tr.empty.value, false
+	}
+	n := tr.isoLoad(&tr.root, mut)
+	for {
+		if n.leaf() {
+			item := n.items[len(n.items)-1]
+			return item.key, item.value, true
+		}
+		n = tr.isoLoad(&(*n.children)[len(*n.children)-1], mut)
+	}
+}
+
+// MinRef returns the minimum key in tree and a pointer to its value, which
+// allows for modifying the value in place. The node holding the value is
+// first isolated from any copies of the tree.
+// The pointer is invalidated by any other change to the tree, such as a Set
+// or Delete, and must not be used after that.
+// Returns false if the tree has no items.
+func (tr *Map[K, V]) MinRef() (K, *V, bool) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.root == nil {
+		return tr.empty.key, nil, false
+	}
+	n := tr.isoLoad(&tr.root, true)
+	for !n.leaf() {
+		n = tr.isoLoad(&(*n.children)[0], true)
+	}
+	return n.items[0].key, &n.items[0].value, true
+}
+
+// MaxRef returns the maximum key in tree and a pointer to its value.
+// See MinRef.
+func (tr *Map[K, V]) MaxRef() (K, *V, bool) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.root == nil {
+		return tr.empty.key, nil, false
+	}
+	n := tr.isoLoad(&tr.root, true)
+	for !n.leaf() {
+		n = tr.isoLoad(&(*n.children)[len(*n.children)-1], true)
+	}
+	item := &n.items[len(n.items)-1]
+	return item.key, &item.value, true
+}
+
+// Quantiles returns the keys at each of the quantiles in qs, which must be
+// within the range [0, 1]. See BTreeG.Quantiles.
+// Returns nil if the tree has no items.
+func (tr *Map[K, V]) Quantiles(qs []float64) []K {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	order, indexes := quantileIndexes(qs, tr.count)
+	if tr.root == nil {
+		return nil
+	}
+	found := tr.root.getAts(indexes, 0, make([]K, 0, len(qs)))
+	keys := make([]K, len(qs))
+	for i, j := range order {
+		keys[j] = found[i]
+	}
+	return keys
+}
+
+// Quantile returns the item at the rank int(q*Len()) of the map.
+// See BTreeG.Quantile.
+func (tr *Map[K, V]) Quantile(q float64) (K, V, bool) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	index, ok := quantileIndex(q, tr.count)
+	if !ok {
+		return tr.empty.key, tr.empty.value, false
+	}
+	return tr.atIndex(index, false)
+}
+
+// Percentile is the same as Quantile(p/100), for p within the range
+// [0, 100].
+func (tr *Map[K, V]) Percentile(p int) (K, V, bool) {
+	return tr.Quantile(float64(p) / 100)
+}
+
+// getAts appends the keys at the ascending indexes, which are offset by the
+// position of the node in the tree, visiting each node at most once.
+func (n *mapNode[K, V]) getAts(indexes []int, offset int, keys []K) []K {
+	if n.leaf() {
+		for _, index := range indexes {
+			keys = append(keys, n.items[index-offset].key)
+		}
+		return keys
+	}
+	for i := 0; len(indexes) > 0; i++ {
+		child := (*n.children)[i]
+		j := 0
+		for j < len(indexes) && indexes[j] < offset+child.count {
+			j++
+		}
+		if j > 0 {
+			keys = child.getAts(indexes[:j], offset, keys)
+			indexes = indexes[j:]
+		}
+		offset += child.count
+		for len(indexes) > 0 && indexes[0] == offset {
+			keys = append(keys, n.items[i].key)
+			indexes = indexes[1:]
+		}
+		offset++
+	}
+	return keys
+}
+
+// MinKey returns the minimum key in tree, without copying its value.
+// Returns false if the tree has no items.
+func (tr *Map[K, V]) MinKey() (K, bool) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.root == nil {
+		return tr.empty.key, false
+	}
+	n := tr.root
+	for !n.leaf() {
+		n = (*n.children)[0]
+	}
+	return n.items[0].key, true
+}
+
+// MaxKey returns the maximum key in tree, without copying its value.
+// Returns false if the tree has no items.
+func (tr *Map[K, V]) MaxKey() (K, bool) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
 	if tr.root == nil {
-		return tr.empty.key, tr.empty.value, false
+		return tr.empty.key, false
 	}
-	n := tr.isoLoad(&tr.root, mut)
-	for {
-		if n.leaf() {
-			item := n.items[len(n.items)-1]
-			return item.key, item.value, true
-		}
-		n = tr.isoLoad(&(*n.children)[len(*n.children)-1], mut)
+	n := tr.root
+	for !n.leaf() {
+		n = (*n.children)[len(*n.children)-1]
 	}
+	return n.items[len(n.items)-1].key, true
 }
 
 // PopMin removes the minimum item in tree and returns it.
 // Returns nil if the tree has no items.
 func (tr *Map[K, V]) PopMin() (K, V, bool) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("PopMin", tr.restructs)
+	}
+	return tr.popMin()
+}
+
+func (tr *Map[K, V]) popMin() (K, V, bool) {
 	if tr.root == nil {
 		return tr.empty.key, tr.empty.value, false
 	}
@@ -717,7 +2176,7 @@ func (tr *Map[K, V]) PopMin() (K, V, bool) {
 		n.count-- // optimistically update counts
 		if n.leaf() {
 			item = n.items[0]
-			if len(n.items) == tr.min {
+			if len(n.items) <= tr.min {
 				break
 			}
 			copy(n.items[:], n.items[1:])
@@ -726,6 +2185,7 @@ func (tr *Map[K, V]) PopMin() (K, V, bool) {
 			tr.count--
 			if tr.count == 0 {
 				tr.root = nil
+				tr.restructs++
 			}
 			return item.key, item.value, true
 		}
@@ -740,7 +2200,7 @@ func (tr *Map[K, V]) PopMin() (K, V, bool) {
 		}
 		n = (*n.children)[0]
 	}
-	value, deleted := tr.Delete(item.key)
+	value, deleted := tr.deleteKey(item.key)
 	if deleted {
 		return item.key, value, true
 	}
@@ -750,6 +2210,16 @@ func (tr *Map[K, V]) PopMin() (K, V, bool) {
 // PopMax removes the maximum item in tree and returns it.
 // Returns nil if the tree has no items.
 func (tr *Map[K, V]) PopMax() (K, V, bool) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("PopMax", tr.restructs)
+	}
+	return tr.popMax()
+}
+
+func (tr *Map[K, V]) popMax() (K, V, bool) {
 	if tr.root == nil {
 		return tr.empty.key, tr.empty.value, false
 	}
@@ -759,7 +2229,7 @@ func (tr *Map[K, V]) PopMax() (K, V, bool) {
 		n.count-- // optimistically update counts
 		if n.leaf() {
 			item = n.items[len(n.items)-1]
-			if len(n.items) == tr.min {
+			if len(n.items) <= tr.min {
 				break
 			}
 			n.items[len(n.items)-1] = tr.empty
@@ -767,6 +2237,7 @@ func (tr *Map[K, V]) PopMax() (K, V, bool) {
 			tr.count--
 			if tr.count == 0 {
 				tr.root = nil
+				tr.restructs++
 			}
 			return item.key, item.value, true
 		}
@@ -781,13 +2252,131 @@ func (tr *Map[K, V]) PopMax() (K, V, bool) {
 		}
 		n = (*n.children)[len(*n.children)-1]
 	}
-	value, deleted := tr.Delete(item.key)
+	value, deleted := tr.deleteKey(item.key)
 	if deleted {
 		return item.key, value, true
 	}
 	return tr.empty.key, tr.empty.value, false
 }
 
+// PopMinN removes up to n of the minimum items in tree and returns them in
+// ascending order.
+func (tr *Map[K, V]) PopMinN(n int) (keys []K, values []V) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("PopMinN", tr.restructs)
+	}
+	if n > tr.count {
+		n = tr.count
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	keys, values = make([]K, n), make([]V, n)
+	for i := 0; i < n; i++ {
+		keys[i], values[i], _ = tr.popMin()
+	}
+	return keys, values
+}
+
+// PopMaxN removes up to n of the maximum items in tree and returns them in
+// ascending order.
+func (tr *Map[K, V]) PopMaxN(n int) (keys []K, values []V) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("PopMaxN", tr.restructs)
+	}
+	if n > tr.count {
+		n = tr.count
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	keys, values = make([]K, n), make([]V, n)
+	for i := n - 1; i >= 0; i-- {
+		keys[i], values[i], _ = tr.popMax()
+	}
+	return keys, values
+}
+
+// LenRange returns the number of items within the range [lo, hi), which
+// includes lo but not hi. It uses the counts of the nodes, so only the paths
+// to lo and hi are visited, rather than the items in the range.
+func (tr *Map[K, V]) LenRange(lo, hi K) int {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.root == nil || !(lo < hi) {
+		return 0
+	}
+	return tr.rank(hi) - tr.rank(lo)
+}
+
+// rank returns the number of items that are less than key.
+func (tr *Map[K, V]) rank(key K) int {
+	var index int
+	n := tr.root
+	for {
+		i, found := tr.search(n, key)
+		index += i
+		if n.leaf() {
+			return index
+		}
+		for _, child := range (*n.children)[:i] {
+			index += child.count
+		}
+		if found {
+			return index + (*n.children)[i].count
+		}
+		n = (*n.children)[i]
+	}
+}
+
+// Around returns the items nearest to pivot, in ascending order, which are
+// up to before items that are less than pivot, the item at pivot when it
+// exists, and up to after items that are greater than pivot. The items are
+// read while holding the lock once.
+func (tr *Map[K, V]) Around(pivot K, before, after int,
+) (keys []K, values []V) {
+	iter := tr.Iter()
+	defer iter.Release()
+	add := func() {
+		keys = append(keys, iter.Key())
+		values = append(values, iter.Value())
+	}
+	ok := iter.Seek(pivot)
+	if !ok {
+		// all items are less than pivot
+		ok = before > 0 && iter.Last()
+		if ok {
+			add()
+		}
+	}
+	for ok && len(keys) < before {
+		if ok = iter.Prev(); ok {
+			add()
+		}
+	}
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+		values[i], values[j] = values[j], values[i]
+	}
+	ok = iter.Seek(pivot)
+	if ok && !(pivot < iter.Key()) {
+		add()
+		ok = iter.Next()
+	}
+	for n := 0; ok && n < after; n++ {
+		add()
+		ok = iter.Next()
+	}
+	return keys, values
+}
+
 // GetAt returns the value at index.
 // Return nil if the tree is empty or the index is out of bounds.
 func (tr *Map[K, V]) GetAt(index int) (K, V, bool) {
@@ -799,6 +2388,13 @@ func (tr *Map[K, V]) GetAtMut(index int) (K, V, bool) {
 }
 
 func (tr *Map[K, V]) getAt(index int, mut bool) (K, V, bool) {
+	if tr.lock(mut) {
+		defer tr.unlock(mut)
+	}
+	return tr.atIndex(index, mut)
+}
+
+func (tr *Map[K, V]) atIndex(index int, mut bool) (K, V, bool) {
 	if tr.root == nil || index < 0 || index >= tr.count {
 		return tr.empty.key, tr.empty.value, false
 	}
@@ -823,10 +2419,16 @@ func (tr *Map[K, V]) getAt(index int, mut bool) (K, V, bool) {
 // DeleteAt deletes the item at index.
 // Return nil if the tree is empty or the index is out of bounds.
 func (tr *Map[K, V]) DeleteAt(index int) (K, V, bool) {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.onStructure != nil {
+		defer tr.structureChanged("DeleteAt", tr.restructs)
+	}
 	if tr.root == nil || index < 0 || index >= tr.count {
 		return tr.empty.key, tr.empty.value, false
 	}
-	var pathbuf [8]uint8 // track the path
+	var pathbuf [8]int // track the path
 	path := pathbuf[:0]
 	var item mapPair[K, V]
 	n := tr.isoLoad(&tr.root, true)
@@ -836,8 +2438,8 @@ outer:
 		if n.leaf() {
 			// the index is the item position
 			item = n.items[index]
-			if len(n.items) == tr.min {
-				path = append(path, uint8(index))
+			if len(n.items) <= tr.min {
+				path = append(path, index)
 				break outer
 			}
 			copy(n.items[index:], n.items[index+1:])
@@ -846,6 +2448,7 @@ outer:
 			tr.count--
 			if tr.count == 0 {
 				tr.root = nil
+				tr.restructs++
 			}
 			return item.key, item.value, true
 		}
@@ -855,12 +2458,12 @@ outer:
 				break
 			} else if index == (*n.children)[i].count {
 				item = n.items[i]
-				path = append(path, uint8(i))
+				path = append(path, i)
 				break outer
 			}
 			index -= (*n.children)[i].count + 1
 		}
-		path = append(path, uint8(i))
+		path = append(path, i)
 		n = tr.isoLoad(&(*n.children)[i], true)
 	}
 	// revert the counts
@@ -868,19 +2471,35 @@ outer:
 	for i := 0; i < len(path); i++ {
 		n.count++
 		if !n.leaf() {
-			n = (*n.children)[uint8(path[i])]
+			n = (*n.children)[path[i]]
 		}
 	}
-	value, deleted := tr.Delete(item.key)
+	value, deleted := tr.deleteKey(item.key)
 	if deleted {
 		return item.key, value, true
 	}
 	return tr.empty.key, tr.empty.value, false
 }
 
+// Degree returns the degree of the tree, which is the default of 32 for a
+// zero-value map that has not been written to.
+func (tr *Map[K, V]) Degree() int {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.max == 0 {
+		_, max := degreeToMinMax(0)
+		return maxToDegree(max)
+	}
+	return maxToDegree(tr.max)
+}
+
 // Height returns the height of the tree.
 // Returns zero if tree has no items.
 func (tr *Map[K, V]) Height() int {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
 	var height int
 	if tr.root != nil {
 		n := tr.root
@@ -895,10 +2514,55 @@ func (tr *Map[K, V]) Height() int {
 	return height
 }
 
+// WalkNodes iterates over every node in the tree, in depth-first pre-order.
+// The level is the depth of the node, where the root is zero. The keys and
+// values params are the items stored in the node. They are reused between
+// calls and are only valid until the iter function returns.
+// Return false to stop iterating.
+func (tr *Map[K, V]) WalkNodes(
+	iter func(level int, isLeaf bool, keys []K, values []V) bool,
+) {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	if tr.root == nil {
+		return
+	}
+	keys := make([]K, 0, tr.max)
+	values := make([]V, 0, tr.max)
+	tr.root.walkNodes(0, keys, values, iter)
+}
+
+func (n *mapNode[K, V]) walkNodes(level int, keys []K, values []V,
+	iter func(level int, isLeaf bool, keys []K, values []V) bool,
+) bool {
+	keys, values = keys[:0], values[:0]
+	for i := 0; i < len(n.items); i++ {
+		keys = append(keys, n.items[i].key)
+		values = append(values, n.items[i].value)
+	}
+	if !iter(level, n.leaf(), keys, values) {
+		return false
+	}
+	if !n.leaf() {
+		for i := 0; i < len(*n.children); i++ {
+			if !(*n.children)[i].walkNodes(level+1, keys, values, iter) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // MapIter represents an iterator for btree.Map
 type MapIter[K ordered, V any] struct {
 	tr      *Map[K, V]
 	mut     bool
+	locked  *releaseGuard // nil unless the iterator holds the lock
 	seeked  bool
 	atstart bool
 	atend   bool
@@ -912,14 +2576,29 @@ type mapIterStackItem[K ordered, V any] struct {
 }
 
 // Iter returns a read-only iterator.
+// For maps with locks, the Release method must be called when finished with
+// the iterator.
 func (tr *Map[K, V]) Iter() MapIter[K, V] {
-	return tr.iter(false)
+	iter := tr.iter(false)
+	iter.locked = newReleaseGuard(tr.lock(false))
+	return iter
 }
 
 func (tr *Map[K, V]) IterMut() MapIter[K, V] {
-	return tr.iter(true)
+	iter := tr.iter(true)
+	iter.locked = newReleaseGuard(tr.lock(true))
+	return iter
+}
+
+// UnsafeIter returns a read-only iterator that skips locking, even for a
+// map that uses locks. The caller must guarantee that there are no
+// concurrent writes while the iterator is in use, much like ranging over a
+// plain Go map. Calling Release is not required.
+func (tr *Map[K, V]) UnsafeIter() MapIter[K, V] {
+	return tr.iter(false)
 }
 
+// iter returns an iterator without taking the lock.
 func (tr *Map[K, V]) iter(mut bool) MapIter[K, V] {
 	var iter MapIter[K, V]
 	iter.tr = tr
@@ -927,6 +2606,88 @@ func (tr *Map[K, V]) iter(mut bool) MapIter[K, V] {
 	return iter
 }
 
+// Release the iterator. This is only required for maps with locks, but is
+// safe to call on any iterator, more than once, and on copies of the
+// iterator, as the lock is only released by the first call. A copy must not
+// be used after any copy has been released.
+func (iter *MapIter[K, V]) Release() {
+	if iter.tr == nil {
+		return
+	}
+	if iter.locked.release() {
+		iter.tr.unlock(iter.mut)
+	}
+	iter.locked = nil
+	iter.stack = nil
+	iter.tr = nil
+}
+
+// reset releases the iterator, and then makes it a new read-only iterator
+// for tr, like Iter, that keeps the stack of the iterator for reuse.
+func (iter *MapIter[K, V]) reset(tr *Map[K, V]) {
+	stack := iter.stack[:0]
+	iter.Release()
+	*iter = tr.iter(false)
+	iter.stack = stack
+	iter.locked = newReleaseGuard(tr.lock(false))
+}
+
+// SeekIter returns a read-only iterator that is positioned at the first item
+// that is greater-or-equal-to key. This is like calling Iter followed by
+// Seek, but the iterator is only made once the item is found. See
+// BTreeG.SeekIter.
+// Returns false if there was no item found, in which case the iterator is
+// already released.
+func (tr *Map[K, V]) SeekIter(key K) (MapIter[K, V], bool) {
+	return tr.seekIter(key, false)
+}
+
+// SeekIterLT returns a read-only iterator that is positioned at the last item
+// that is less-than key, which is found in a single descent.
+// Returns false if there was no item found, in which case the iterator is
+// already released.
+func (tr *Map[K, V]) SeekIterLT(key K) (MapIter[K, V], bool) {
+	return tr.seekIter(key, true)
+}
+
+func (tr *Map[K, V]) seekIter(key K, lt bool) (MapIter[K, V], bool) {
+	locked := tr.lock(false)
+	iter := tr.iter(false)
+	var ok bool
+	if lt {
+		ok = iter.seekLT(key)
+	} else {
+		ok = iter.Seek(key)
+	}
+	if !ok {
+		if locked {
+			tr.unlock(false)
+		}
+		return MapIter[K, V]{}, false
+	}
+	iter.locked = newReleaseGuard(locked)
+	return iter, true
+}
+
+// seekLT moves the iterator to the last item that is less-than key, by
+// descending to the leaf position of key and then stepping back once.
+func (iter *MapIter[K, V]) seekLT(key K) bool {
+	iter.seeked = true
+	iter.stack = iter.stack[:0]
+	if iter.tr.root == nil {
+		return false
+	}
+	n := iter.tr.isoLoad(&iter.tr.root, iter.mut)
+	for {
+		i, _ := iter.tr.search(n, key)
+		iter.stack = append(iter.stack, mapIterStackItem[K, V]{n, i})
+		if n.leaf() {
+			return iter.Prev()
+		}
+		n = iter.tr.isoLoad(&(*n.children)[i], iter.mut)
+	}
+}
+
 // Seek to item greater-or-equal-to key.
 // Returns false if there was no item found.
 func (iter *MapIter[K, V]) Seek(key K) bool {
@@ -1122,6 +2883,9 @@ func (tr *Map[K, V]) ValuesMut() []V {
 }
 
 func (tr *Map[K, V]) values(mut bool) []V {
+	if tr.lock(mut) {
+		defer tr.unlock(mut)
+	}
 	values := make([]V, 0, tr.Len())
 	if tr.root != nil {
 		values = tr.nodeValues(&tr.root, values, mut)
@@ -1146,6 +2910,9 @@ func (tr *Map[K, V]) nodeValues(cn **mapNode[K, V], values []V, mut bool) []V {
 
 // Keys returns all the keys in order.
 func (tr *Map[K, V]) Keys() []K {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
 	keys := make([]K, 0, tr.Len())
 	if tr.root != nil {
 		keys = tr.root.keys(keys)
@@ -1153,6 +2920,33 @@ func (tr *Map[K, V]) Keys() []K {
 	return keys
 }
 
+// AppendKeys appends all the keys in order to dst and returns the extended
+// slice. Reusing dst between calls avoids allocating for each call.
+//
+// There is no way to access the keys without copying them, because each key
+// is stored beside its value, in many separate nodes.
+func (tr *Map[K, V]) AppendKeys(dst []K) []K {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.root != nil {
+		dst = tr.root.keys(dst)
+	}
+	return dst
+}
+
+// AppendValues appends all the values in order to dst and returns the
+// extended slice. See AppendKeys.
+func (tr *Map[K, V]) AppendValues(dst []V) []V {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.root != nil {
+		dst = tr.nodeValues(&tr.root, dst, false)
+	}
+	return dst
+}
+
 func (n *mapNode[K, V]) keys(keys []K) []K {
 	if n.leaf() {
 		for i := 0; i < len(n.items); i++ {
@@ -1176,7 +2970,16 @@ func (tr *Map[K, V]) KeyValuesMut() ([]K, []V) {
 	return tr.keyValues(true)
 }
 
+// ToSortedSlice returns a copy of all the keys and values, sorted by key.
+// This is the same as KeyValues.
+func (tr *Map[K, V]) ToSortedSlice() ([]K, []V) {
+	return tr.keyValues(false)
+}
+
 func (tr *Map[K, V]) keyValues(mut bool) ([]K, []V) {
+	if tr.lock(mut) {
+		defer tr.unlock(mut)
+	}
 	keys := make([]K, 0, tr.Len())
 	values := make([]V, 0, tr.Len())
 	if tr.root != nil {
@@ -1205,8 +3008,512 @@ func (tr *Map[K, V]) nodeKeyValues(cn **mapNode[K, V], keys []K, values []V,
 		mut)
 }
 
+// build replaces the contents of the tree with the provided items, which must
+// be sorted and unique. The tree is constructed from the bottom up, with the
+// items spread as evenly as possible across the nodes of each level.
+func (tr *Map[K, V]) build(items []mapPair[K, V]) {
+	tr.init(0)
+	tr.root = nil
+	tr.sparseRight = false
+	tr.count = len(items)
+	atomic.StoreInt64(&tr.length, int64(tr.count))
+	if len(items) == 0 {
+		return
+	}
+	height := 1
+	for capacity := tr.max; capacity < len(items); height++ {
+		capacity = (capacity+1)*(tr.max+1) - 1
+	}
+	tr.root = tr.buildNode(items, height)
+}
+
+func (tr *Map[K, V]) buildNode(items []mapPair[K, V], height int,
+) *mapNode[K, V] {
+	n := tr.newNode(height == 1)
+	n.count = len(items)
+	if height == 1 {
+		n.items = make([]mapPair[K, V], len(items))
+		copy(n.items, items)
+		return n
+	}
+	// Use the fewest children that can hold all of the items. Each child is
+	// then guaranteed to be at least half full.
+	childCap := tr.max
+	for i := 2; i < height; i++ {
+		childCap = (childCap+1)*(tr.max+1) - 1
+	}
+	nchildren := (len(items) + childCap + 1) / (childCap + 1)
+	n.items = make([]mapPair[K, V], 0, nchildren-1)
+	*n.children = make([]*mapNode[K, V], 0, nchildren)
+	size := len(items) - (nchildren - 1)
+	for i := 0; i < nchildren; i++ {
+		csize := size / nchildren
+		if i < size%nchildren {
+			csize++
+		}
+		*n.children = append(*n.children, tr.buildNode(items[:csize], height-1))
+		items = items[csize:]
+		if i < nchildren-1 {
+			n.items = append(n.items, items[0])
+			items = items[1:]
+		}
+	}
+	return n
+}
+
+// KeySet returns a new Set that contains all of the keys in the map.
+// The set is bulk constructed, which is much faster than inserting each key.
+func (tr *Map[K, V]) KeySet() *Set[K] {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	set := new(Set[K])
+	if tr.max != 0 {
+		set.base.init((tr.max + 1) / 2)
+	}
+	items := make([]mapPair[K, struct{}], 0, tr.Len())
+	if tr.root != nil {
+		items = tr.root.keyItems(items)
+	}
+	set.base.build(items)
+	return set
+}
+
+func (n *mapNode[K, V]) keyItems(items []mapPair[K, struct{}],
+) []mapPair[K, struct{}] {
+	if n.leaf() {
+		for i := 0; i < len(n.items); i++ {
+			items = append(items, mapPair[K, struct{}]{key: n.items[i].key})
+		}
+		return items
+	}
+	for i := 0; i < len(n.items); i++ {
+		items = (*n.children)[i].keyItems(items)
+		items = append(items, mapPair[K, struct{}]{key: n.items[i].key})
+	}
+	return (*n.children)[len(*n.children)-1].keyItems(items)
+}
+
+// newFrom returns a new map with the same degree and options as tr that
+// contains the provided sorted items.
+func (tr *Map[K, V]) newFrom(items []mapPair[K, V]) *Map[K, V] {
+	tr2 := tr.newEmpty()
+	tr2.build(items)
+	return tr2
+}
+
+// newEmpty returns a new empty map with the same degree and options as tr.
+func (tr *Map[K, V]) newEmpty() *Map[K, V] {
+	tr2 := new(Map[K, V])
+	if tr.mu != nil {
+		tr2.mu = new(sync.RWMutex)
+	}
+	tr2.locks = tr.locks
+	if tr.reentry != nil {
+		tr2.reentry = new(reentryDetector)
+	}
+	tr2.rejectNaN = tr.rejectNaN
+	if tr.max != 0 {
+		tr2.init((tr.max + 1) / 2)
+	}
+	return tr2
+}
+
+// CopyWithFilter returns a new map, with the same options as tr, that
+// contains only the items for which keep returns true. The new map is loaded
+// in a single ordered pass, without copying the entire map first.
+func (tr *Map[K, V]) CopyWithFilter(keep func(key K, value V) bool,
+) *Map[K, V] {
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.reentry != nil {
+		tr.reentry.enter()
+		defer tr.reentry.leave()
+	}
+	tr2 := tr.newEmpty()
+	if tr.root != nil {
+		tr.nodeScan(&tr.root, func(key K, value V) bool {
+			if keep(key, value) {
+				if tr.copyValues {
+					value = ((interface{})(value)).(copier[V]).Copy()
+				} else if tr.isoCopyValues {
+					value = ((interface{})(value)).(isoCopier[V]).IsoCopy()
+				}
+				tr2.load(key, value)
+			}
+			return true
+		}, false)
+	}
+	tr2.length = int64(tr2.count)
+	return tr2
+}
+
+// lockPair takes the read locks of both maps, which may be the same map.
+// The maps are locked in the order of their ids, so that operations on the
+// same two maps in the opposite order cannot deadlock while writers are
+// waiting on both maps.
+func (tr *Map[K, V]) lockPair(other *Map[K, V]) {
+	if other == tr {
+		tr.lock(false)
+		return
+	}
+	if other.id < tr.id {
+		other.lock(false)
+		tr.lock(false)
+	} else {
+		tr.lock(false)
+		other.lock(false)
+	}
+}
+
+func (tr *Map[K, V]) unlockPair(other *Map[K, V]) {
+	// A map that was not frozen when it was locked cannot be frozen until
+	// it is unlocked.
+	if tr.locks && !tr.Frozen() {
+		tr.unlock(false)
+	}
+	if other != tr && other.locks && !other.Frozen() {
+		other.unlock(false)
+	}
+}
+
+// Intersection returns a new map that contains the keys that are in both
+// maps, using the values from tr.
+func (tr *Map[K, V]) Intersection(other *Map[K, V]) *Map[K, V] {
+	tr.lockPair(other)
+	defer tr.unlockPair(other)
+	var items []mapPair[K, V]
+	iter1, iter2 := tr.iter(false), other.iter(false)
+	ok1, ok2 := iter1.First(), iter2.First()
+	for ok1 && ok2 {
+		if iter1.item.key < iter2.item.key {
+			ok1 = iter1.Next()
+		} else if iter2.item.key < iter1.item.key {
+			ok2 = iter2.Next()
+		} else {
+			items = append(items, iter1.item)
+			ok1, ok2 = iter1.Next(), iter2.Next()
+		}
+	}
+	return tr.newFrom(items)
+}
+
+// Union returns a new map that contains the keys from both maps. When a key
+// is in both maps, the resolve function is called with the value from tr and
+// the value from other, and returns the value to use. Pass nil for resolve
+// to always use the value from tr.
+func (tr *Map[K, V]) Union(other *Map[K, V], resolve func(key K, v1, v2 V) V,
+) *Map[K, V] {
+	tr.lockPair(other)
+	defer tr.unlockPair(other)
+	return tr.newFrom(tr.union(other, resolve))
+}
+
+func (tr *Map[K, V]) union(other *Map[K, V], resolve func(key K, v1, v2 V) V,
+) []mapPair[K, V] {
+	items := make([]mapPair[K, V], 0, tr.count+other.count)
+	iter1, iter2 := tr.iter(false), other.iter(false)
+	ok1, ok2 := iter1.First(), iter2.First()
+	for ok1 || ok2 {
+		if !ok2 || (ok1 && iter1.item.key < iter2.item.key) {
+			items = append(items, iter1.item)
+			ok1 = iter1.Next()
+		} else if !ok1 || iter2.item.key < iter1.item.key {
+			items = append(items, iter2.item)
+			ok2 = iter2.Next()
+		} else {
+			item := iter1.item
+			if resolve != nil {
+				item.value = resolve(item.key, item.value, iter2.item.value)
+			}
+			items = append(items, item)
+			ok1, ok2 = iter1.Next(), iter2.Next()
+		}
+	}
+	return items
+}
+
+// ConflictPolicy selects the value to keep in Map.MergePolicy when a key is
+// in both maps.
+type ConflictPolicy int
+
+const (
+	// KeepLeft keeps the value from the map being merged into.
+	KeepLeft ConflictPolicy = iota
+	// KeepRight uses the value from the other map.
+	KeepRight
+	// KeepMin keeps the lesser value. Values must be of an ordered type or
+	// implement Orderer.
+	KeepMin
+	// KeepMax keeps the greater value. Values must be of an ordered type or
+	// implement Orderer.
+	KeepMax
+	// Sum uses the sum of the values. Values must be of a numeric type or
+	// implement Adder.
+	Sum
+)
+
+// Adder is implemented by values that can be used with the Sum policy.
+type Adder[V any] interface {
+	Add(other V) V
+}
+
+// Orderer is implemented by values that can be used with the KeepMin and
+// KeepMax policies.
+type Orderer[V any] interface {
+	Less(other V) bool
+}
+
+// MergePolicy merges the items of other into the map, using the policy to
+// resolve the keys that are in both maps. It's the same merge as Union, but
+// it replaces the contents of tr rather than returning a new map.
+// Panics if the values do not support the policy.
+func (tr *Map[K, V]) MergePolicy(other *Map[K, V], policy ConflictPolicy) {
+	var resolve func(key K, v1, v2 V) V
+	switch policy {
+	case KeepLeft:
+	case KeepRight:
+		resolve = func(key K, v1, v2 V) V { return v2 }
+	case KeepMin:
+		resolve = func(key K, v1, v2 V) V {
+			if lessValues(v2, v1) {
+				return v2
+			}
+			return v1
+		}
+	case KeepMax:
+		resolve = func(key K, v1, v2 V) V {
+			if lessValues(v1, v2) {
+				return v2
+			}
+			return v1
+		}
+	case Sum:
+		resolve = func(key K, v1, v2 V) V { return addValues(v1, v2) }
+	default:
+		panic("btree: invalid conflict policy")
+	}
+	// The maps are locked in the order of their ids, see lockPair.
+	if other != tr && other.id < tr.id && other.lock(false) {
+		defer other.unlock(false)
+	}
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if other != tr && other.id > tr.id && other.lock(false) {
+		defer other.unlock(false)
+	}
+	items := tr.union(other, resolve)
+	if tr.maxLen > 0 && len(items) > tr.maxLen {
+		// drop the items that the evict policy would delete
+		if tr.evictPolicy == EvictMax {
+			items = items[:tr.maxLen]
+		} else {
+			items = items[len(items)-tr.maxLen:]
+		}
+	}
+	tr.build(items)
+}
+
+func lessValues[V any](v1, v2 V) bool {
+	if o, ok := any(v1).(Orderer[V]); ok {
+		return o.Less(v2)
+	}
+	r1, r2 := reflect.ValueOf(&v1).Elem(), reflect.ValueOf(&v2).Elem()
+	switch r1.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return r1.Int() < r2.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return r1.Uint() < r2.Uint()
+	case reflect.Float32, reflect.Float64:
+		return r1.Float() < r2.Float()
+	case reflect.String:
+		return r1.String() < r2.String()
+	}
+	panic("btree: values are not ordered and do not implement Orderer")
+}
+
+func addValues[V any](v1, v2 V) V {
+	if a, ok := any(v1).(Adder[V]); ok {
+		return a.Add(v2)
+	}
+	r1, r2 := reflect.ValueOf(&v1).Elem(), reflect.ValueOf(&v2).Elem()
+	switch r1.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		r1.SetInt(r1.Int() + r2.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		r1.SetUint(r1.Uint() + r2.Uint())
+	case reflect.Float32, reflect.Float64:
+		r1.SetFloat(r1.Float() + r2.Float())
+	default:
+		panic("btree: values are not numeric and do not implement Adder")
+	}
+	return v1
+}
+
+// Subtract returns a new map that contains the keys from tr that are not in
+// other.
+func (tr *Map[K, V]) Subtract(other *Map[K, V]) *Map[K, V] {
+	tr.lockPair(other)
+	defer tr.unlockPair(other)
+	var items []mapPair[K, V]
+	iter1, iter2 := tr.iter(false), other.iter(false)
+	ok1, ok2 := iter1.First(), iter2.First()
+	for ok1 {
+		if !ok2 || iter1.item.key < iter2.item.key {
+			items = append(items, iter1.item)
+			ok1 = iter1.Next()
+		} else if iter2.item.key < iter1.item.key {
+			ok2 = iter2.Next()
+		} else {
+			ok1, ok2 = iter1.Next(), iter2.Next()
+		}
+	}
+	return tr.newFrom(items)
+}
+
+// MapDiff is the difference between two maps, as returned by Map.Diff.
+type MapDiff[K ordered, V any] struct {
+	// Added are the items that are only in the new map.
+	Added *Map[K, V]
+	// Removed are the items that are only in the old map.
+	Removed *Map[K, V]
+	// Changed are the items whose values differ, with the new values.
+	Changed *Map[K, V]
+	// prior has the old values of the changed items, for Invert.
+	prior *Map[K, V]
+}
+
+// Diff returns the changes that turn tr into other. Values are compared
+// using reflect.DeepEqual.
+func (tr *Map[K, V]) Diff(other *Map[K, V]) MapDiff[K, V] {
+	tr.lockPair(other)
+	defer tr.unlockPair(other)
+	var added, removed, changed, prior []mapPair[K, V]
+	iter1, iter2 := tr.iter(false), other.iter(false)
+	ok1, ok2 := iter1.First(), iter2.First()
+	for ok1 || ok2 {
+		if !ok2 || (ok1 && iter1.item.key < iter2.item.key) {
+			removed = append(removed, iter1.item)
+			ok1 = iter1.Next()
+		} else if !ok1 || iter2.item.key < iter1.item.key {
+			added = append(added, iter2.item)
+			ok2 = iter2.Next()
+		} else {
+			if !reflect.DeepEqual(iter1.item.value, iter2.item.value) {
+				changed = append(changed, iter2.item)
+				prior = append(prior, iter1.item)
+			}
+			ok1, ok2 = iter1.Next(), iter2.Next()
+		}
+	}
+	return MapDiff[K, V]{
+		Added:   tr.newFrom(added),
+		Removed: tr.newFrom(removed),
+		Changed: tr.newFrom(changed),
+		prior:   tr.newFrom(prior),
+	}
+}
+
+// Apply patches target with the diff, by deleting the removed keys and
+// setting the added and changed items.
+func (d MapDiff[K, V]) Apply(target *Map[K, V]) {
+	if d.Removed != nil {
+		d.Removed.Scan(func(key K, _ V) bool {
+			target.Delete(key)
+			return true
+		})
+	}
+	for _, m := range [2]*Map[K, V]{d.Added, d.Changed} {
+		if m != nil {
+			m.Scan(func(key K, value V) bool {
+				target.Set(key, value)
+				return true
+			})
+		}
+	}
+}
+
+// Invert returns the reverse diff, which undoes the changes of d. The old
+// values of changed items are only known to diffs returned by Map.Diff, and
+// otherwise the inverted diff has no changed items.
+func (d MapDiff[K, V]) Invert() MapDiff[K, V] {
+	return MapDiff[K, V]{
+		Added:   d.Removed,
+		Removed: d.Added,
+		Changed: d.prior,
+		prior:   d.Changed,
+	}
+}
+
 // Clear will delete all items.
 func (tr *Map[K, V]) Clear() {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	tr.clear("Clear")
+}
+
+// ClearWithDegree will delete all items, and then initialize the map again
+// using the provided degree, like Reinit.
+func (tr *Map[K, V]) ClearWithDegree(degree int) {
+	min, max := degreeToMinMax(degree)
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	tr.clear("ClearWithDegree")
+	tr.configure(min, max)
+	atomic.StoreInt32(&tr.initState, initStateDone)
+}
+
+func (tr *Map[K, V]) clear(op string) {
+	if tr.onStructure != nil {
+		defer tr.structureChanged(op, tr.restructs)
+	}
+	if tr.root != nil {
+		tr.restructs++
+	}
 	tr.count = 0
 	tr.root = nil
+	tr.sparseRight = false
+}
+
+// Shrink releases the unused capacity of the node slices, such as after bulk
+// deletes, by copying each of them to a slice that's exactly as large as
+// needed. This is an O(n) operation that should be called explicitly.
+// Nodes that are shared with copies of the map are copied first, which
+// breaks the copy-on-write sharing, so it should only be called on maps that
+// are no longer shared.
+func (tr *Map[K, V]) Shrink() {
+	if tr.lock(true) {
+		defer tr.unlock(true)
+	}
+	if tr.root != nil {
+		tr.shrink(&tr.root)
+	}
+}
+
+func (tr *Map[K, V]) shrink(cn **mapNode[K, V]) {
+	n := tr.isoLoad(cn, true)
+	if cap(n.items) > len(n.items) {
+		items := make([]mapPair[K, V], len(n.items))
+		copy(items, n.items)
+		n.items = items
+	}
+	if n.leaf() {
+		return
+	}
+	if cap(*n.children) > len(*n.children) {
+		children := make([]*mapNode[K, V], len(*n.children))
+		copy(children, *n.children)
+		*n.children = children
+	}
+	for i := range *n.children {
+		tr.shrink(&(*n.children)[i])
+	}
 }
@@ -1,9 +1,12 @@
 package btree
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
+	"runtime"
 	"sort"
 	"sync"
 	"testing"
@@ -837,6 +840,23 @@ func TestMapDeleteAt(t *testing.T) {
 	}
 }
 
+func TestMapDeleteAtWide(t *testing.T) {
+	// nodes with more than 256 children
+	tr := NewMap[int, int](200)
+	N := 300_000
+	for i := 0; i < N; i++ {
+		tr.Load(i, i)
+	}
+	tr.sane()
+	for i := 0; i < 1000; i++ {
+		index := tr.Len() - 1 - rand.Intn(10_000)
+		key1, _, ok1 := tr.GetAt(index)
+		key2, _, ok2 := tr.DeleteAt(index)
+		assert(ok1 && ok2 && key1 == key2)
+	}
+	tr.sane()
+}
+
 func TestMapVarious(t *testing.T) {
 	N := 1_000_000
 	tr := testMapNewBTree()
@@ -906,188 +926,6 @@ func (tr *Map[K, V]) sane() {
 	}
 }
 
-type saneMapError string
-
-func (err saneMapError) Error() string {
-	return string(err)
-}
-
-// btree_sane returns true if the entire btree and every node are valid.
-// - height of all leaves are the equal to the btree height.
-// - deep count matches the btree count.
-// - all nodes have the correct number of items and counts.
-// - all items are in order.
-func (tr *Map[K, V]) Sane() error {
-	if tr == nil {
-		return nil
-	}
-	if !tr.saneheight() {
-		return saneMapError("!sane-height")
-	}
-	if tr.Len() != tr.count || tr.deepcount() != tr.count {
-		return saneMapError("!sane-count")
-	}
-	if !tr.saneprops() {
-		return saneMapError("!sane-props")
-	}
-	if !tr.saneorder() {
-		return saneMapError("!sane-order")
-	}
-	if !tr.sanenils() {
-		return saneMapError("!sane-nils")
-	}
-	return nil
-}
-
-// btree_saneheight returns true if the height of all leaves match the height
-// of the btree.
-func (tr *Map[K, V]) saneheight() bool {
-	height := tr.Height()
-	if tr.root != nil {
-		if height == 0 {
-			return false
-		}
-		return tr.root.saneheight(1, height)
-	}
-	return height == 0
-}
-
-func (n *mapNode[K, V]) saneheight(height, maxheight int) bool {
-	if n.leaf() {
-		if height != maxheight {
-			return false
-		}
-	} else {
-		i := 0
-		for ; i < len(n.items); i++ {
-			if !(*n.children)[i].saneheight(height+1, maxheight) {
-				return false
-			}
-		}
-		if !(*n.children)[i].saneheight(height+1, maxheight) {
-			return false
-		}
-	}
-	return true
-}
-
-// btree_deepcount returns the number of items in the btree.
-func (tr *Map[K, V]) deepcount() int {
-	if tr.root != nil {
-		return tr.root.deepcount()
-	}
-	return 0
-}
-
-func (n *mapNode[K, V]) deepcount() int {
-	count := len(n.items)
-	if !n.leaf() {
-		for i := 0; i <= len(n.items); i++ {
-			count += (*n.children)[i].deepcount()
-		}
-	}
-	if n.count != count {
-		return -1
-	}
-	return count
-}
-
-func (tr *Map[K, V]) nodesaneprops(n *mapNode[K, V], height int) bool {
-	if height == 1 {
-		if len(n.items) < 1 || len(n.items) > tr.max {
-			println(len(n.items) < 1)
-			return false
-		}
-	} else {
-		if len(n.items) < tr.min || len(n.items) > tr.max {
-			println(2)
-			return false
-		}
-	}
-	if !n.leaf() {
-		if len(*n.children) != len(n.items)+1 {
-			println(3)
-			return false
-		}
-		for i := 0; i < len(n.items); i++ {
-			if !tr.nodesaneprops((*n.children)[i], height+1) {
-				println(4)
-				return false
-			}
-		}
-		if !tr.nodesaneprops((*n.children)[len(n.items)], height+1) {
-			println(5)
-			return false
-		}
-	}
-	return true
-}
-
-func (tr *Map[K, V]) saneprops() bool {
-	if tr.root != nil {
-		return tr.nodesaneprops(tr.root, 1)
-	}
-	return true
-}
-
-func (tr *Map[K, V]) sanenilsnode(n *mapNode[K, V]) bool {
-	items := n.items[:cap(n.items):cap(n.items)]
-	for i := len(n.items); i < len(items); i++ {
-		if !tr.eq(items[i].key, tr.empty.key) {
-			return false
-		}
-	}
-	if !n.leaf() {
-		for i := 0; i < len(*n.children); i++ {
-			if (*n.children)[i] == nil {
-				return false
-			}
-		}
-		children := (*n.children)[:cap(*n.children):cap(*n.children)]
-		for i := len(*n.children); i < len(children); i++ {
-			if children[i] != nil {
-				return false
-			}
-		}
-		for i := 0; i < len(*n.children); i++ {
-			if !tr.sanenilsnode((*n.children)[i]) {
-				return false
-			}
-		}
-	}
-	return true
-}
-
-// sanenils checks that all the slots in the item slice that are not used,
-//
-//	n.items[len(n.items):cap(n.items):cap(n.items)]
-//
-// are equal to the empty value of the kind.
-func (tr *Map[K, V]) sanenils() bool {
-	if tr.root != nil {
-		return tr.sanenilsnode(tr.root)
-	}
-	return true
-}
-
-func (tr *Map[K, V]) saneorder() bool {
-	var last K
-	var count int
-	var bad bool
-	tr.Scan(func(key K, value V) bool {
-		if count > 0 {
-			if !tr.lt(last, key) {
-				bad = true
-				return false
-			}
-		}
-		last = key
-		count++
-		return true
-	})
-	return !bad && count == tr.count
-}
-
 func TestMapIter(t *testing.T) {
 	N := 100_000
 	tr := testMapNewBTree()
@@ -1213,6 +1051,187 @@ func TestMapIterSeekPrefix(t *testing.T) {
 	}
 }
 
+func TestMapSetWith(t *testing.T) {
+	tr := NewMapOptions[int, string](Options{DetectReentrancy: true})
+	var olds []string
+	onReplace := func(old string) {
+		olds = append(olds, old)
+	}
+	tr.SetWith(1, "a", onReplace)
+	assert(len(olds) == 0)
+	tr.SetWith(1, "b", onReplace)
+	assert(len(olds) == 1 && olds[0] == "a")
+	tr.SetWith(2, "c", onReplace)
+	tr.SetWith(1, "d", onReplace)
+	assert(len(olds) == 2 && olds[1] == "b")
+	v, _ := tr.Get(1)
+	assert(v == "d" && tr.Len() == 2)
+	// the map is locked during onReplace
+	func() {
+		defer func() { assert(recover() != nil) }()
+		tr.SetWith(1, "e", func(old string) { tr.Delete(2) })
+	}()
+	assert(tr.Len() == 2)
+}
+
+func TestMapHintOwner(t *testing.T) {
+	var tr Map[int, int]
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, i)
+	}
+	c := tr.Cursor()
+	c.Get(500)
+	assert(c.hint.owner == tr.id)
+	saved := c.hint.path
+	tr2 := tr.Copy()
+	c2 := tr2.Cursor()
+	c2.hint = c.hint
+	for i := 0; i < 1000; i += 7 {
+		c2.Delete(i)
+		v, ok := c2.Get(i + 1)
+		assert(ok && v == i+1)
+	}
+	assert(c2.hint.path == saved)
+	tr2.ResetHint(&c2.hint)
+	assert(c2.hint.owner == tr2.id && c2.hint.owner != tr.id)
+	c2.Get(10)
+	assert(c2.hint.used[0])
+	tr2.sane()
+}
+
+func TestMapAscendN(t *testing.T) {
+	tr := NewMap[int, int](4)
+	for i := 0; i < 200; i++ {
+		tr.Set(i*2, i)
+	}
+	// the first leaf ends before the first separator in the root
+	var leaf []int
+	tr.WalkNodes(func(level int, isLeaf bool, keys []int, values []int) bool {
+		if isLeaf && leaf == nil {
+			leaf = append([]int{}, keys...)
+		}
+		return true
+	})
+	sep := leaf[len(leaf)-1] + 2
+	var keys []int
+	iter := func(key, value int) bool {
+		assert(value == key/2)
+		keys = append(keys, key)
+		return true
+	}
+	assert(tr.AscendN(0, len(leaf), iter) == len(leaf))
+	assert(reflect.DeepEqual(keys, leaf))
+	keys = nil
+	assert(tr.AscendN(leaf[len(leaf)-1], 3, iter) == 3)
+	assert(reflect.DeepEqual(keys, []int{sep - 2, sep, sep + 2}))
+	keys = nil
+	assert(tr.DescendN(sep+2, 3, iter) == 3)
+	assert(reflect.DeepEqual(keys, []int{sep + 2, sep, sep - 2}))
+	for pivot := -1; pivot < 402; pivot += 3 {
+		for n := -1; n < 30; n++ {
+			var expect []int
+			for key := pivot + pivot&1; key < 400 && len(expect) < n; key += 2 {
+				expect = append(expect, key)
+			}
+			keys = nil
+			assert(tr.AscendN(pivot, n, iter) == len(expect))
+			assert(reflect.DeepEqual(keys, expect))
+			expect = nil
+			for key := pivot - pivot&1; key >= 0 && len(expect) < n; key -= 2 {
+				if key < 400 {
+					expect = append(expect, key)
+				}
+			}
+			keys = nil
+			assert(tr.DescendN(pivot, n, iter) == len(expect))
+			assert(reflect.DeepEqual(keys, expect))
+		}
+	}
+	// stopping early counts the last item visited
+	assert(tr.AscendN(0, 10, func(key, value int) bool {
+		return key < 4
+	}) == 3)
+	assert(tr.AscendN(0, 1000, func(key, value int) bool {
+		return true
+	}) == 200)
+}
+
+func TestMapScanN(t *testing.T) {
+	tr := NewMap[int, int](4)
+	for i := 0; i < 200; i++ {
+		tr.Set(i, i*2)
+	}
+	for _, limit := range []int{-1, 0, 1, 7, 199, 200, 201, 1000} {
+		var keys []int
+		tr.ScanN(limit, func(key, value int) bool {
+			assert(value == key*2)
+			keys = append(keys, key)
+			return true
+		})
+		expect := limit
+		if expect < 0 {
+			expect = 0
+		} else if expect > tr.Len() {
+			expect = tr.Len()
+		}
+		assert(len(keys) == expect)
+		for i := range keys {
+			assert(keys[i] == i)
+		}
+	}
+	var count int
+	tr.ScanN(100, func(key, value int) bool {
+		count++
+		return key != 9
+	})
+	assert(count == 10)
+	var empty Map[int, int]
+	empty.ScanN(10, func(key, value int) bool {
+		panic("unreachable")
+	})
+}
+
+func TestMapAscendPrefix(t *testing.T) {
+	var tr Map[string, int]
+	keys := []string{"", "a", "ab", "abc", "abcd", "abd", "abz", "ab\xff",
+		"ac", "b"}
+	for i, key := range keys {
+		tr.Set(key, i)
+	}
+	prefix := func(prefix string) []string {
+		var keys []string
+		AscendPrefix(&tr, prefix, func(key string, value int) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+	assert(reflect.DeepEqual(prefix("ab"),
+		[]string{"ab", "abc", "abcd", "abd", "abz", "ab\xff"}))
+	assert(reflect.DeepEqual(prefix("abc"), []string{"abc", "abcd"}))
+	assert(reflect.DeepEqual(prefix("abd"), []string{"abd"}))
+	assert(reflect.DeepEqual(prefix("ac"), []string{"ac"}))
+	assert(reflect.DeepEqual(prefix("a"), keys[1:9]))
+	assert(reflect.DeepEqual(prefix(""), keys))
+	assert(len(prefix("aa")) == 0 && len(prefix("abe")) == 0)
+	assert(len(prefix("c")) == 0)
+	var n int
+	AscendPrefix(&tr, "ab", func(key string, value int) bool {
+		n++
+		return n < 2
+	})
+	assert(n == 2)
+
+	type name string
+	var tr2 Map[name, int]
+	tr2.Set("ab", 1)
+	tr2.Set("ac", 2)
+	AscendPrefix(&tr2, "ab", func(key name, value int) bool {
+		assert(key == "ab" && value == 1)
+		return true
+	})
+}
+
 func copyMapEntries(m *Map[int, int]) []mapPair[int, int] {
 	all := make([]mapPair[int, int], m.Len())
 	keys := m.Keys()
@@ -1414,6 +1433,37 @@ func TestMapValueCopy(t *testing.T) {
 
 }
 
+func TestMapReinit(t *testing.T) {
+	// a map that is reconstructed without a constructor, which has missed
+	// the detection of the Copy method
+	m := Map[string, *testCopyItem]{min: 3, max: 7, initState: initStateDone}
+	assert(m.Reinit(4) == nil)
+	assert(m.copyValues && m.max == 7 && m.Degree() == 4)
+	m.Set("hello", newTestCopyItem("world"))
+	assert(m.Reinit(4) == ErrNotEmpty)
+	m2 := m.Copy()
+	v, _ := m.GetMut("hello")
+	v.data = "planet"
+	v, _ = m2.Get("hello")
+	assert(v.data == "world")
+
+	// stale detection is reset
+	m3 := Map[string, *testNonCopyItem]{copyValues: true, isoCopyValues: true}
+	assert(m3.Reinit(0) == nil)
+	assert(!m3.isoCopyValues && !m3.copyValues && m3.Degree() == 32)
+
+	for i := 0; i < 100; i++ {
+		m.Set(fmt.Sprint(i), newTestCopyItem("x"))
+	}
+	m.ClearWithDegree(2)
+	assert(m.Len() == 0 && m.root == nil && m.Degree() == 2)
+	for i := 0; i < 100; i++ {
+		m.Set(fmt.Sprint(i), newTestCopyItem("x"))
+	}
+	assert(m.Len() == 100 && m.Height() > 4)
+	m.sane()
+}
+
 func TestMapDeepCopy(t *testing.T) {
 
 	Ncols := 1000
@@ -1484,3 +1534,2077 @@ func TestMapDeepCopy(t *testing.T) {
 	assert(count1 == Ncols*Nvals/2)
 	assert(count2 == Ncols*Nvals/2)
 }
+
+func TestMapInitRace(t *testing.T) {
+	min, max := degreeToMinMax(0)
+	for i := 0; i < 100; i++ {
+		var tr Map[int, int]
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tr.init(0)
+			}()
+		}
+		wg.Wait()
+		assert(tr.min == min && tr.max == max)
+		for j := 0; j < 1000; j++ {
+			tr.Set(j, j)
+		}
+		tr.sane()
+	}
+
+	// a tree that has items but was never initialized is torn
+	var tr Map[int, int]
+	tr.root = tr.newNode(true)
+	tr.root.items = append(tr.root.items, mapPair[int, int]{key: 1})
+	tr.root.count = 1
+	tr.count = 1
+	func() {
+		defer func() {
+			msg, ok := recover().(string)
+			assert(ok && msg ==
+				"btree: map is corrupt, concurrent first write detected")
+		}()
+		tr.Set(2, 2)
+	}()
+}
+
+// TestMapInitRaceLocked runs the first writes to maps and sets from many
+// goroutines at once, using either the caller's lock for the zero values or
+// the map's own locks. It's meant for go test -race.
+func TestMapInitRaceLocked(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		var mu sync.Mutex
+		var tr Map[int, int]
+		var set Set[int]
+		locked := NewMapOptions[int, int](Options{})
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				locked.Set(j, j)
+				mu.Lock()
+				tr.Set(j, j)
+				set.Insert(j)
+				mu.Unlock()
+			}(j)
+		}
+		wg.Wait()
+		assert(tr.Len() == 8 && set.Len() == 8 && locked.Len() == 8)
+		for j := 8; j < 1000; j++ {
+			tr.Set(j, j)
+			set.Insert(j)
+			locked.Set(j, j)
+		}
+		tr.sane()
+		locked.sane()
+		assert(set.Len() == 1000)
+	}
+}
+
+func TestMapKeySet(t *testing.T) {
+	for _, degree := range []int{2, 3, 4, 16, 0} {
+		for _, N := range []int{0, 1, 2, 3, 10, 100, 1000, 12345} {
+			tr := testMapNewBTreeDegrees(degree)
+			for _, key := range randMapKeys(N) {
+				tr.Set(key*2, key)
+			}
+			set := tr.KeySet()
+			set.base.sane()
+			assert(set.Len() == tr.Len())
+			assert(set.Height() <= tr.Height())
+			for i := -1; i < N*2+1; i++ {
+				_, ok := tr.Get(i)
+				assert(set.Contains(i) == ok)
+			}
+			// the set is independent of the map
+			set.Insert(-1)
+			set.base.sane()
+			_, ok := tr.Get(-1)
+			assert(!ok && set.Len() == tr.Len()+1)
+		}
+	}
+	var tr Map[int, int]
+	set := tr.KeySet()
+	assert(set.Len() == 0)
+	set.Insert(1)
+	assert(set.Contains(1))
+}
+
+func TestMapFromSlice(t *testing.T) {
+	for _, N := range []int{0, 1, 2, 3, 10, 100, 1000, 12345} {
+		keys := make([]int, N)
+		values := make([]int, N)
+		for i := 0; i < N; i++ {
+			keys[i] = rand.Intn(N)
+			values[i] = i
+		}
+		var tr2 Map[int, int]
+		for i := range keys {
+			tr2.Set(keys[i], values[i])
+		}
+		tr := NewMapFromSlice(keys, values)
+		tr.sane()
+		assert(tr.Len() == tr2.Len())
+		k1, v1 := tr.KeyValues()
+		k2, v2 := tr2.KeyValues()
+		assert(reflect.DeepEqual(k1, k2) && reflect.DeepEqual(v1, v2))
+		for _, key := range keys {
+			tr.Delete(key)
+		}
+		tr.sane()
+		assert(tr.Len() == 0)
+	}
+	func() {
+		defer func() { assert(recover() != nil) }()
+		NewMapFromSlice([]int{1, 2}, []int{1})
+	}()
+}
+
+func TestMapSeekIter(t *testing.T) {
+	var tr Map[int, int]
+	_, ok := tr.SeekIter(0)
+	assert(!ok)
+	_, ok = tr.SeekIterLT(0)
+	assert(!ok)
+	for i := 0; i < 1000; i++ {
+		tr.Set(i*2, i)
+	}
+	for i := -1; i < 2001; i++ {
+		iter, ok := tr.SeekIter(i)
+		if i > 1998 {
+			assert(!ok)
+		} else {
+			assert(ok && iter.Key() == (i+1)/2*2 && iter.Value() == (i+1)/2)
+		}
+		iter, ok = tr.SeekIterLT(i)
+		if i <= 0 {
+			assert(!ok)
+		} else {
+			assert(ok && iter.Key() == (i-1)/2*2)
+			if ok = iter.Prev(); i > 2 {
+				assert(ok && iter.Key() == (i-1)/2*2-2)
+			}
+		}
+	}
+	// the lock must be released on the not-found path
+	tr2 := NewMapOptions[int, int](Options{Degree: 3})
+	for i := 0; i < 1000; i++ {
+		tr2.Set(i, i)
+	}
+	for i := 0; i < 10; i++ {
+		_, ok := tr2.SeekIter(1000)
+		assert(!ok)
+		_, ok = tr2.SeekIterLT(0)
+		assert(!ok)
+	}
+	tr2.Set(1000, 1000)
+	iter, ok := tr2.SeekIterLT(2000)
+	assert(ok && iter.Key() == 1000)
+	iter.Release()
+	iter, ok = tr2.SeekIter(500)
+	assert(ok && iter.Key() == 500 && iter.Prev() && iter.Key() == 499)
+	iter.Release()
+	tr2.Set(1001, 1001)
+	assert(tr2.Len() == 1002)
+}
+
+func TestMapSetAlgebra(t *testing.T) {
+	for _, N := range []int{0, 1, 10, 1000} {
+		m1 := testMapNewBTreeDegrees(3)
+		m2 := testMapNewBTreeDegrees(5)
+		for _, key := range randMapKeys(N) {
+			if key%2 == 0 {
+				m1.Set(key, key)
+			}
+			if key%3 == 0 {
+				m2.Set(key, -key)
+			}
+		}
+		inter := m1.Intersection(m2)
+		union := m1.Union(m2, nil)
+		union2 := m1.Union(m2, func(key, v1, v2 int) int { return v1 + v2 + 1 })
+		sub := m1.Subtract(m2)
+		for _, m := range []*Map[int, int]{inter, union, union2, sub} {
+			m.sane()
+			assert(m.max == m1.max)
+		}
+		var ninter, nunion, nsub int
+		for i := 0; i < N; i++ {
+			in1, in2 := i%2 == 0, i%3 == 0
+			v, ok := inter.Get(i)
+			assert(ok == (in1 && in2) && (!ok || v == i))
+			v, ok = union.Get(i)
+			assert(ok == (in1 || in2))
+			if in1 {
+				assert(v == i)
+			} else if in2 {
+				assert(v == -i)
+			}
+			v, ok = union2.Get(i)
+			if in1 && in2 {
+				assert(ok && v == 1)
+			}
+			v, ok = sub.Get(i)
+			assert(ok == (in1 && !in2) && (!ok || v == i))
+			if in1 && in2 {
+				ninter++
+			}
+			if in1 || in2 {
+				nunion++
+			}
+			if in1 && !in2 {
+				nsub++
+			}
+		}
+		assert(inter.Len() == ninter && union.Len() == nunion)
+		assert(union2.Len() == nunion && sub.Len() == nsub)
+	}
+}
+
+func (n *mapNode[K, V]) countIsoid(isoid uint64) int {
+	var count int
+	if n.isoid == isoid {
+		count++
+	}
+	if !n.leaf() {
+		for _, child := range *n.children {
+			count += child.countIsoid(isoid)
+		}
+	}
+	return count
+}
+
+func TestMapIsEmpty(t *testing.T) {
+	var tr Map[int, int]
+	assert(tr.IsEmpty() && tr.Len() == 0)
+	tr.Set(1, 1)
+	assert(!tr.IsEmpty() && tr.Len() == 1)
+	tr2 := NewMapOptions[int, int](Options{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			tr2.Set(i, i)
+		}
+	}()
+	for last := 0; last < 1000; {
+		n := tr2.Len()
+		assert(n >= last && n <= 1000)
+		last = n
+	}
+	wg.Wait()
+	tr3 := tr2.Subtract(&tr)
+	assert(tr3.Len() == 999 && !tr3.IsEmpty())
+	tr3 = tr2.CopyWithFilter(func(key, value int) bool { return false })
+	assert(tr3.IsEmpty())
+	var set Set[int]
+	assert(set.IsEmpty())
+	set.Insert(1)
+	assert(!set.IsEmpty())
+}
+
+func TestMapScanContext(t *testing.T) {
+	var tr Map[int, int]
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, i)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var n int
+	err := tr.ScanContext(ctx, func(key, value int) bool {
+		assert(key == n && value == n)
+		n++
+		return true
+	})
+	assert(err == nil && n == 1000)
+	n = 0
+	err = tr.DescendContext(ctx, 500, func(key, value int) bool {
+		assert(key == 500-n)
+		if n++; n == 100 {
+			cancel()
+		}
+		return true
+	})
+	assert(err == context.Canceled && n < 100+contextCheckInterval)
+	err = tr.AscendContext(ctx, 500, func(key, value int) bool {
+		panic("!")
+	})
+	assert(err == context.Canceled)
+	err = tr.ReverseContext(ctx, func(key, value int) bool { panic("!") })
+	assert(err == context.Canceled)
+}
+
+func TestMapScanMutIf(t *testing.T) {
+	N := 1_000_000
+	var tr Map[int, int]
+	for i := 0; i < N; i++ {
+		tr.Load(i, i)
+	}
+	_, nodes := testMapNodeWaste(tr.root)
+	tr2 := tr.Copy()
+	var count int
+	tr2.ScanMutIf(func(key int, value *int) bool {
+		assert(key == count && *value == key)
+		count++
+		if key%2 == 0 && key < N/50 {
+			*value = -key
+			return true
+		}
+		*value = -1
+		return false
+	})
+	assert(count == N)
+	copied := tr2.root.countIsoid(tr2.isoid)
+	assert(copied > 0 && copied*20 < nodes)
+	tr.Scan(func(key int, value int) bool {
+		assert(value == key)
+		return true
+	})
+	tr2.Scan(func(key int, value int) bool {
+		if key%2 == 0 && key < N/50 {
+			assert(value == -key)
+		} else {
+			assert(value == key)
+		}
+		return true
+	})
+	tr2.sane()
+	// ScanMut copies every node.
+	tr3 := tr.Copy()
+	tr3.ScanMut(func(key int, value int) bool { return true })
+	assert(tr3.root.countIsoid(tr3.isoid) == nodes)
+	var empty Map[int, int]
+	empty.ScanMutIf(func(key int, value *int) bool { panic("!") })
+}
+
+func TestMapUpdateRange(t *testing.T) {
+	N := 10_000
+	tr := testMapNewBTreeDegrees(4)
+	for _, key := range randMapKeys(N) {
+		tr.Set(key, key)
+	}
+	for _, r := range [][2]int{{-5, 3}, {100, 110}, {5000, 7000}, {N - 3, N + 5},
+		{50, 50}, {60, 40}} {
+		lo, hi := r[0], r[1]
+		tr2 := tr.Copy()
+		var keys []int
+		tr2.UpdateRange(lo, hi, func(key, value int) int {
+			keys = append(keys, key)
+			return -value
+		})
+		tr.sane()
+		tr2.sane()
+		// only the nodes along the updated range are copied
+		var want int
+		for i := 0; i < N; i++ {
+			v1, _ := tr.Get(i)
+			v2, _ := tr2.Get(i)
+			assert(v1 == i)
+			if i >= lo && i < hi {
+				assert(v2 == -i && keys[want] == i)
+				want++
+			} else {
+				assert(v2 == i)
+			}
+		}
+		assert(len(keys) == want)
+		copied := 0
+		if tr2.root != nil {
+			copied = tr2.root.countIsoid(tr2.isoid)
+		}
+		if want == 0 {
+			assert(copied <= tr2.Height())
+		} else {
+			assert(copied <= want+tr2.Height()*2)
+		}
+	}
+}
+
+func TestMapRejectNaN(t *testing.T) {
+	nan := math.NaN()
+	tr := NewMapOptions[float64, int](Options{Degree: 4, RejectNaN: true})
+	for i, f := range []float64{math.Inf(-1), -1, math.Copysign(0, -1), 1,
+		math.Inf(1)} {
+		_, _, err := tr.SetE(f, i)
+		assert(err == nil)
+	}
+	_, _, err := tr.SetE(nan, 0)
+	assert(err == ErrNaNKey)
+	for _, fn := range []func(){
+		func() { tr.Set(nan, 0) },
+		func() { tr.Load(nan, 0) },
+	} {
+		func() {
+			defer func() {
+				assert(recover() == ErrNaNKey)
+			}()
+			fn()
+		}()
+	}
+	tr.sane()
+	assert(tr.Len() == 5)
+	// -0 and +0 are the same key
+	v, ok := tr.Get(0)
+	assert(ok && v == 2)
+	prev, replaced, err := tr.SetE(0, 10)
+	assert(err == nil && replaced && prev == 2 && tr.Len() == 5)
+	assert(reflect.DeepEqual(tr.Keys(),
+		[]float64{math.Inf(-1), -1, 0, 1, math.Inf(1)}))
+	_, ok = tr.Delete(math.Inf(1))
+	assert(ok && tr.Len() == 4)
+
+	// NaN keys are allowed without the option
+	tr2 := NewMapOptions[float64, int](Options{})
+	_, _, err = tr2.SetE(nan, 0)
+	assert(err == nil && tr2.Len() == 1)
+}
+
+func TestMapWalkNodes(t *testing.T) {
+	tr := testMapNewBTreeDegrees(3)
+	for _, key := range randMapKeys(10_000) {
+		tr.Set(key, -key)
+	}
+	var keys []int
+	var root bool
+	height := tr.Height()
+	tr.WalkNodes(func(level int, isLeaf bool, k []int, v []int) bool {
+		assert(isLeaf == (level == height-1) && len(k) == len(v))
+		if level == 0 {
+			assert(!root)
+			root = true
+		}
+		for i := range k {
+			assert(v[i] == -k[i])
+		}
+		keys = append(keys, k...)
+		return true
+	})
+	sort.Ints(keys)
+	assert(root && reflect.DeepEqual(keys, tr.Keys()))
+}
+
+func TestMapLoadFill(t *testing.T) {
+	N := 1_000_000
+	var tr Map[int, int]
+	for i := 0; i < N; i++ {
+		tr.Load(i, i)
+	}
+	assert(tr.sparseRight)
+	tr.sane()
+	var leaves int
+	tr.WalkNodes(func(level int, isLeaf bool, keys, values []int) bool {
+		if isLeaf {
+			leaves++
+		}
+		return true
+	})
+	assert(leaves < N/(tr.max-2))
+	for i := 0; i < N; i += 3 {
+		tr.Delete(i)
+	}
+	tr.sane()
+	for i := N; i < N*2; i++ {
+		tr.Load(i, i)
+	}
+	tr.sane()
+	for tr.Len() > 0 {
+		switch rand.Intn(3) {
+		case 0:
+			tr.PopMax()
+		case 1:
+			tr.PopMin()
+		case 2:
+			tr.DeleteAt(tr.Len() - 1 - rand.Intn(100))
+		}
+		if rand.Intn(10000) == 0 {
+			tr.sane()
+		}
+	}
+	tr.sane()
+}
+
+func TestMapLocks(t *testing.T) {
+	tr := NewMapOptions[int, int](Options{})
+	assert(tr.locks)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := j*8 + i
+				tr.Set(key, key)
+				tr.Get(key)
+				if j%3 == 0 {
+					tr.Delete(key)
+				}
+				if j%100 == 0 {
+					iter := tr.Iter()
+					for ok := iter.First(); ok; ok = iter.Next() {
+					}
+					iter.Release()
+					tr.Copy().PopMin()
+					tr.Intersection(tr)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	tr.sane()
+	assert(tr.Len() == 8*666)
+
+	// iterators that fail to seek are released
+	_, ok := tr.SeekIter(math.MaxInt)
+	assert(!ok)
+	tr.Set(-1, -1)
+
+	tr = NewMapOptions[int, int](Options{NoLocks: true})
+	assert(!tr.locks)
+	tr.Set(1, 1)
+	iter := tr.Iter()
+	iter.Release()
+	iter.Release()
+	tr.Set(2, 2)
+	assert(tr.Len() == 2)
+}
+
+func TestMapMaxDegree(t *testing.T) {
+	tr := NewMap[int, int](MaxDegree)
+	assert(tr.max == MaxDegree*2-1)
+	// insert in order to keep the cost of shifting the huge nodes down
+	N := tr.max * 2
+	for i := 0; i < N; i++ {
+		tr.Set(i, i)
+	}
+	tr.sane()
+	assert(tr.Height() == 2 && cap(*tr.root.children) < tr.max)
+	for i := 0; i < 100; i++ {
+		key := rand.Intn(N)
+		v, ok := tr.Delete(key)
+		_, ok2 := tr.Get(key)
+		assert((!ok || v == key) && !ok2)
+	}
+	for i := N - 1; i >= 0; i-- {
+		tr.Delete(i)
+	}
+	tr.sane()
+	assert(tr.Len() == 0)
+
+	// absurd degrees are rejected before anything is allocated
+	func() {
+		defer func() {
+			msg, ok := recover().(string)
+			assert(ok && msg == "btree: degree exceeds MaxDegree")
+		}()
+		NewMap[int, int](1_000_000)
+	}()
+}
+
+func TestMapScanE(t *testing.T) {
+	var tr Map[int, int]
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, i*10)
+	}
+	errStop := fmt.Errorf("stop")
+	var n int
+	err := tr.ScanE(func(key, value int) (bool, error) {
+		assert(key == n && value == n*10)
+		n++
+		if key == 500 {
+			return true, errStop
+		}
+		return true, nil
+	})
+	assert(err == errStop && n == 501)
+	n = 0
+	err = tr.ScanE(func(key, value int) (bool, error) {
+		n++
+		return key < 10, nil
+	})
+	assert(err == nil && n == 11)
+	n = 0
+	err = tr.ScanMutE(func(key, value int) (bool, error) {
+		n++
+		return true, nil
+	})
+	assert(err == nil && n == 1000)
+}
+
+func TestMapMinMaxKey(t *testing.T) {
+	var tr Map[int, [1024]byte]
+	_, ok := tr.MinKey()
+	assert(!ok)
+	_, ok = tr.MaxKey()
+	assert(!ok)
+	tr.Set(5, [1024]byte{})
+	key, ok := tr.MinKey()
+	assert(ok && key == 5)
+	key, ok = tr.MaxKey()
+	assert(ok && key == 5)
+	tr.Delete(5)
+	_, ok = tr.MinKey()
+	assert(!ok)
+	for _, key := range rand.Perm(1000) {
+		tr.Set(key, [1024]byte{})
+	}
+	for i := 0; tr.Len() > 0; i++ {
+		min, ok1 := tr.MinKey()
+		max, ok2 := tr.MaxKey()
+		assert(ok1 && ok2 && min == (i+1)/2 && max == 999-i/2)
+		if i%2 == 0 {
+			tr.PopMin()
+		} else {
+			tr.PopMax()
+		}
+	}
+	_, ok = tr.MaxKey()
+	assert(!ok)
+}
+
+func BenchmarkMapMaxKey(b *testing.B) {
+	var tr Map[int, [1024]byte]
+	for i := 0; i < 10000; i++ {
+		tr.Set(i, [1024]byte{})
+	}
+	b.Run("Max", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tr.Max()
+		}
+	})
+	b.Run("MaxKey", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tr.MaxKey()
+		}
+	})
+}
+
+func TestMapDetectReentrancy(t *testing.T) {
+	tr := NewMapOptions[int, int](Options{DetectReentrancy: true})
+	for i := 0; i < 100; i++ {
+		tr.Set(i, i)
+	}
+	mustPanic := func(fn func()) {
+		defer func() {
+			msg, ok := recover().(string)
+			assert(ok &&
+				msg == "btree: tree modified from within an iterator callback")
+		}()
+		fn()
+		panic("!")
+	}
+	mustPanic(func() {
+		tr.Scan(func(key, value int) bool {
+			tr.Set(-1, -1)
+			return true
+		})
+	})
+	mustPanic(func() {
+		tr.Ascend(50, func(key, value int) bool {
+			tr.Delete(key)
+			return true
+		})
+	})
+	mustPanic(func() {
+		tr.UpdateRange(0, 10, func(key, value int) int {
+			tr.PopMin()
+			return value
+		})
+	})
+	mustPanic(func() {
+		tr.WalkNodes(func(level int, isLeaf bool, keys, values []int) bool {
+			tr.Clear()
+			return true
+		})
+	})
+	tr.sane()
+	assert(tr.Len() == 100)
+
+	// reads, and writes to other trees, are allowed
+	tr2 := tr.Copy()
+	tr.Reverse(func(key, value int) bool {
+		_, ok := tr.Get(key)
+		assert(ok)
+		tr2.Delete(key)
+		return true
+	})
+	assert(tr2.Len() == 0)
+
+	// writes from other goroutines panic while a callback is running
+	tr.Scan(func(key, value int) bool {
+		if key == 0 {
+			done := make(chan bool)
+			go func() {
+				defer func() { done <- recover() != nil }()
+				tr.Set(100, 100)
+			}()
+			assert(<-done)
+		}
+		return true
+	})
+	assert(tr.Len() == 100)
+	tr.Set(100, 100)
+	assert(tr.Len() == 101)
+}
+
+func TestMapAscendE(t *testing.T) {
+	var tr Map[int, int]
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, i)
+	}
+	errStop := fmt.Errorf("stop")
+	var keys []int
+	err := tr.AscendE(500, func(key, value int) (bool, error) {
+		keys = append(keys, key)
+		if key == 510 {
+			return false, errStop
+		}
+		return true, nil
+	})
+	assert(err == errStop && len(keys) == 11 && keys[0] == 500)
+	keys = keys[:0]
+	err = tr.AscendE(995, func(key, value int) (bool, error) {
+		keys = append(keys, key)
+		return true, nil
+	})
+	assert(err == nil && len(keys) == 5)
+	keys = keys[:0]
+	err = tr.DescendE(500, func(key, value int) (bool, error) {
+		keys = append(keys, key)
+		return key > 490, nil
+	})
+	assert(err == nil && len(keys) == 11 && keys[10] == 490)
+	err = tr.DescendE(500, func(key, value int) (bool, error) {
+		return true, errStop
+	})
+	assert(err == errStop)
+}
+
+func TestMapGetMutMissing(t *testing.T) {
+	var tr Map[int, int]
+	for i := 0; i < 10000; i++ {
+		tr.Set(i*2, i)
+	}
+	tr2 := tr.Copy()
+	allocs := testing.AllocsPerRun(100, func() {
+		_, ok := tr2.GetMut(-1)
+		assert(!ok)
+		_, ok = tr2.GetMut(5001)
+		assert(!ok)
+	})
+	assert(allocs == 0 && tr2.root.countIsoid(tr2.isoid) == 0)
+	v, ok := tr2.GetMut(5000)
+	assert(ok && v == 2500)
+	assert(tr2.root.countIsoid(tr2.isoid) == tr2.Height())
+	tr.sane()
+	tr2.sane()
+}
+
+func BenchmarkMapGetMutMissing(b *testing.B) {
+	var tr Map[int, int]
+	for i := 0; i < 100000; i++ {
+		tr.Set(i*2, i)
+	}
+	tr2 := tr.Copy()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr2.GetMut(i%100000*2 + 1)
+	}
+}
+
+func TestMapOnCopy(t *testing.T) {
+	var copies int
+	tr := NewMapOptions[int, int](Options{Degree: 3,
+		OnCopy: func(level int) { copies++ },
+	})
+	for i := 0; i < 10000; i++ {
+		tr.Set(i, i)
+	}
+	tr2 := tr.Copy()
+	tr2.Set(0, 1)
+	assert(copies == tr2.Height())
+	copies = 0
+	tr2.Set(0, 2)
+	assert(copies == 0)
+}
+
+func TestMapPopMinN(t *testing.T) {
+	var tr Map[int, int]
+	keys, values := tr.PopMinN(10)
+	assert(keys == nil && values == nil)
+	for _, key := range rand.Perm(1000) {
+		tr.Set(key, -key)
+	}
+	keys, values = tr.PopMinN(100)
+	assert(len(keys) == 100 && cap(keys) == 100 && len(values) == 100)
+	for i := range keys {
+		assert(keys[i] == i && values[i] == -i)
+	}
+	keys, values = tr.PopMaxN(100)
+	assert(len(keys) == 100 && len(values) == 100)
+	for i := range keys {
+		assert(keys[i] == 900+i && values[i] == -(900+i))
+	}
+	tr.sane()
+	assert(tr.Len() == 800)
+	keys, _ = tr.PopMinN(0)
+	assert(keys == nil)
+	keys, _ = tr.PopMaxN(1000)
+	assert(len(keys) == 800 && keys[0] == 100 && keys[799] == 899)
+	assert(tr.Len() == 0)
+}
+
+func TestMapMaxLen(t *testing.T) {
+	tr := NewMapOptions[int, int](Options{Degree: 3, MaxLen: 100})
+	for _, i := range rand.Perm(1000) {
+		tr.Set(i, i)
+		assert(tr.Len() <= 100)
+	}
+	tr.sane()
+	key, _, _ := tr.Min()
+	assert(tr.Len() == 100 && key == 900)
+	key, _, ok, _, _ := tr.SetEvict(-1, -1)
+	assert(ok && key == -1)
+	key, value, ok, _, replaced := tr.SetEvict(1000, 1000)
+	assert(ok && !replaced && key == 900 && value == 900)
+	tr = NewMapOptions[int, int](Options{MaxLen: 10, EvictPolicy: EvictMax})
+	for i := 0; i < 100; i++ {
+		tr.Load(i, i)
+	}
+	key, _, _ = tr.Max()
+	assert(tr.Len() == 10 && key == 9)
+	_, _, err := tr.SetE(-1, -1)
+	assert(err == nil && tr.Len() == 10)
+	key, _, _ = tr.Max()
+	assert(key == 8)
+
+	// ApplyFunc inserts
+	tr = NewMapOptions[int, int](Options{Degree: 3, MaxLen: 10})
+	for i := 0; i < 100; i++ {
+		tr.ApplyFunc(i, func(value *int, exists bool) { *value = i })
+		assert(tr.Len() <= 10)
+	}
+	tr.sane()
+	key, _, _ = tr.Min()
+	assert(tr.Len() == 10 && key == 90)
+
+	// MergePolicy
+	for _, policy := range []EvictPolicy{EvictMin, EvictMax} {
+		tr = NewMapOptions[int, int](Options{Degree: 3, MaxLen: 10,
+			EvictPolicy: policy})
+		var other Map[int, int]
+		for i := 0; i < 50; i++ {
+			tr.Set(i*2, i)
+			other.Set(i*2+1, i)
+		}
+		tr.MergePolicy(&other, KeepRight)
+		tr.sane()
+		keys, _ := tr.KeyValues()
+		expect := []int{90, 91, 92, 93, 94, 95, 96, 97, 98, 99}
+		if policy == EvictMax {
+			expect = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+		}
+		assert(reflect.DeepEqual(keys, expect))
+	}
+}
+
+func TestMapMultiGet(t *testing.T) {
+	tr := NewMapOptions[int, int](Options{Degree: 4})
+	for i := 0; i < 10000; i++ {
+		tr.Set(i*2, i)
+	}
+	keys := rand.Perm(20010)
+	keys = append(keys, keys[:100]...)
+	keys = append(keys, -1, -1)
+	orig := append([]int(nil), keys...)
+	values, found := tr.MultiGet(keys)
+	assert(reflect.DeepEqual(keys, orig))
+	assert(len(values) == len(keys) && len(found) == len(keys))
+	for i, key := range keys {
+		v, ok := tr.Get(key)
+		assert(found[i] == ok && values[i] == v)
+	}
+	values, found = tr.MultiGet(nil)
+	assert(len(values) == 0 && len(found) == 0)
+	var empty Map[int, int]
+	values, found = empty.MultiGet([]int{1, 2})
+	assert(len(values) == 2 && !found[0] && !found[1])
+}
+
+func benchmarkMapClusteredKeys() (*Map[int, int], [][]int) {
+	var tr Map[int, int]
+	for i := 0; i < 1_000_000; i++ {
+		tr.Set(i, i)
+	}
+	batches := make([][]int, 1000)
+	for i := range batches {
+		start := rand.Intn(1_000_000 - 1000)
+		keys := make([]int, 100)
+		for j := range keys {
+			keys[j] = start + rand.Intn(1000)
+		}
+		batches[i] = keys
+	}
+	return &tr, batches
+}
+
+func BenchmarkMapMultiGet(b *testing.B) {
+	tr, batches := benchmarkMapClusteredKeys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.MultiGet(batches[i%len(batches)])
+	}
+}
+
+func BenchmarkMapMultiGetLoop(b *testing.B) {
+	tr, batches := benchmarkMapClusteredKeys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		keys := batches[i%len(batches)]
+		values := make([]int, len(keys))
+		found := make([]bool, len(keys))
+		for j, key := range keys {
+			values[j], found[j] = tr.Get(key)
+		}
+	}
+}
+
+func TestMapLenRange(t *testing.T) {
+	var tr Map[int, int]
+	assert(tr.LenRange(0, 100) == 0)
+	for i := 0; i < 10000; i++ {
+		tr.Set(i*2, i)
+	}
+	for i := 0; i < 1000; i++ {
+		lo, hi := rand.Intn(20100)-50, rand.Intn(20100)-50
+		var n int
+		tr.Ascend(lo, func(key, value int) bool {
+			if key >= hi {
+				return false
+			}
+			n++
+			return true
+		})
+		assert(tr.LenRange(lo, hi) == n)
+	}
+	assert(tr.LenRange(10, 20) == 5 && tr.LenRange(11, 21) == 5)
+	assert(tr.LenRange(20, 10) == 0 && tr.LenRange(10, 10) == 0)
+	var set Set[int]
+	for i := 0; i < 100; i++ {
+		set.Insert(i)
+	}
+	assert(set.LenRange(10, 20) == 10 && set.LenRange(-5, 5) == 5)
+}
+
+func BenchmarkMapLenRange(b *testing.B) {
+	var tr Map[int, int]
+	for i := 0; i < 1_000_000; i++ {
+		tr.Set(i, i)
+	}
+	lo, hi := 100_000, 900_000
+	b.Run("LenRange", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tr.LenRange(lo, hi)
+		}
+	})
+	b.Run("Ascend", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var n int
+			tr.Ascend(lo, func(key, value int) bool {
+				if key >= hi {
+					return false
+				}
+				n++
+				return true
+			})
+		}
+	})
+}
+
+func TestMapDeleteAndNeighbors(t *testing.T) {
+	for _, degree := range []int{2, 3, 16} {
+		tr := NewMap[int, int](degree)
+		_, _, hasPrev, _, _, hasNext, deleted := tr.DeleteAndNeighbors(1)
+		assert(!hasPrev && !hasNext && !deleted)
+		var all []int
+		for _, key := range rand.Perm(1000) {
+			tr.Set(key*2, -key*2)
+			all = append(all, key*2)
+		}
+		sort.Ints(all)
+		_, _, hasPrev, _, _, hasNext, deleted = tr.DeleteAndNeighbors(5)
+		assert(!hasPrev && !hasNext && !deleted && tr.Len() == 1000)
+		for _, key := range rand.Perm(1000) {
+			key *= 2
+			j := sort.SearchInts(all, key)
+			prevKey, prevValue, hasPrev, nextKey, nextValue, hasNext,
+				deleted := tr.DeleteAndNeighbors(key)
+			assert(deleted)
+			assert(hasPrev == (j > 0) && hasNext == (j < len(all)-1))
+			if hasPrev {
+				assert(prevKey == all[j-1] && prevValue == -all[j-1])
+			}
+			if hasNext {
+				assert(nextKey == all[j+1] && nextValue == -all[j+1])
+			}
+			all = append(all[:j], all[j+1:]...)
+			_, ok := tr.Get(key)
+			assert(!ok && tr.Len() == len(all))
+		}
+		tr.sane()
+		assert(tr.Len() == 0)
+	}
+}
+
+func TestMapAround(t *testing.T) {
+	var tr Map[int, int]
+	keys, values := tr.Around(0, 5, 5)
+	assert(len(keys) == 0 && len(values) == 0)
+	var all []int
+	for _, key := range rand.Perm(1000) {
+		if key%3 != 0 {
+			tr.Set(key, -key)
+		}
+	}
+	tr.Scan(func(key, value int) bool {
+		all = append(all, key)
+		return true
+	})
+	for i := 0; i < 1000; i++ {
+		pivot := rand.Intn(1100) - 50
+		before, after := rand.Intn(20), rand.Intn(20)
+		if i%10 == 0 {
+			before, after = before*100, 0
+		}
+		var expect []int
+		j := sort.SearchInts(all, pivot)
+		for k := j - 1; k >= 0 && j-k <= before; k-- {
+			expect = append([]int{all[k]}, expect...)
+		}
+		if j < len(all) && all[j] == pivot {
+			expect = append(expect, pivot)
+			j++
+		}
+		for k := j; k < len(all) && k-j < after; k++ {
+			expect = append(expect, all[k])
+		}
+		keys, values := tr.Around(pivot, before, after)
+		assert(len(keys) == len(expect) && len(values) == len(expect))
+		for k := range keys {
+			assert(keys[k] == expect[k] && values[k] == -expect[k])
+		}
+	}
+	keys, _ = tr.Around(3, 0, 0)
+	assert(len(keys) == 0)
+	keys, _ = tr.Around(4, 0, 0)
+	assert(len(keys) == 1 && keys[0] == 4)
+}
+
+func TestMapTargetNodeBytes(t *testing.T) {
+	var zero Map[int, int]
+	assert(zero.Degree() == 32)
+	tr := NewMapOptions[int, [2048]byte](Options{TargetNodeBytes: 16384})
+	assert(tr.Degree() == 4)
+	tr2 := NewMapOptions[int64, int64](Options{TargetNodeBytes: 4096})
+	assert(tr2.Degree() == 128)
+	var value [2048]byte
+	for i, key := range rand.Perm(10000) {
+		value[0] = byte(key)
+		tr.Set(key, value)
+		tr2.Set(int64(key), int64(key))
+		if i%2 == 0 {
+			tr.Delete(i)
+			tr2.Delete(int64(i))
+		}
+	}
+	tr.sane()
+	tr2.sane()
+	assert(tr.Len() == tr2.Len())
+	tr.Scan(func(key int, value [2048]byte) bool {
+		v, ok := tr2.Get(int64(key))
+		assert(ok && value[0] == byte(v))
+		return true
+	})
+	var set Set[int64]
+	assert(set.Degree() == 32)
+}
+
+func BenchmarkMapTargetNodeBytes(b *testing.B) {
+	keys := rand.Perm(100_000)
+	var value [2048]byte
+	for _, opts := range []struct {
+		name string
+		opts Options
+	}{
+		{"default", Options{}},
+		{"4KB", Options{TargetNodeBytes: 4096}},
+		{"16KB", Options{TargetNodeBytes: 16384}},
+	} {
+		b.Run(opts.name+"/Set", func(b *testing.B) {
+			tr := NewMapOptions[int, [2048]byte](opts.opts)
+			for i := 0; i < b.N; i++ {
+				tr.Set(keys[i%len(keys)], value)
+			}
+		})
+		b.Run(opts.name+"/Get", func(b *testing.B) {
+			tr := NewMapOptions[int, [2048]byte](opts.opts)
+			for _, key := range keys {
+				tr.Set(key, value)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tr.Get(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func TestMapCopyWithFilter(t *testing.T) {
+	for _, N := range []int{0, 1, 10, 1000, 10000} {
+		tr := NewMapOptions[int, int](Options{Degree: 4})
+		for _, key := range randMapKeys(N) {
+			tr.Set(key, key*10)
+		}
+		tr2 := tr.CopyWithFilter(func(key, value int) bool {
+			return value%30 == 0
+		})
+		tr.sane()
+		tr2.sane()
+		assert(tr.Len() == N && tr2.Len() == (N+2)/3)
+		assert(tr2.max == tr.max && tr2.locks)
+		i := 0
+		tr2.Scan(func(key, value int) bool {
+			assert(key == i*3 && value == key*10)
+			i++
+			return true
+		})
+		tr2.Delete(0)
+		_, ok := tr.Get(0)
+		assert(ok == (N > 0))
+		assert(tr.CopyWithFilter(func(key, value int) bool {
+			return false
+		}).Len() == 0)
+	}
+}
+
+func TestMapApplyFunc(t *testing.T) {
+	var tr Map[int, int]
+	for i := 0; i < 1000; i++ {
+		tr.ApplyFunc(i%100, func(value *int, exists bool) {
+			assert(exists == (i >= 100) && *value == i/100)
+			*value++
+		})
+	}
+	tr.sane()
+	assert(tr.Len() == 100)
+	for i := 0; i < 100; i++ {
+		v, ok := tr.Get(i)
+		assert(ok && v == 10)
+	}
+
+	// values are isolated from copies
+	tr2 := tr.Copy()
+	tr2.ApplyFunc(50, func(value *int, exists bool) {
+		*value = -1
+	})
+	v, _ := tr.Get(50)
+	v2, _ := tr2.Get(50)
+	assert(v == 10 && v2 == -1)
+
+	// large values are updated without copying
+	var tr3 Map[int, [1024]byte]
+	tr3.ApplyFunc(1, func(value *[1024]byte, exists bool) {
+		value[0] = 1
+	})
+	tr3.ApplyFunc(1, func(value *[1024]byte, exists bool) {
+		assert(exists && value[0] == 1)
+		value[1023] = 2
+	})
+	v3, _ := tr3.Get(1)
+	assert(v3[0] == 1 && v3[1023] == 2)
+}
+
+func TestMapCompareAndSwap(t *testing.T) {
+	tr := NewMapOptions[int, int](Options{DetectReentrancy: true})
+	eq := func(a, b int) bool { return a == b }
+	assert(!tr.CompareAndSwap(1, 0, 1, eq))
+	assert(tr.Len() == 0)
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, i)
+	}
+	tr2 := tr.Copy()
+	for i := 0; i < 1000; i++ {
+		// success
+		assert(tr.CompareAndSwap(i, i, i+1, eq))
+		v, ok := tr.Get(i)
+		assert(ok && v == i+1)
+		// failure, the value has changed
+		assert(!tr.CompareAndSwap(i, i, -1, eq))
+		v, ok = tr.Get(i)
+		assert(ok && v == i+1)
+	}
+	// missing key
+	assert(!tr.CompareAndSwap(1000, 0, 0, eq))
+	_, ok := tr.Get(1000)
+	assert(!ok && tr.Len() == 1000)
+	tr.sane()
+	// values are isolated from copies
+	for i := 0; i < 1000; i++ {
+		v, _ := tr2.Get(i)
+		assert(v == i)
+	}
+	// only a swap copies the path of a shared map
+	var copies int
+	tr3 := NewMapOptions[int, int](Options{Degree: 3,
+		OnCopy: func(level int) { copies++ }})
+	for i := 0; i < 1000; i++ {
+		tr3.Set(i, i)
+	}
+	tr4 := tr3.Copy()
+	assert(!tr4.CompareAndSwap(-1, 0, 0, eq))
+	assert(!tr4.CompareAndSwap(500, 0, 0, eq))
+	assert(copies == 0)
+	assert(tr4.CompareAndSwap(500, 500, -500, eq))
+	assert(copies > 0 && copies <= tr4.Height())
+	v, _ := tr4.Get(500)
+	v3, _ := tr3.Get(500)
+	assert(v == -500 && v3 == 500)
+	tr4.sane()
+	// the map is locked during eq
+	func() {
+		defer func() { assert(recover() != nil) }()
+		tr.CompareAndSwap(1, 2, 3, func(a, b int) bool {
+			tr.Delete(2)
+			return true
+		})
+	}()
+	assert(tr.Len() == 1000)
+}
+
+func TestMapMinMaxRef(t *testing.T) {
+	var tr Map[int, int]
+	_, ref, ok := tr.MinRef()
+	assert(!ok && ref == nil)
+	_, ref, ok = tr.MaxRef()
+	assert(!ok && ref == nil)
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, i)
+	}
+	tr2 := tr.Copy()
+	key, ref, ok := tr2.MinRef()
+	assert(ok && key == 0 && *ref == 0)
+	*ref = -1
+	key, ref, ok = tr2.MaxRef()
+	assert(ok && key == 999 && *ref == 999)
+	*ref = -999
+	// the original is not affected
+	v, _ := tr.Get(0)
+	assert(v == 0)
+	v, _ = tr.Get(999)
+	assert(v == 999)
+	v, _ = tr2.Get(0)
+	assert(v == -1)
+	v, _ = tr2.Get(999)
+	assert(v == -999)
+	_, ref, _ = tr.MinRef()
+	*ref++
+	v, _ = tr.Get(0)
+	assert(v == 1)
+	v, _ = tr2.Get(0)
+	assert(v == -1)
+	tr.sane()
+	tr2.sane()
+}
+
+func TestMapPeek(t *testing.T) {
+	var tr Map[int, int]
+	for _, msg := range []string{"PeekMin", "PeekMax"} {
+		func() {
+			defer func() {
+				assert(recover() == "btree: "+msg+" on empty Map")
+			}()
+			if msg == "PeekMin" {
+				tr.PeekMin()
+			} else {
+				tr.PeekMax()
+			}
+		}()
+	}
+	for i := 1; i <= 100; i++ {
+		tr.Set(i, -i)
+	}
+	key, value := tr.PeekMin()
+	assert(key == 1 && value == -1)
+	key, value = tr.PeekMax()
+	assert(key == 100 && value == -100)
+}
+
+func TestMapAppendKeys(t *testing.T) {
+	var tr Map[int, int]
+	assert(len(tr.AppendKeys(nil)) == 0 && len(tr.AppendValues(nil)) == 0)
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, -i)
+	}
+	keys := tr.AppendKeys([]int{-1})
+	values := tr.AppendValues(nil)
+	assert(len(keys) == 1001 && keys[0] == -1 && len(values) == 1000)
+	for i := 0; i < 1000; i++ {
+		assert(keys[i+1] == i && values[i] == -i)
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		keys = tr.AppendKeys(keys[:0])
+		values = tr.AppendValues(values[:0])
+	})
+	assert(allocs == 0)
+	assert(reflect.DeepEqual(keys, tr.Keys()))
+	assert(reflect.DeepEqual(values, tr.Values()))
+}
+
+func TestMapNoLocksCopy(t *testing.T) {
+	// Run with -race. Copy must not race with readers of a NoLocks map.
+	tr := NewMapOptions[int, int](Options{NoLocks: true})
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, i)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			v, ok := tr.Get(j)
+			assert(ok && v == j)
+			var n int
+			tr.Scan(func(key, value int) bool {
+				n++
+				return true
+			})
+			assert(n == 1000 && tr.Len() == 1000)
+		}
+	}()
+	copies := make([]*Map[int, int], 100)
+	go func() {
+		defer wg.Done()
+		for i := range copies {
+			copies[i] = tr.Copy()
+		}
+	}()
+	wg.Wait()
+	for _, tr2 := range copies {
+		tr2.Delete(0)
+		assert(tr2.Len() == 999)
+	}
+	assert(tr.Len() == 1000)
+}
+
+func TestMapThreadSafeCopy(t *testing.T) {
+	// Run with -race. The map is guarded by mu, which ThreadSafeCopy takes,
+	// while a writer changes the map.
+	var mu sync.RWMutex
+	var tr Map[int, int]
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, i)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			mu.Lock()
+			tr.Set(i, -i)
+			mu.Unlock()
+			mu.RLock()
+			v, ok := tr.Get(i)
+			mu.RUnlock()
+			assert(ok && v == -i)
+		}
+	}()
+	copies := make([]*Map[int, int], 100)
+	go func() {
+		defer wg.Done()
+		for i := range copies {
+			copies[i] = tr.ThreadSafeCopy(&mu)
+		}
+	}()
+	wg.Wait()
+	for _, tr2 := range copies {
+		tr2.Scan(func(key, value int) bool {
+			assert(value == key || value == -key)
+			return true
+		})
+		tr2.Set(0, 1)
+		assert(tr2.Len() == 1000)
+	}
+	v, _ := tr.Get(0)
+	assert(v == 0)
+}
+
+func TestMapQuantile(t *testing.T) {
+	var tr Map[int, int]
+	_, _, ok := tr.Quantile(0)
+	assert(!ok)
+	for i := 0; i < 10; i++ {
+		tr.Set(i, i*10)
+	}
+	key, value, ok := tr.Quantile(0.55)
+	assert(ok && key == 5 && value == 50)
+	key, _, ok = tr.Quantile(1)
+	assert(ok && key == 9)
+	key, _, ok = tr.Percentile(0)
+	assert(ok && key == 0)
+	_, _, ok = tr.Percentile(-1)
+	assert(!ok)
+}
+
+func TestMapQuantiles(t *testing.T) {
+	var tr Map[int, int]
+	assert(tr.Quantiles([]float64{0.5}) == nil)
+	for _, N := range []int{1, 7, 1000, 100_000} {
+		tr.Clear()
+		for tr.Len() < N {
+			key := int(math.Exp(rand.Float64() * 20))
+			tr.Set(key, -key)
+		}
+		keys := tr.Keys()
+		var qs []float64
+		for i := 0; i < 50; i++ {
+			qs = append(qs, rand.Float64())
+		}
+		qs = append(qs, 1, 0, 0.5, 0.5)
+		for i, key := range tr.Quantiles(qs) {
+			assert(key == keys[int(math.Round(qs[i]*float64(N-1)))])
+		}
+	}
+	func() {
+		defer func() { assert(recover() != nil) }()
+		tr.Quantiles([]float64{2})
+	}()
+}
+
+// testMapNodeWaste returns the unused capacity of the node slices, and the
+// number of nodes.
+func testMapNodeWaste(n *mapNode[int, int]) (waste, nodes int) {
+	waste, nodes = cap(n.items)-len(n.items), 1
+	if !n.leaf() {
+		waste += cap(*n.children) - len(*n.children)
+		for _, child := range *n.children {
+			w, c := testMapNodeWaste(child)
+			waste, nodes = waste+w, nodes+c
+		}
+	}
+	return waste, nodes
+}
+
+func TestMapShrink(t *testing.T) {
+	var tr Map[int, int]
+	tr.Shrink()
+	for i := 0; i < 100_000; i++ {
+		tr.Set(i, i)
+	}
+	tr2 := tr.Copy()
+	for i := 0; i < 100_000; i++ {
+		if i%10 != 0 {
+			tr.Delete(i)
+		}
+	}
+	waste, _ := testMapNodeWaste(tr.root)
+	assert(waste > 0)
+	tr.Shrink()
+	tr.sane()
+	waste, nodes := testMapNodeWaste(tr.root)
+	assert(waste == 0 && tr.root.countIsoid(tr.isoid) == nodes)
+	for i := 0; i < 100_000; i++ {
+		v, ok := tr.Get(i)
+		assert(ok == (i%10 == 0) && (!ok || v == i))
+	}
+	// the copy is untouched, and the map can still grow
+	assert(tr2.Len() == 100_000)
+	tr2.sane()
+	for i := 0; i < 100_000; i++ {
+		tr.Set(i, -i)
+	}
+	tr.sane()
+	assert(tr.Len() == 100_000)
+}
+
+func BenchmarkMapShrink(b *testing.B) {
+	var ms runtime.MemStats
+	heap := func() uint64 {
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+	var before, after uint64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		var tr Map[int, int]
+		for i := 0; i < 1_000_000; i++ {
+			tr.Set(i, i)
+		}
+		for i := 0; i < 1_000_000; i++ {
+			if i%10 != 0 {
+				tr.Delete(i)
+			}
+		}
+		before = heap()
+		b.StartTimer()
+		tr.Shrink()
+		b.StopTimer()
+		after = heap()
+		runtime.KeepAlive(&tr)
+	}
+	b.ReportMetric(float64(before), "heap-before")
+	b.ReportMetric(float64(after), "heap-after")
+}
+
+func TestMapCapacity(t *testing.T) {
+	func() {
+		defer func() { assert(recover() == "btree: negative capacity") }()
+		NewMapOptions[int, int](Options{Capacity: -1})
+	}()
+	tr := NewMapOptions[int, int](Options{Degree: 4, Capacity: 100})
+	tr.Set(1, 1)
+	assert(cap(tr.root.items) == tr.max)
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, i)
+	}
+	tr.sane()
+	tr.Clear()
+	tr.Set(1, 1)
+	assert(cap(tr.root.items) == tr.max)
+}
+
+func TestMapScanBatch(t *testing.T) {
+	tr := NewMapOptions[int, int](Options{Degree: 3})
+	tr.ScanBatch(10, func(keys, values []int) bool { panic("!") })
+	for _, i := range rand.Perm(1000) {
+		tr.Set(i, i*10)
+	}
+	for _, size := range []int{1, 3, 7, 100, 999, 1000, 5000} {
+		var n, batches int
+		tr.ScanBatch(size, func(keys, values []int) bool {
+			assert(len(keys) == len(values) && len(keys) <= size)
+			if n+size <= 1000 {
+				assert(len(keys) == size)
+			}
+			for i := range keys {
+				assert(keys[i] == n && values[i] == n*10)
+				n++
+			}
+			batches++
+			return true
+		})
+		assert(n == 1000 && batches == (1000+size-1)/size)
+	}
+	var batches int
+	tr.ScanBatch(10, func(keys, values []int) bool {
+		batches++
+		return batches < 3
+	})
+	assert(batches == 3)
+}
+
+func TestMapScanLimit(t *testing.T) {
+	N := 10_000
+	tr := NewMapOptions[int, int](Options{})
+	ref := make(map[int]bool)
+	for i := 0; i < N; i++ {
+		tr.Set(i*2, i)
+		ref[i*2] = true
+	}
+	// expect returns the first limit keys that are >= key
+	expect := func(key, limit int) []int {
+		var keys []int
+		for k := range ref {
+			if k >= key {
+				keys = append(keys, k)
+			}
+		}
+		sort.Ints(keys)
+		if len(keys) > limit {
+			keys = keys[:limit]
+		}
+		return keys
+	}
+	var resume *int
+	var chunks int
+	for {
+		from := -1
+		if resume != nil {
+			from = *resume
+		}
+		want := expect(from, 100)
+		var keys []int
+		writer := make(chan bool)
+		next, done := tr.ScanLimit(100, resume, func(key, value int) bool {
+			if len(keys) == 0 {
+				// a writer that waits for the lock of this chunk
+				go func() {
+					tr.Set(-1, -1)
+					writer <- true
+				}()
+			}
+			keys = append(keys, key)
+			return true
+		})
+		<-writer
+		_, ok := tr.Delete(-1)
+		assert(ok)
+		assert(reflect.DeepEqual(keys, want))
+		chunks++
+		if done {
+			assert(next == nil && len(expect(from, N*2)) <= 100)
+			break
+		}
+		assert(*next > keys[len(keys)-1] && ref[*next])
+		// change unrelated keys behind and ahead of the cursor
+		for i := 0; i < 10; i++ {
+			key := rand.Intn(N*2 + 100)
+			if rand.Intn(2) == 0 {
+				tr.Set(key, key)
+				ref[key] = true
+			} else {
+				tr.Delete(key)
+				delete(ref, key)
+			}
+		}
+		resume = next
+	}
+	assert(chunks > 50)
+
+	// stopping early
+	var n int
+	next, done := tr.ScanLimit(100, nil, func(key, value int) bool {
+		n++
+		return n < 10
+	})
+	assert(n == 10 && next == nil && done)
+	var empty Map[int, int]
+	next, done = empty.ScanLimit(1, nil, func(key, value int) bool {
+		panic("!")
+	})
+	assert(next == nil && done)
+	func() {
+		defer func() { assert(recover() == "btree: limit must be positive") }()
+		empty.ScanLimit(0, nil, nil)
+	}()
+}
+
+func TestMapIterReleaseCopy(t *testing.T) {
+	tr := NewMapOptions[int, int](Options{})
+	for i := 0; i < 100; i++ {
+		tr.Set(i, i)
+	}
+	iter := tr.Iter()
+	iter2 := iter
+	defer iter.Release()
+	iter2.Release()
+	iter.Release()
+	done := make(chan bool)
+	go func() {
+		tr.Set(100, 100)
+		done <- true
+	}()
+	<-done
+	assert(tr.Len() == 101)
+}
+
+func TestMapUnsafeIter(t *testing.T) {
+	tr := NewMapOptions[int, int](Options{})
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, -i)
+	}
+	iter := tr.UnsafeIter()
+	assert(iter.locked == nil)
+	var i int
+	for ok := iter.First(); ok; ok = iter.Next() {
+		assert(iter.Key() == i && iter.Value() == -i)
+		i++
+	}
+	assert(i == 1000)
+	tr.Set(1000, -1000)
+	assert(iter.Last() && iter.Key() == 1000)
+	iter.Release()
+}
+
+func TestMapOnStructureChange(t *testing.T) {
+	var ops []string
+	tr := NewMapOptions[int, int](Options{
+		Degree:            3,
+		OnStructureChange: func(op string) { ops = append(ops, op) },
+	})
+	nodes := func() int {
+		if tr.root == nil {
+			return 0
+		}
+		_, nodes := testMapNodeWaste(tr.root)
+		return nodes
+	}
+	N := 1000
+	for i := 0; i < 20_000; i++ {
+		key := rand.Intn(N)
+		before := nodes()
+		ops = ops[:0]
+		var op string
+		switch rand.Intn(8) {
+		case 0, 1:
+			op = "Set"
+			tr.Set(key, key)
+		case 2:
+			op = "Load"
+			tr.Load(N+i, i)
+		case 3:
+			op = "ApplyFunc"
+			tr.ApplyFunc(key, func(value *int, exists bool) {})
+		case 4:
+			op = "Delete"
+			tr.Delete(key)
+		case 5:
+			op = "PopMin"
+			tr.PopMin()
+		case 6:
+			op = "PopMax"
+			tr.PopMax()
+		case 7:
+			op = "DeleteAt"
+			tr.DeleteAt(key)
+		}
+		if nodes() == before {
+			assert(len(ops) == 0)
+		} else {
+			assert(len(ops) == 1 && ops[0] == op)
+		}
+	}
+	tr.sane()
+	tr.Set(-1, -1)
+	ops = ops[:0]
+	tr.Clear()
+	tr.Clear()
+	assert(len(ops) == 1 && ops[0] == "Clear")
+}
+
+func TestMapEnumerate(t *testing.T) {
+	var tr Map[int, int]
+	for _, i := range rand.Perm(1000) {
+		tr.Set(i, -i)
+	}
+	var n int
+	tr.Enumerate(1, func(index, key, value int) bool {
+		assert(index == n+1 && key == n && value == -n)
+		n++
+		return true
+	})
+	assert(n == 1000)
+}
+
+func TestMapGetOr(t *testing.T) {
+	tr := NewMapOptions[string, int](Options{})
+	assert(tr.GetOr("a", -1) == -1)
+	tr.Set("a", 1)
+	assert(tr.GetOr("a", -1) == 1 && tr.GetOr("b", -1) == -1)
+	var calls int
+	def := func() int {
+		calls++
+		// the map is not locked
+		tr.Set("c", 3)
+		return -1
+	}
+	assert(tr.GetOrFunc("a", def) == 1 && calls == 0)
+	assert(tr.GetOrFunc("b", def) == -1 && calls == 1)
+	assert(tr.GetOr("c", -1) == 3)
+}
+
+func TestMapToSortedSlice(t *testing.T) {
+	var tr Map[int, int]
+	for _, i := range rand.Perm(1000) {
+		tr.Set(i, -i)
+	}
+	keys, values := tr.ToSortedSlice()
+	assert(len(keys) == 1000 && len(values) == 1000)
+	for i := range keys {
+		assert(keys[i] == i && values[i] == -i)
+	}
+}
+
+func TestMapLockPairOrder(t *testing.T) {
+	a := NewMapOptions[int, int](Options{})
+	b := NewMapOptions[int, int](Options{})
+	for i := 0; i < 100; i++ {
+		a.Set(i, i)
+		b.Set(i, i)
+	}
+	// Two-map operations in both orders, with writers waiting on both maps,
+	// must not deadlock.
+	ops := []func(x, y *Map[int, int]){
+		func(x, y *Map[int, int]) { x.Intersection(y) },
+		func(x, y *Map[int, int]) { x.Union(y, nil) },
+		func(x, y *Map[int, int]) { x.Subtract(y) },
+		func(x, y *Map[int, int]) { x.Diff(y) },
+		func(x, y *Map[int, int]) { x.MergePolicy(y, KeepLeft) },
+	}
+	done := make(chan bool)
+	go func() {
+		var wg sync.WaitGroup
+		for _, op := range ops {
+			for _, pair := range [][2]*Map[int, int]{{a, b}, {b, a}} {
+				wg.Add(1)
+				go func(op func(x, y *Map[int, int]), x, y *Map[int, int]) {
+					defer wg.Done()
+					for i := 0; i < 1000; i++ {
+						op(x, y)
+					}
+				}(op, pair[0], pair[1])
+			}
+		}
+		for _, tr := range []*Map[int, int]{a, b} {
+			wg.Add(1)
+			go func(tr *Map[int, int]) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					tr.Set(i%100, i)
+				}
+			}(tr)
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("deadlock")
+	}
+}
+
+type testMergeVec struct{ x, y int }
+
+func (v testMergeVec) Add(other testMergeVec) testMergeVec {
+	return testMergeVec{v.x + other.x, v.y + other.y}
+}
+
+func (v testMergeVec) Less(other testMergeVec) bool {
+	return v.x*v.x+v.y*v.y < other.x*other.x+other.y*other.y
+}
+
+func TestMapDiff(t *testing.T) {
+	var m1, m2 Map[int, int]
+	for i := 0; i < 1000; i++ {
+		m1.Set(i, i)
+		m2.Set(i+100, i+100)
+	}
+	for i := 500; i < 600; i++ {
+		m2.Set(i, -i)
+	}
+	d := m1.Diff(&m2)
+	assert(d.Added.Len() == 100 && d.Removed.Len() == 100)
+	assert(d.Changed.Len() == 100)
+	v, _ := d.Added.Get(1050)
+	assert(v == 1050)
+	_, ok := d.Removed.Get(50)
+	assert(ok)
+	v, _ = d.Changed.Get(550)
+	assert(v == -550)
+	m3 := m1.Copy()
+	d.Apply(m3)
+	assert(testMapEqual(m3, &m2))
+	d.Invert().Apply(m3)
+	assert(testMapEqual(m3, &m1))
+	d = m1.Diff(&m1)
+	assert(d.Added.Len() == 0 && d.Removed.Len() == 0)
+	assert(d.Changed.Len() == 0)
+	d = MapDiff[int, int]{Removed: m1.Copy()}
+	d.Apply(m3)
+	assert(m3.Len() == 0)
+	d.Invert().Apply(m3)
+	assert(testMapEqual(m3, &m1))
+}
+
+func TestMapMergePolicy(t *testing.T) {
+	type myFloat float64
+	policies := []ConflictPolicy{KeepLeft, KeepRight, KeepMin, KeepMax, Sum}
+	for _, policy := range policies {
+		var a, b Map[int, myFloat]
+		for i := 0; i < 1000; i++ {
+			a.Set(i*2, myFloat(rand.Intn(100)))
+			b.Set(i*3, myFloat(rand.Intn(100)))
+		}
+		a2 := a.Copy()
+		a.MergePolicy(&b, policy)
+		a.sane()
+		for i := 0; i < 3000; i++ {
+			v1, ok1 := a2.Get(i)
+			v2, ok2 := b.Get(i)
+			v, ok := a.Get(i)
+			assert(ok == (ok1 || ok2))
+			switch {
+			case !ok1 && !ok2:
+			case ok1 && !ok2:
+				assert(v == v1)
+			case !ok1 && ok2:
+				assert(v == v2)
+			case policy == KeepLeft:
+				assert(v == v1)
+			case policy == KeepRight:
+				assert(v == v2)
+			case policy == KeepMin:
+				assert(v == myFloat(math.Min(float64(v1), float64(v2))))
+			case policy == KeepMax:
+				assert(v == myFloat(math.Max(float64(v1), float64(v2))))
+			case policy == Sum:
+				assert(v == v1+v2)
+			}
+		}
+		// the copy and the other map are unchanged
+		assert(a2.Len() == 1000 && b.Len() == 1000)
+		// merging with itself
+		a.MergePolicy(&a, policy)
+		assert(a.Len() == 1000+1000-334)
+	}
+
+	// Adder and Orderer values
+	var a, b Map[string, testMergeVec]
+	a.Set("a", testMergeVec{1, 2})
+	a.Set("b", testMergeVec{5, 5})
+	b.Set("a", testMergeVec{3, 0})
+	b.Set("c", testMergeVec{1, 1})
+	a2 := a.Copy()
+	a2.MergePolicy(&b, Sum)
+	assert(a2.GetOr("a", testMergeVec{}) == testMergeVec{4, 2})
+	a2 = a.Copy()
+	a2.MergePolicy(&b, KeepMin)
+	assert(a2.GetOr("a", testMergeVec{}) == testMergeVec{1, 2})
+	a2.MergePolicy(&b, KeepMax)
+	assert(a2.GetOr("a", testMergeVec{}) == testMergeVec{3, 0})
+	assert(a2.Len() == 3)
+
+	// unsupported values leave the map unchanged
+	var c, d Map[int, []int]
+	c.Set(1, []int{1})
+	d.Set(1, []int{2})
+	d.Set(2, []int{2})
+	for _, policy := range []ConflictPolicy{KeepMin, Sum, 100} {
+		func() {
+			defer func() { assert(recover() != nil) }()
+			c.MergePolicy(&d, policy)
+		}()
+		assert(c.Len() == 1)
+	}
+	c.MergePolicy(&d, KeepRight)
+	assert(c.Len() == 2 && c.GetOr(1, nil)[0] == 2)
+}
+
+func assertFrozen(f func()) {
+	defer func() {
+		assert(recover() == ErrFrozen)
+	}()
+	f()
+}
+
+func TestMapFreeze(t *testing.T) {
+	tr := NewMapOptions[int, int](Options{DetectReentrancy: true})
+	for i := 0; i < 100; i++ {
+		tr.Set(i, i)
+	}
+	assert(!tr.Frozen())
+	tr.Freeze()
+	tr.Freeze()
+	assert(tr.Frozen())
+	other := new(Map[int, int])
+	other.Set(1000, 1000)
+	data, err := other.GobEncode()
+	assert(err == nil)
+	for _, f := range []func(){
+		func() { tr.Set(1000, 1000) },
+		func() { tr.SetE(1000, 1000) },
+		func() { tr.SetEvict(1000, 1000) },
+		func() { tr.Load(1000, 1000) },
+		func() { tr.ApplyFunc(0, func(*int, bool) {}) },
+		func() { tr.CompareAndSwap(0, 0, 1, func(a, b int) bool { return true }) },
+		func() { tr.UpdateRange(0, 10, func(k, v int) int { return v }) },
+		func() { tr.Delete(0) },
+		func() { tr.Delete(1000) },
+		func() { tr.DeleteAndNeighbors(0) },
+		func() { tr.DeleteAt(0) },
+		func() { tr.PopMin() },
+		func() { tr.PopMax() },
+		func() { tr.PopMinN(1) },
+		func() { tr.PopMaxN(1) },
+		func() { tr.Clear() },
+		func() { tr.ClearWithDegree(2) },
+		func() { tr.Reinit(2) },
+		func() { tr.Shrink() },
+		func() { tr.MergePolicy(other, KeepLeft) },
+		func() { tr.GobDecode(data) },
+		func() { tr.GetMut(0) },
+		func() { tr.GetAtMut(0) },
+		func() { tr.MinMut() },
+		func() { tr.MaxMut() },
+		func() { tr.MinRef() },
+		func() { tr.MaxRef() },
+		func() { tr.ScanMut(func(k, v int) bool { return true }) },
+		func() { tr.ScanMutIf(func(k int, v *int) bool { return false }) },
+		func() { tr.AscendMut(0, func(k, v int) bool { return true }) },
+		func() { tr.DescendMut(0, func(k, v int) bool { return true }) },
+		func() { tr.ReverseMut(func(k, v int) bool { return true }) },
+		func() { tr.ValuesMut() },
+		func() { tr.KeyValuesMut() },
+		func() { tr.IterMut() },
+		func() { tr.Cursor().Set(1000, 1000) },
+		func() { tr.Cursor().Delete(0) },
+	} {
+		assertFrozen(f)
+	}
+	assert(tr.Len() == 100)
+	tr.sane()
+
+	// reads do not take the lock, so they are not blocked by a held lock
+	tr.mu.Lock()
+	v, ok := tr.Get(50)
+	assert(ok && v == 50)
+	iter := tr.Iter()
+	assert(iter.First() && iter.Key() == 0)
+	iter.Release()
+	keys, _ := tr.Around(50, 1, 1)
+	assert(len(keys) == 3)
+	assert(len(tr.Intersection(tr).Keys()) == 100)
+	tr.mu.Unlock()
+
+	// the copy is not frozen and is isolated from the frozen map
+	tr2 := tr.Copy()
+	assert(!tr2.Frozen() && tr2.Len() == 100)
+	tr2.Set(1000, 1000)
+	tr2.Delete(0)
+	tr2.sane()
+	_, ok = tr.Get(0)
+	assert(ok && tr.Len() == 100)
+	_, ok = tr.Get(1000)
+	assert(!ok)
+	tr.sane()
+
+	// a zero-value map can be frozen
+	var tr3 Map[int, int]
+	tr3.Freeze()
+	_, ok = tr3.Get(0)
+	assert(!ok)
+	assertFrozen(func() { tr3.Set(0, 0) })
+}
+
+func BenchmarkMapFreeze(b *testing.B) {
+	tr := NewMapOptions[int, int](Options{})
+	for i := 0; i < 1000; i++ {
+		tr.Set(i, i)
+	}
+	b.Run("Locked", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tr.Get(i % 1000)
+		}
+	})
+	tr.Freeze()
+	b.Run("Frozen", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tr.Get(i % 1000)
+		}
+	})
+}
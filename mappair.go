@@ -0,0 +1,15 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !tinygo
+
+package btree
+
+type mapPair[K ordered, V any] struct {
+	// The `value` field should be before the `key` field because doing so
+	// allows for the Go compiler to optimize away the `value` field when
+	// it's a `struct{}`, which is the case for `btree.Set`.
+	value V
+	key   K
+}
@@ -0,0 +1,16 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build tinygo
+
+package btree
+
+// mapPair puts the key first when building with TinyGo. The value-first
+// layout, which lets the Go compiler optimize away a struct{} value, crashes
+// the LLVM instruction selection of some TinyGo versions for Map types with
+// a zero-size value, such as the one used by Set.
+type mapPair[K ordered, V any] struct {
+	key   K
+	value V
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package btree
+
+// OrderedMap is the minimal set of methods shared by the ordered maps in this
+// package. It's intended for code that needs to swap between implementations,
+// such as tests and benchmarks.
+type OrderedMap[K, V any] interface {
+	Get(key K) (V, bool)
+	Set(key K, value V) (V, bool)
+	Delete(key K) (V, bool)
+	Len() int
+	Scan(iter func(key K, value V) bool)
+	Ascend(pivot K, iter func(key K, value V) bool)
+	Descend(pivot K, iter func(key K, value V) bool)
+	Min() (K, V, bool)
+	Max() (K, V, bool)
+}
+
+var (
+	_ OrderedMap[string, int] = (*Map[string, int])(nil)
+	_ OrderedMap[string, int] = (*KeyedBTreeG[string, int])(nil)
+)
+
+type keyedItem[K, V any] struct {
+	key   K
+	value V
+}
+
+// KeyedBTreeG adapts a BTreeG to the OrderedMap interface by storing key/value
+// pairs that are ordered by key.
+type KeyedBTreeG[K, V any] struct {
+	base *BTreeG[keyedItem[K, V]]
+}
+
+// NewKeyedBTreeG returns a new KeyedBTreeG that orders keys using less.
+func NewKeyedBTreeG[K, V any](less func(a, b K) bool) *KeyedBTreeG[K, V] {
+	return NewKeyedBTreeGOptions[K, V](less, Options{})
+}
+
+// NewKeyedBTreeGOptions is the same as NewKeyedBTreeG, but with options.
+func NewKeyedBTreeGOptions[K, V any](less func(a, b K) bool, opts Options,
+) *KeyedBTreeG[K, V] {
+	return &KeyedBTreeG[K, V]{
+		base: NewBTreeGOptions(func(a, b keyedItem[K, V]) bool {
+			return less(a.key, b.key)
+		}, opts),
+	}
+}
+
+// Get a value for key.
+func (tr *KeyedBTreeG[K, V]) Get(key K) (V, bool) {
+	item, ok := tr.base.Get(keyedItem[K, V]{key: key})
+	return item.value, ok
+}
+
+// Set or replace a value for a key.
+// Returns the previous value and true if the key was replaced.
+func (tr *KeyedBTreeG[K, V]) Set(key K, value V) (V, bool) {
+	prev, ok := tr.base.Set(keyedItem[K, V]{key: key, value: value})
+	return prev.value, ok
+}
+
+// Delete a value for a key and returns the deleted value.
+// Returns false if there was no value by that key found.
+func (tr *KeyedBTreeG[K, V]) Delete(key K) (V, bool) {
+	prev, ok := tr.base.Delete(keyedItem[K, V]{key: key})
+	return prev.value, ok
+}
+
+// Len returns the number of items in the tree.
+func (tr *KeyedBTreeG[K, V]) Len() int {
+	return tr.base.Len()
+}
+
+// Scan all items in ascending order.
+func (tr *KeyedBTreeG[K, V]) Scan(iter func(key K, value V) bool) {
+	tr.base.Scan(func(item keyedItem[K, V]) bool {
+		return iter(item.key, item.value)
+	})
+}
+
+// Ascend the tree within the range [pivot, last].
+func (tr *KeyedBTreeG[K, V]) Ascend(pivot K,
+	iter func(key K, value V) bool,
+) {
+	tr.base.Ascend(keyedItem[K, V]{key: pivot},
+		func(item keyedItem[K, V]) bool {
+			return iter(item.key, item.value)
+		})
+}
+
+// Descend the tree within the range [pivot, first].
+func (tr *KeyedBTreeG[K, V]) Descend(pivot K,
+	iter func(key K, value V) bool,
+) {
+	tr.base.Descend(keyedItem[K, V]{key: pivot},
+		func(item keyedItem[K, V]) bool {
+			return iter(item.key, item.value)
+		})
+}
+
+// Min returns the minimum item in tree.
+// Returns false if the tree has no items.
+func (tr *KeyedBTreeG[K, V]) Min() (K, V, bool) {
+	item, ok := tr.base.Min()
+	return item.key, item.value, ok
+}
+
+// Max returns the maximum item in tree.
+// Returns false if the tree has no items.
+func (tr *KeyedBTreeG[K, V]) Max() (K, V, bool) {
+	item, ok := tr.base.Max()
+	return item.key, item.value, ok
+}
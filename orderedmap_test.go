@@ -0,0 +1,81 @@
+package btree
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func testOrderedMap(tr OrderedMap[int, int]) {
+	N := 10_000
+	// a plain go map is the reference
+	ref := make(map[int]int)
+	for i := 0; i < N; i++ {
+		key := rand.Intn(N)
+		switch rand.Intn(3) {
+		case 0, 1:
+			prev, ok := tr.Set(key, i)
+			prev2, ok2 := ref[key]
+			assert(ok == ok2 && prev == prev2)
+			ref[key] = i
+		case 2:
+			prev, ok := tr.Delete(key)
+			prev2, ok2 := ref[key]
+			assert(ok == ok2 && prev == prev2)
+			delete(ref, key)
+		}
+		assert(tr.Len() == len(ref))
+	}
+	keys := make([]int, 0, len(ref))
+	for key := range ref {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	for key := -1; key <= N; key++ {
+		value, ok := tr.Get(key)
+		value2, ok2 := ref[key]
+		assert(ok == ok2 && value == value2)
+	}
+	var i int
+	tr.Scan(func(key, value int) bool {
+		assert(key == keys[i] && value == ref[key])
+		i++
+		return true
+	})
+	assert(i == len(keys))
+	pivot := N / 2
+	i = sort.SearchInts(keys, pivot)
+	tr.Ascend(pivot, func(key, value int) bool {
+		assert(key == keys[i] && value == ref[key])
+		i++
+		return i < len(keys)-10
+	})
+	assert(i == len(keys)-10)
+	i = sort.SearchInts(keys, pivot+1) - 1
+	tr.Descend(pivot, func(key, value int) bool {
+		assert(key == keys[i] && value == ref[key])
+		i--
+		return true
+	})
+	assert(i == -1)
+	key, value, ok := tr.Min()
+	assert(ok && key == keys[0] && value == ref[key])
+	key, value, ok = tr.Max()
+	assert(ok && key == keys[len(keys)-1] && value == ref[key])
+	for _, key := range keys {
+		tr.Delete(key)
+	}
+	_, _, ok = tr.Min()
+	assert(!ok && tr.Len() == 0)
+	_, _, ok = tr.Max()
+	assert(!ok)
+}
+
+func TestOrderedMap(t *testing.T) {
+	testOrderedMap(new(Map[int, int]))
+	testOrderedMap(NewMap[int, int](3))
+	less := func(a, b int) bool { return a < b }
+	testOrderedMap(NewKeyedBTreeG[int, int](less))
+	testOrderedMap(NewKeyedBTreeGOptions[int, int](less,
+		Options{Degree: 3, NoLocks: true}))
+}
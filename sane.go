@@ -0,0 +1,313 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package btree
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// SaneError is returned by Sane for the first problem found in a tree.
+type SaneError struct {
+	Check string // failed check, such as height, count, order or summary
+	Depth int    // depth of the node, starting at 0 for the root, or -1
+	Path  []int  // child indexes from the root to the node
+	Index int    // index of the item in the node, or -1
+	Item  any    // item at Index, which is the key for a Map
+	Msg   string // description of the problem
+}
+
+func (e *SaneError) Error() string {
+	s := fmt.Sprintf("btree: !sane-%s: %s", e.Check, e.Msg)
+	if e.Depth >= 0 {
+		s += fmt.Sprintf(" (depth %d, path %v", e.Depth, e.Path)
+		if e.Index >= 0 {
+			s += fmt.Sprintf(", index %d, item %v", e.Index, e.Item)
+		}
+		s += ")"
+	}
+	return s
+}
+
+// saneState is the state of a Sane check, which walks the tree in order.
+type saneState[T any] struct {
+	height int   // depth of the leaves plus one
+	path   []int // path to the current node
+	last   T     // last item visited
+	seen   bool  // last is valid
+}
+
+func (st *saneState[T]) errorf(check string, depth, index int, item any,
+	format string, args ...any,
+) *SaneError {
+	return &SaneError{
+		Check: check,
+		Depth: depth,
+		Path:  append([]int{}, st.path...),
+		Index: index,
+		Item:  item,
+		Msg:   fmt.Sprintf(format, args...),
+	}
+}
+
+// isZero returns true if v is the zero value of its type.
+func isZero[T any](v *T) bool {
+	return reflect.ValueOf(v).Elem().IsZero()
+}
+
+// Sane checks the structure of the entire tree and returns a *SaneError
+// describing the first invalid node, or a *ChecksumError when the tree has
+// an item hasher. Returns nil if the tree is valid:
+//   - all leaves are at the same depth.
+//   - the counts of all nodes, and the tree, match their items.
+//   - all nodes have the correct number of items and children, except for
+//     the nodes on the right spine of a tree that was appended to by Load.
+//   - all items are in order, which catches a less function that is not a
+//     strict weak ordering.
+//   - the unused slots of all nodes are cleared.
+//   - the weights, summary ranges and checksums of all nodes match their
+//     items.
+//
+// Sane visits every node and item, which is O(n), and is intended as a
+// self-check after suspicious operations, not for regular use.
+func (tr *BTreeG[T]) Sane() error {
+	if tr == nil {
+		return nil
+	}
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.Len() != tr.count {
+		return &SaneError{Check: "count", Depth: -1, Index: -1,
+			Msg: fmt.Sprintf("length is %d, want %d", tr.Len(), tr.count)}
+	}
+	if tr.root == nil {
+		if tr.count != 0 {
+			return &SaneError{Check: "count", Depth: -1, Index: -1,
+				Msg: fmt.Sprintf("empty tree has count %d", tr.count)}
+		}
+		return nil
+	}
+	var st saneState[T]
+	for n := tr.root; ; n = (*n.children)[0] {
+		st.height++
+		if n.leaf() {
+			break
+		}
+	}
+	count, _, err := tr.saneNode(tr.root, &st, 0, true)
+	if err != nil {
+		return err
+	}
+	if count != tr.count {
+		return &SaneError{Check: "count", Depth: -1, Index: -1,
+			Msg: fmt.Sprintf("tree has %d items, want %d", count, tr.count)}
+	}
+	return tr.verifyChecksums()
+}
+
+// saneNode checks the node and its children, and returns the number of items
+// and the weight of the node.
+func (tr *BTreeG[T]) saneNode(n *node[T], st *saneState[T], depth int,
+	rightmost bool,
+) (count int, weight int64, err *SaneError) {
+	if n.leaf() != (depth == st.height-1) {
+		return 0, 0, st.errorf("height", depth, -1, nil,
+			"leaf status is %t, want %t", n.leaf(), !n.leaf())
+	}
+	min := tr.min
+	if depth == 0 || (rightmost && tr.sparseRight) {
+		min = 1
+	}
+	if len(n.items) < min || len(n.items) > tr.max {
+		return 0, 0, st.errorf("props", depth, -1, nil,
+			"node has %d items, want %d to %d", len(n.items), min, tr.max)
+	}
+	items := n.items[:cap(n.items):cap(n.items)]
+	for i := len(n.items); i < len(items); i++ {
+		if !isZero(&items[i]) {
+			return 0, 0, st.errorf("nils", depth, i, items[i],
+				"unused item slot is not cleared")
+		}
+	}
+	if !n.leaf() {
+		if len(*n.children) != len(n.items)+1 {
+			return 0, 0, st.errorf("props", depth, -1, nil,
+				"node has %d children, want %d", len(*n.children),
+				len(n.items)+1)
+		}
+		children := (*n.children)[:cap(*n.children):cap(*n.children)]
+		for i := range children {
+			if (children[i] == nil) != (i >= len(*n.children)) {
+				return 0, 0, st.errorf("nils", depth, i, nil,
+					"child slot is nil: %t", children[i] == nil)
+			}
+		}
+	}
+	count = len(n.items)
+	var sum node[T] // summary range of the node
+	sum.summin = math.MaxUint64
+	for i := 0; i <= len(n.items); i++ {
+		if !n.leaf() {
+			child := (*n.children)[i]
+			st.path = append(st.path, i)
+			ccount, cweight, err := tr.saneNode(child, st, depth+1,
+				rightmost && i == len(n.items))
+			if err != nil {
+				return 0, 0, err
+			}
+			st.path = st.path[:len(st.path)-1]
+			count += ccount
+			weight += cweight
+			sum.extendSummary(child.summin)
+			sum.extendSummary(child.summax)
+		}
+		if i == len(n.items) {
+			break
+		}
+		item := n.items[i]
+		if st.seen && (tr.less(item, st.last) ||
+			(!tr.dups && !tr.less(st.last, item))) {
+			return 0, 0, st.errorf("order", depth, i, item,
+				"item is not greater than the previous item %v", st.last)
+		}
+		st.last, st.seen = item, true
+		if tr.weight != nil {
+			weight += tr.weight(item)
+		}
+		if tr.summary != nil {
+			sum.extendSummary(tr.summary(item))
+		}
+	}
+	if n.count != count {
+		return 0, 0, st.errorf("count", depth, -1, nil,
+			"node count is %d, want %d", n.count, count)
+	}
+	if tr.weight != nil && n.weight != weight {
+		return 0, 0, st.errorf("weight", depth, -1, nil,
+			"node weight is %d, want %d", n.weight, weight)
+	}
+	if tr.summary != nil && (n.summin != sum.summin ||
+		n.summax != sum.summax) {
+		return 0, 0, st.errorf("summary", depth, -1, nil,
+			"node summary range is [%d, %d], want [%d, %d]", n.summin,
+			n.summax, sum.summin, sum.summax)
+	}
+	return count, weight, nil
+}
+
+// Sane checks the structure of the entire map and returns a *SaneError
+// describing the first invalid node. Returns nil if the map is valid.
+// See BTreeG.Sane.
+func (tr *Map[K, V]) Sane() error {
+	if tr == nil {
+		return nil
+	}
+	if tr.lock(false) {
+		defer tr.unlock(false)
+	}
+	if tr.Len() != tr.count {
+		return &SaneError{Check: "count", Depth: -1, Index: -1,
+			Msg: fmt.Sprintf("length is %d, want %d", tr.Len(), tr.count)}
+	}
+	if tr.root == nil {
+		if tr.count != 0 {
+			return &SaneError{Check: "count", Depth: -1, Index: -1,
+				Msg: fmt.Sprintf("empty map has count %d", tr.count)}
+		}
+		return nil
+	}
+	var st saneState[K]
+	for n := tr.root; ; n = (*n.children)[0] {
+		st.height++
+		if n.leaf() {
+			break
+		}
+	}
+	count, err := tr.saneNode(tr.root, &st, 0, true)
+	if err != nil {
+		return err
+	}
+	if count != tr.count {
+		return &SaneError{Check: "count", Depth: -1, Index: -1,
+			Msg: fmt.Sprintf("map has %d items, want %d", count, tr.count)}
+	}
+	return nil
+}
+
+// saneNode checks the node and its children, and returns the number of
+// items.
+func (tr *Map[K, V]) saneNode(n *mapNode[K, V], st *saneState[K], depth int,
+	rightmost bool,
+) (count int, err *SaneError) {
+	if n.leaf() != (depth == st.height-1) {
+		return 0, st.errorf("height", depth, -1, nil,
+			"leaf status is %t, want %t", n.leaf(), !n.leaf())
+	}
+	min := tr.min
+	if depth == 0 || (rightmost && tr.sparseRight) {
+		min = 1
+	}
+	if len(n.items) < min || len(n.items) > tr.max {
+		return 0, st.errorf("props", depth, -1, nil,
+			"node has %d items, want %d to %d", len(n.items), min, tr.max)
+	}
+	items := n.items[:cap(n.items):cap(n.items)]
+	for i := len(n.items); i < len(items); i++ {
+		if !isZero(&items[i]) {
+			return 0, st.errorf("nils", depth, i, items[i].key,
+				"unused item slot is not cleared")
+		}
+	}
+	if !n.leaf() {
+		if len(*n.children) != len(n.items)+1 {
+			return 0, st.errorf("props", depth, -1, nil,
+				"node has %d children, want %d", len(*n.children),
+				len(n.items)+1)
+		}
+		children := (*n.children)[:cap(*n.children):cap(*n.children)]
+		for i := range children {
+			if (children[i] == nil) != (i >= len(*n.children)) {
+				return 0, st.errorf("nils", depth, i, nil,
+					"child slot is nil: %t", children[i] == nil)
+			}
+		}
+	}
+	count = len(n.items)
+	for i := 0; i <= len(n.items); i++ {
+		if !n.leaf() {
+			st.path = append(st.path, i)
+			ccount, err := tr.saneNode((*n.children)[i], st, depth+1,
+				rightmost && i == len(n.items))
+			if err != nil {
+				return 0, err
+			}
+			st.path = st.path[:len(st.path)-1]
+			count += ccount
+		}
+		if i == len(n.items) {
+			break
+		}
+		key := n.items[i].key
+		if st.seen && !(st.last < key) {
+			return 0, st.errorf("order", depth, i, key,
+				"key is not greater than the previous key %v", st.last)
+		}
+		st.last, st.seen = key, true
+	}
+	if n.count != count {
+		return 0, st.errorf("count", depth, -1, nil,
+			"node count is %d, want %d", n.count, count)
+	}
+	return count, nil
+}
+
+// Sane checks the structure of the entire set. See Map.Sane.
+func (tr *Set[K]) Sane() error {
+	if tr == nil {
+		return nil
+	}
+	return tr.base.Sane()
+}
@@ -0,0 +1,116 @@
+package btree
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSane(t *testing.T) {
+	var ntr *BTreeG[int]
+	assert(ntr.Sane() == nil)
+	tr := NewBTreeG(func(a, b int) bool { return a < b })
+	assert(tr.Sane() == nil)
+	for i := 0; i < 1000; i++ {
+		tr.Set(i)
+	}
+	assert(tr.Sane() == nil)
+
+	// swap two items in the last leaf
+	n := tr.root
+	var path []int
+	for !n.leaf() {
+		path = append(path, len(*n.children)-1)
+		n = (*n.children)[len(*n.children)-1]
+	}
+	n.items[0], n.items[1] = n.items[1], n.items[0]
+	var serr *SaneError
+	assert(errors.As(tr.Sane(), &serr))
+	assert(serr.Check == "order" && serr.Depth == len(path))
+	assert(serr.Index == 1 && serr.Item == n.items[1])
+	assert(len(serr.Path) == len(path))
+	for i := range path {
+		assert(serr.Path[i] == path[i])
+	}
+	assert(strings.Contains(serr.Error(), "!sane-order"))
+	n.items[0], n.items[1] = n.items[1], n.items[0]
+	assert(tr.Sane() == nil)
+
+	n.count++
+	assert(errors.As(tr.Sane(), &serr) && serr.Check == "count")
+	n.count--
+	tr.count++
+	assert(errors.As(tr.Sane(), &serr) && serr.Check == "count")
+	assert(serr.Depth == -1 && !strings.Contains(serr.Error(), "depth"))
+	tr.count--
+
+	items := n.items
+	n.items = n.items[:len(n.items)-1]
+	n.count--
+	assert(errors.As(tr.Sane(), &serr) && serr.Check == "nils")
+	n.items = items
+	n.count++
+	assert(tr.Sane() == nil)
+
+	// stale summary range
+	tr.SetItemSummarizer(func(item int) uint64 { return uint64(item) })
+	assert(tr.Sane() == nil)
+	n.summax++
+	assert(errors.As(tr.Sane(), &serr) && serr.Check == "summary")
+	assert(serr.Depth == len(path))
+	n.summax--
+	assert(tr.Sane() == nil)
+
+	// an underfull node on the right spine is only allowed after Load has
+	// split it unevenly
+	tr.SetItemSummarizer(nil)
+	var nodes []*node[int]
+	for n := tr.root; ; n = (*n.children)[len(*n.children)-1] {
+		nodes = append(nodes, n)
+		if n.leaf() {
+			break
+		}
+	}
+	removed := len(n.items) - 1
+	for i := 1; i < len(n.items); i++ {
+		n.items[i] = 0
+	}
+	n.items = n.items[:1]
+	for _, n := range nodes {
+		n.count -= removed
+	}
+	tr.count -= removed
+	tr.length = int64(tr.count)
+	assert(errors.As(tr.Sane(), &serr) && serr.Check == "props")
+	assert(serr.Depth == len(path))
+	tr.sparseRight = true
+	assert(tr.Sane() == nil)
+	tr.Clear()
+	assert(!tr.sparseRight)
+}
+
+func TestMapSane(t *testing.T) {
+	var nm *Map[int, int]
+	assert(nm.Sane() == nil)
+	var ns *Set[int]
+	assert(ns.Sane() == nil)
+	var m Map[int, int]
+	for i := 0; i < 1000; i++ {
+		m.Set(i, i)
+	}
+	assert(m.Sane() == nil)
+	n := m.root
+	n.items[1].key = n.items[0].key
+	var serr *SaneError
+	assert(errors.As(m.Sane(), &serr))
+	assert(serr.Check == "order" && serr.Depth == 0 && len(serr.Path) == 0)
+	assert(serr.Index == 1 && serr.Item == n.items[1].key)
+	m.root = (*n.children)[0]
+	assert(errors.As(m.Sane(), &serr) && serr.Check == "count")
+
+	var s Set[int]
+	s.Insert(1)
+	assert(s.Sane() == nil)
+	s.base.root.count = 2
+	assert(errors.As(s.Sane(), &serr) && serr.Check == "count")
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.23
+
+package btree
+
+import "iter"
+
+// UnionSeq returns a sequence of the keys that are in either set, in
+// ascending order. Like the other set operation sequences, the keys are
+// merged lazily while ranging, without building a new set, and both sets are
+// read locked until the range loop ends. The sets must not be changed from
+// within the loop.
+func (tr *Set[K]) UnionSeq(other *Set[K]) iter.Seq[K] {
+	return func(yield func(K) bool) {
+		tr.base.mergeKeys(&other.base, true, true, true, yield)
+	}
+}
+
+// IntersectSeq returns a sequence of the keys that are in both sets, in
+// ascending order.
+func (tr *Set[K]) IntersectSeq(other *Set[K]) iter.Seq[K] {
+	return func(yield func(K) bool) {
+		tr.base.mergeKeys(&other.base, false, true, false, yield)
+	}
+}
+
+// DifferenceSeq returns a sequence of the keys that are in tr, but not in
+// other, in ascending order.
+func (tr *Set[K]) DifferenceSeq(other *Set[K]) iter.Seq[K] {
+	return func(yield func(K) bool) {
+		tr.base.mergeKeys(&other.base, true, false, false, yield)
+	}
+}
+
+// mergeKeys walks the keys of both maps in order, yielding the keys that are
+// only in tr, in both maps, or only in other, as requested.
+func (tr *Map[K, V]) mergeKeys(other *Map[K, V], only1, both, only2 bool,
+	yield func(key K) bool,
+) {
+	tr.lockPair(other)
+	defer tr.unlockPair(other)
+	iter1, iter2 := tr.iter(false), other.iter(false)
+	ok1, ok2 := iter1.First(), iter2.First()
+	for ok1 || ok2 {
+		var key K
+		var want bool
+		switch {
+		case !ok2 || (ok1 && iter1.item.key < iter2.item.key):
+			key, want = iter1.item.key, only1
+			ok1 = iter1.Next()
+		case !ok1 || iter2.item.key < iter1.item.key:
+			key, want = iter2.item.key, only2
+			ok2 = iter2.Next()
+		default:
+			key, want = iter1.item.key, both
+			ok1, ok2 = iter1.Next(), iter2.Next()
+		}
+		if want && !yield(key) {
+			return
+		}
+		if (!ok1 && !only2) || (!ok2 && !only1) {
+			return
+		}
+	}
+}
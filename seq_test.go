@@ -0,0 +1,63 @@
+//go:build go1.23
+
+package btree
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestSetSeq(t *testing.T) {
+	var a, b Set[int]
+	ina, inb := make(map[int]bool), make(map[int]bool)
+	for i := 0; i < 10_000; i++ {
+		x, y := rand.Intn(20_000), rand.Intn(20_000)
+		a.Insert(x)
+		b.Insert(y)
+		ina[x], inb[y] = true, true
+	}
+	collect := func(seq func(yield func(int) bool)) []int {
+		keys := []int{}
+		for key := range seq {
+			keys = append(keys, key)
+		}
+		return keys
+	}
+	filter := func(keep func(key int) bool) []int {
+		keys := []int{}
+		for i := 0; i < 20_000; i++ {
+			if keep(i) {
+				keys = append(keys, i)
+			}
+		}
+		return keys
+	}
+	assert(reflect.DeepEqual(collect(a.UnionSeq(&b)),
+		filter(func(key int) bool { return ina[key] || inb[key] })))
+	assert(reflect.DeepEqual(collect(a.IntersectSeq(&b)),
+		filter(func(key int) bool { return ina[key] && inb[key] })))
+	assert(reflect.DeepEqual(collect(a.DifferenceSeq(&b)),
+		filter(func(key int) bool { return ina[key] && !inb[key] })))
+	assert(reflect.DeepEqual(collect(b.DifferenceSeq(&a)),
+		filter(func(key int) bool { return inb[key] && !ina[key] })))
+	assert(reflect.DeepEqual(collect(a.UnionSeq(&a)), a.Keys()))
+	assert(reflect.DeepEqual(collect(a.IntersectSeq(&a)), a.Keys()))
+	assert(len(collect(a.DifferenceSeq(&a))) == 0)
+	var empty Set[int]
+	assert(reflect.DeepEqual(collect(empty.UnionSeq(&a)), a.Keys()))
+	assert(len(collect(empty.IntersectSeq(&a))) == 0)
+	assert(reflect.DeepEqual(collect(a.DifferenceSeq(&empty)), a.Keys()))
+
+	// stop early, then write once the loop has released the locks
+	var n int
+	for range a.UnionSeq(&b) {
+		n++
+		if n == 10 {
+			break
+		}
+	}
+	assert(n == 10)
+	a.Insert(-1)
+	assert(collect(a.UnionSeq(&b))[0] == -1)
+}
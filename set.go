@@ -1,22 +1,54 @@
 package btree
 
+import (
+	"math/rand"
+	"sort"
+)
+
 type Set[K ordered] struct {
 	base Map[K, struct{}]
 }
 
-// Copy
+// NewSetFromSlice returns a new Set that contains the provided keys.
+// The keys are sorted and de-duplicated, and the set is bulk constructed,
+// which is much faster than inserting each key.
+func NewSetFromSlice[K ordered](keys []K) *Set[K] {
+	items := make([]mapPair[K, struct{}], len(keys))
+	for i := range keys {
+		items[i].key = keys[i]
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+	set := new(Set[K])
+	set.base.build(dedupPairs(items))
+	return set
+}
+
+// Copy the set. This is a copy-on-write operation and is very fast because
+// it only performs a shadow copy. Like Map.Copy, the original and the copy
+// are isolated from each other's changes.
 func (tr *Set[K]) Copy() *Set[K] {
-	tr2 := new(Set[K])
-	tr2.base = *tr.base.Copy()
-	return tr2
+	return tr.IsoCopy()
 }
 
+// IsoCopy is the same as Copy.
 func (tr *Set[K]) IsoCopy() *Set[K] {
 	tr2 := new(Set[K])
 	tr2.base = *tr.base.IsoCopy()
 	return tr2
 }
 
+// Freeze makes the set immutable. See Map.Freeze.
+func (tr *Set[K]) Freeze() {
+	tr.base.Freeze()
+}
+
+// Frozen returns true if the set is frozen.
+func (tr *Set[K]) Frozen() bool {
+	return tr.base.Frozen()
+}
+
 // Insert an item
 func (tr *Set[K]) Insert(key K) {
 	tr.base.Set(key, struct{}{})
@@ -28,6 +60,14 @@ func (tr *Set[K]) Scan(iter func(key K) bool) {
 	})
 }
 
+// ScanE is like Scan, but the iterator may also return an error, which stops
+// the iteration and is returned by ScanE.
+func (tr *Set[K]) ScanE(iter func(key K) (bool, error)) error {
+	return tr.base.ScanE(func(key K, value struct{}) (bool, error) {
+		return iter(key)
+	})
+}
+
 // Get a value for key
 func (tr *Set[K]) Contains(key K) bool {
 	_, ok := tr.base.Get(key)
@@ -39,6 +79,11 @@ func (tr *Set[K]) Len() int {
 	return tr.base.Len()
 }
 
+// IsEmpty returns true if the set has no items.
+func (tr *Set[K]) IsEmpty() bool {
+	return tr.base.IsEmpty()
+}
+
 // Delete an item
 func (tr *Set[K]) Delete(key K) {
 	tr.base.Delete(key)
@@ -68,6 +113,22 @@ func (tr *Set[K]) Descend(pivot K, iter func(key K) bool) {
 	})
 }
 
+// AscendN is like Ascend, but stops after n items, and returns the number of
+// items visited. Nothing is visited if n is zero or less.
+func (tr *Set[K]) AscendN(pivot K, n int, iter func(key K) bool) int {
+	return tr.base.AscendN(pivot, n, func(key K, value struct{}) bool {
+		return iter(key)
+	})
+}
+
+// DescendN is like Descend, but stops after n items, and returns the number
+// of items visited. Nothing is visited if n is zero or less.
+func (tr *Set[K]) DescendN(pivot K, n int, iter func(key K) bool) int {
+	return tr.base.DescendN(pivot, n, func(key K, value struct{}) bool {
+		return iter(key)
+	})
+}
+
 // Load is for bulk loading pre-sorted items
 func (tr *Set[K]) Load(key K) {
 	tr.base.Load(key, struct{}{})
@@ -76,17 +137,57 @@ func (tr *Set[K]) Load(key K) {
 // Min returns the minimum item in tree.
 // Returns nil if the treex has no items.
 func (tr *Set[K]) Min() (K, bool) {
-	key, _, ok := tr.base.Min()
-	return key, ok
+	return tr.base.MinKey()
 }
 
 // Max returns the maximum item in tree.
 // Returns nil if the tree has no items.
 func (tr *Set[K]) Max() (K, bool) {
-	key, _, ok := tr.base.Max()
+	return tr.base.MaxKey()
+}
+
+// Quantiles returns the items at each of the quantiles in qs, which must be
+// within the range [0, 1]. See BTreeG.Quantiles.
+// Returns nil if the tree has no items.
+func (tr *Set[K]) Quantiles(qs []float64) []K {
+	return tr.base.Quantiles(qs)
+}
+
+// Quantile returns the item at the rank int(q*Len()) of the set.
+// See BTreeG.Quantile.
+func (tr *Set[K]) Quantile(q float64) (K, bool) {
+	key, _, ok := tr.base.Quantile(q)
+	return key, ok
+}
+
+// Percentile is the same as Quantile(p/100), for p within the range
+// [0, 100].
+func (tr *Set[K]) Percentile(p int) (K, bool) {
+	key, _, ok := tr.base.Percentile(p)
 	return key, ok
 }
 
+// PeekMin returns the minimum item in tree, and panics if the tree has no
+// items. The Peek methods are for sets that are known to be non-empty, and
+// are otherwise the same as Min and Max.
+func (tr *Set[K]) PeekMin() K {
+	key, ok := tr.base.MinKey()
+	if !ok {
+		panic("btree: PeekMin on empty Set")
+	}
+	return key
+}
+
+// PeekMax returns the maximum item in tree, and panics if the tree has no
+// items.
+func (tr *Set[K]) PeekMax() K {
+	key, ok := tr.base.MaxKey()
+	if !ok {
+		panic("btree: PeekMax on empty Set")
+	}
+	return key
+}
+
 // PopMin removes the minimum item in tree and returns it.
 // Returns nil if the tree has no items.
 func (tr *Set[K]) PopMin() (K, bool) {
@@ -101,6 +202,12 @@ func (tr *Set[K]) PopMax() (K, bool) {
 	return key, ok
 }
 
+// LenRange returns the number of items within the range [lo, hi), which
+// includes lo but not hi. See Map.LenRange.
+func (tr *Set[K]) LenRange(lo, hi K) int {
+	return tr.base.LenRange(lo, hi)
+}
+
 // GetAt returns the value at index.
 // Return nil if the tree is empty or the index is out of bounds.
 func (tr *Set[K]) GetAt(index int) (K, bool) {
@@ -115,6 +222,20 @@ func (tr *Set[K]) DeleteAt(index int) (K, bool) {
 	return key, ok
 }
 
+// Enumerate visits all items in ascending order, passing each item with its
+// index, which is counted up from start.
+// Return false to stop iterating.
+func (tr *Set[K]) Enumerate(start int, iter func(index int, key K) bool) {
+	tr.base.Enumerate(start, func(index int, key K, _ struct{}) bool {
+		return iter(index, key)
+	})
+}
+
+// Degree returns the degree of the tree.
+func (tr *Set[K]) Degree() int {
+	return tr.base.Degree()
+}
+
 // Height returns the height of the tree.
 // Returns zero if tree has no items.
 func (tr *Set[K]) Height() int {
@@ -123,29 +244,43 @@ func (tr *Set[K]) Height() int {
 
 // SetIter represents an iterator for btree.Set
 type SetIter[K ordered] struct {
-	base MapIter[K, struct{}]
+	base  MapIter[K, struct{}]
+	index int // ordinal of the current item, see Index
 }
 
 // Iter returns a read-only iterator.
 func (tr *Set[K]) Iter() SetIter[K] {
-	return SetIter[K]{tr.base.Iter()}
+	return SetIter[K]{base: tr.base.Iter()}
 }
 
-// Seek to item greater-or-equal-to key.
+// Init makes the iterator a new read-only iterator for tr, just like Iter,
+// after releasing it. The memory of the iterator is reused, which allows for
+// a single iterator to be used for many iterations without allocating. Init
+// may be called on a zero-value iterator.
+// The Release method must be called when finished with the iterator.
+func (iter *SetIter[K]) Init(tr *Set[K]) {
+	iter.base.reset(&tr.base)
+	iter.index = 0
+}
+
+// Seek to the first item that is greater-or-equal-to item.
 // Returns false if there was no item found.
-func (iter *SetIter[K]) Seek(key K) bool {
-	return iter.base.Seek(key)
+func (iter *SetIter[K]) Seek(item K) bool {
+	iter.index = 0
+	return iter.base.Seek(item)
 }
 
 // First moves iterator to first item in tree.
 // Returns false if the tree is empty.
 func (iter *SetIter[K]) First() bool {
+	iter.index = 0
 	return iter.base.First()
 }
 
 // Last moves iterator to last item in tree.
 // Returns false if the tree is empty.
 func (iter *SetIter[K]) Last() bool {
+	iter.index = 0
 	return iter.base.Last()
 }
 
@@ -153,26 +288,124 @@ func (iter *SetIter[K]) Last() bool {
 // Returns false if the tree is empty or the iterator is at the end of
 // the tree.
 func (iter *SetIter[K]) Next() bool {
-	return iter.base.Next()
+	if !iter.base.seeked {
+		// Next on an iterator that is not positioned yet moves to the first
+		// item, like First.
+		iter.index = 0
+		return iter.base.Next()
+	}
+	if !iter.base.Next() {
+		return false
+	}
+	iter.index++
+	return true
 }
 
 // Prev moves iterator to the previous item in iterator.
 // Returns false if the tree is empty or the iterator is at the beginning of
 // the tree.
 func (iter *SetIter[K]) Prev() bool {
-	return iter.base.Prev()
+	if !iter.base.Prev() {
+		return false
+	}
+	iter.index--
+	return true
 }
 
-// Key returns the current iterator item key.
+// Index returns the ordinal of the current item within the iteration, which
+// is zero at the item found by the last First, Last or Seek, and is counted
+// up by Next and down by Prev. It is not the index of the item in the set,
+// see GetAt.
+func (iter *SetIter[K]) Index() int {
+	return iter.index
+}
+
+// Item returns the current iterator item.
+func (iter *SetIter[K]) Item() K {
+	return iter.base.Key()
+}
+
+// Key returns the current iterator item.
+//
+// Deprecated: use Item.
 func (iter *SetIter[K]) Key() K {
 	return iter.base.Key()
 }
 
+// Release the iterator. This is safe to call on any iterator, and must be
+// called for the iterators of a set that uses locks.
+func (iter *SetIter[K]) Release() {
+	iter.base.Release()
+}
+
+// Sample returns a uniformly random item, chosen by rng.
+// Returns false if the set is empty.
+func (tr *Set[K]) Sample(rng *rand.Rand) (K, bool) {
+	n := tr.Len()
+	if n == 0 {
+		return tr.base.empty.key, false
+	}
+	return tr.GetAt(rng.Intn(n))
+}
+
+// SampleN returns n distinct random items, chosen by rng, in ascending
+// order. Every subset of n items is equally likely. The items are selected in
+// a single pass over the set, using Knuth's Algorithm S, which stops once n
+// items have been selected. Panics if n is negative or greater than Len.
+func (tr *Set[K]) SampleN(n int, rng *rand.Rand) []K {
+	count := tr.Len()
+	if n < 0 || n > count {
+		panic("btree: sample size out of range")
+	}
+	keys := make([]K, 0, n)
+	if n == 0 {
+		return keys
+	}
+	var seen int
+	tr.Scan(func(key K) bool {
+		// select the key with the probability of the number of keys that
+		// are still needed over the number of keys that are left
+		if rng.Intn(count-seen) < n-len(keys) {
+			keys = append(keys, key)
+		}
+		seen++
+		return len(keys) < n
+	})
+	return keys
+}
+
+// Shuffle returns all items in a random order, chosen by rng.
+func (tr *Set[K]) Shuffle(rng *rand.Rand) []K {
+	keys := tr.Keys()
+	rng.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	return keys
+}
+
 // Keys returns all the keys in order.
 func (tr *Set[K]) Keys() []K {
 	return tr.base.Keys()
 }
 
+// ToSlice returns a copy of all the items, in ascending order.
+// This is the same as Keys.
+func (tr *Set[K]) ToSlice() []K {
+	return tr.base.Keys()
+}
+
+// ToSortedSlice returns a sorted copy of all the items.
+// This is the same as Keys.
+func (tr *Set[K]) ToSortedSlice() []K {
+	return tr.base.Keys()
+}
+
+// ToUnsortedSlice returns a copy of all the items, for callers that do not
+// depend on their order. This is the same as Keys.
+func (tr *Set[K]) ToUnsortedSlice() []K {
+	return tr.base.Keys()
+}
+
 // Clear will delete all items.
 func (tr *Set[K]) Clear() {
 	tr.base.Clear()
@@ -1,6 +1,7 @@
 package btree
 
 import (
+	"errors"
 	"math/rand"
 	"reflect"
 	"sort"
@@ -130,6 +131,68 @@ func TestSet(t *testing.T) {
 	assert(tr.base.lt(2, 10))
 }
 
+func TestSetFromSlice(t *testing.T) {
+	for _, N := range []int{0, 1, 2, 3, 10, 100, 1000, 12345} {
+		keys := make([]int, N)
+		for i := 0; i < N; i++ {
+			keys[i] = rand.Intn(N)
+		}
+		var tr2 Set[int]
+		for _, key := range keys {
+			tr2.Insert(key)
+		}
+		tr := NewSetFromSlice(keys)
+		tr.base.sane()
+		assert(reflect.DeepEqual(tr.Keys(), tr2.Keys()))
+		tr.Insert(-1)
+		tr.base.sane()
+		assert(tr.Len() == tr2.Len()+1)
+	}
+}
+
+func TestSetAscendN(t *testing.T) {
+	var tr Set[int]
+	for i := 0; i < 100; i++ {
+		tr.Insert(i)
+	}
+	var keys []int
+	iter := func(key int) bool {
+		keys = append(keys, key)
+		return true
+	}
+	assert(tr.AscendN(10, 3, iter) == 3)
+	assert(reflect.DeepEqual(keys, []int{10, 11, 12}))
+	keys = nil
+	assert(tr.DescendN(10, 3, iter) == 3)
+	assert(reflect.DeepEqual(keys, []int{10, 9, 8}))
+	assert(tr.AscendN(10, 0, iter) == 0 && tr.DescendN(1, 10, iter) == 2)
+}
+
+func TestSetFreeze(t *testing.T) {
+	var tr Set[int]
+	for i := 0; i < 100; i++ {
+		tr.Insert(i)
+	}
+	tr.Freeze()
+	assert(tr.Frozen())
+	for _, f := range []func(){
+		func() { tr.Insert(1000) },
+		func() { tr.Load(1000) },
+		func() { tr.Delete(0) },
+		func() { tr.DeleteAt(0) },
+		func() { tr.PopMin() },
+		func() { tr.PopMax() },
+		func() { tr.Clear() },
+	} {
+		assertFrozen(f)
+	}
+	assert(tr.Len() == 100 && tr.Contains(0))
+	tr2 := tr.Copy()
+	assert(!tr2.Frozen())
+	tr2.Insert(1000)
+	assert(tr2.Len() == 101 && tr.Len() == 100)
+}
+
 func TestSetClear(t *testing.T) {
 	var tr Set[int]
 	for i := 0; i < 100; i++ {
@@ -232,6 +295,95 @@ func TestSetIter(t *testing.T) {
 	}
 }
 
+// TestSetIterItem is TestSetIter using Item, rather than the deprecated Key.
+func TestSetIterItem(t *testing.T) {
+	N := 100_000
+	lt := func(a, b int) bool { return a < b }
+	eq := func(a, b int) bool { return !lt(a, b) && !lt(b, a) }
+	var tr Set[int]
+	var all []int
+	for i := 0; i < N; i++ {
+		tr.Load(i)
+		all = append(all, i)
+	}
+	var count int
+	var i int
+	iter := tr.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if !eq(all[i], iter.Item()) {
+			panic("!")
+		}
+		count++
+		i++
+	}
+	if count != N {
+		t.Fatalf("expected %v, got %v", N, count)
+	}
+
+	count = 0
+	i = len(all) - 1
+	iter = tr.Iter()
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		if !eq(all[i], iter.Item()) {
+			panic("!")
+		}
+		i--
+		count++
+	}
+	if count != N {
+		t.Fatalf("expected %v, got %v", N, count)
+	}
+
+	i = 0
+	iter = tr.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if !eq(all[i], iter.Item()) {
+			panic("!")
+		}
+		i++
+	}
+	i--
+	for ok := iter.Prev(); ok; ok = iter.Prev() {
+		i--
+		if !eq(all[i], iter.Item()) {
+			panic("!")
+		}
+
+	}
+	if i != 0 {
+		panic("!")
+	}
+
+	i++
+	for ok := iter.Next(); ok; ok = iter.Next() {
+		if !eq(all[i], iter.Item()) {
+			panic("!")
+		}
+		i++
+
+	}
+	if i != N {
+		panic("!")
+	}
+
+	i = 0
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if !eq(all[i], iter.Item()) {
+			panic("!")
+		}
+		if eq(iter.Item(), N/2) {
+			for ok = iter.Prev(); ok; ok = iter.Prev() {
+				i--
+				if !eq(all[i], iter.Item()) {
+					panic("!")
+				}
+			}
+			break
+		}
+		i++
+	}
+}
+
 func copySetEntries(m *Set[int]) []int {
 	all := m.Keys()
 	sort.Ints(all)
@@ -321,3 +473,267 @@ func TestSetCopy(t *testing.T) {
 		panic("!")
 	}
 }
+
+func TestSetScanE(t *testing.T) {
+	var tr Set[int]
+	for i := 0; i < 1000; i++ {
+		tr.Insert(i)
+	}
+	var n int
+	err := tr.ScanE(func(key int) (bool, error) {
+		assert(key == n)
+		n++
+		return key < 10, nil
+	})
+	assert(err == nil && n == 11)
+	errStop := errors.New("stop")
+	err = tr.ScanE(func(key int) (bool, error) {
+		return true, errStop
+	})
+	assert(err == errStop)
+}
+
+func TestSetIterInit(t *testing.T) {
+	var tr1, tr2 Set[int]
+	for i := 0; i < 1000; i++ {
+		tr1.Insert(i)
+		tr2.Insert(-i)
+	}
+	var iter SetIter[int]
+	iter.Init(&tr1)
+	assert(iter.Seek(500) && iter.Item() == 500 && iter.Next())
+	assert(iter.Index() == 1)
+	iter.Init(&tr2)
+	assert(iter.Index() == 0)
+	assert(iter.First() && iter.Item() == -999)
+	assert(iter.Last() && iter.Item() == 0)
+	// reusing the iterator does not allocate
+	allocs := testing.AllocsPerRun(100, func() {
+		iter.Init(&tr1)
+		var count int
+		for ok := iter.First(); ok; ok = iter.Next() {
+			count++
+		}
+		assert(count == 1000)
+	})
+	assert(allocs == 0)
+	iter.Release()
+
+	// the lock is released by Init and Release
+	tr3 := new(Set[int])
+	tr3.base = *NewMapOptions[int, struct{}](Options{})
+	assert(tr3.base.locks)
+	tr3.Insert(1)
+	iter.Init(tr3)
+	assert(iter.First() && iter.Item() == 1)
+	iter.Init(tr3)
+	assert(iter.First())
+	iter.Release()
+	tr3.Insert(2)
+	assert(tr3.Len() == 2)
+}
+
+func TestSetIterSeek(t *testing.T) {
+	var tr Set[int]
+	iter := tr.Iter()
+	assert(!iter.Seek(0))
+	iter.Release()
+	for i := 0; i < 1000; i++ {
+		tr.Insert(i * 2)
+	}
+	iter = tr.Iter()
+	defer iter.Release()
+	// seek to a missing item lands on the next item
+	assert(iter.Seek(501) && iter.Item() == 502)
+	// reverse after seek
+	assert(iter.Prev() && iter.Item() == 500)
+	assert(iter.Prev() && iter.Item() == 498)
+	assert(iter.Next() && iter.Item() == 500)
+	assert(iter.Seek(-1) && iter.Item() == 0)
+	assert(!iter.Prev())
+	assert(iter.Seek(1998) && iter.Item() == 1998)
+	assert(!iter.Next())
+	assert(!iter.Seek(1999))
+	assert(iter.Last() && iter.Item() == 1998 && iter.Key() == 1998)
+}
+
+func TestSetCopyIsolation(t *testing.T) {
+	N := 10_000
+	var s1 Set[int]
+	for i := 0; i < N; i++ {
+		s1.Insert(i)
+	}
+	s2 := s1.Copy()
+	assert(s2.base.isoid != s1.base.isoid)
+	// mutate the original and the copy at the same time
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < N; i += 2 {
+			s1.Delete(i)
+			s1.Insert(N + i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 1; i < N; i += 2 {
+			s2.Delete(i)
+			s2.Insert(-i)
+		}
+	}()
+	wg.Wait()
+	s1.base.sane()
+	s2.base.sane()
+	assert(s1.Len() == N && s2.Len() == N)
+	for i := 0; i < N; i++ {
+		assert(s1.Contains(i) == (i%2 == 1) && s1.Contains(N+i) == (i%2 == 0))
+		assert(s2.Contains(i) == (i%2 == 0))
+		assert(i == 0 || s2.Contains(-i) == (i%2 == 1))
+	}
+	s3 := s2.IsoCopy()
+	s3.Clear()
+	assert(s2.Len() == N)
+}
+
+func TestSetPeek(t *testing.T) {
+	var tr Set[int]
+	for _, msg := range []string{"PeekMin", "PeekMax"} {
+		func() {
+			defer func() {
+				assert(recover() == "btree: "+msg+" on empty Set")
+			}()
+			if msg == "PeekMin" {
+				tr.PeekMin()
+			} else {
+				tr.PeekMax()
+			}
+		}()
+	}
+	for i := 1; i <= 100; i++ {
+		tr.Insert(i)
+	}
+	assert(tr.PeekMin() == 1 && tr.PeekMax() == 100)
+}
+
+func TestSetQuantiles(t *testing.T) {
+	var tr Set[int]
+	assert(tr.Quantiles([]float64{0.5}) == nil)
+	for i := 0; i < 101; i++ {
+		tr.Insert(i * 10)
+	}
+	keys := tr.Quantiles([]float64{1, 0, 0.25, 0.5})
+	assert(reflect.DeepEqual(keys, []int{1000, 0, 250, 500}))
+}
+
+func TestSetQuantile(t *testing.T) {
+	var tr Set[int]
+	_, ok := tr.Quantile(0.5)
+	assert(!ok)
+	for i := 0; i < 100; i++ {
+		tr.Insert(i)
+	}
+	key, ok := tr.Quantile(0.5)
+	assert(ok && key == 50)
+	key, ok = tr.Percentile(99)
+	assert(ok && key == 99)
+	key, ok = tr.Percentile(100)
+	assert(ok && key == 99)
+}
+
+func TestSetToSlice(t *testing.T) {
+	var tr Set[int]
+	assert(len(tr.ToSlice()) == 0 && len(tr.ToUnsortedSlice()) == 0)
+	for _, i := range rand.Perm(1000) {
+		tr.Insert(i)
+	}
+	keys := tr.ToSortedSlice()
+	assert(len(keys) == 1000 && sort.IntsAreSorted(keys))
+	assert(reflect.DeepEqual(keys, tr.Keys()))
+	assert(reflect.DeepEqual(tr.ToSlice(), keys))
+	assert(reflect.DeepEqual(tr.ToUnsortedSlice(), keys))
+	// the slices are copies
+	for _, slice := range []func() []int{
+		tr.ToSlice, tr.ToSortedSlice, tr.ToUnsortedSlice,
+	} {
+		keys := slice()
+		keys[0] = -1
+		assert(slice()[0] == 0)
+	}
+}
+
+func TestSetEnumerate(t *testing.T) {
+	var tr Set[int]
+	for i := 0; i < 100; i++ {
+		tr.Insert(i * 2)
+	}
+	var n int
+	tr.Enumerate(10, func(index, key int) bool {
+		assert(index == n+10 && key == n*2)
+		n++
+		return n < 50
+	})
+	assert(n == 50)
+	iter := tr.Iter()
+	assert(iter.Seek(21) && iter.Index() == 0 && iter.Item() == 22)
+	for i := 1; iter.Next(); i++ {
+		assert(iter.Index() == i && iter.Item() == 22+i*2)
+	}
+	assert(iter.Index() == 88)
+	assert(iter.Last() && iter.Index() == 0)
+	assert(iter.Prev() && iter.Prev() && iter.Index() == -2)
+	assert(iter.First() && iter.Index() == 0)
+	assert(!iter.Prev() && iter.Index() == 0)
+	iter.Release()
+
+	// Next on a new iterator starts at the first item
+	iter = tr.Iter()
+	for i := 0; iter.Next(); i++ {
+		assert(iter.Index() == i && iter.Item() == i*2)
+	}
+	assert(iter.Index() == 99)
+	iter.Release()
+}
+
+func TestSetSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var tr Set[int]
+	_, ok := tr.Sample(rng)
+	assert(!ok && len(tr.SampleN(0, rng)) == 0 && len(tr.Shuffle(rng)) == 0)
+	for i := 0; i < 10; i++ {
+		tr.Insert(i)
+	}
+	var hits [10]int
+	for i := 0; i < 10000; i++ {
+		key, ok := tr.Sample(rng)
+		assert(ok)
+		hits[key]++
+	}
+	for _, n := range hits {
+		assert(n > 800 && n < 1200)
+	}
+	hits = [10]int{}
+	for i := 0; i < 10000; i++ {
+		keys := tr.SampleN(3, rng)
+		assert(len(keys) == 3 && sort.IntsAreSorted(keys))
+		assert(keys[0] != keys[1] && keys[1] != keys[2])
+		for _, key := range keys {
+			hits[key]++
+		}
+	}
+	for _, n := range hits {
+		assert(n > 2700 && n < 3300)
+	}
+	assert(len(tr.SampleN(10, rng)) == 10)
+	keys := tr.Shuffle(rng)
+	assert(len(keys) == 10 && !sort.IntsAreSorted(keys))
+	sort.Ints(keys)
+	assert(reflect.DeepEqual(keys, tr.Keys()))
+	func() {
+		defer func() {
+			msg, ok := recover().(string)
+			assert(ok && msg == "btree: sample size out of range")
+		}()
+		tr.SampleN(11, rng)
+	}()
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package btree
+
+import "time"
+
+// mapValueWithExpiry is a TimedMap value along with its expiry time.
+type mapValueWithExpiry[V any] struct {
+	value  V
+	expiry time.Time
+}
+
+// timedKey is a TimedMap key, which is ordered by its expiry time.
+type timedKey[K ordered] struct {
+	expiry time.Time
+	key    K
+}
+
+// TimedMap is a Map where every key has an expiry time, after which the key
+// is treated as missing. Expired keys are kept until Purge is called.
+//
+// The zero value is ready to use. A TimedMap is not safe for concurrent use.
+type TimedMap[K ordered, V any] struct {
+	base     Map[K, mapValueWithExpiry[V]]
+	expiries *BTreeG[timedKey[K]] // keys ordered by expiry
+}
+
+func (tm *TimedMap[K, V]) init() {
+	if tm.expiries != nil {
+		return
+	}
+	tm.expiries = NewBTreeGOptions(func(a, b timedKey[K]) bool {
+		if !a.expiry.Equal(b.expiry) {
+			return a.expiry.Before(b.expiry)
+		}
+		return a.key < b.key
+	}, Options{NoLocks: true})
+}
+
+// SetExpiry sets the value for key, which expires at the expiry time.
+// Returns true if an unexpired value was replaced.
+func (tm *TimedMap[K, V]) SetExpiry(key K, value V, expiry time.Time) bool {
+	tm.init()
+	prev, replaced := tm.base.Set(key, mapValueWithExpiry[V]{value, expiry})
+	if replaced {
+		tm.expiries.Delete(timedKey[K]{prev.expiry, key})
+	}
+	tm.expiries.Set(timedKey[K]{expiry, key})
+	return replaced && time.Now().Before(prev.expiry)
+}
+
+// Get returns the value for key.
+// Returns false if the key is not found or has expired.
+func (tm *TimedMap[K, V]) Get(key K) (V, bool) {
+	v, ok := tm.base.Get(key)
+	if !ok || !time.Now().Before(v.expiry) {
+		return tm.base.empty.value.value, false
+	}
+	return v.value, true
+}
+
+// Delete the key and return its value.
+// Returns false if the key is not found or has expired.
+func (tm *TimedMap[K, V]) Delete(key K) (V, bool) {
+	v, ok := tm.base.Delete(key)
+	if !ok {
+		return v.value, false
+	}
+	tm.expiries.Delete(timedKey[K]{v.expiry, key})
+	if !time.Now().Before(v.expiry) {
+		return tm.base.empty.value.value, false
+	}
+	return v.value, true
+}
+
+// Len returns the number of keys, including the expired keys that have not
+// been purged.
+func (tm *TimedMap[K, V]) Len() int {
+	return tm.base.Len()
+}
+
+// Purge deletes all expired keys and returns the number of keys deleted.
+// Only the expired keys are visited.
+func (tm *TimedMap[K, V]) Purge() int {
+	if tm.expiries == nil {
+		return 0
+	}
+	now := time.Now()
+	var n int
+	for {
+		item, ok := tm.expiries.Min()
+		if !ok || now.Before(item.expiry) {
+			return n
+		}
+		tm.expiries.PopMin()
+		tm.base.Delete(item.key)
+		n++
+	}
+}
+
+// Next returns the time until the next key expires, which is zero or
+// negative if a key has already expired and has not been purged.
+// Returns false if the map is empty.
+func (tm *TimedMap[K, V]) Next() (time.Duration, bool) {
+	if tm.expiries == nil {
+		return 0, false
+	}
+	item, ok := tm.expiries.Min()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(item.expiry), true
+}
@@ -0,0 +1,52 @@
+package btree
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimedMap(t *testing.T) {
+	var tm TimedMap[int, string]
+	_, ok := tm.Next()
+	assert(!ok && tm.Purge() == 0)
+	_, ok = tm.Get(1)
+	assert(!ok)
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			assert(!tm.SetExpiry(i, "old", past.Add(time.Duration(i))))
+		} else {
+			assert(!tm.SetExpiry(i, "new", future.Add(time.Duration(i))))
+		}
+	}
+	assert(tm.Len() == 100)
+	for i := 0; i < 100; i++ {
+		v, ok := tm.Get(i)
+		assert(ok == (i%2 == 1))
+		assert((ok && v == "new") || (!ok && v == ""))
+	}
+	d, ok := tm.Next()
+	assert(ok && d < 0)
+	// Replacing an expired key extends it, and replacing an unexpired key
+	// moves its expiry.
+	assert(!tm.SetExpiry(0, "again", future))
+	assert(tm.SetExpiry(1, "sooner", past))
+	assert(tm.Purge() == 50)
+	assert(tm.Len() == 50 && tm.expiries.Len() == 50)
+	v, ok := tm.Get(0)
+	assert(ok && v == "again")
+	_, ok = tm.Get(1)
+	assert(!ok)
+	d, ok = tm.Next()
+	assert(ok && d > 0 && d <= time.Hour)
+	assert(tm.Purge() == 0)
+	v, ok = tm.Delete(0)
+	assert(ok && v == "again")
+	_, ok = tm.Delete(0)
+	assert(!ok)
+	tm.SetExpiry(1000, "expired", past)
+	_, ok = tm.Delete(1000)
+	assert(!ok)
+	assert(tm.Len() == 49 && tm.expiries.Len() == 49)
+}
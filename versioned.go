@@ -0,0 +1,103 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package btree
+
+// VersionedMap keeps the most recent snapshots of a Map, each identified by
+// its version, for MVCC-style reads.
+//
+// The snapshots share their nodes with the live map using copy-on-write, so
+// each one only costs the nodes that have changed since it was taken.
+// Snapshots are frozen. Use Copy on a snapshot to get a writable tree.
+type VersionedMap[K ordered, V any] struct {
+	live  *Map[K, V]
+	keep  int
+	snaps []versionedSnap[K, V] // oldest to newest
+}
+
+// versionedSnap is a snapshot and its version. The version is kept apart from
+// the snapshot, as the generation of a map is changed by copying it.
+type versionedSnap[K ordered, V any] struct {
+	snap    *Map[K, V]
+	version uint64
+}
+
+// NewVersionedMap returns a VersionedMap that retains up to keep snapshots
+// of the provided live map. A keep of zero or less retains one snapshot.
+func NewVersionedMap[K ordered, V any](live *Map[K, V], keep int,
+) *VersionedMap[K, V] {
+	if keep < 1 {
+		keep = 1
+	}
+	return &VersionedMap[K, V]{live: live, keep: keep}
+}
+
+// Live returns the live map.
+func (vm *VersionedMap[K, V]) Live() *Map[K, V] {
+	return vm.live
+}
+
+// Snapshot takes a snapshot of the live map and returns its version. When the
+// live map has not changed since the previous snapshot, no copy is made and
+// the previous version is returned. The oldest snapshots are released once
+// there are more than the number to keep.
+func (vm *VersionedMap[K, V]) Snapshot() uint64 {
+	if len(vm.snaps) > 0 {
+		last := vm.snaps[len(vm.snaps)-1]
+		// Every write to the live map performs a copy-on-write of its root,
+		// so a shared root means nothing has changed.
+		locked := vm.live.lock(false)
+		same := last.snap.root == vm.live.root &&
+			last.snap.count == vm.live.count
+		if locked {
+			vm.live.unlock(false)
+		}
+		if same {
+			return last.version
+		}
+	}
+	snap, version := vm.live.CopyVersioned()
+	// A frozen snapshot is not changed by a copy of it, which is safe while
+	// other goroutines are reading the snapshot.
+	snap.Freeze()
+	vm.snaps = append(vm.snaps, versionedSnap[K, V]{snap, version})
+	if len(vm.snaps) > vm.keep {
+		n := len(vm.snaps) - vm.keep
+		copy(vm.snaps, vm.snaps[n:])
+		for i := len(vm.snaps) - n; i < len(vm.snaps); i++ {
+			vm.snaps[i] = versionedSnap[K, V]{}
+		}
+		vm.snaps = vm.snaps[:len(vm.snaps)-n]
+	}
+	return version
+}
+
+// At returns the snapshot for version.
+// Returns nil if the version is unknown or has been released.
+func (vm *VersionedMap[K, V]) At(version uint64) *Map[K, V] {
+	for i := len(vm.snaps) - 1; i >= 0; i-- {
+		if vm.snaps[i].version == version {
+			return vm.snaps[i].snap
+		}
+	}
+	return nil
+}
+
+// Latest returns the most recent snapshot and its version.
+// Returns nil if no snapshots have been taken.
+func (vm *VersionedMap[K, V]) Latest() (*Map[K, V], uint64) {
+	if len(vm.snaps) == 0 {
+		return nil, 0
+	}
+	last := vm.snaps[len(vm.snaps)-1]
+	return last.snap, last.version
+}
+
+// Versions returns the versions of all retained snapshots, oldest first.
+func (vm *VersionedMap[K, V]) Versions() []uint64 {
+	versions := make([]uint64, len(vm.snaps))
+	for i, snap := range vm.snaps {
+		versions[i] = snap.version
+	}
+	return versions
+}
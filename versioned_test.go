@@ -0,0 +1,91 @@
+package btree
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVersionedMap(t *testing.T) {
+	live := new(Map[int, int])
+	vm := NewVersionedMap(live, 3)
+	assert(vm.Live() == live)
+	snap, v := vm.Latest()
+	assert(snap == nil && v == 0)
+
+	var versions []uint64
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 1000; j++ {
+			live.Set(i*1000+j, i)
+		}
+		versions = append(versions, vm.Snapshot())
+	}
+	for i := 1; i < len(versions); i++ {
+		assert(versions[i] > versions[i-1])
+	}
+	// unchanged trees are not copied again
+	assert(vm.Snapshot() == versions[4])
+
+	assert(vm.At(versions[0]) == nil && vm.At(versions[1]) == nil)
+	for i := 2; i < 5; i++ {
+		snap := vm.At(versions[i])
+		assert(snap != nil && snap.Len() == (i+1)*1000)
+		snap.sane()
+	}
+	got := vm.Versions()
+	assert(len(got) == 3 && got[0] == versions[2] && got[2] == versions[4])
+	snap, v = vm.Latest()
+	assert(snap.Len() == 5000 && v == versions[4])
+
+	// writes to the live map do not affect the snapshots
+	live.Clear()
+	assert(vm.At(versions[4]).Len() == 5000)
+	v = vm.Snapshot()
+	assert(v > versions[4] && vm.At(v).Len() == 0)
+}
+
+func TestVersionedMapRelease(t *testing.T) {
+	live := new(Map[int, int])
+	vm := NewVersionedMap(live, 2)
+	var released int32
+	for i := 0; i < 10; i++ {
+		live.Set(i, i)
+		vm.Snapshot()
+		snap, _ := vm.Latest()
+		runtime.SetFinalizer(snap, func(*Map[int, int]) {
+			atomic.AddInt32(&released, 1)
+		})
+	}
+	start := time.Now()
+	for atomic.LoadInt32(&released) < 8 && time.Since(start) < time.Second*5 {
+		runtime.GC()
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert(atomic.LoadInt32(&released) == 8)
+	assert(len(vm.Versions()) == 2)
+	runtime.KeepAlive(vm)
+}
+
+func TestVersionedMapCopySnapshot(t *testing.T) {
+	live := new(Map[int, int])
+	vm := NewVersionedMap(live, 3)
+	live.Set(1, 1)
+	v1 := vm.Snapshot()
+	live.Set(2, 2)
+	v2 := vm.Snapshot()
+	snap := vm.At(v1)
+	assert(snap.Frozen())
+	gen := snap.gen
+	tr := snap.Copy()
+	tr.Set(3, 3)
+	assert(snap.gen == gen && !tr.Frozen())
+	got := vm.Versions()
+	assert(len(got) == 2 && got[0] == v1 && got[1] == v2)
+	assert(vm.At(v1) == snap && snap.Len() == 1)
+	assert(vm.At(v2).Len() == 2 && tr.Len() == 2)
+	func() {
+		defer func() { assert(recover() == ErrFrozen) }()
+		snap.Set(4, 4)
+	}()
+}
@@ -0,0 +1,10 @@
+module github.com/tidwall/btree/yaml
+
+go 1.19
+
+require (
+	github.com/tidwall/btree v0.0.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+replace github.com/tidwall/btree => ../
@@ -0,0 +1,113 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package yaml provides a btree.Map that can be encoded to and decoded from
+// YAML using gopkg.in/yaml.v3. It's a separate module so that the btree
+// module itself does not depend on yaml.v3.
+package yaml
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/tidwall/btree"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+type ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64 | ~string
+}
+
+// Map is a btree.Map that implements the yaml.Marshaler and
+// yaml.Unmarshaler interfaces.
+//
+// A map with string keys is encoded as a YAML mapping in ascending key order.
+// Other maps are encoded as a sequence of single pair mappings, which keeps
+// keys such as floats intact and in order.
+type Map[K ordered, V any] struct {
+	btree.Map[K, V]
+}
+
+// MarshalYAML returns the map as a yaml.Node. It has a value receiver so
+// that a Map field is encoded even when the struct holding it is not
+// addressable.
+func (tr Map[K, V]) MarshalYAML() (interface{}, error) {
+	var key K
+	strKeys := reflect.TypeOf(key).Kind() == reflect.String
+	node := &yamlv3.Node{Kind: yamlv3.SequenceNode}
+	if strKeys {
+		node.Kind = yamlv3.MappingNode
+	}
+	var err error
+	tr.Scan(func(key K, value V) bool {
+		var pair [2]yamlv3.Node
+		if err = pair[0].Encode(key); err != nil {
+			return false
+		}
+		if err = pair[1].Encode(value); err != nil {
+			return false
+		}
+		if strKeys {
+			node.Content = append(node.Content, &pair[0], &pair[1])
+		} else {
+			node.Content = append(node.Content, &yamlv3.Node{
+				Kind:    yamlv3.MappingNode,
+				Content: []*yamlv3.Node{&pair[0], &pair[1]},
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// UnmarshalYAML replaces the contents of the map with the YAML value, which
+// may be a mapping, a sequence of single pair mappings, or null.
+// When a key appears more than once, the last pair wins.
+func (tr *Map[K, V]) UnmarshalYAML(value *yamlv3.Node) error {
+	for value.Kind == yamlv3.AliasNode {
+		value = value.Alias
+	}
+	var pairs []*yamlv3.Node
+	switch {
+	case value.Kind == yamlv3.MappingNode:
+		pairs = value.Content
+	case value.Kind == yamlv3.SequenceNode:
+		for _, item := range value.Content {
+			for item.Kind == yamlv3.AliasNode {
+				item = item.Alias
+			}
+			if item.Kind != yamlv3.MappingNode || len(item.Content) != 2 {
+				return fmt.Errorf("btree: line %d: cannot unmarshal %s "+
+					"into Map pair", item.Line, item.ShortTag())
+			}
+			pairs = append(pairs, item.Content...)
+		}
+	case value.ShortTag() != "!!null":
+		return fmt.Errorf("btree: line %d: cannot unmarshal %s into Map",
+			value.Line, value.ShortTag())
+	}
+	var tr2 btree.Map[K, V]
+	for i := 0; i < len(pairs); i += 2 {
+		var key K
+		var val V
+		if err := pairs[i].Decode(&key); err != nil {
+			return err
+		}
+		if err := pairs[i+1].Decode(&val); err != nil {
+			return err
+		}
+		tr2.Set(key, val)
+	}
+	tr.Clear()
+	tr2.Scan(func(key K, value V) bool {
+		tr.Load(key, value)
+		return true
+	})
+	return nil
+}
@@ -0,0 +1,129 @@
+package yaml
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+func assert(x bool) {
+	if !x {
+		panic("assert failed")
+	}
+}
+
+func TestMapStringKeys(t *testing.T) {
+	for _, N := range []int{0, 1, 1000} {
+		var m1 Map[string, []int]
+		for _, i := range rand.Perm(N) {
+			m1.Set(fmt.Sprintf("key:%d", i), []int{i, -i})
+		}
+		data, err := yamlv3.Marshal(&m1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m2 Map[string, []int]
+		m2.Set("stale", nil)
+		if err := yamlv3.Unmarshal(data, &m2); err != nil {
+			t.Fatal(err)
+		}
+		k1, v1 := m1.KeyValues()
+		k2, v2 := m2.KeyValues()
+		assert(reflect.DeepEqual(k1, k2) && reflect.DeepEqual(v1, v2))
+	}
+	var m Map[string, int]
+	m.Set("b", 2)
+	m.Set("a", 1)
+	data, err := yamlv3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(string(data) == "a: 1\nb: 2\n")
+}
+
+func TestMapOtherKeys(t *testing.T) {
+	var m1 Map[float64, string]
+	for i := 0; i < 1000; i++ {
+		key := rand.NormFloat64()
+		m1.Set(key, fmt.Sprint(key))
+	}
+	data, err := yamlv3.Marshal(&m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m2 Map[float64, string]
+	if err := yamlv3.Unmarshal(data, &m2); err != nil {
+		t.Fatal(err)
+	}
+	k1, v1 := m1.KeyValues()
+	k2, v2 := m2.KeyValues()
+	assert(reflect.DeepEqual(k1, k2) && reflect.DeepEqual(v1, v2))
+
+	var m Map[int, string]
+	m.Set(2, "two")
+	m.Set(1, "one")
+	data, err = yamlv3.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(string(data) == "- 1: one\n- 2: two\n")
+	// a plain mapping also decodes, and the last duplicate key wins
+	m.Clear()
+	err = yamlv3.Unmarshal([]byte("3: three\n1: uno\n1: one\n"), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, values := m.KeyValues()
+	assert(reflect.DeepEqual(keys, []int{1, 3}))
+	assert(reflect.DeepEqual(values, []string{"one", "three"}))
+}
+
+func TestMapInvalid(t *testing.T) {
+	var m Map[int, string]
+	m.Set(1, "one")
+	for _, data := range []string{
+		"hello", "[1, 2]", "- 1: one\n  2: two\n", "a: one\n", "1: [one]\n",
+	} {
+		assert(yamlv3.Unmarshal([]byte(data), &m) != nil)
+		assert(m.Len() == 1)
+	}
+	assert(yamlv3.Unmarshal([]byte("null"), &m) == nil)
+}
+
+func ExampleMap() {
+	var config struct {
+		Name string
+		Env  Map[string, string]
+	}
+	data := []byte(`
+name: server
+env:
+  PORT: "8080"
+  HOST: localhost
+  DEBUG: "false"
+`)
+	if err := yamlv3.Unmarshal(data, &config); err != nil {
+		panic(err)
+	}
+	config.Env.Scan(func(key, value string) bool {
+		fmt.Printf("%s=%s\n", key, value)
+		return true
+	})
+	data, err := yamlv3.Marshal(&config)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Print(string(data))
+	// Output:
+	// DEBUG=false
+	// HOST=localhost
+	// PORT=8080
+	// name: server
+	// env:
+	//     DEBUG: "false"
+	//     HOST: localhost
+	//     PORT: "8080"
+}